@@ -30,23 +30,35 @@ type Consensus struct {
 	Round       uint64   `json:"round"`
 	TotalMiners uint64   `json:"total_miners"`
 	Difficulty  *big.Int `json:"difficulty"`
+	//dpos randomness beacon from genesis, use a fork for a running chain
+	RandomBeacon bool `json:"random_beacon"`
 }
 
 type Config struct {
-	HostId          string          `json:"host_id"`
-	RpcAddress      string          `json:"rpc_address"`
-	DBPath          string          `json:"db_path"`
-	MinerAddress    string          `json:"miner_address"`
-	MinerPassphrase string          `json:"miner_passphrase"`
-	Port            int             `json:"port"`
-	Seeds           []string        `json:"seeds"`
-	Voters          []ConfigAccount `json:"voters"`
-	EnableMining    bool            `json:"enable_mining"`
-	Consensus       Consensus       `json:"consensus"`
-	NodeKeyPath     string          `json:"node_key_path"`
-	KeystoreFile    string          `json:"keystore_file"`
-	Coinbase        string          `json:"coinbase"`
-	MiningReward    int             `json:"mining_reward"`
+	HostId            string          `json:"host_id"`
+	RpcAddress        string          `json:"rpc_address"`
+	DBPath            string          `json:"db_path"`
+	MinerAddress      string          `json:"miner_address"`
+	MinerPassphrase   string          `json:"miner_passphrase"`
+	Port              int             `json:"port"`
+	Seeds             []string        `json:"seeds"`
+	Voters            []ConfigAccount `json:"voters"`
+	EnableMining      bool            `json:"enable_mining"`
+	Consensus         Consensus       `json:"consensus"`
+	NodeKeyPath       string          `json:"node_key_path"`
+	KeystoreFile      string          `json:"keystore_file"`
+	Coinbase          string          `json:"coinbase"`
+	MiningReward      int             `json:"mining_reward"`
+	Forks             []core.Fork     `json:"forks"`
+	TrustedCheckpoint string          `json:"trusted_checkpoint"`
+	ChainID           uint64          `json:"chain_id"`
+	BanDuration       int             `json:"ban_duration"`
+	StaticPeers       []string        `json:"static_peers"`
+	TrustedPeers      []string        `json:"trusted_peers"`
+	SyncMode          string          `json:"sync_mode"`
+	EnableEthRpc      bool            `json:"enable_eth_rpc"`
+	EnableWs          bool            `json:"enable_ws"`
+	WsOrigins         []string        `json:"ws_origins"`
 }
 
 func MakeVoterAccountsFromConfig(config *Config) (voters []*core.Account) {
@@ -60,6 +72,21 @@ func MakeVoterAccountsFromConfig(config *Config) (voters []*core.Account) {
 	return voters
 }
 
+// MakeForkScheduleFromConfig makes the genesis fork from consensus and mining_reward and adds forks
+func MakeForkScheduleFromConfig(config *Config) (*core.ForkSchedule, error) {
+	reward := uint64(config.MiningReward)
+	genesis := core.Fork{
+		Name:         core.GenesisForkName,
+		Consensus:    config.Consensus.Name,
+		Period:       config.Consensus.Period,
+		Round:        config.Consensus.Round,
+		TotalMiners:  config.Consensus.TotalMiners,
+		MiningReward: &reward,
+		RandomBeacon: config.Consensus.RandomBeacon,
+	}
+	return core.NewForkSchedule(genesis, config.Forks)
+}
+
 func NewConfigFromFile(file string) (config *Config) {
 	configFile, err := os.Open(file)
 	defer configFile.Close()
@@ -133,7 +160,7 @@ func (c *Config) NodePrivateKey() (key crypto.PrivKey, err error) {
 }
 
 func (c *Config) VerifyConsensus() (err error) {
-	if c.Consensus.Name == "dpos" {
+	if core.SameConsensus(c.Consensus.Name, "dpos") {
 		if c.Consensus.Period <= 0 {
 			return errors.New("Period must be greater than 0")
 		}
@@ -148,5 +175,32 @@ func (c *Config) VerifyConsensus() (err error) {
 		}
 
 	}
+	if _, err := MakeForkScheduleFromConfig(c); err != nil {
+		return err
+	}
+	if c.Consensus.Name != "" && !isConsensusName(c.Consensus.Name) {
+		return errors.Errorf("Unknown consensus: %s", c.Consensus.Name)
+	}
+	for _, fork := range c.Forks {
+		if fork.TotalMiners > 0 && fork.TotalMiners%3 != 0 {
+			return errors.New("TotalMiners must be a multiple of three")
+		}
+		if fork.Consensus != "" && !isConsensusName(fork.Consensus) {
+			return errors.Errorf("Unknown consensus: %s", fork.Consensus)
+		}
+		if fork.Consensus != "" && !core.SameConsensus(fork.Consensus, c.Consensus.Name) && len(fork.Voters) == 0 {
+			return errors.New("Voters are needed to switch consensus")
+		}
+	}
 	return nil
 }
+
+// isConsensusName reports whether a node can make the engine of name
+func isConsensusName(name string) bool {
+	for _, known := range []string{"dpos", "poa", "pow"} {
+		if core.SameConsensus(name, known) {
+			return true
+		}
+	}
+	return false
+}
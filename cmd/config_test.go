@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/nacamp/go-simplechain/cmd"
+	"github.com/nacamp/go-simplechain/core"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -85,4 +86,11 @@ func TestConfig(t *testing.T) {
 	assert.Error(t, config.VerifyConsensus())
 	config.Consensus.TotalMiners = 9
 	assert.Error(t, config.VerifyConsensus())
+
+	//fork consensus
+	config.Consensus.TotalMiners = 3
+	config.Forks = []core.Fork{{Name: "poa", Height: 10, Consensus: "pbft"}}
+	assert.Error(t, config.VerifyConsensus())
+	config.Forks = []core.Fork{{Name: "period", Height: 10, Consensus: "DPOS"}}
+	assert.NoError(t, config.VerifyConsensus())
 }
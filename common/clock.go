@@ -0,0 +1,175 @@
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of consensus loops and the memory network, tests replace it with VirtualClock
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func())
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the wall clock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{ticker: time.NewTicker(d)}
+}
+
+func (SystemClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+type virtualTimer struct {
+	clock  *VirtualClock
+	when   time.Time
+	seq    uint64
+	period time.Duration //ticker if period > 0
+	c      chan time.Time
+	f      func()
+	stop   bool
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stop = true
+}
+
+/*
+VirtualClock moves only by Advance.
+Timers fire in order of their deadline and then in order of their creation,
+a ticker drops ticks like time.Ticker when its channel is full.
+*/
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers []*virtualTimer
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) NewTicker(d time.Duration) Ticker {
+	t := &virtualTimer{period: d, c: make(chan time.Time, 1)}
+	c.schedule(t, d)
+	return t
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) {
+	c.schedule(&virtualTimer{f: f}, d)
+}
+
+func (c *VirtualClock) schedule(t *virtualTimer, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t.clock = c
+	t.seq = c.seq
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+}
+
+// Advance moves the clock by d and fires the timers which are due
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		t := c.next(end)
+		if t == nil {
+			break
+		}
+		if t.f != nil {
+			t.f()
+			continue
+		}
+		select {
+		case t.c <- t.when:
+		default:
+		}
+	}
+	c.mu.Lock()
+	c.now = end
+	c.mu.Unlock()
+}
+
+// next removes the earliest timer due by end and moves the clock to it, a ticker is scheduled again
+func (c *VirtualClock) next(end time.Time) *virtualTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.stop {
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+	if len(c.timers) == 0 {
+		return nil
+	}
+	sort.Slice(c.timers, func(i, j int) bool {
+		if c.timers[i].when.Equal(c.timers[j].when) {
+			return c.timers[i].seq < c.timers[j].seq
+		}
+		return c.timers[i].when.Before(c.timers[j].when)
+	})
+	t := c.timers[0]
+	if t.when.After(end) {
+		return nil
+	}
+	c.now = t.when
+	if t.period > 0 {
+		fired := *t
+		c.seq++
+		t.seq = c.seq
+		t.when = t.when.Add(t.period)
+		return &fired
+	}
+	c.timers = c.timers[1:]
+	return t
+}
+
+// Pending returns the number of timers which are not fired yet
+func (c *VirtualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewVirtualClock(start)
+	fired := make([]int, 0)
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 11) })
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, 0, len(fired))
+	assert.Equal(t, start.Add(500*time.Millisecond), clock.Now())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, []int{1, 11}, fired)
+	assert.Equal(t, start.Add(time.Second), <-ticker.C())
+
+	//ticks are dropped while the channel is full
+	clock.Advance(3 * time.Second)
+	assert.Equal(t, []int{1, 11, 2}, fired)
+	assert.Equal(t, start.Add(2*time.Second), <-ticker.C())
+	select {
+	case <-ticker.C():
+		t.Fatal("tick must be dropped")
+	default:
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Second)
+	assert.Equal(t, 0, clock.Pending())
+}
@@ -1,6 +1,7 @@
 package dpos
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sort"
 	"time"
@@ -9,6 +10,8 @@ import (
 
 	"github.com/nacamp/go-simplechain/account"
 	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/rlp"
 	"github.com/nacamp/go-simplechain/trie"
 
 	"github.com/nacamp/go-simplechain/core"
@@ -27,13 +30,16 @@ type Dpos struct {
 	period      uint64
 	round       uint64
 	totalMiners uint64
+
+	clock common.Clock
 }
 
 func NewDpos(streamPool *net.PeerStreamPool, period, round, totalMiners uint64) *Dpos {
 	return &Dpos{streamPool: streamPool,
 		period:      period,
 		round:       round,
-		totalMiners: totalMiners}
+		totalMiners: totalMiners,
+		clock:       common.SystemClock{}}
 }
 
 func (cs *Dpos) SetupMining(address common.Address, wallet *account.Wallet) {
@@ -42,28 +48,98 @@ func (cs *Dpos) SetupMining(address common.Address, wallet *account.Wallet) {
 	cs.wallet = wallet
 }
 
+// SetClock replaces the wall clock which drives mining, call it before Start
+func (cs *Dpos) SetClock(clock common.Clock) {
+	cs.clock = clock
+}
+
+/*
+params returns period, round and totalMiners of state.
+They are decided by the chain(genesis, forks and votes of miners), the local config is used only when state has not them.
+*/
+func (cs *Dpos) params(state *DposState) (period, round, totalMiners uint64) {
+	period, round, totalMiners = cs.period, cs.round, cs.totalMiners
+	if state.Params.Period > 0 {
+		period = state.Params.Period
+	}
+	if state.Params.Round > 0 {
+		round = state.Params.Round
+	}
+	if state.Params.TotalMiners > 0 {
+		totalMiners = state.Params.TotalMiners
+	}
+	return period, round, totalMiners
+}
+
+func (cs *Dpos) paramsFromRules(height uint64) DposParams {
+	period, round, totalMiners := cs.period, cs.round, cs.totalMiners
+	rules := cs.bc.Rules(height)
+	if rules.Period > 0 {
+		period = rules.Period
+	}
+	if rules.Round > 0 {
+		round = rules.Round
+	}
+	if rules.TotalMiners > 0 {
+		totalMiners = rules.TotalMiners
+	}
+	return DposParams{Period: period, Round: round, TotalMiners: totalMiners}
+}
+
+/*
+applyForkParams keeps the params changed by a fork of the schedule at height in ForkParams of state.
+They take effect at the next election like the voted params, the miners of the round keep their turns until then.
+*/
+func (cs *Dpos) applyForkParams(state *DposState, height uint64) {
+	if height == 0 {
+		return
+	}
+	rules := cs.bc.Rules(height)
+	prev := cs.bc.Rules(height - 1)
+	if rules.Period != prev.Period {
+		state.ForkParams.Period = rules.Period
+	}
+	if rules.Round != prev.Round {
+		state.ForkParams.Round = rules.Round
+	}
+	if rules.TotalMiners != prev.TotalMiners {
+		state.ForkParams.TotalMiners = rules.TotalMiners
+	}
+}
+
 func (cs *Dpos) MakeBlock(now uint64) *core.Block {
 	bc := cs.bc
-	turn := (now % (cs.totalMiners * cs.period)) / cs.period
+	rules := bc.Rules(bc.Tail().Header.Height + 1)
+	if !rules.IsConsensus(cs.ConsensusType()) {
+		return nil
+	}
 	block, err := bc.NewBlockFromTail()
 	if err != nil {
 		log.CLog().Warning(fmt.Sprintf("%+v", err))
+		return nil
 	}
 	block.Header.Time = now
 	state := block.ConsensusState().(*DposState)
-	electedTime := GetNewElectedTime(state.ElectedTime, block.Header.Time, cs.period, cs.round, cs.totalMiners)
+	cs.applyForkParams(state, block.Header.Height)
+	period, round, totalMiners := cs.params(state)
+	turn := (now % (totalMiners * period)) / period
+	electedTime := GetNewElectedTime(state.ElectedTime, block.Header.Time, period, round, totalMiners)
 	var minerGroup []common.Address
 	if electedTime != now {
 		minerGroup, err = state.GetMiners(state.MinersHash)
 		//minerGroup, _, err := block.MinerState.GetMinerGroup(bc, block)
 		if err != nil {
 			log.CLog().Warning(fmt.Sprintf("%+v", err))
+			return nil
+		}
+		if int(turn) >= len(minerGroup) {
+			return nil
 		}
 	}
 	if electedTime == now || minerGroup[turn] == cs.coinbase {
 		//parent := bc.GetBlockByHash(bc.Tail().Header.ParentHash)
 		parent := bc.Tail()
-		if (parent != nil) && (now-parent.Header.Time < cs.period) { //(3 * 3)
+		if (parent != nil) && (now-parent.Header.Time < period) { //(3 * 3)
 			log.CLog().WithFields(logrus.Fields{
 				"address": common.AddressToHex(cs.coinbase),
 			}).Debug("Interval is short")
@@ -74,6 +150,14 @@ func (cs *Dpos) MakeBlock(now uint64) *core.Block {
 			"address": common.BytesToHex(cs.coinbase[:]),
 		}).Debug("my turn")
 		block.Header.Coinbase = cs.coinbase
+		if rules.RandomBeacon {
+			reveal, commit, err := cs.makeRandom(state, block.Header.Height)
+			if err != nil {
+				log.CLog().Warning(fmt.Sprintf("%+v", err))
+				return nil
+			}
+			block.Header.SetRandomBeacon(reveal, commit)
+		}
 
 		block.Transactions = make([]*core.Transaction, 0)
 		accs := block.AccountState
@@ -83,6 +167,12 @@ func (cs *Dpos) MakeBlock(now uint64) *core.Block {
 			if tx == nil {
 				break
 			}
+			if err := rules.VerifyTransaction(tx); err != nil {
+				log.CLog().WithFields(logrus.Fields{
+					"Hash": common.HashToHex(tx.Hash),
+				}).Warning(err)
+				continue
+			}
 			fromAccount := accs.GetAccount(tx.From)
 			if fromAccount == nil {
 				log.CLog().WithFields(logrus.Fields{
@@ -120,13 +210,22 @@ func (cs *Dpos) MakeBlock(now uint64) *core.Block {
 			}
 		}
 
+		if rules.MaxTransactions > 0 && uint64(len(block.Transactions)) > rules.MaxTransactions {
+			for _, tx := range block.Transactions[rules.MaxTransactions:] {
+				bc.TxPool.Put(tx)
+			}
+			block.Transactions = block.Transactions[:rules.MaxTransactions]
+		}
 		for _, tx := range block.Transactions {
 			tx.Height = block.Header.Height
 		}
 
 		bc.RewardForCoinbase(block)
 		bc.ExecuteTransaction(block)
-		cs.SaveState(block)
+		if err := cs.SaveState(block); err != nil {
+			log.CLog().Warning(fmt.Sprintf("%+v", err))
+			return nil
+		}
 		if err := cs.Verify(block); err != nil {
 			log.CLog().WithFields(logrus.Fields{
 				"address": common.BytesToHex(cs.coinbase[:]),
@@ -147,11 +246,46 @@ func (cs *Dpos) MakeBlock(now uint64) *core.Block {
 	}
 }
 
+/*
+makeRandom returns the secret of the last commit of the miner and the commit of a new secret.
+A secret is derived from the signature of its height, so it is not needed to keep secrets.
+*/
+func (cs *Dpos) makeRandom(state *DposState, height uint64) (reveal, commit common.Hash, err error) {
+	last, err := state.GetRandomCommit(cs.coinbase)
+	if err != nil {
+		return reveal, commit, err
+	}
+	if last != nil {
+		reveal, err = cs.randomSecret(last.Height)
+		if err != nil {
+			return reveal, commit, err
+		}
+	}
+	secret, err := cs.randomSecret(height)
+	if err != nil {
+		return reveal, commit, err
+	}
+	commit = common.BytesToHash(crypto.Sha3b256(secret[:]))
+	return reveal, commit, nil
+}
+
+func (cs *Dpos) randomSecret(height uint64) (secret common.Hash, err error) {
+	encodedBytes, err := rlp.EncodeToBytes([]interface{}{"dpos random", height})
+	if err != nil {
+		return secret, err
+	}
+	sig, err := cs.wallet.SignHash(cs.coinbase, crypto.Sha3b256(encodedBytes))
+	if err != nil {
+		return secret, err
+	}
+	return common.BytesToHash(crypto.Sha3b256(sig)), nil
+}
+
 func (cs *Dpos) loop() {
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := cs.clock.NewTicker(1 * time.Second)
 	for {
 		select {
-		case now := <-ticker.C:
+		case now := <-ticker.C():
 			block := cs.MakeBlock(uint64(now.Unix()))
 			if block != nil {
 				sig, err := cs.wallet.SignHash(cs.coinbase, block.Header.Hash[:])
@@ -162,7 +296,7 @@ func (cs *Dpos) loop() {
 				cs.bc.PutBlockByCoinbase(block)
 				cs.bc.Consensus.UpdateLIB()
 				message, _ := net.NewRLPMessage(net.MsgNewBlock, block.BaseBlock)
-				cs.streamPool.BroadcastMessage(&message)
+				cs.streamPool.BroadcastBlock(block.Hash(), block.Header.Height, &message)
 			}
 		}
 	}
@@ -183,30 +317,60 @@ func (cs *Dpos) Verify(block *core.Block) (err error) {
 	if err != nil {
 		return err
 	}
-	turn := (block.Header.Time % (cs.totalMiners * cs.period)) / cs.period
-	if miners[turn] != block.Header.Coinbase {
+	period, _, totalMiners := cs.params(state)
+	if len(miners) == 0 || period == 0 || totalMiners == 0 {
+		return errors.New("Miners, period and totalMiners must be one more")
+	}
+	turn := (block.Header.Time % (totalMiners * period)) / period
+	if int(turn) >= len(miners) || miners[turn] != block.Header.Coinbase {
 		return errors.New("This time is not your turn")
 	}
 	return nil
 }
 
 // not use this at GenesisBlock
+/*
+VerifyHeader verifies block with the state of parent, for light nodes.
+If a new round starts at block, its miners are elected again from the state of parent,
+the stakes of the ending round are in the state of parent, the transactions of block do not change the election.
+*/
+func (cs *Dpos) VerifyHeader(block *core.Block, parent *core.Header) (err error) {
+	state := block.ConsensusState().(*DposState)
+	cs.applyForkParams(state, block.Header.Height)
+	period, round, totalMiners := cs.params(state)
+	if period == 0 || totalMiners == 0 {
+		return errors.New("Period and totalMiners must be one more")
+	}
+	if err := cs.recordMissedSlots(state, block, parent); err != nil {
+		return err
+	}
+	electedTime := GetNewElectedTime(state.ElectedTime, block.Header.Time, period, round, totalMiners)
+	if electedTime == block.Header.Time && block.Header.Height > 1 {
+		if err := cs.newRound(state, block, round); err != nil {
+			return err
+		}
+	}
+	return cs.Verify(block)
+}
+
 func (cs *Dpos) SaveState(block *core.Block) (err error) {
 	state := block.ConsensusState().(*DposState)
 	accs := block.AccountState
-	electedTime := GetNewElectedTime(state.ElectedTime, block.Header.Time, cs.period, cs.round, cs.totalMiners)
+	cs.applyForkParams(state, block.Header.Height)
+	period, round, totalMiners := cs.params(state)
+	if err := cs.recordMissedSlots(state, block, nil); err != nil {
+		return err
+	}
+	electedTime := GetNewElectedTime(state.ElectedTime, block.Header.Time, period, round, totalMiners)
 	if electedTime == block.Header.Time {
 		//because genesis block time is 0, 1 height block become new round, so change only electedtime and skip othe process
 		if block.Header.Height == 1 {
-			state.ElectedTime = electedTime - cs.period
+			state.ElectedTime = electedTime - period
 		} else {
-			miners, err := state.GetNewRoundMiners(block.Header.Time, cs.totalMiners)
-			if err != nil {
+			if err := cs.newRound(state, block, round); err != nil {
 				log.CLog().WithFields(logrus.Fields{}).Panic(err)
 				return err
 			}
-			state.MinersHash, err = state.PutMiners(miners)
-			state.ElectedTime = block.Header.Time
 
 			iter, err := state.Voter.Iterator(nil)
 			if err != nil {
@@ -227,6 +391,14 @@ func (cs *Dpos) SaveState(block *core.Block) (err error) {
 			state.Voter, err = trie.NewTrie(nil, cs.bc.Storage, false)
 		}
 	}
+	//mix after election, so the miner of this block cannot choose the new order
+	if cs.bc.Rules(block.Header.Height).RandomBeacon {
+		reveal, commit := block.Header.RandomBeacon()
+		err = state.MixRandom(block.Header.Coinbase, reveal, commit, block.Header.Height)
+		if err != nil {
+			return err
+		}
+	}
 	err = state.Put(block.Header.Height, state.ElectedTime, state.MinersHash)
 	if err != nil {
 		return err
@@ -234,15 +406,141 @@ func (cs *Dpos) SaveState(block *core.Block) (err error) {
 	return nil
 }
 
+// a miner who missed more than half of its turns in a round is jailed
+func maxMissedSlots(round uint64) uint64 {
+	return round / 2
+}
+
+/*
+recordMissedSlots counts the turns skipped between the parent and block.
+A slot is period long and its miner is miners[(time/period) % totalMiners] as in Verify.
+Only the slots of the current round are counted, after the round anyone can make the election block.
+The parent is looked up in the chain when it is nil.
+*/
+func (cs *Dpos) recordMissedSlots(state *DposState, block *core.Block, parent *core.Header) error {
+	if block.Header.Height <= 1 || cs.bc.ForkSchedule().IsConsensusSwitch(block.Header.Height) {
+		return nil
+	}
+	if parent == nil {
+		parentBlock := cs.bc.GetBlockByHash(block.Header.ParentHash)
+		if parentBlock == nil {
+			return errors.New("Parent is nil")
+		}
+		parent = parentBlock.Header
+	}
+	miners, err := state.GetMiners(state.MinersHash)
+	if err != nil {
+		return err
+	}
+	if len(miners) == 0 {
+		return nil
+	}
+	period, round, totalMiners := cs.params(state)
+	from := parent.Time/period + 1
+	if start := state.ElectedTime / period; from < start {
+		from = start
+	}
+	to := block.Header.Time / period
+	if end := (state.ElectedTime + period*round*totalMiners) / period; to > end {
+		to = end
+	}
+	for slot := from; slot < to; slot++ {
+		turn := slot % totalMiners
+		if int(turn) >= len(miners) {
+			continue
+		}
+		if err := state.AddMissedSlot(miners[turn]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRound jails the miners who missed too many slots and elects miners of the round starting at block
+func (cs *Dpos) newRound(state *DposState, block *core.Block, round uint64) (err error) {
+	if err := state.JailMiners(maxMissedSlots(round)); err != nil {
+		return err
+	}
+	miners, err := cs.electMiners(state, block)
+	if err != nil {
+		return err
+	}
+	state.MinersHash, err = state.PutMiners(miners)
+	if err != nil {
+		return err
+	}
+	state.ElectedTime = block.Header.Time
+	return nil
+}
+
+/*
+electMiners applies the params approved by miners of the ending round and the params of a fork activated in the round,
+and elects miners of new round. A fork overrides the voted params.
+If there are not enough candidates for the new totalMiners, the params are not changed and the fork params wait for the next election.
+*/
+func (cs *Dpos) electMiners(state *DposState, block *core.Block) ([]common.Address, error) {
+	period, round, totalMiners := cs.params(state)
+	approved, err := state.TallyParams(totalMiners)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.ResetProposal(cs.bc.Storage); err != nil {
+		return nil, err
+	}
+	current := DposParams{Period: period, Round: round, TotalMiners: totalMiners}
+	next := current
+	if approved != nil {
+		next = *approved
+	}
+	if state.ForkParams.Period > 0 {
+		next.Period = state.ForkParams.Period
+	}
+	if state.ForkParams.Round > 0 {
+		next.Round = state.ForkParams.Round
+	}
+	if state.ForkParams.TotalMiners > 0 {
+		next.TotalMiners = state.ForkParams.TotalMiners
+	}
+	seed := cs.roundSeed(state, block.Header.Height, block.Header.Time)
+	if next == current {
+		state.ForkParams = DposParams{}
+		return state.GetNewRoundMiners(seed, totalMiners)
+	}
+	miners, err := state.GetNewRoundMiners(seed, next.TotalMiners)
+	if err == nil {
+		log.CLog().WithFields(logrus.Fields{
+			"Height":      block.Header.Height,
+			"Period":      next.Period,
+			"Round":       next.Round,
+			"TotalMiners": next.TotalMiners,
+		}).Info("Changed params")
+		state.Params = next
+		state.ForkParams = DposParams{}
+		return miners, nil
+	}
+	log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+	return state.GetNewRoundMiners(seed, totalMiners)
+}
+
+// roundSeed is the seed of the beacon, before the beacon is activated by the fork schedule miners are shuffled by the elected time
+func (cs *Dpos) roundSeed(state *DposState, height, electedTime uint64) (seed common.Hash) {
+	if cs.bc.Rules(height).RandomBeacon {
+		return state.Seed
+	}
+	binary.BigEndian.PutUint64(seed[:8], electedTime)
+	return seed
+}
+
 func (cs *Dpos) UpdateLIB() {
 	bc := cs.bc
 	block := bc.Tail()
+	_, _, totalMiners := cs.params(block.ConsensusState().(*DposState))
 	miners := make(map[common.Address]bool)
 	turn := 1
 	for bc.Lib().Hash() != block.Hash() {
 		miners[block.Header.Coinbase] = true
-		if turn == int(cs.totalMiners) {
-			if len(miners) == int(cs.totalMiners) {
+		if turn == int(totalMiners) {
+			if len(miners) == int(totalMiners) {
 				bc.SetLib(block)
 				log.CLog().WithFields(logrus.Fields{
 					"Height": block.Header.Height,
@@ -274,6 +572,36 @@ func (cs *Dpos) LoadState(block *core.Block) (state core.ConsensusState, err err
 	return state, nil
 }
 
+// Validators returns the miners who sign the checkpoint of block
+func (cs *Dpos) Validators(block *core.Block) ([]common.Address, error) {
+	state, err := cs.LoadState(block)
+	if err != nil {
+		return nil, err
+	}
+	dposState := state.(*DposState)
+	return dposState.GetMiners(dposState.MinersHash)
+}
+
+// StateTrieRoots returns the candidate, voter and proposal tries of block
+func (cs *Dpos) StateTrieRoots(block *core.Block) ([]common.Hash, error) {
+	tr, err := trie.NewTrie(block.Header.ConsensusHash[:], cs.bc.Storage, false)
+	if err != nil {
+		return nil, err
+	}
+	state := &DposState{Miner: tr}
+	stateHash, err := state.Get(block.Header.Height)
+	if err != nil {
+		return nil, err
+	}
+	return []common.Hash{
+		common.BytesToHash(stateHash.Candidate),
+		common.BytesToHash(stateHash.Voter),
+		common.BytesToHash(stateHash.Proposal),
+		common.BytesToHash(stateHash.Random),
+		common.BytesToHash(stateHash.Missed),
+	}, nil
+}
+
 func (cs *Dpos) MakeGenesisBlock(block *core.Block, voters []*core.Account) (err error) {
 	bc := cs.bc
 
@@ -285,7 +613,8 @@ func (cs *Dpos) MakeGenesisBlock(block *core.Block, voters []*core.Account) (err
 	for _, v := range voters {
 		state.Stake(v.Address, v.Address, v.Balance)
 	}
-	miners, err := state.GetNewRoundMiners(block.Header.Time, cs.totalMiners)
+	state.Params = cs.paramsFromRules(0)
+	miners, err := state.GetNewRoundMiners(cs.roundSeed(state, 0, block.Header.Time), state.Params.TotalMiners)
 	if err != nil {
 		return err
 	}
@@ -300,6 +629,30 @@ func (cs *Dpos) MakeGenesisBlock(block *core.Block, voters []*core.Account) (err
 	return nil
 }
 
+// InitState elects the first miners from voters when dpos takes over the chain at a fork height
+func (cs *Dpos) InitState(parent *core.Block, voters []*core.Account) (core.ConsensusState, error) {
+	state, err := NewInitState(common.Hash{}, 0, cs.bc.Storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range voters {
+		if err := state.Stake(v.Address, v.Address, v.Balance); err != nil {
+			return nil, err
+		}
+	}
+	state.Params = cs.paramsFromRules(parent.Header.Height + 1)
+	miners, err := state.GetNewRoundMiners(cs.roundSeed(state, parent.Header.Height+1, parent.Header.Time), state.Params.TotalMiners)
+	if err != nil {
+		return nil, err
+	}
+	state.MinersHash, err = state.PutMiners(miners)
+	if err != nil {
+		return nil, err
+	}
+	state.ElectedTime = parent.Header.Time
+	return state, nil
+}
+
 func (cs *Dpos) AddBlockChain(bc *core.BlockChain) {
 	cs.bc = bc
 }
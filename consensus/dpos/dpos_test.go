@@ -2,7 +2,6 @@ package dpos
 
 import (
 	"bytes"
-	"fmt"
 	"math/big"
 	"reflect"
 	"testing"
@@ -118,19 +117,18 @@ func NewDposMiner(index int) *DposMiner {
 
 	cs.SetupMining(common.HexToAddress(config.MinerAddress), wallet)
 	bc := core.NewBlockChain(mstrg, common.HexToAddress(config.Coinbase), uint64(config.MiningReward))
+	config.Consensus.RandomBeacon = true
+	forkSchedule, err := cmd.MakeForkScheduleFromConfig(config)
+	if err != nil {
+		log.CLog().Fatal(err)
+	}
+	bc.SetForkSchedule(forkSchedule)
 	bc.Setup(cs, voters)
 
 	tester := new(DposMiner)
 	tester.Cs = cs
 	tester.Bc = bc
-	tester.Turn = findTurn(cs.coinbase, 0)
-	go func() {
-		for {
-			select {
-			case <-bc.LibCh:
-			}
-		}
-	}()
+	tester.Turn = findTurn(cs.coinbase, common.Hash{})
 	return tester
 }
 
@@ -155,12 +153,12 @@ func (m *DposMiner) MakeBlock(time int) *core.Block {
 
 }
 
-func findTurn(address common.Address, time int64) int {
+func findTurn(address common.Address, seed common.Hash) int {
 	tempMiners := make([]common.Address, 0)
 	tempMiners = append(tempMiners, tests.Address0)
 	tempMiners = append(tempMiners, tests.Address1)
 	tempMiners = append(tempMiners, tests.Address2)
-	randomShuffle(tempMiners, time)
+	randomShuffle(tempMiners, shuffleSeed(seed))
 	for i, v := range tempMiners {
 		if v == address {
 			return i
@@ -310,6 +308,63 @@ func TestVoteTransaction(t *testing.T) {
 	}
 }
 
+func TestSimulateTransaction(t *testing.T) {
+	_stateShuffle = noneShuffle
+	miner1 := NewDposMiner(0)
+	bc1 := miner1.Bc
+	block1 := miner1.MakeBlock(27 + 3*(0+3*0))
+	assert.NoError(t, bc1.PutBlock(block1))
+
+	//transfer
+	tx := core.NewTransaction(tests.Address0, tests.Address2, new(big.Int).SetUint64(5), 1)
+	changes, err := bc1.SimulateTransaction(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, tests.Address0, changes[0].After.Address)
+	assert.Equal(t, uint64(1), changes[0].After.Nonce)
+	assert.Equal(t, new(big.Int).Sub(changes[0].Before.Balance, big.NewInt(5)), changes[0].After.Balance)
+	assert.Equal(t, new(big.Int).Add(changes[1].Before.Balance, big.NewInt(5)), changes[1].After.Balance)
+
+	//the trie nodes of the simulation are not written to the storage of the chain
+	accs, err := core.NewAccountStateRootHash(bc1.Tail().Header.AccountHash, storage.NewOverlayStorage(bc1.Storage))
+	assert.NoError(t, err)
+	var root common.Hash
+	for _, change := range changes {
+		root = accs.PutAccount(change.After)
+	}
+	_, err = bc1.Storage.Get(root[:])
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+
+	//stake
+	var candidate = common.HexToAddress("0x1df75c884f7f1d1537177a3a35e783236739a426ee649fa3e2d8aed598b4f29e838170e2")
+	payload := new(core.Payload)
+	payload.Code = core.TxCVoteStake
+	payload.Data, _ = rlp.EncodeToBytes(new(big.Int).SetUint64(5))
+	tx = core.NewTransactionPayload(tests.Address0, candidate, new(big.Int).SetUint64(0), 1, payload)
+	changes, err = bc1.SimulateTransaction(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, new(big.Int).SetUint64(5), changes[0].After.Staking[candidate])
+
+	//unstake without stake
+	payload = new(core.Payload)
+	payload.Code = core.TxCVoteUnStake
+	payload.Data, _ = rlp.EncodeToBytes(new(big.Int).SetUint64(5))
+	tx = core.NewTransactionPayload(tests.Address0, candidate, new(big.Int).SetUint64(0), 1, payload)
+	_, err = bc1.SimulateTransaction(tx)
+	assert.Error(t, err)
+
+	//wrong nonce
+	tx = core.NewTransaction(tests.Address0, tests.Address2, new(big.Int).SetUint64(5), 2)
+	_, err = bc1.SimulateTransaction(tx)
+	assert.Equal(t, core.ErrTransactionNonce, err)
+
+	//the tail is not changed
+	account := bc1.Tail().AccountState.GetAccount(tests.Address0)
+	assert.Equal(t, uint64(0), account.Nonce)
+	assert.Equal(t, 0, len(account.Staking))
+}
+
 func TestNewRound(t *testing.T) {
 	_stateShuffle = noneShuffle
 	miner1 := NewDposMiner(0)
@@ -341,29 +396,93 @@ func TestNewRound(t *testing.T) {
 	err = bc3.PutBlock(block3)
 	assert.NoError(t, err)
 
-	//new round
+	for _, block := range []*core.Block{block1, block2, block3} {
+		assert.NoError(t, bc1.PutBlock(block))
+		assert.NoError(t, bc2.PutBlock(block))
+	}
+
+	//new round is shuffled by the seed of the parent, miner0 and miner1 are jailed because they missed 2 turns
 	_stateShuffle = nil
-	for i := 3; i < 10; i++ {
-		newTurn := findTurn(tests.Address2, int64(27+3*(turn+3*i)))
-		if turn != newTurn {
-			fmt.Println("newTurn : ", newTurn)
-			block := miner3.MakeBlock(27 + 3*(turn+3*i))
-			assert.Nil(t, block)
-			if turn == findTurn(tests.Address0, int64(27+3*(turn+3*i))) {
-				block := miner1.MakeBlock(27 + 3*(turn+3*i))
-				err = bc1.PutBlock(block)
-				assert.NoError(t, err)
-				fmt.Println(tests.AddressHex0, " mined")
-			} else if turn == findTurn(tests.Address1, int64(27+3*(turn+3*i))) {
-				block := miner2.MakeBlock(27 + 3*(turn+3*i))
-				err = bc2.PutBlock(block)
-				assert.NoError(t, err)
-				fmt.Println(tests.AddressHex1, " mined")
+	seed := block3.ConsensusState().(*DposState).Seed
+	assert.NotEqual(t, common.Hash{}, seed)
+	cloned, err := block3.ConsensusState().Clone()
+	assert.NoError(t, err)
+	state := cloned.(*DposState)
+	assert.NoError(t, state.JailMiners(maxMissedSlots(3)))
+	slot, err := state.GetMissedSlot(tests.Address0)
+	assert.NoError(t, err)
+	assert.True(t, slot.Jailed)
+	newMiners, err := state.GetNewRoundMiners(seed, 3)
+	assert.NoError(t, err)
+	newTurn := func(address common.Address) int {
+		for i, v := range newMiners {
+			if v == address {
+				return i
 			}
-			break
 		}
+		return -1
 	}
 
+	//only the miner of the turn in the new round makes a block
+	newTime := 27 + 3*(turn+3*3)
+	var newBlock *core.Block
+	for i, address := range []common.Address{tests.Address0, tests.Address1, tests.Address2} {
+		miner := []*DposMiner{miner1, miner2, miner3}[i]
+		block := miner.MakeBlock(newTime)
+		if turn == newTurn(address) {
+			assert.NotNil(t, block)
+			assert.Equal(t, address, block.Header.Coinbase)
+			newBlock = block
+		} else {
+			assert.Nil(t, block)
+		}
+	}
+
+	//a light node elects the new round from the state of parent, not from the state of the header
+	verifyHeader := func(coinbase common.Address) error {
+		header := *newBlock.Header
+		header.Coinbase = coinbase
+		block := &core.Block{BaseBlock: core.BaseBlock{Header: &header}}
+		state, err := miner3.Cs.LoadState(block3)
+		assert.NoError(t, err)
+		block.SetConsensusState(state)
+		return miner3.Cs.VerifyHeader(block, block3.Header)
+	}
+	assert.NoError(t, verifyHeader(newBlock.Header.Coinbase))
+	for _, address := range []common.Address{tests.Address0, tests.Address1, tests.Address2} {
+		if address != newBlock.Header.Coinbase {
+			assert.Error(t, verifyHeader(address))
+		}
+	}
+}
+
+func TestForkParams(t *testing.T) {
+	miner := NewDposMiner(0)
+	config := tests.NewConfig(0)
+	config.Consensus.RandomBeacon = true
+	config.Forks = []core.Fork{{Name: "fast", Height: 2, Period: 2}}
+	forkSchedule, err := cmd.MakeForkScheduleFromConfig(config)
+	assert.NoError(t, err)
+	miner.Bc.SetForkSchedule(forkSchedule)
+	cloned, err := miner.Bc.GenesisBlock.ConsensusState().Clone()
+	assert.NoError(t, err)
+	state := cloned.(*DposState)
+
+	//the turns of the round are not changed by the fork
+	miner.Cs.applyForkParams(state, 2)
+	period, _, _ := miner.Cs.params(state)
+	assert.Equal(t, uint64(3), period)
+	assert.Equal(t, uint64(2), state.ForkParams.Period)
+
+	//the fork params take effect at the election
+	block := &core.Block{BaseBlock: core.BaseBlock{Header: &core.Header{Height: 10, Time: 90}}}
+	miners, err := miner.Cs.electMiners(state, block)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(miners))
+	period, _, totalMiners := miner.Cs.params(state)
+	assert.Equal(t, uint64(2), period)
+	assert.Equal(t, uint64(3), totalMiners)
+	assert.Equal(t, DposParams{}, state.ForkParams)
 }
 
 /*
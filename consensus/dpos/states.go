@@ -2,6 +2,7 @@ package dpos
 
 import (
 	"bytes"
+	"encoding/binary"
 	"math/big"
 	"math/rand"
 	"sort"
@@ -31,8 +32,41 @@ type DposState struct {
 	Candidate   *trie.Trie
 	Miner       *trie.Trie
 	Voter       *trie.Trie
+	Proposal    *trie.Trie
+	Random      *trie.Trie
+	Missed      *trie.Trie
 	MinersHash  common.Hash
 	ElectedTime uint64
+	Params      DposParams
+	Seed        common.Hash
+	//params of a fork activated during the round, they take effect at the next election
+	ForkParams DposParams
+}
+
+// DposParams is decided by the chain, not by the local config
+type DposParams struct {
+	Period      uint64
+	Round       uint64
+	TotalMiners uint64
+}
+
+func (p *DposParams) Hash() (hash common.Hash) {
+	encodedBytes, _ := rlp.EncodeToBytes(p)
+	copy(hash[:], crypto.Sha3b256(encodedBytes))
+	return hash
+}
+
+func (p *DposParams) Verify() error {
+	if p.Period == 0 {
+		return errors.New("Period must be greater than 0")
+	}
+	if p.Round == 0 {
+		return errors.New("Round must be greater than 0")
+	}
+	if p.TotalMiners == 0 || p.TotalMiners%3 != 0 {
+		return errors.New("TotalMiners must be a multiple of three")
+	}
+	return nil
 }
 
 func (cs *DposState) Stake(voter, candidate common.Address, amount *big.Int) (err error) {
@@ -115,7 +149,11 @@ func (ds *DposState) GetMiners(minerHash common.Hash) ([]common.Address, error)
 	return miner, nil
 }
 
-func (ds *DposState) GetNewRoundMiners(electedTime uint64, totalMiners uint64) ([]common.Address, error) {
+/*
+GetNewRoundMiners elects candidates by stake and shuffles them with seed.
+seed is the randomness beacon of the parent state, so anyone can reproduce the order.
+*/
+func (ds *DposState) GetNewRoundMiners(seed common.Hash, totalMiners uint64) ([]common.Address, error) {
 	iter, err := ds.Candidate.Iterator(nil)
 	if err != nil {
 		return nil, err
@@ -147,13 +185,27 @@ func (ds *DposState) GetNewRoundMiners(electedTime uint64, totalMiners uint64) (
 		return candidates[i].Balance.Cmp(candidates[j].Balance) > 0
 	})
 
-	candidates = candidates[:totalMiners]
+	//jailed miners are elected only if there are not enough candidates
+	elected := make([]core.BasicAccount, 0, len(candidates))
+	jailed := make([]core.BasicAccount, 0)
+	for _, v := range candidates {
+		slot, err := ds.GetMissedSlot(v.Address)
+		if err != nil {
+			return nil, err
+		}
+		if slot != nil && slot.Jailed {
+			jailed = append(jailed, v)
+		} else {
+			elected = append(elected, v)
+		}
+	}
+	candidates = append(elected, jailed...)[:totalMiners]
 	candidateAddrs := []common.Address{}
 	for _, v := range candidates {
 		candidateAddrs = append(candidateAddrs, v.Address)
 	}
 	if _stateShuffle == nil {
-		randomShuffle(candidateAddrs, int64(electedTime))
+		randomShuffle(candidateAddrs, shuffleSeed(seed))
 	} else {
 		_stateShuffle()
 	}
@@ -176,6 +228,12 @@ type StateHash struct {
 	Voter       []byte
 	Miner       []byte
 	ElectedTime uint64
+	Proposal    []byte
+	Params      DposParams
+	Random      []byte
+	Seed        common.Hash
+	Missed      []byte
+	ForkParams  DposParams
 }
 
 func (ds *DposState) Put(blockNumber, electedTime uint64, minersHash common.Hash) error {
@@ -188,6 +246,12 @@ func (ds *DposState) Put(blockNumber, electedTime uint64, minersHash common.Hash
 	stateHash.Candidate = ds.Candidate.RootHash()
 	stateHash.Voter = ds.Voter.RootHash()
 	stateHash.Miner = minersHash[:]
+	stateHash.Proposal = ds.Proposal.RootHash()
+	stateHash.Params = ds.Params
+	stateHash.Random = ds.Random.RootHash()
+	stateHash.Seed = ds.Seed
+	stateHash.Missed = ds.Missed.RootHash()
+	stateHash.ForkParams = ds.ForkParams
 
 	encodedStateHash, err := rlp.EncodeToBytes(stateHash)
 	if err != nil {
@@ -238,18 +302,84 @@ func (ds *DposState) Clone() (core.ConsensusState, error) {
 	if err3 != nil {
 		return nil, err3
 	}
+	tr4, err4 := ds.Proposal.Clone()
+	if err4 != nil {
+		return nil, err4
+	}
+	tr5, err5 := ds.Random.Clone()
+	if err5 != nil {
+		return nil, err5
+	}
+	tr6, err6 := ds.Missed.Clone()
+	if err6 != nil {
+		return nil, err6
+	}
 	return &DposState{
 		Candidate:   tr1,
 		Miner:       tr2,
 		Voter:       tr3,
+		Proposal:    tr4,
+		Random:      tr5,
+		Missed:      tr6,
 		MinersHash:  ds.MinersHash,
 		ElectedTime: ds.ElectedTime,
+		Params:      ds.Params,
+		Seed:        ds.Seed,
+		ForkParams:  ds.ForkParams,
+	}, nil
+}
+
+// CopyTo returns the state whose tries write to storage
+func (ds *DposState) CopyTo(storage storage.Storage) (core.ConsensusState, error) {
+	tr1, err1 := ds.Candidate.CopyTo(storage, false)
+	if err1 != nil {
+		return nil, err1
+	}
+	tr2, err2 := ds.Miner.CopyTo(storage, false)
+	if err2 != nil {
+		return nil, err2
+	}
+	tr3, err3 := ds.Voter.CopyTo(storage, false)
+	if err3 != nil {
+		return nil, err3
+	}
+	tr4, err4 := ds.Proposal.CopyTo(storage, false)
+	if err4 != nil {
+		return nil, err4
+	}
+	tr5, err5 := ds.Random.CopyTo(storage, false)
+	if err5 != nil {
+		return nil, err5
+	}
+	tr6, err6 := ds.Missed.CopyTo(storage, false)
+	if err6 != nil {
+		return nil, err6
+	}
+	return &DposState{
+		Candidate:   tr1,
+		Miner:       tr2,
+		Voter:       tr3,
+		Proposal:    tr4,
+		Random:      tr5,
+		Missed:      tr6,
+		MinersHash:  ds.MinersHash,
+		ElectedTime: ds.ElectedTime,
+		Params:      ds.Params,
+		Seed:        ds.Seed,
+		ForkParams:  ds.ForkParams,
 	}, nil
 }
 
 func (cs *DposState) ExecuteTransaction(block *core.Block, txIndex int, account *core.Account) (err error) {
 
 	tx := block.Transactions[txIndex]
+	if tx.Payload.Code == core.TxCVoteParams {
+		params := DposParams{}
+		if err = rlp.DecodeBytes(tx.Payload.Data, &params); err != nil {
+			return err
+		}
+		return cs.VoteParams(account.Address, params)
+	}
 	amount := new(big.Int)
 	err = rlp.Decode(bytes.NewReader(tx.Payload.Data), amount)
 	if err != nil {
@@ -301,6 +431,18 @@ func NewInitState(rootHash common.Hash, blockNumber uint64, storage storage.Stor
 				log.CLog().WithFields(logrus.Fields{}).Panic(err)
 			}
 			state.Voter = tr3
+			state.Proposal, err = trie.NewTrie(nil, storage, false)
+			if err != nil {
+				log.CLog().WithFields(logrus.Fields{}).Panic(err)
+			}
+			state.Random, err = trie.NewTrie(nil, storage, false)
+			if err != nil {
+				log.CLog().WithFields(logrus.Fields{}).Panic(err)
+			}
+			state.Missed, err = trie.NewTrie(nil, storage, false)
+			if err != nil {
+				log.CLog().WithFields(logrus.Fields{}).Panic(err)
+			}
 			return state, nil
 		}
 		//return nil, err
@@ -317,11 +459,162 @@ func NewInitState(rootHash common.Hash, blockNumber uint64, storage storage.Stor
 		log.CLog().WithFields(logrus.Fields{}).Panic(err)
 	}
 	state.Voter = tr3
+	tr4, err := trie.NewTrie(stateHash.Proposal, storage, false)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
+	}
+	state.Proposal = tr4
+	tr5, err := trie.NewTrie(stateHash.Random, storage, false)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
+	}
+	state.Random = tr5
+	tr6, err := trie.NewTrie(stateHash.Missed, storage, false)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
+	}
+	state.Missed = tr6
 	state.MinersHash = common.BytesToHash(stateHash.Miner)
 	state.ElectedTime = stateHash.ElectedTime
+	state.Params = stateHash.Params
+	state.Seed = stateHash.Seed
+	state.ForkParams = stateHash.ForkParams
 	return state, nil
 }
 
+/*
+VoteParams records that a miner of this round votes for params.
+The first vote for params makes the proposal and a miner has only the last vote.
+key: proposal hash => params, miner => proposal hash
+*/
+func (ds *DposState) VoteParams(miner common.Address, params DposParams) error {
+	if err := params.Verify(); err != nil {
+		return err
+	}
+	miners, err := ds.GetMiners(ds.MinersHash)
+	if err != nil {
+		return err
+	}
+	isMiner := false
+	for _, v := range miners {
+		if v == miner {
+			isMiner = true
+			break
+		}
+	}
+	if !isMiner {
+		return errors.New("Only miners can vote for params")
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	hash := params.Hash()
+	encodedBytes, err := rlp.EncodeToBytes(params)
+	if err != nil {
+		return err
+	}
+	if _, err := ds.Proposal.Put(hash[:], encodedBytes); err != nil {
+		return err
+	}
+	_, err = ds.Proposal.Put(miner[:], hash[:])
+	return err
+}
+
+// TallyParams returns the params that more than 2/3 of totalMiners voted for
+func (ds *DposState) TallyParams(totalMiners uint64) (params *DposParams, err error) {
+	iter, err := ds.Proposal.Iterator(nil)
+	if err != nil {
+		if err == trie.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	votes := make(map[common.Hash]uint64)
+	proposals := make(map[common.Hash]*DposParams)
+	exist, _ := iter.Next()
+	for exist {
+		if len(iter.Key()) == common.HashLength {
+			p := new(DposParams)
+			if err := rlp.DecodeBytes(iter.Value(), p); err != nil {
+				return nil, err
+			}
+			proposals[common.BytesToHash(iter.Key())] = p
+		} else {
+			votes[common.BytesToHash(iter.Value())]++
+		}
+		exist, err = iter.Next()
+	}
+	for hash, count := range votes {
+		if count >= totalMiners*2/3+1 {
+			return proposals[hash], nil
+		}
+	}
+	return nil, nil
+}
+
+//proposals expire at the end of round
+func (ds *DposState) ResetProposal(storage storage.Storage) (err error) {
+	ds.Proposal, err = trie.NewTrie(nil, storage, false)
+	return err
+}
+
+// RandomCommit is the last commit of a miner and the height of the block including it
+type RandomCommit struct {
+	Commit common.Hash
+	Height uint64
+}
+
+func (ds *DposState) GetRandomCommit(miner common.Address) (*RandomCommit, error) {
+	encodedBytes, err := ds.Random.Get(miner[:])
+	if err != nil {
+		if err == trie.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	commit := new(RandomCommit)
+	if err := rlp.DecodeBytes(encodedBytes, commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+/*
+MixRandom is the commit-reveal randomness beacon.
+A miner reveals the secret of its last commit and commits a new secret in each block.
+The reveal is mixed into the seed, the first block of a miner has no reveal.
+*/
+func (ds *DposState) MixRandom(miner common.Address, reveal, commit common.Hash, height uint64) error {
+	if commit == (common.Hash{}) {
+		return errors.New("Random commit must not be empty")
+	}
+	last, err := ds.GetRandomCommit(miner)
+	if err != nil {
+		return err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if last == nil {
+		if reveal != (common.Hash{}) {
+			return errors.New("There is no commit to reveal")
+		}
+	} else {
+		if common.BytesToHash(crypto.Sha3b256(reveal[:])) != last.Commit {
+			return errors.New("Random reveal does not match the commit")
+		}
+		ds.Seed = common.BytesToHash(crypto.Sha3b256(ds.Seed[:], reveal[:]))
+	}
+	encodedBytes, err := rlp.EncodeToBytes(&RandomCommit{Commit: commit, Height: height})
+	if err != nil {
+		return err
+	}
+	_, err = ds.Random.Put(miner[:], encodedBytes)
+	return err
+}
+
+func shuffleSeed(seed common.Hash) int64 {
+	return int64(binary.BigEndian.Uint64(seed[:8]))
+}
+
 func randomShuffle(slice []common.Address, seed int64) {
 	r := rand.New(rand.NewSource(seed))
 	for len(slice) > 0 {
@@ -334,3 +627,96 @@ func randomShuffle(slice []common.Address, seed int64) {
 
 func noneShuffle() {
 }
+
+// MissedSlot is the number of turns a miner skipped
+type MissedSlot struct {
+	Missed      uint64 //in this round
+	TotalMissed uint64
+	JailCount   uint64
+	Jailed      bool //excluded from this round
+}
+
+func (ds *DposState) GetMissedSlot(miner common.Address) (*MissedSlot, error) {
+	encodedBytes, err := ds.Missed.Get(miner[:])
+	if err != nil {
+		if err == trie.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	slot := new(MissedSlot)
+	if err := rlp.DecodeBytes(encodedBytes, slot); err != nil {
+		return nil, err
+	}
+	return slot, nil
+}
+
+func (ds *DposState) putMissedSlot(miner common.Address, slot *MissedSlot) error {
+	encodedBytes, err := rlp.EncodeToBytes(slot)
+	if err != nil {
+		return err
+	}
+	_, err = ds.Missed.Put(miner[:], encodedBytes)
+	return err
+}
+
+func (ds *DposState) AddMissedSlot(miner common.Address) error {
+	slot, err := ds.GetMissedSlot(miner)
+	if err != nil {
+		return err
+	}
+	if slot == nil {
+		slot = new(MissedSlot)
+	}
+	slot.Missed++
+	slot.TotalMissed++
+	return ds.putMissedSlot(miner, slot)
+}
+
+// MissedSlots returns the missed slots of every miner who has ever missed
+func (ds *DposState) MissedSlots() (map[common.Address]*MissedSlot, error) {
+	slots := make(map[common.Address]*MissedSlot)
+	iter, err := ds.Missed.Iterator(nil)
+	if err != nil {
+		if err == trie.ErrNotFound {
+			return slots, nil
+		}
+		return nil, err
+	}
+	exist, _ := iter.Next()
+	for exist {
+		slot := new(MissedSlot)
+		if err := rlp.DecodeBytes(iter.Value(), slot); err != nil {
+			return nil, err
+		}
+		slots[common.BytesToAddress(iter.Key())] = slot
+		exist, err = iter.Next()
+	}
+	return slots, nil
+}
+
+/*
+JailMiners jails miners who missed more than maxMissed turns in the ending round
+and starts counting for the new round. Call it before GetNewRoundMiners.
+*/
+func (ds *DposState) JailMiners(maxMissed uint64) error {
+	slots, err := ds.MissedSlots()
+	if err != nil {
+		return err
+	}
+	for address, slot := range slots {
+		slot.Jailed = slot.Missed > maxMissed
+		if slot.Jailed {
+			slot.JailCount++
+			log.CLog().WithFields(logrus.Fields{
+				"Address": common.AddressToHex(address),
+				"Missed":  slot.Missed,
+			}).Info("Jailed miner")
+		}
+		slot.Missed = 0
+		if err := ds.putMissedSlot(address, slot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/nacamp/go-simplechain/tests"
 
 	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/crypto"
 	"github.com/nacamp/go-simplechain/storage"
 	"github.com/stretchr/testify/assert"
 )
@@ -49,14 +50,14 @@ func TestStake(t *testing.T) {
 
 	var newAddr = "0x1df75c884f7f1d1537177a3a35e783236739a426ee649fa3e2d8aed598b4f29e838170e2"
 	state.Stake(tests.Address0, common.HexToAddress(newAddr), new(big.Int).SetUint64(10))
-	_, err = state.GetNewRoundMiners(uint64(5), 3)
+	_, err = state.GetNewRoundMiners(common.Hash{}, 3)
 	assert.Error(t, err)
 	state.Stake(tests.Address0, tests.Address0, new(big.Int).SetUint64(30))
 	state.Stake(tests.Address0, tests.Address1, new(big.Int).SetUint64(40))
 	state.Stake(tests.Address0, tests.Address2, new(big.Int).SetUint64(50))
 
 	//test GetNewRoundMiners
-	miners, _ := state.GetNewRoundMiners(uint64(5), 3)
+	miners, _ := state.GetNewRoundMiners(common.Hash{}, 3)
 	minerSize := 0
 	for _, v := range miners {
 		if v == tests.Address0 || v == tests.Address1 || v == tests.Address2 {
@@ -94,3 +95,121 @@ func TestGetNewElectedTime(t *testing.T) {
 	assert.Equal(t, uint64(0), GetNewElectedTime(0, 26, 3, 3, 3))
 	assert.Equal(t, uint64(27), GetNewElectedTime(0, 27, 3, 3, 3))
 }
+
+func TestVoteParams(t *testing.T) {
+	_storage, _ := storage.NewMemoryStorage()
+	state, err := NewInitState(common.Hash{}, 0, _storage)
+	assert.NoError(t, err)
+	state.MinersHash, err = state.PutMiners([]common.Address{tests.Address0, tests.Address1, tests.Address2})
+	assert.NoError(t, err)
+
+	params := DposParams{Period: 5, Round: 2, TotalMiners: 6}
+	assert.Error(t, state.VoteParams(tests.Address3, params))
+	assert.Error(t, state.VoteParams(tests.Address0, DposParams{Period: 5, Round: 2, TotalMiners: 4}))
+
+	assert.NoError(t, state.VoteParams(tests.Address0, params))
+	assert.NoError(t, state.VoteParams(tests.Address1, params))
+	approved, err := state.TallyParams(3)
+	assert.NoError(t, err)
+	assert.Nil(t, approved)
+
+	//a miner has only the last vote
+	assert.NoError(t, state.VoteParams(tests.Address2, DposParams{Period: 3, Round: 3, TotalMiners: 3}))
+	assert.NoError(t, state.VoteParams(tests.Address2, params))
+	approved, err = state.TallyParams(3)
+	assert.NoError(t, err)
+	assert.Equal(t, params, *approved)
+
+	//proposal is in state hash
+	state.Params = *approved
+	assert.NoError(t, state.Put(1, 0, state.MinersHash))
+	state2, err := NewInitState(state.RootHash(), 1, _storage)
+	assert.NoError(t, err)
+	assert.Equal(t, params, state2.Params)
+	approved, _ = state2.TallyParams(3)
+	assert.Equal(t, params, *approved)
+
+	assert.NoError(t, state2.ResetProposal(_storage))
+	approved, _ = state2.TallyParams(3)
+	assert.Nil(t, approved)
+}
+
+func TestMixRandom(t *testing.T) {
+	_storage, _ := storage.NewMemoryStorage()
+	state, err := NewInitState(common.Hash{}, 0, _storage)
+	assert.NoError(t, err)
+
+	secret1 := common.BytesToHash(crypto.Sha3b256([]byte("secret1")))
+	secret2 := common.BytesToHash(crypto.Sha3b256([]byte("secret2")))
+	commit1 := common.BytesToHash(crypto.Sha3b256(secret1[:]))
+	commit2 := common.BytesToHash(crypto.Sha3b256(secret2[:]))
+
+	//first block has no reveal
+	assert.Error(t, state.MixRandom(tests.Address0, secret1, commit1, 1))
+	assert.Error(t, state.MixRandom(tests.Address0, common.Hash{}, common.Hash{}, 1))
+	assert.NoError(t, state.MixRandom(tests.Address0, common.Hash{}, commit1, 1))
+	assert.Equal(t, common.Hash{}, state.Seed)
+
+	//reveal must match the last commit
+	assert.Error(t, state.MixRandom(tests.Address0, secret2, commit2, 2))
+	assert.NoError(t, state.MixRandom(tests.Address0, secret1, commit2, 2))
+	assert.Equal(t, common.BytesToHash(crypto.Sha3b256(make([]byte, common.HashLength), secret1[:])), state.Seed)
+	last, err := state.GetRandomCommit(tests.Address0)
+	assert.NoError(t, err)
+	assert.Equal(t, RandomCommit{Commit: commit2, Height: 2}, *last)
+
+	//seed is in state hash
+	assert.NoError(t, state.Put(2, 0, state.MinersHash))
+	state2, err := NewInitState(state.RootHash(), 2, _storage)
+	assert.NoError(t, err)
+	assert.Equal(t, state.Seed, state2.Seed)
+	last, _ = state2.GetRandomCommit(tests.Address0)
+	assert.Equal(t, commit2, last.Commit)
+}
+
+func TestMissedSlots(t *testing.T) {
+	_stateShuffle = noneShuffle
+	_storage, _ := storage.NewMemoryStorage()
+	state, err := NewInitState(common.Hash{}, 0, _storage)
+	assert.NoError(t, err)
+	state.Stake(tests.Address0, tests.Address0, new(big.Int).SetUint64(300))
+	state.Stake(tests.Address1, tests.Address1, new(big.Int).SetUint64(200))
+	state.Stake(tests.Address2, tests.Address2, new(big.Int).SetUint64(100))
+
+	slot, err := state.GetMissedSlot(tests.Address0)
+	assert.NoError(t, err)
+	assert.Nil(t, slot)
+	assert.NoError(t, state.AddMissedSlot(tests.Address0))
+	assert.NoError(t, state.AddMissedSlot(tests.Address0))
+	assert.NoError(t, state.AddMissedSlot(tests.Address1))
+
+	//only the miner over maxMissed is jailed, missed is reset for new round
+	assert.NoError(t, state.JailMiners(1))
+	slots, err := state.MissedSlots()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(slots))
+	assert.Equal(t, MissedSlot{Missed: 0, TotalMissed: 2, JailCount: 1, Jailed: true}, *slots[tests.Address0])
+	assert.Equal(t, MissedSlot{Missed: 0, TotalMissed: 1, JailCount: 0, Jailed: false}, *slots[tests.Address1])
+
+	//jailed miner is elected after the others
+	miners, err := state.GetNewRoundMiners(common.Hash{}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []common.Address{tests.Address1, tests.Address2}, miners)
+	miners, err = state.GetNewRoundMiners(common.Hash{}, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []common.Address{tests.Address1, tests.Address2, tests.Address0}, miners)
+
+	//missed slots are in state hash
+	assert.NoError(t, state.Put(1, 0, state.MinersHash))
+	state2, err := NewInitState(state.RootHash(), 1, _storage)
+	assert.NoError(t, err)
+	slot, err = state2.GetMissedSlot(tests.Address0)
+	assert.NoError(t, err)
+	assert.True(t, slot.Jailed)
+
+	//released when the miner does not miss in next round
+	assert.NoError(t, state2.JailMiners(1))
+	slot, _ = state2.GetMissedSlot(tests.Address0)
+	assert.False(t, slot.Jailed)
+	assert.Equal(t, uint64(1), slot.JailCount)
+}
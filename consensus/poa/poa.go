@@ -14,6 +14,7 @@ import (
 	"github.com/nacamp/go-simplechain/core"
 	"github.com/nacamp/go-simplechain/log"
 	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/trie"
 	"github.com/sirupsen/logrus"
 )
 
@@ -27,10 +28,11 @@ type Poa struct {
 	period     uint64
 	wallet     *account.Wallet
 	streamPool *net.PeerStreamPool
+	clock      common.Clock
 }
 
 func NewPoa(streamPool *net.PeerStreamPool, period uint64) *Poa {
-	return &Poa{streamPool: streamPool, period: period}
+	return &Poa{streamPool: streamPool, period: period, clock: common.SystemClock{}}
 }
 
 func (cs *Poa) SetupMining(address common.Address, wallet *account.Wallet) {
@@ -39,11 +41,32 @@ func (cs *Poa) SetupMining(address common.Address, wallet *account.Wallet) {
 	cs.wallet = wallet
 }
 
+// SetClock replaces the wall clock which drives mining, call it before Start
+func (cs *Poa) SetClock(clock common.Clock) {
+	cs.clock = clock
+}
+
+// getPeriod returns the period in force at height
+func (cs *Poa) getPeriod(height uint64) uint64 {
+	if cs.bc != nil {
+		if period := cs.bc.Rules(height).Period; period > 0 {
+			return period
+		}
+	}
+	return cs.period
+}
+
 func (cs *Poa) MakeBlock(now uint64) *core.Block {
 	bc := cs.bc
+	rules := bc.Rules(bc.Tail().Header.Height + 1)
+	if !rules.IsConsensus(cs.ConsensusType()) {
+		return nil
+	}
+	period := cs.getPeriod(rules.Height)
 	block, err := bc.NewBlockFromTail()
 	if err != nil {
 		log.CLog().Warning(fmt.Sprintf("%+v", err))
+		return nil
 	}
 
 	block.Header.Time = now
@@ -58,13 +81,13 @@ func (cs *Poa) MakeBlock(now uint64) *core.Block {
 	if err != nil {
 		log.CLog().Warning(fmt.Sprintf("%+v", err))
 	}
-	turn := (now % (uint64(len(miners)) * cs.period)) / cs.period
+	turn := (now % (uint64(len(miners)) * period)) / period
 	if miners[turn] == cs.coinbase {
 		//parent := bc.GetBlockByHash(block.Header.ParentHash)
 		parent := bc.Tail()
 
 		//if (parent != nil) && (now-parent.Header.Time < ((uint64(len(miners)) * cs.Period) - 1)) { //(3 * 3)
-		if (parent != nil) && (now-parent.Header.Time < cs.period) { //(3 * 3)
+		if (parent != nil) && (now-parent.Header.Time < period) { //(3 * 3)
 			log.CLog().WithFields(logrus.Fields{
 				"address": common.AddressToHex(cs.coinbase),
 			}).Debug("Interval is short")
@@ -85,6 +108,12 @@ func (cs *Poa) MakeBlock(now uint64) *core.Block {
 			if tx == nil {
 				break
 			}
+			if err := rules.VerifyTransaction(tx); err != nil {
+				log.CLog().WithFields(logrus.Fields{
+					"Hash": common.HashToHex(tx.Hash),
+				}).Warning(err)
+				continue
+			}
 			fromAccount := accs.GetAccount(tx.From)
 			if fromAccount == nil {
 				log.CLog().WithFields(logrus.Fields{
@@ -134,6 +163,12 @@ func (cs *Poa) MakeBlock(now uint64) *core.Block {
 				}
 			}
 		}
+		if rules.MaxTransactions > 0 && uint64(len(block.Transactions)) > rules.MaxTransactions {
+			for _, tx := range block.Transactions[rules.MaxTransactions:] {
+				bc.TxPool.Put(tx)
+			}
+			block.Transactions = block.Transactions[:rules.MaxTransactions]
+		}
 		for _, tx := range block.Transactions {
 			tx.Height = block.Header.Height
 		}
@@ -161,10 +196,10 @@ func (cs *Poa) MakeBlock(now uint64) *core.Block {
 }
 
 func (cs *Poa) loop() {
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := cs.clock.NewTicker(1 * time.Second)
 	for {
 		select {
-		case now := <-ticker.C:
+		case now := <-ticker.C():
 			block := cs.MakeBlock(uint64(now.Unix()))
 			if block != nil {
 				sig, err := cs.wallet.SignHash(cs.coinbase, block.Header.Hash[:])
@@ -175,7 +210,7 @@ func (cs *Poa) loop() {
 				cs.bc.PutBlockByCoinbase(block)
 				cs.bc.Consensus.UpdateLIB()
 				message, _ := net.NewRLPMessage(net.MsgNewBlock, block.BaseBlock)
-				cs.streamPool.BroadcastMessage(&message)
+				cs.streamPool.BroadcastBlock(block.Hash(), block.Header.Height, &message)
 			}
 		}
 	}
@@ -281,6 +316,18 @@ func (cs *Poa) MakeGenesisBlock(block *core.Block, voters []*core.Account) (err
 	return nil
 }
 
+// InitState makes voters signers when poa takes over the chain at a fork height
+func (cs *Poa) InitState(parent *core.Block, voters []*core.Account) (core.ConsensusState, error) {
+	state, err := NewInitState(common.Hash{}, 0, cs.bc.Storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range voters {
+		state.Signer.Put(v.Address[:], []byte{})
+	}
+	return state, nil
+}
+
 func (cs *Poa) AddBlockChain(bc *core.BlockChain) {
 	cs.bc = bc
 }
@@ -291,7 +338,11 @@ func (cs *Poa) Verify(block *core.Block) error {
 	if err != nil {
 		return err
 	}
-	index := (block.Header.Time % (uint64(len(miners)) * cs.period)) / cs.period
+	period := cs.getPeriod(block.Header.Height)
+	if len(miners) == 0 || period == 0 {
+		return errors.New("Miners and period must be one more")
+	}
+	index := (block.Header.Time % (uint64(len(miners)) * period)) / period
 	if miners[index] != block.Header.Coinbase {
 		return errors.New("This turn is not this miner's turn ")
 	}
@@ -318,3 +369,26 @@ func (cs *Poa) LoadState(block *core.Block) (state core.ConsensusState, err erro
 	state.(*PoaState).RefreshSigner()
 	return state, nil
 }
+
+// Validators returns the signers who sign the checkpoint of block
+func (cs *Poa) Validators(block *core.Block) ([]common.Address, error) {
+	state, err := cs.LoadState(block)
+	if err != nil {
+		return nil, err
+	}
+	return state.(*PoaState).GetMiners()
+}
+
+// StateTrieRoots returns the signer and voter tries of block
+func (cs *Poa) StateTrieRoots(block *core.Block) ([]common.Hash, error) {
+	tr, err := trie.NewTrie(block.Header.ConsensusHash[:], cs.bc.Storage, false)
+	if err != nil {
+		return nil, err
+	}
+	state := &PoaState{Snapshot: tr}
+	signersHash, votersHash, err := state.Get(block.Header.Height)
+	if err != nil {
+		return nil, err
+	}
+	return []common.Hash{signersHash, votersHash}, nil
+}
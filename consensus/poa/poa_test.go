@@ -77,6 +77,10 @@ func TestPoa(t *testing.T) {
 	assert.NoError(t, cs.Verify(block))
 	block.Header.Time = 3 * 4
 	assert.Error(t, cs.Verify(block))
+	//a state without miners is rejected
+	empty, _ := NewInitState(common.Hash{}, 0, mstrg)
+	block.SetConsensusState(empty)
+	assert.Error(t, cs.Verify(block))
 
 	//test getMinerSize
 	minerSize, _ := cs.getMinerSize(block)
@@ -111,13 +115,6 @@ func NewPoaMiner(index int) *PoaMiner {
 	tester := new(PoaMiner)
 	tester.Cs = cs
 	tester.Bc = bc
-	go func() {
-		for {
-			select {
-			case <-bc.LibCh:
-			}
-		}
-	}()
 	return tester
 }
 
@@ -450,3 +447,82 @@ func TestUpdateLIB3(t *testing.T) {
 	bc1.Consensus.UpdateLIB()
 	assert.Equal(t, block4.Hash(), bc1.Lib().Hash(), "")
 }
+
+func TestCheckpoint(t *testing.T) {
+	miner1 := NewPoaMiner(0)
+	miner2 := NewPoaMiner(1)
+	miner3 := NewPoaMiner(2)
+	bc1 := miner1.Bc
+
+	block1 := miner1.MakeBlock(27 + 3*0)
+	assert.NoError(t, bc1.PutBlock(block1))
+
+	cp := core.Checkpoint{Height: block1.Header.Height, Hash: block1.Hash()}
+	vote := func(miner *PoaMiner) *core.CheckpointVote {
+		v := &core.CheckpointVote{Checkpoint: cp}
+		sig, err := miner.Cs.wallet.SignHash(miner.Cs.coinbase, v.SigHash())
+		assert.NoError(t, err)
+		copy(v.Signature[:], sig)
+		return v
+	}
+
+	//over 2/3 of signers
+	signed, err := bc1.AddCheckpointVote(vote(miner1))
+	assert.NoError(t, err)
+	assert.Nil(t, signed)
+	signed, err = bc1.AddCheckpointVote(vote(miner2))
+	assert.NoError(t, err)
+	assert.Nil(t, signed)
+	_, err = bc1.AddCheckpointVote(vote(miner2))
+	assert.Equal(t, core.ErrCheckpointVoteKnown, err)
+	signed, err = bc1.AddCheckpointVote(vote(miner3))
+	assert.NoError(t, err)
+	assert.Equal(t, cp, signed.Checkpoint)
+	assert.Equal(t, 3, len(signed.Signatures))
+	assert.Equal(t, &cp, bc1.Checkpoint())
+
+	//a signed checkpoint is verified with the validators, a validator is counted once
+	validators, err := bc1.Validators(bc1.GenesisBlock)
+	assert.NoError(t, err)
+	assert.NoError(t, core.VerifySignedCheckpoint(signed, validators))
+	twice := &core.SignedCheckpoint{Checkpoint: cp, Signatures: []common.Signature{signed.Signatures[0], signed.Signatures[0], signed.Signatures[1]}}
+	assert.Equal(t, core.ErrCheckpointSignatures, core.VerifySignedCheckpoint(twice, validators))
+	assert.Equal(t, core.ErrCheckpointSigner, core.VerifySignedCheckpoint(signed, validators[:2]))
+	forged := &core.SignedCheckpoint{Checkpoint: core.Checkpoint{Height: cp.Height, Hash: common.Hash{0x1}}, Signatures: signed.Signatures}
+	assert.Error(t, core.VerifySignedCheckpoint(forged, validators))
+
+	//finalized height
+	_, err = bc1.AddCheckpointVote(vote(miner1))
+	assert.Equal(t, core.ErrCheckpointVoteKnown, err)
+
+	//unknown block
+	unknown := vote(miner1)
+	unknown.Hash = common.Hash{0x1}
+	_, err = bc1.AddCheckpointVote(unknown)
+	assert.Equal(t, core.ErrCheckpointUnknownBlock, err)
+
+	//conflicting branch
+	bc2 := miner2.Bc
+	bc2.SetTrustedCheckpoint(&core.Checkpoint{Height: 1, Hash: common.Hash{0x1}})
+	assert.Equal(t, core.ErrCheckpointConflict, bc2.PutBlock(block1))
+	bc2.SetTrustedCheckpoint(&cp)
+	assert.NoError(t, bc2.PutBlock(block1))
+
+	//a descendant of a conflicting branch is refused
+	bc3 := miner3.Bc
+	assert.NoError(t, bc3.PutBlock(block1))
+	block2 := miner2.MakeBlock(27 + 3*1)
+	bc3.SetTrustedCheckpoint(&core.Checkpoint{Height: 1, Hash: common.Hash{0x1}})
+	assert.Equal(t, core.ErrCheckpointConflict, bc3.PutBlock(block2))
+
+	//the height of a trusted checkpoint is taken from the block with its hash
+	bc3.SetTrustedCheckpoint(&core.Checkpoint{Hash: block1.Hash()})
+	assert.NoError(t, bc3.PutBlock(block2))
+	assert.Equal(t, &cp, bc3.Checkpoint())
+
+	//a block below the checkpoint must be on the canonical chain
+	bc3.SetTrustedCheckpoint(&core.Checkpoint{Height: 2, Hash: block2.Hash()})
+	other := NewPoaMiner(1).MakeBlock(27 + 3*1)
+	assert.Equal(t, uint64(1), other.Header.Height)
+	assert.Equal(t, core.ErrCheckpointConflict, bc3.PutBlock(other))
+}
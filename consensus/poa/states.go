@@ -245,6 +245,28 @@ func (cs *PoaState) Clone() (core.ConsensusState, error) {
 	}, nil
 }
 
+// CopyTo returns the state whose tries write to storage
+func (cs *PoaState) CopyTo(storage storage.Storage) (core.ConsensusState, error) {
+	tr1, err1 := cs.Voter.CopyTo(storage, false)
+	if err1 != nil {
+		return nil, err1
+	}
+	tr2, err2 := cs.Signer.CopyTo(storage, false)
+	if err2 != nil {
+		return nil, err2
+	}
+	tr3, err3 := cs.Snapshot.CopyTo(storage, false)
+	if err3 != nil {
+		return nil, err3
+	}
+	return &PoaState{
+		Voter:     tr1,
+		Signer:    tr2,
+		Snapshot:  tr3,
+		firstVote: cs.firstVote,
+	}, nil
+}
+
 func (cs *PoaState) ExecuteTransaction(block *core.Block, txIndex int, account *core.Account) (err error) {
 	tx := block.Transactions[txIndex]
 	if tx.From == block.Header.Coinbase && cs.firstVote {
@@ -26,10 +26,11 @@ type Pow struct {
 	enableMining      bool
 	streamPool        *net.PeerStreamPool
 	genesisDifficulty *big.Int //big.NewInt(5000000)
+	clock             common.Clock
 }
 
 func NewPow(streamPool *net.PeerStreamPool, difficulty *big.Int) *Pow {
-	return &Pow{streamPool: streamPool, genesisDifficulty: difficulty}
+	return &Pow{streamPool: streamPool, genesisDifficulty: difficulty, clock: common.SystemClock{}}
 }
 
 func (cs *Pow) SetupMining(address common.Address, wallet *account.Wallet) {
@@ -38,6 +39,11 @@ func (cs *Pow) SetupMining(address common.Address, wallet *account.Wallet) {
 	cs.wallet = wallet
 }
 
+// SetClock replaces the wall clock which drives mining, call it before Start
+func (cs *Pow) SetClock(clock common.Clock) {
+	cs.clock = clock
+}
+
 //code copied from ethereum >>>>>>>>>>
 var (
 	two256                 = new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
@@ -109,14 +115,27 @@ func work(hash []byte, nonce uint64) []byte {
 
 //code copied from ethereum <<<<<<<<<<<
 
+//the parent of the first pow block after a fork has no difficulty
+func (cs *Pow) difficulty(time uint64, parent *core.Header) *big.Int {
+	if parent.Difficulty == nil {
+		return new(big.Int).Set(cs.genesisDifficulty)
+	}
+	return calcDifficulty(time, parent)
+}
+
 func (cs *Pow) MakeBlock(now uint64) *core.Block {
 	bc := cs.bc
+	rules := bc.Rules(bc.Tail().Header.Height + 1)
+	if !rules.IsConsensus(cs.ConsensusType()) {
+		return nil
+	}
 	block, err := bc.NewBlockFromTail()
 	if err != nil {
 		log.CLog().Warning(fmt.Sprintf("%+v", err))
+		return nil
 	}
 	block.Header.Time = now
-	block.Header.Difficulty = calcDifficulty(now, bc.Tail().Header)
+	block.Header.Difficulty = cs.difficulty(now, bc.Tail().Header)
 	block.Header.Coinbase = cs.coinbase
 
 	block.Transactions = make([]*core.Transaction, 0)
@@ -127,6 +146,12 @@ func (cs *Pow) MakeBlock(now uint64) *core.Block {
 		if tx == nil {
 			break
 		}
+		if err := rules.VerifyTransaction(tx); err != nil {
+			log.CLog().WithFields(logrus.Fields{
+				"Hash": common.HashToHex(tx.Hash),
+			}).Warning(err)
+			continue
+		}
 		fromAccount := accs.GetAccount(tx.From)
 		if fromAccount == nil {
 			log.CLog().WithFields(logrus.Fields{
@@ -164,6 +189,12 @@ func (cs *Pow) MakeBlock(now uint64) *core.Block {
 		}
 	}
 
+	if rules.MaxTransactions > 0 && uint64(len(block.Transactions)) > rules.MaxTransactions {
+		for _, tx := range block.Transactions[rules.MaxTransactions:] {
+			bc.TxPool.Put(tx)
+		}
+		block.Transactions = block.Transactions[:rules.MaxTransactions]
+	}
 	for _, tx := range block.Transactions {
 		tx.Height = block.Header.Height
 	}
@@ -198,10 +229,10 @@ func (cs *Pow) MakeBlock(now uint64) *core.Block {
 }
 
 func (cs *Pow) loop() {
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := cs.clock.NewTicker(1 * time.Second)
 	for {
 		select {
-		case now := <-ticker.C:
+		case now := <-ticker.C():
 			block := cs.MakeBlock(uint64(now.Unix()))
 			if block != nil {
 				sig, err := cs.wallet.SignHash(cs.coinbase, block.Header.Hash[:])
@@ -213,7 +244,7 @@ func (cs *Pow) loop() {
 				cs.bc.Consensus.UpdateLIB()
 				cs.bc.RemoveOrphanBlock()
 				message, _ := net.NewRLPMessage(net.MsgNewBlock, block.BaseBlock)
-				cs.streamPool.BroadcastMessage(&message)
+				cs.streamPool.BroadcastBlock(block.Hash(), block.Header.Height, &message)
 			}
 		}
 	}
@@ -233,7 +264,15 @@ func (cs *Pow) Verify(block *core.Block) (err error) {
 	if parent == nil {
 		return errors.New("Parent block is nil")
 	}
-	if block.Header.Difficulty.Cmp(calcDifficulty(block.Header.Time, parent.Header)) != 0 {
+	return cs.VerifyHeader(block, parent.Header)
+}
+
+// VerifyHeader verifies the difficulty and the work of block with the header of parent
+func (cs *Pow) VerifyHeader(block *core.Block, parent *core.Header) (err error) {
+	if block.Header.Difficulty == nil {
+		return errors.New("Difficulty is nil")
+	}
+	if block.Header.Difficulty.Cmp(cs.difficulty(block.Header.Time, parent)) != 0 {
 		return errors.New("Difficulty is not valid")
 	}
 	if block.Header.Difficulty.Cmp(new(big.Int).SetUint64(0)) <= 0 {
@@ -277,6 +316,10 @@ func (cs *Pow) MakeGenesisBlock(block *core.Block, voters []*core.Account) (err
 	return nil
 }
 
+func (cs *Pow) InitState(parent *core.Block, voters []*core.Account) (core.ConsensusState, error) {
+	return &PowState{}, nil
+}
+
 func (cs *Pow) AddBlockChain(bc *core.BlockChain) {
 	cs.bc = bc
 }
@@ -19,15 +19,20 @@ import (
 )
 
 type NodeServer struct {
-	consensus  core.Consensus
-	bc         *core.BlockChain
-	rpcServer  *rpc.RpcServer
-	wallet     *account.Wallet
-	bcService  *service.BlockChainService
-	db         storage.Storage
-	streamPool *net.PeerStreamPool
-	node       *net.Node
-	config     *cmd.Config
+	consensus   core.Consensus
+	bc          *core.BlockChain
+	rpcServer   *rpc.RpcServer
+	wallet      *account.Wallet
+	bcService   *service.BlockChainService
+	cpService   *service.CheckpointService
+	syncService *service.SyncService
+	txService   *service.TxService
+	snapshot    *service.SnapshotService
+	light       *service.LightService
+	db          storage.Storage
+	streamPool  *net.PeerStreamPool
+	node        *net.Node
+	config      *cmd.Config
 }
 
 func NewNodeServer(config *cmd.Config) *NodeServer {
@@ -36,6 +41,9 @@ func NewNodeServer(config *cmd.Config) *NodeServer {
 	if err != nil {
 		log.CLog().WithFields(logrus.Fields{}).Panic(err)
 	}
+	if config.SyncMode == "light" && config.EnableMining {
+		log.CLog().WithFields(logrus.Fields{}).Panic("light node cannot mine")
+	}
 	ns := NodeServer{config: config}
 
 	ns.streamPool = net.NewPeerStreamPool()
@@ -45,7 +53,17 @@ func NewNodeServer(config *cmd.Config) *NodeServer {
 	} else {
 		ns.db, _ = storage.NewLevelDBStorage(config.DBPath)
 	}
+	banDuration := net.DefaultBanDuration
+	if config.BanDuration > 0 {
+		banDuration = time.Duration(config.BanDuration) * time.Second
+	}
+	reputation, err := net.NewReputation(ns.db, banDuration)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
+	}
+	ns.streamPool.SetReputation(reputation)
 	ns.bc = core.NewBlockChain(ns.db, common.HexToAddress(config.Coinbase), uint64(config.MiningReward))
+	ns.streamPool.SetEvents(ns.bc.Events())
 
 	ns.wallet = account.NewWallet(config.KeystoreFile)
 	ns.wallet.Load()
@@ -57,14 +75,33 @@ func NewNodeServer(config *cmd.Config) *NodeServer {
 		}).Panic("NodePrivateKey")
 	}
 	ns.node = net.NewNode(config.Port, privKey, ns.streamPool)
+	peerDB, err := net.NewPeerDB(ns.db)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
+	}
+	ns.node.SetPeerDB(peerDB)
+	for _, addr := range config.StaticPeers {
+		if err := ns.node.AddStaticPeer(addr); err != nil {
+			log.CLog().WithFields(logrus.Fields{
+				"Address": addr,
+				"Msg":     err,
+			}).Warning("static peer")
+		}
+	}
+	for _, addr := range config.TrustedPeers {
+		if err := ns.node.AddTrustedPeer(addr); err != nil {
+			log.CLog().WithFields(logrus.Fields{
+				"Address": addr,
+				"Msg":     err,
+			}).Warning("trusted peer")
+		}
+	}
 
-	if config.Consensus.Name == "dpos" {
-		ns.consensus = dpos.NewDpos(ns.streamPool, config.Consensus.Period, config.Consensus.Round, config.Consensus.TotalMiners)
-	} else if config.Consensus.Name == "poa" {
-		ns.consensus = poa.NewPoa(ns.streamPool, config.Consensus.Period)
-	} else {
-		ns.consensus = pow.NewPow(ns.streamPool, config.Consensus.Difficulty)
+	forkSchedule, err := cmd.MakeForkScheduleFromConfig(config)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
 	}
+	ns.bc.SetForkSchedule(forkSchedule)
 
 	if config.EnableMining {
 		log.CLog().WithFields(logrus.Fields{
@@ -75,30 +112,142 @@ func NewNodeServer(config *cmd.Config) *NodeServer {
 		if err != nil {
 			log.CLog().Fatal(err)
 		}
-		if config.Consensus.Name == "dpos" {
-			//? Setup is not suitable to exist in consensus package because setup have wallet(not core package)
-			ns.consensus.(*dpos.Dpos).SetupMining(common.HexToAddress(config.MinerAddress), ns.wallet)
-		} else if config.Consensus.Name == "poa" {
-			ns.consensus.(*poa.Poa).SetupMining(common.HexToAddress(config.MinerAddress), ns.wallet)
-		} else {
-			ns.consensus.(*pow.Pow).SetupMining(common.HexToAddress(config.MinerAddress), ns.wallet)
+		miner := common.HexToAddress(config.MinerAddress)
+		err = ns.node.SetValidator(miner, func(hash []byte) ([]byte, error) {
+			return ns.wallet.SignHash(miner, hash)
+		})
+		if err != nil {
+			log.CLog().Fatal(err)
+		}
+	}
+	engines := make(map[string]core.Consensus)
+	for _, name := range forkSchedule.ConsensusNames() {
+		engines[name] = ns.newConsensus(name)
+	}
+	if len(engines) == 1 {
+		ns.consensus = engines[config.Consensus.Name]
+	} else {
+		ns.consensus, err = core.NewForkConsensus(engines, forkSchedule)
+		if err != nil {
+			log.CLog().WithFields(logrus.Fields{}).Panic(err)
 		}
 	}
 	ns.bc.Setup(ns.consensus, cmd.MakeVoterAccountsFromConfig(config))
 
+	ns.light = service.NewLightService(ns.bc, ns.streamPool)
+	ns.streamPool.AddHandler(ns.light)
+	ns.rpcServer = rpc.NewRpcServer(config.RpcAddress)
+	rpcService := &rpc.RpcService{}
+	if config.SyncMode == "light" {
+		//the status keeps genesis as the tail, so full peers do not sync from a light node
+		if err := ns.light.Enable(); err != nil {
+			log.CLog().WithFields(logrus.Fields{}).Panic(err)
+		}
+		rpcService.SetupLight(ns.rpcServer, ns.light, ns.wallet)
+		rpcService.SetupAdmin(ns.streamPool, ns.node)
+		if config.EnableEthRpc {
+			log.CLog().WithFields(logrus.Fields{}).Warning("eth rpc is not served by a light node")
+		}
+		if config.EnableWs {
+			ns.rpcServer.EnableWebsocket(config.WsOrigins)
+		}
+		ns.node.Setup(common.HashToHex(ns.bc.GenesisBlock.Hash()))
+		ns.node.SetStatusFunc(ns.status)
+		return &ns
+	}
+
 	ns.bcService = service.NewBlockChainService(ns.bc, ns.streamPool)
 	ns.streamPool.AddHandler(ns.bcService)
 
-	ns.rpcServer = rpc.NewRpcServer(config.RpcAddress)
-	rpcService := &rpc.RpcService{}
+	ns.cpService = service.NewCheckpointService(ns.bc, ns.streamPool)
+	if config.EnableMining {
+		ns.cpService.SetupSigner(common.HexToAddress(config.MinerAddress), ns.wallet)
+	}
+	ns.streamPool.AddHandler(ns.cpService)
+
+	ns.syncService = service.NewSyncService(ns.bc, ns.streamPool)
+	ns.streamPool.AddHandler(ns.syncService)
+
+	ns.txService = service.NewTxService(ns.bc, ns.streamPool)
+	ns.streamPool.AddHandler(ns.txService)
+
+	ns.snapshot = service.NewSnapshotService(ns.bc, ns.streamPool)
+	if config.TrustedCheckpoint != "" {
+		ns.snapshot.SyncFrom(common.HexToHash(config.TrustedCheckpoint))
+	} else if config.SyncMode == "snapshot" {
+		ns.snapshot.Enable()
+	}
+
 	rpcService.Setup(ns.rpcServer, config, ns.bc, ns.wallet)
+	rpcService.SetupSync(ns.syncService)
+	rpcService.SetupAdmin(ns.streamPool, ns.node)
+	if config.EnableEthRpc {
+		rpcService.SetupEth(config, ns.bc)
+	}
+	if config.EnableWs {
+		ns.rpcServer.EnableWebsocket(config.WsOrigins)
+		ns.rpcServer.EnableSubscription(ns.bc)
+	}
 	ns.node.Setup(common.HashToHex(ns.bc.GenesisBlock.Hash()))
+	ns.node.SetStatusFunc(ns.status)
 	return &ns
 }
 
+// status is sent to peers at handshake
+func (ns *NodeServer) status() *net.Status {
+	tail := ns.bc.Tail()
+	lib := ns.bc.Lib()
+	return &net.Status{
+		Version:     net.ProtocolVersion,
+		ChainID:     ns.config.ChainID,
+		GenesisHash: ns.bc.GenesisBlock.Hash(),
+		TailHeight:  tail.Header.Height,
+		TailHash:    tail.Hash(),
+		LibHeight:   lib.Header.Height,
+		LibHash:     lib.Hash(),
+	}
+}
+
+func (ns *NodeServer) newConsensus(name string) core.Consensus {
+	config := ns.config
+	minerAddress := common.HexToAddress(config.MinerAddress)
+	if core.SameConsensus(name, "dpos") {
+		cs := dpos.NewDpos(ns.streamPool, config.Consensus.Period, config.Consensus.Round, config.Consensus.TotalMiners)
+		if config.EnableMining {
+			//? Setup is not suitable to exist in consensus package because setup have wallet(not core package)
+			cs.SetupMining(minerAddress, ns.wallet)
+		}
+		return cs
+	} else if core.SameConsensus(name, "poa") {
+		cs := poa.NewPoa(ns.streamPool, config.Consensus.Period)
+		if config.EnableMining {
+			cs.SetupMining(minerAddress, ns.wallet)
+		}
+		return cs
+	}
+	difficulty := config.Consensus.Difficulty
+	if difficulty == nil {
+		difficulty = pow.GenesisDifficulty
+	}
+	cs := pow.NewPow(ns.streamPool, difficulty)
+	if config.EnableMining {
+		cs.SetupMining(minerAddress, ns.wallet)
+	}
+	return cs
+}
+
 func (ns *NodeServer) Start() {
-	ns.node.Start(ns.config.Seeds[0])
+	ns.node.Start(ns.config.Seeds)
+	ns.light.Start()
+	if ns.config.SyncMode == "light" {
+		ns.rpcServer.Start()
+		return
+	}
 	ns.consensus.Start()
 	ns.bcService.Start()
+	ns.cpService.Start()
+	ns.syncService.Start()
+	ns.txService.Start()
+	ns.snapshot.Start()
 	ns.rpcServer.Start()
 }
@@ -28,6 +28,24 @@ type Header struct {
 	Signature  common.Signature
 	Nonce      uint64
 	Difficulty *big.Int
+	//dpos randomness beacon, the secret of the last commit and the hash of a new secret
+	//it is a tail, so headers stored before the beacon are decoded
+	Random []common.Hash `rlp:"tail"`
+}
+
+func (h *Header) HasRandom() bool {
+	return len(h.Random) > 0
+}
+
+func (h *Header) RandomBeacon() (reveal, commit common.Hash) {
+	if len(h.Random) != 2 {
+		return reveal, commit
+	}
+	return h.Random[0], h.Random[1]
+}
+
+func (h *Header) SetRandomBeacon(reveal, commit common.Hash) {
+	h.Random = []common.Hash{reveal, commit}
 }
 
 // Simple Block
@@ -66,9 +84,13 @@ func (b *Block) MakeHash() {
 	b.Header.Hash = b.CalcHash()
 }
 
+/*
+CalcHash hashes the random beacon only if the header has it,
+they are allowed only when Rules.RandomBeacon is active, so other blocks keep the hash they had before.
+*/
 func (b *Block) CalcHash() (hash common.Hash) {
 	hasher := sha3.New256()
-	rlp.Encode(hasher, []interface{}{
+	fields := []interface{}{
 		b.Header.ParentHash,
 		b.Header.Coinbase,
 		b.Header.Height,
@@ -77,7 +99,11 @@ func (b *Block) CalcHash() (hash common.Hash) {
 		b.Header.TransactionHash,
 		b.Header.ConsensusHash,
 		b.Header.Difficulty,
-	})
+	}
+	if b.Header.HasRandom() {
+		fields = append(fields, b.Header.Random)
+	}
+	rlp.Encode(hasher, fields)
 	hasher.Sum(hash[:0])
 	return hash
 }
@@ -48,3 +48,11 @@ func TestSignAndVerify(t *testing.T) {
 	assert.Error(t, err, "")
 
 }
+
+// a header without the random beacon keeps the hash it had before the beacon
+func TestHashWithoutRandomBeacon(t *testing.T) {
+	h := core.Header{ParentHash: common.Hash{0x01, 0x02, 0x03}, Time: 1540854071}
+	block := core.Block{BaseBlock: core.BaseBlock{Header: &h}}
+	encodedBytes, _ := rlp.EncodeToBytes([]interface{}{h.ParentHash, h.Coinbase, h.Height, h.Time, h.AccountHash, h.TransactionHash, h.ConsensusHash, h.Difficulty})
+	assert.Equal(t, common.BytesToHash(crypto.Sha3b256(encodedBytes)), block.CalcHash())
+}
@@ -11,6 +11,7 @@ import (
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/event"
 	"github.com/nacamp/go-simplechain/log"
 	"github.com/nacamp/go-simplechain/net"
 	"github.com/nacamp/go-simplechain/rlp"
@@ -24,6 +25,8 @@ const (
 	maxFutureBlocks = 256
 )
 
+var ErrInvalidBody = errors.New("block body does not match the header")
+
 type BlockChain struct {
 	mu                  sync.RWMutex
 	GenesisBlock        *Block
@@ -36,10 +39,15 @@ type BlockChain struct {
 	MessageToRandomNode chan *net.Message
 	BroadcastMessage    chan *net.Message
 	NewTXMessage        chan *Transaction
-	LibCh               chan struct{}
 	tailGroup           *sync.Map
 	coinbase            common.Address
 	miningReward        uint64
+	forkSchedule        *ForkSchedule
+	checkpoint          *Checkpoint
+	finalizedCheckpoint *SignedCheckpoint
+	checkpointVotes     map[Checkpoint]map[common.Address]common.Signature
+	checkpointSyncing   bool
+	events              *event.Feed
 	//poa
 	Signers []common.Address
 }
@@ -53,13 +61,32 @@ func NewBlockChain(storage storage.Storage, coinbase common.Address, miningRewar
 		MessageToRandomNode: make(chan *net.Message, 1),
 		BroadcastMessage:    make(chan *net.Message, 1),
 		NewTXMessage:        make(chan *Transaction, 1),
-		LibCh:               make(chan struct{}, 1),
+		events:              new(event.Feed),
 		coinbase:            coinbase,
 		miningReward:        miningReward,
+		checkpointVotes:     make(map[Checkpoint]map[common.Address]common.Signature),
 	}
 	return &bc
 }
 
+// SetForkSchedule must be called before Setup
+func (bc *BlockChain) SetForkSchedule(forkSchedule *ForkSchedule) {
+	bc.forkSchedule = forkSchedule
+}
+
+func (bc *BlockChain) ForkSchedule() *ForkSchedule {
+	if bc.forkSchedule == nil {
+		reward := bc.miningReward
+		bc.forkSchedule, _ = NewForkSchedule(Fork{MiningReward: &reward}, nil)
+	}
+	return bc.forkSchedule
+}
+
+// Rules returns the parameters in force at height
+func (bc *BlockChain) Rules(height uint64) *Rules {
+	return bc.ForkSchedule().Rules(height)
+}
+
 func (bc *BlockChain) Setup(consensus Consensus, voters []*Account) {
 	consensus.AddBlockChain(bc)
 	bc.Consensus = consensus
@@ -70,7 +97,27 @@ func (bc *BlockChain) Setup(consensus Consensus, voters []*Account) {
 		bc.MakeGenesisBlock(voters)
 		bc.PutBlockByCoinbase(bc.GenesisBlock)
 	}
-	bc.TxPool = NewTransactionPool()
+	if err := bc.checkForkSchedule(); err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
+	}
+	if err := bc.loadFinalizedCheckpoint(); err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Panic(err)
+	}
+	bc.TxPool = newTransactionPool(bc.events)
+}
+
+//a fork already activated at the tail cannot be changed
+func (bc *BlockChain) checkForkSchedule() error {
+	stored, err := LoadForkSchedule(bc.Storage)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return err
+	}
+	if stored != nil {
+		if err := bc.ForkSchedule().CheckCompatible(stored, bc.Tail().Header.Height); err != nil {
+			return err
+		}
+	}
+	return bc.ForkSchedule().Save(bc.Storage)
 }
 
 func (bc *BlockChain) LoadBlockChainFromStorage() bool {
@@ -117,7 +164,7 @@ func (bc *BlockChain) MakeGenesisBlock(voters []*Account) {
 	}
 	account := NewAccount()
 	copy(account.Address[:], bc.coinbase[:])
-	account.AddBalance(new(big.Int).SetUint64(bc.miningReward))
+	account.AddBalance(new(big.Int).SetUint64(bc.Rules(0).MiningReward))
 	accs.PutAccount(account)
 	block.AccountState = accs
 	header.AccountHash = accs.RootHash()
@@ -190,7 +237,7 @@ func (bc *BlockChain) PutState(block *Block) error {
 
 	// parent maybe not have ConsensusState
 	// block.ConsensusState, err = parentBlock.ConsensusState.Clone()
-	consensusState, err := bc.Consensus.LoadState(parentBlock)
+	consensusState, err := bc.newConsensusState(parentBlock, block.Header.Height, false)
 	if err != nil {
 		return err
 	}
@@ -229,35 +276,152 @@ func (bc *BlockChain) RewardForCoinbase(block *Block) {
 		account = NewAccount()
 		account.Address = block.Header.Coinbase
 	}
-	account.AddBalance(new(big.Int).SetUint64(bc.miningReward))
+	account.AddBalance(new(big.Int).SetUint64(bc.Rules(block.Header.Height).MiningReward))
 	accs.PutAccount(account)
 }
 
+/*
+newConsensusState returns the state that a child of parent starts with.
+At the height where the fork schedule switches consensus, the new consensus initializes it.
+*/
+func (bc *BlockChain) newConsensusState(parent *Block, height uint64, clone bool) (ConsensusState, error) {
+	if bc.ForkSchedule().IsConsensusSwitch(height) {
+		initializer, ok := bc.Consensus.(ConsensusInitializer)
+		if !ok {
+			return nil, errors.New("Consensus cannot take over the chain")
+		}
+		log.CLog().WithFields(logrus.Fields{
+			"Height":    height,
+			"Consensus": bc.Rules(height).Consensus,
+		}).Info("Switch consensus")
+		return initializer.InitState(parent, BasicAccountsToAccounts(bc.Rules(height).Voters))
+	}
+	if clone {
+		return parent.ConsensusState().Clone()
+	}
+	return bc.Consensus.LoadState(parent)
+}
+
 func (bc *BlockChain) ExecuteTransaction(block *Block) error {
+	_, err := bc.executeTransaction(block)
+	return err
+}
+
+/*
+executeTransaction also returns the first error of the consensus transactions.
+It does not fail the block, the sender uses its nonce and the consensus state is kept as the transaction left it.
+*/
+func (bc *BlockChain) executeTransaction(block *Block) (txErr error, err error) {
 	accs := block.AccountState
 	txs := block.TransactionState
+	rules := bc.Rules(block.Header.Height)
+	if err := rules.VerifyTransactionCount(len(block.Transactions)); err != nil {
+		return nil, err
+	}
 	// firstVote := true
 	for i, tx := range block.Transactions {
+		if err := rules.VerifyTransaction(tx); err != nil {
+			return nil, err
+		}
 		fromAccount := accs.GetAccount(tx.From)
 		if fromAccount.Nonce+1 != tx.Nonce {
-			return ErrTransactionNonce
+			return nil, ErrTransactionNonce
 		}
 		fromAccount.Nonce += uint64(1)
 		if tx.Payload.Code == uint64(0) {
 			//if tx.Payload == nil {
 			toAccount := accs.GetAccount(tx.To)
 			if err := fromAccount.SubBalance(tx.Amount); err != nil {
-				return err
+				return nil, err
 			}
 			toAccount.AddBalance(tx.Amount)
 			accs.PutAccount(toAccount)
 		} else {
-			block.ConsensusState().ExecuteTransaction(block, i, fromAccount)
+			if err := block.ConsensusState().ExecuteTransaction(block, i, fromAccount); err != nil && txErr == nil {
+				txErr = err
+			}
 		}
 		accs.PutAccount(fromAccount)
 		txs.PutTransaction(tx)
 	}
-	return nil
+	return txErr, nil
+}
+
+// AccountChange is an account before and after a simulated transaction
+type AccountChange struct {
+	Before *Account
+	After  *Account
+}
+
+/*
+SimulateTransaction executes tx on a block made from the tail like NewBlockFromTail, the block is not committed.
+It returns the changed accounts or the error which makes tx fail. The transactions in the pool are not executed before tx,
+and the signature is not checked, so a transaction can be simulated before signing.
+*/
+func (bc *BlockChain) SimulateTransaction(tx *Transaction) ([]*AccountChange, error) {
+	block, err := bc.NewBlockFromTail()
+	if err != nil {
+		return nil, err
+	}
+	//the cloned tries share the storage of the chain, the simulation writes to an overlay instead
+	overlay := storage.NewOverlayStorage(bc.Storage)
+	accTrie, err := block.AccountState.Trie.CopyTo(overlay, false)
+	if err != nil {
+		return nil, err
+	}
+	block.AccountState = &AccountState{Trie: accTrie}
+	txTrie, err := block.TransactionState.Trie.CopyTo(overlay, false)
+	if err != nil {
+		return nil, err
+	}
+	block.TransactionState = &TransactionState{Trie: txTrie}
+	if copier, ok := block.ConsensusState().(ConsensusStateCopier); ok {
+		state, err := copier.CopyTo(overlay)
+		if err != nil {
+			return nil, err
+		}
+		block.SetConsensusState(state)
+	}
+	block.Transactions = []*Transaction{tx}
+	addresses := []common.Address{tx.From}
+	if tx.To != tx.From {
+		addresses = append(addresses, tx.To)
+	}
+	before := make([]*Account, len(addresses))
+	for i, address := range addresses {
+		before[i] = block.AccountState.GetAccount(address)
+	}
+	txErr, err := bc.executeTransaction(block)
+	if err != nil {
+		return nil, err
+	}
+	if txErr != nil {
+		return nil, txErr
+	}
+	changes := make([]*AccountChange, 0, len(addresses))
+	for i, address := range addresses {
+		after := block.AccountState.GetAccount(address)
+		if !sameAccount(before[i], after) {
+			changes = append(changes, &AccountChange{Before: before[i], After: after})
+		}
+	}
+	return changes, nil
+}
+
+func sameAccount(a, b *Account) bool {
+	if a.Nonce != b.Nonce || a.Balance.Cmp(b.Balance) != 0 || len(a.Staking) != len(b.Staking) {
+		return false
+	}
+	if (a.TotalPeggedStake == nil) != (b.TotalPeggedStake == nil) ||
+		(a.TotalPeggedStake != nil && a.TotalPeggedStake.Cmp(b.TotalPeggedStake) != 0) {
+		return false
+	}
+	for address, amount := range a.Staking {
+		if other, ok := b.Staking[address]; !ok || amount.Cmp(other) != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func (bc *BlockChain) PutBlock(block *Block) error {
@@ -268,11 +432,20 @@ func (bc *BlockChain) PutBlock(block *Block) error {
 	// 	// return nil
 	// }
 
-	var err error
+	//0. refuse a branch conflicting with the checkpoint
+	err := bc.verifyCheckpoint(block)
+	if err != nil {
+		return err
+	}
+
 	//1. verify block.hash
 	if block.Hash() != block.CalcHash() {
 		return errors.New("block.Hash() != block.CalcHash()")
 	}
+	err = bc.Rules(block.Header.Height).VerifyHeader(block.Header)
+	if err != nil {
+		return err
+	}
 
 	//2. check signer
 	err = block.VerifySign()
@@ -306,6 +479,9 @@ func (bc *BlockChain) PutBlock(block *Block) error {
 
 	//set tail
 	bc.SetTail(block)
+	if bc.Tail().Hash() != block.Hash() {
+		bc.events.Send(ChainSideEvent{Block: block})
+	}
 
 	bc.tailGroup.Store(block.Hash(), block)
 	//if parent exist
@@ -358,8 +534,34 @@ func (bc *BlockChain) putBlockIfParentExistInFutureBlocks(block *Block) error {
 	return nil
 }
 
+/*
+VerifyBody checks the transactions of block against the transaction hash of the header before importing it.
+The header is verified by its signer, so only ErrInvalidBody is the fault of the peer which sent the body.
+*/
+func (bc *BlockChain) VerifyBody(block *Block) error {
+	parentBlock := bc.GetBlockByHash(block.Header.ParentHash)
+	if parentBlock == nil {
+		return errors.New("ParentBlock is nil")
+	}
+	if err := block.VerifyTransacion(); err != nil {
+		return errors.Wrap(ErrInvalidBody, err.Error())
+	}
+	txs, err := NewTransactionStateRootHash(parentBlock.Header.TransactionHash, storage.NewOverlayStorage(bc.Storage))
+	if err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		txs.PutTransaction(tx)
+	}
+	if txs.RootHash() != block.Header.TransactionHash {
+		return errors.Wrap(ErrInvalidBody, "transaction hash is not matched")
+	}
+	return nil
+}
+
 func (bc *BlockChain) PutBlockIfParentExist(block *Block) error {
-	if bc.HasParentInBlockChain(block) {
+	//keep blocks until the state of the checkpoint is synced
+	if !bc.IsCheckpointSyncing() && bc.HasParentInBlockChain(block) {
 		if err := bc.PutBlock(block); err != nil {
 			return err
 		}
@@ -378,7 +580,7 @@ func (bc *BlockChain) AddFutureBlock(block *Block) error {
 	}
 	if block.Header.Height > bc.Lib().Header.Height {
 		bc.futureBlocks.Add(block.Header.ParentHash, block)
-		if block.Header.Height > uint64(1) { //if parent hash is not genesis block
+		if block.Header.Height > uint64(1) && !bc.IsCheckpointSyncing() { //if parent hash is not genesis block
 			msg, err := net.NewRLPMessage(net.MsgMissingBlock, block.Header.ParentHash)
 			if err != nil {
 				return err
@@ -418,6 +620,9 @@ func encodeBlockHeight(number uint64) []byte {
 }
 
 func (bc *BlockChain) NewBlockFromTail() (block *Block, err error) {
+	if bc.IsCheckpointSyncing() {
+		return nil, ErrCheckpointSyncing
+	}
 	parentBlock := bc.Tail()
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
@@ -431,7 +636,7 @@ func (bc *BlockChain) NewBlockFromTail() (block *Block, err error) {
 
 	//state
 	//Tail block always have state, but We can not guarantee that another block will have a state.
-	consensusState, err := parentBlock.ConsensusState().Clone()
+	consensusState, err := bc.newConsensusState(parentBlock, h.Height, true)
 	if err != nil {
 		return nil, err
 	}
@@ -448,40 +653,6 @@ func (bc *BlockChain) NewBlockFromTail() (block *Block, err error) {
 	return block, nil
 }
 
-func (bc *BlockChain) RequestMissingBlocks() error {
-	maxHeight := uint64(18446744073709551615)
-	olderHeight := maxHeight
-	for _, k := range bc.futureBlocks.Keys() {
-		v, _ := bc.futureBlocks.Peek(k)
-		block := v.(*Block)
-		if bc.Tail().Header.Height < block.Header.Height && olderHeight > block.Header.Height {
-			olderHeight = block.Header.Height
-		}
-	}
-	if olderHeight == maxHeight {
-		return nil
-	}
-	var blockRange [2]uint64
-	blockRange[0] = bc.Tail().Header.Height + 1
-	blockRange[1] = olderHeight
-	//request max 100 blocks
-	if olderHeight-bc.Tail().Header.Height > 100 {
-		blockRange[1] = bc.Tail().Header.Height + 100
-	}
-
-	msg, err := net.NewRLPMessage(net.MsgMissingBlocks, blockRange)
-	if err != nil {
-		return err
-	}
-	bc.MessageToRandomNode <- &msg
-	log.CLog().WithFields(logrus.Fields{
-		"Height Start": blockRange[0],
-		"Height End":   blockRange[1],
-	}).Info("Request missing blocks")
-
-	return nil
-}
-
 func (bc *BlockChain) RemoveOrphanBlock() {
 	TailTxs := bc.Tail().TransactionState
 	bc.tailGroup.Range(func(key, value interface{}) bool {
@@ -523,7 +694,7 @@ func (bc *BlockChain) RebuildBlockHeight() error {
 		return nil
 	}
 	for {
-		if bc.Lib().Header.Height+1 == block.Header.Height { //block.Hash() == bc.Lib.Hash()
+		if bc.Lib().Header.Height+1 == block.Header.Height || block.Hash() == bc.Lib().Hash() {
 			break
 		}
 		block = bc.GetBlockByHash(block.Header.ParentHash)
@@ -556,7 +727,12 @@ func (bc *BlockChain) SetLib(block *Block) {
 	bc.lib = block
 	bc.Storage.Put([]byte(libKey), block.Header.Hash[:])
 	bc.mu.Unlock()
-	bc.LibCh <- struct{}{}
+	bc.events.Send(LibEvent{Block: block})
+}
+
+// Events is shared by the chain, the transaction pool and the peers, see events.go
+func (bc *BlockChain) Events() *event.Feed {
+	return bc.events
 }
 
 func (bc *BlockChain) LoadLibFromStorage() {
@@ -601,6 +777,7 @@ func (bc *BlockChain) SetTail(block *Block) {
 	}
 	if block.Header.Height >= bc.tail.Header.Height {
 		bc.mu.Lock()
+		old := bc.tail
 		bc.tail = block
 		bc.Storage.Put([]byte(tailKey), block.Header.Hash[:])
 		log.CLog().WithFields(logrus.Fields{
@@ -608,6 +785,10 @@ func (bc *BlockChain) SetTail(block *Block) {
 		}).Debug("Tail")
 		bc.mu.Unlock()
 		bc.RebuildBlockHeight()
+		if old.Hash() != block.Hash() && old.Hash() != block.Header.ParentHash {
+			bc.events.Send(ReorgEvent{OldTail: old, NewTail: block})
+		}
+		bc.events.Send(ChainHeadEvent{Block: block})
 	}
 }
 
@@ -0,0 +1,322 @@
+package core
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checkpointKey = "checkpoint"
+)
+
+var (
+	ErrCheckpointConflict     = errors.New("block conflicts with the checkpoint")
+	ErrCheckpointSyncing      = errors.New("state is being synced from the checkpoint")
+	ErrCheckpointUnknownBlock = errors.New("checkpoint block is unknown")
+	ErrCheckpointSigner       = errors.New("checkpoint signer is not a validator")
+	ErrCheckpointVoteKnown    = errors.New("checkpoint vote is already known")
+	ErrCheckpointSignatures   = errors.New("checkpoint is not signed by over 2/3 of validators")
+)
+
+// Checkpoint is a block that must be in the chain
+type Checkpoint struct {
+	Height uint64
+	Hash   common.Hash
+}
+
+// SigHash is the hash that validators sign
+func (cp *Checkpoint) SigHash() []byte {
+	encodedBytes, _ := rlp.EncodeToBytes([]interface{}{checkpointKey, cp.Height, cp.Hash})
+	return crypto.Sha3b256(encodedBytes)
+}
+
+// CheckpointVote is a signature of a validator for the lib
+type CheckpointVote struct {
+	Checkpoint
+	Signature common.Signature
+}
+
+func (v *CheckpointVote) Signer() (common.Address, error) {
+	pub, err := crypto.Ecrecover(v.SigHash(), v.Signature[:])
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.CreateAddressFromPublicKeyByte(pub), nil
+}
+
+// SignedCheckpoint is a checkpoint signed by over 2/3 of validators
+type SignedCheckpoint struct {
+	Checkpoint
+	Signatures []common.Signature
+}
+
+// VerifySignedCheckpoint checks that over 2/3 of validators signed the checkpoint, a validator is counted once
+func VerifySignedCheckpoint(signed *SignedCheckpoint, validators []common.Address) error {
+	isValidator := make(map[common.Address]bool, len(validators))
+	for _, v := range validators {
+		isValidator[v] = true
+	}
+	signers := make(map[common.Address]bool, len(signed.Signatures))
+	for _, sig := range signed.Signatures {
+		vote := &CheckpointVote{Checkpoint: signed.Checkpoint, Signature: sig}
+		signer, err := vote.Signer()
+		if err != nil {
+			return err
+		}
+		if !isValidator[signer] {
+			return ErrCheckpointSigner
+		}
+		signers[signer] = true
+	}
+	if len(signers) < len(validators)*2/3+1 {
+		return ErrCheckpointSignatures
+	}
+	return nil
+}
+
+/*
+SetTrustedCheckpoint sets the checkpoint given in config.
+The height is unknown until the block is fetched, verifyCheckpoint sets it when a block with the hash is known.
+*/
+func (bc *BlockChain) SetTrustedCheckpoint(cp *Checkpoint) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.checkpoint = cp
+}
+
+func (bc *BlockChain) Checkpoint() *Checkpoint {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.checkpoint
+}
+
+func (bc *BlockChain) SetCheckpointSyncing(syncing bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.checkpointSyncing = syncing
+}
+
+func (bc *BlockChain) IsCheckpointSyncing() bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.checkpointSyncing
+}
+
+/*
+verifyCheckpoint refuses any branch that conflicts with the checkpoint.
+A block at or above the checkpoint height must descend from the checkpoint block,
+and a block below it must be an ancestor of the checkpoint block on the canonical chain,
+so a reorg cannot drop the checkpoint block either.
+While the height of a trusted checkpoint is unknown, the block with its hash gives the height.
+*/
+func (bc *BlockChain) verifyCheckpoint(block *Block) error {
+	if bc.IsCheckpointSyncing() {
+		return ErrCheckpointSyncing
+	}
+	cp := bc.Checkpoint()
+	if cp == nil {
+		return nil
+	}
+	if cp.Height == 0 {
+		if known := bc.GetBlockByHash(cp.Hash); known != nil {
+			cp = &Checkpoint{Height: known.Header.Height, Hash: cp.Hash}
+		} else if block.Hash() == cp.Hash {
+			cp = &Checkpoint{Height: block.Header.Height, Hash: cp.Hash}
+		} else {
+			return nil
+		}
+		bc.SetTrustedCheckpoint(cp)
+	}
+	if block.Header.Height < cp.Height {
+		canonical := bc.GetBlockByHeight(block.Header.Height)
+		checkpoint := bc.GetBlockByHeight(cp.Height)
+		if canonical == nil || canonical.Hash() != block.Hash() || checkpoint == nil || checkpoint.Hash() != cp.Hash {
+			return ErrCheckpointConflict
+		}
+		return nil
+	}
+	if !bc.descendsFromCheckpoint(block, cp) {
+		return ErrCheckpointConflict
+	}
+	return nil
+}
+
+// descendsFromCheckpoint reports whether block is the checkpoint block or its descendant
+func (bc *BlockChain) descendsFromCheckpoint(block *Block, cp *Checkpoint) bool {
+	canonical := bc.GetBlockByHeight(cp.Height)
+	onCanonical := canonical != nil && canonical.Hash() == cp.Hash
+	header := block.Header
+	for header.Height > cp.Height {
+		//the canonical chain has the checkpoint, so a block on it descends from the checkpoint
+		if onCanonical {
+			if b := bc.GetBlockByHeight(header.Height); b != nil && b.Hash() == header.Hash {
+				return true
+			}
+		}
+		parent := bc.GetBlockByHash(header.ParentHash)
+		if parent == nil {
+			return false
+		}
+		header = parent.Header
+	}
+	return header.Hash == cp.Hash
+}
+
+// Validators returns the miners or signers who sign the checkpoint of block
+func (bc *BlockChain) Validators(block *Block) ([]common.Address, error) {
+	validators, ok := bc.Consensus.(Validators)
+	if !ok {
+		return nil, errors.New("Consensus has no validators")
+	}
+	return validators.Validators(block)
+}
+
+/*
+AddCheckpointVote collects the vote of a validator.
+When over 2/3 of validators sign the same block, the signed checkpoint is saved and returned.
+ErrCheckpointVoteKnown is returned for a vote recorded before or at a finalized height, so only a new vote is relayed.
+*/
+func (bc *BlockChain) AddCheckpointVote(vote *CheckpointVote) (*SignedCheckpoint, error) {
+	block := bc.GetBlockByHash(vote.Hash)
+	if block == nil || block.Header.Height != vote.Height {
+		return nil, ErrCheckpointUnknownBlock
+	}
+	signer, err := vote.Signer()
+	if err != nil {
+		return nil, err
+	}
+	validators, err := bc.Validators(block)
+	if err != nil {
+		return nil, err
+	}
+	isValidator := false
+	for _, v := range validators {
+		if v == signer {
+			isValidator = true
+			break
+		}
+	}
+	if !isValidator {
+		return nil, ErrCheckpointSigner
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if finalized := bc.finalizedCheckpoint; finalized != nil && finalized.Height >= vote.Height {
+		return nil, ErrCheckpointVoteKnown
+	}
+	votes, ok := bc.checkpointVotes[vote.Checkpoint]
+	if !ok {
+		votes = make(map[common.Address]common.Signature)
+		bc.checkpointVotes[vote.Checkpoint] = votes
+	}
+	if _, ok := votes[signer]; ok {
+		return nil, ErrCheckpointVoteKnown
+	}
+	votes[signer] = vote.Signature
+	if len(votes) < len(validators)*2/3+1 {
+		return nil, nil
+	}
+
+	signed := &SignedCheckpoint{Checkpoint: vote.Checkpoint, Signatures: make([]common.Signature, 0, len(votes))}
+	for _, v := range validators {
+		if sig, ok := votes[v]; ok {
+			signed.Signatures = append(signed.Signatures, sig)
+		}
+	}
+	encodedBytes, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		return nil, err
+	}
+	if err := bc.Storage.Put([]byte(checkpointKey), encodedBytes); err != nil {
+		return nil, err
+	}
+	bc.finalizedCheckpoint = signed
+	if bc.checkpoint == nil || bc.checkpoint.Height < signed.Height {
+		bc.checkpoint = &signed.Checkpoint
+	}
+	for cp := range bc.checkpointVotes {
+		if cp.Height <= signed.Height {
+			delete(bc.checkpointVotes, cp)
+		}
+	}
+	log.CLog().WithFields(logrus.Fields{
+		"Height":     signed.Height,
+		"Signatures": len(signed.Signatures),
+	}).Info("Finalized checkpoint")
+	return signed, nil
+}
+
+func (bc *BlockChain) FinalizedCheckpoint() *SignedCheckpoint {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.finalizedCheckpoint
+}
+
+func (bc *BlockChain) loadFinalizedCheckpoint() error {
+	encodedBytes, err := bc.Storage.Get([]byte(checkpointKey))
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	signed := new(SignedCheckpoint)
+	if err := rlp.DecodeBytes(encodedBytes, signed); err != nil {
+		return err
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.finalizedCheckpoint = signed
+	if bc.checkpoint == nil || (bc.checkpoint.Height != 0 && bc.checkpoint.Height < signed.Height) {
+		bc.checkpoint = &signed.Checkpoint
+	}
+	return nil
+}
+
+/*
+ResetWithCheckpointBlock makes the checkpoint block lib and tail
+after its account, transaction and consensus tries are synced.
+Blocks before the checkpoint are not imported.
+*/
+func (bc *BlockChain) ResetWithCheckpointBlock(block *Block) error {
+	cp := bc.Checkpoint()
+	if cp == nil || cp.Hash != block.Hash() {
+		return ErrCheckpointConflict
+	}
+	var err error
+	block.AccountState, err = NewAccountStateRootHash(block.Header.AccountHash, bc.Storage)
+	if err != nil {
+		return err
+	}
+	block.TransactionState, err = NewTransactionStateRootHash(block.Header.TransactionHash, bc.Storage)
+	if err != nil {
+		return err
+	}
+	consensusState, err := bc.Consensus.LoadState(block)
+	if err != nil {
+		return err
+	}
+	block.SetConsensusState(consensusState)
+
+	if err := bc.putBlockToStorage(block); err != nil {
+		return err
+	}
+	bc.SetTrustedCheckpoint(&Checkpoint{Height: block.Header.Height, Hash: block.Hash()})
+	bc.tailGroup.Delete(bc.Tail().Hash())
+	bc.AddTailToGroup(block)
+	bc.SetLib(block)
+	bc.SetTail(block)
+	bc.SetCheckpointSyncing(false)
+	log.CLog().WithFields(logrus.Fields{
+		"Height": block.Header.Height,
+		"Hash":   common.HashToHex(block.Hash()),
+	}).Info("Synced state from checkpoint")
+	return bc.putBlockIfParentExistInFutureBlocks(block)
+}
@@ -0,0 +1,32 @@
+package core
+
+/*
+The events are sent to the feed of BlockChain.Events, net.PeerEvent too.
+Subscribers choose the types they receive and miss events if they are slow, see event.Feed.
+*/
+
+// ChainHeadEvent is sent when block becomes the tail
+type ChainHeadEvent struct {
+	Block *Block
+}
+
+// ChainSideEvent is sent when an imported block does not become the tail
+type ChainSideEvent struct {
+	Block *Block
+}
+
+// ReorgEvent is sent before ChainHeadEvent when the new tail is not a child of the old tail
+type ReorgEvent struct {
+	OldTail *Block
+	NewTail *Block
+}
+
+// LibEvent is sent when block becomes the last irreversible block
+type LibEvent struct {
+	Block *Block
+}
+
+// TxPoolAddEvent is sent when a transaction is new in the pool
+type TxPoolAddEvent struct {
+	Tx *Transaction
+}
@@ -0,0 +1,282 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/storage"
+)
+
+const (
+	forkScheduleKey = "forkschedule"
+	GenesisForkName = "genesis"
+)
+
+var (
+	ErrForkIncompatible    = errors.New("fork schedule is incompatible with the stored chain")
+	ErrPayloadCodeDisabled = errors.New("payload code is disabled at this height")
+	ErrTooManyTransactions = errors.New("block has more transactions than allowed at this height")
+	ErrRandomBeacon        = errors.New("random fields of the header do not match the random beacon at this height")
+)
+
+/*
+Fork is a named set of parameter changes activated at Height.
+A zero value (or nil pointer) means the parameter is inherited from the previous fork.
+Voters are only used when Consensus changes, to build the initial state of the new engine.
+RandomBeacon turns on the dpos randomness beacon, once activated it is kept by the next forks.
+*/
+type Fork struct {
+	Name                string         `json:"name"`
+	Height              uint64         `json:"height"`
+	Consensus           string         `json:"consensus,omitempty"`
+	Period              uint64         `json:"period,omitempty"`
+	Round               uint64         `json:"round,omitempty"`
+	TotalMiners         uint64         `json:"total_miners,omitempty"`
+	MiningReward        *uint64        `json:"mining_reward,omitempty"`
+	MaxTransactions     *uint64        `json:"max_transactions,omitempty"`
+	DisablePayloadCodes []uint64       `json:"disable_payload_codes,omitempty"`
+	EnablePayloadCodes  []uint64       `json:"enable_payload_codes,omitempty"`
+	Voters              []BasicAccount `json:"voters,omitempty"`
+	RandomBeacon        bool           `json:"random_beacon,omitempty"`
+}
+
+// Rules is the set of parameters in force at Height
+type Rules struct {
+	Height          uint64
+	Forks           []string
+	Consensus       string
+	Period          uint64
+	Round           uint64
+	TotalMiners     uint64
+	MiningReward    uint64
+	MaxTransactions uint64 //0 is unlimited
+	DisabledCodes   map[uint64]bool
+	Voters          []BasicAccount
+	RandomBeacon    bool
+}
+
+// IsActive reports whether the named fork is activated
+func (r *Rules) IsActive(name string) bool {
+	for _, v := range r.Forks {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsConsensus reports whether the engine type(DPOS, POA, POW) is scheduled
+func (r *Rules) IsConsensus(consensusType string) bool {
+	return r.Consensus == "" || SameConsensus(r.Consensus, consensusType)
+}
+
+// SameConsensus compares consensus names ignoring case, the config uses dpos and the engines DPOS
+func SameConsensus(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+func (r *Rules) VerifyTransaction(tx *Transaction) error {
+	if tx.Payload != nil && r.DisabledCodes[tx.Payload.Code] {
+		return ErrPayloadCodeDisabled
+	}
+	return nil
+}
+
+func (r *Rules) VerifyTransactionCount(count int) error {
+	if r.MaxTransactions > 0 && uint64(count) > r.MaxTransactions {
+		return ErrTooManyTransactions
+	}
+	return nil
+}
+
+// VerifyHeader allows the random fields only when the random beacon is active
+func (r *Rules) VerifyHeader(header *Header) error {
+	if header.HasRandom() && (!r.RandomBeacon || !r.IsConsensus("dpos") || len(header.Random) != 2) {
+		return ErrRandomBeacon
+	}
+	return nil
+}
+
+func (r *Rules) apply(fork *Fork) {
+	r.Forks = append(r.Forks, fork.Name)
+	if fork.Consensus != "" && !SameConsensus(fork.Consensus, r.Consensus) {
+		r.Consensus = fork.Consensus
+		r.Voters = fork.Voters
+	}
+	if fork.Period > 0 {
+		r.Period = fork.Period
+	}
+	if fork.Round > 0 {
+		r.Round = fork.Round
+	}
+	if fork.TotalMiners > 0 {
+		r.TotalMiners = fork.TotalMiners
+	}
+	if fork.MiningReward != nil {
+		r.MiningReward = *fork.MiningReward
+	}
+	if fork.RandomBeacon {
+		r.RandomBeacon = true
+	}
+	if fork.MaxTransactions != nil {
+		r.MaxTransactions = *fork.MaxTransactions
+	}
+	for _, code := range fork.DisablePayloadCodes {
+		r.DisabledCodes[code] = true
+	}
+	for _, code := range fork.EnablePayloadCodes {
+		delete(r.DisabledCodes, code)
+	}
+}
+
+// ForkSchedule is the genesis parameters and the forks sorted by height
+type ForkSchedule struct {
+	Genesis Fork
+	Forks   []Fork
+}
+
+func NewForkSchedule(genesis Fork, forks []Fork) (*ForkSchedule, error) {
+	if genesis.Name == "" {
+		genesis.Name = GenesisForkName
+	}
+	genesis.Height = 0
+	fs := &ForkSchedule{Genesis: genesis, Forks: make([]Fork, len(forks))}
+	copy(fs.Forks, forks)
+	sort.SliceStable(fs.Forks, func(i, j int) bool {
+		return fs.Forks[i].Height < fs.Forks[j].Height
+	})
+	names := map[string]bool{genesis.Name: true}
+	for _, fork := range fs.Forks {
+		if fork.Name == "" {
+			return nil, errors.New("Fork name must not be empty")
+		}
+		if names[fork.Name] {
+			return nil, errors.Errorf("Fork name is duplicated: %s", fork.Name)
+		}
+		names[fork.Name] = true
+		if fork.Height == 0 {
+			return nil, errors.Errorf("Fork height must be greater than 0: %s", fork.Name)
+		}
+	}
+	return fs, nil
+}
+
+// Rules returns the parameters in force at height
+func (fs *ForkSchedule) Rules(height uint64) *Rules {
+	r := &Rules{Height: height, DisabledCodes: make(map[uint64]bool)}
+	r.apply(&fs.Genesis)
+	for i := range fs.Forks {
+		if fs.Forks[i].Height > height {
+			break
+		}
+		r.apply(&fs.Forks[i])
+	}
+	return r
+}
+
+// IsConsensusSwitch reports whether the consensus engine changes at height
+func (fs *ForkSchedule) IsConsensusSwitch(height uint64) bool {
+	if height == 0 {
+		return false
+	}
+	return !SameConsensus(fs.Rules(height-1).Consensus, fs.Rules(height).Consensus)
+}
+
+// ConsensusNames returns every engine used in the schedule
+func (fs *ForkSchedule) ConsensusNames() []string {
+	names := []string{fs.Genesis.Consensus}
+	for _, fork := range fs.Forks {
+		if fork.Consensus == "" {
+			continue
+		}
+		exist := false
+		for _, name := range names {
+			if SameConsensus(name, fork.Consensus) {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			names = append(names, fork.Consensus)
+		}
+	}
+	return names
+}
+
+func (fs *ForkSchedule) fork(name string) *Fork {
+	if fs.Genesis.Name == name {
+		return &fs.Genesis
+	}
+	for i := range fs.Forks {
+		if fs.Forks[i].Name == name {
+			return &fs.Forks[i]
+		}
+	}
+	return nil
+}
+
+/*
+CheckCompatible returns ErrForkIncompatible if a fork already activated at head
+is added, removed or changed compared to the stored schedule.
+*/
+func (fs *ForkSchedule) CheckCompatible(stored *ForkSchedule, head uint64) error {
+	check := func(a, b *ForkSchedule) error {
+		for _, fork := range append([]Fork{a.Genesis}, a.Forks...) {
+			if fork.Height > head {
+				continue
+			}
+			other := b.fork(fork.Name)
+			if other == nil {
+				return errors.Wrapf(ErrForkIncompatible, "%s at %d", fork.Name, fork.Height)
+			}
+			encoded1, _ := json.Marshal(fork)
+			encoded2, _ := json.Marshal(other)
+			if !bytes.Equal(encoded1, encoded2) {
+				return errors.Wrapf(ErrForkIncompatible, "%s at %d", fork.Name, fork.Height)
+			}
+		}
+		return nil
+	}
+	if err := check(fs, stored); err != nil {
+		return err
+	}
+	return check(stored, fs)
+}
+
+func LoadForkSchedule(storage storage.Storage) (*ForkSchedule, error) {
+	encodedBytes, err := storage.Get([]byte(forkScheduleKey))
+	if err != nil {
+		return nil, err
+	}
+	fs := new(ForkSchedule)
+	if err := json.Unmarshal(encodedBytes, fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *ForkSchedule) Save(storage storage.Storage) error {
+	encodedBytes, err := json.Marshal(fs)
+	if err != nil {
+		return err
+	}
+	return storage.Put([]byte(forkScheduleKey), encodedBytes)
+}
+
+func BasicAccountsToAccounts(basicAccounts []BasicAccount) []*Account {
+	accounts := make([]*Account, 0, len(basicAccounts))
+	for _, v := range basicAccounts {
+		account := NewAccount()
+		account.Address = v.Address
+		if v.Balance != nil {
+			account.Balance = new(big.Int).Set(v.Balance)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ForkConsensus dispatches to the consensus scheduled at each height.
+It is used when the fork schedule migrates the chain from one consensus to another.
+*/
+type ForkConsensus struct {
+	bc      *BlockChain
+	engines map[string]Consensus
+}
+
+// ErrUnknownConsensus is returned if the fork schedule uses a consensus which has no engine
+var ErrUnknownConsensus = errors.New("consensus of the fork schedule has no engine")
+
+// engines is keyed by the consensus name of the config(dpos, poa, pow), every consensus of schedule must have one
+func NewForkConsensus(engines map[string]Consensus, schedule *ForkSchedule) (*ForkConsensus, error) {
+	fc := &ForkConsensus{engines: engines}
+	for _, name := range schedule.ConsensusNames() {
+		if fc.engine(name) == nil {
+			return nil, errors.Wrap(ErrUnknownConsensus, name)
+		}
+	}
+	return fc, nil
+}
+
+func (fc *ForkConsensus) engine(name string) Consensus {
+	for k, v := range fc.engines {
+		if SameConsensus(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Engine returns the engine at height, NewForkConsensus checked that the schedule has no consensus without engine
+func (fc *ForkConsensus) Engine(height uint64) Consensus {
+	name := fc.bc.Rules(height).Consensus
+	engine := fc.engine(name)
+	if engine == nil {
+		log.CLog().WithFields(logrus.Fields{
+			"Height":    height,
+			"Consensus": name,
+		}).Panic("Not found consensus")
+	}
+	return engine
+}
+
+func (fc *ForkConsensus) UpdateLIB() {
+	fc.Engine(fc.bc.Tail().Header.Height).UpdateLIB()
+}
+
+func (fc *ForkConsensus) ConsensusType() string {
+	if fc.bc.Tail() == nil {
+		return fc.Engine(0).ConsensusType()
+	}
+	return fc.Engine(fc.bc.Tail().Header.Height).ConsensusType()
+}
+
+func (fc *ForkConsensus) MakeGenesisBlock(block *Block, voters []*Account) error {
+	return fc.Engine(0).MakeGenesisBlock(block, voters)
+}
+
+func (fc *ForkConsensus) AddBlockChain(bc *BlockChain) {
+	fc.bc = bc
+	for _, v := range fc.engines {
+		v.AddBlockChain(bc)
+	}
+}
+
+func (fc *ForkConsensus) Start() {
+	for _, v := range fc.engines {
+		v.Start()
+	}
+}
+
+func (fc *ForkConsensus) Verify(block *Block) error {
+	return fc.Engine(block.Header.Height).Verify(block)
+}
+
+func (fc *ForkConsensus) VerifyHeader(block *Block, parent *Header) error {
+	engine := fc.Engine(block.Header.Height)
+	if verifier, ok := engine.(HeaderVerifier); ok {
+		return verifier.VerifyHeader(block, parent)
+	}
+	return engine.Verify(block)
+}
+
+func (fc *ForkConsensus) SaveState(block *Block) error {
+	return fc.Engine(block.Header.Height).SaveState(block)
+}
+
+func (fc *ForkConsensus) LoadState(block *Block) (ConsensusState, error) {
+	return fc.Engine(block.Header.Height).LoadState(block)
+}
+
+func (fc *ForkConsensus) InitState(parent *Block, voters []*Account) (ConsensusState, error) {
+	initializer, ok := fc.Engine(parent.Header.Height + 1).(ConsensusInitializer)
+	if !ok {
+		return nil, errors.New("Consensus cannot take over the chain")
+	}
+	return initializer.InitState(parent, voters)
+}
+
+func (fc *ForkConsensus) Validators(block *Block) ([]common.Address, error) {
+	validators, ok := fc.Engine(block.Header.Height).(Validators)
+	if !ok {
+		return nil, errors.New("Consensus has no validators")
+	}
+	return validators.Validators(block)
+}
+
+func (fc *ForkConsensus) StateTrieRoots(block *Block) ([]common.Hash, error) {
+	roots, ok := fc.Engine(block.Header.Height).(StateTrieRoots)
+	if !ok {
+		return nil, nil
+	}
+	return roots.StateTrieRoots(block)
+}
@@ -0,0 +1,135 @@
+package core_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/nacamp/go-simplechain/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeForkSchedule(t *testing.T) *core.ForkSchedule {
+	reward := uint64(10)
+	reward2 := uint64(5)
+	maxTxs := uint64(2)
+	genesis := core.Fork{Consensus: "dpos", Period: 3, Round: 3, TotalMiners: 3, MiningReward: &reward}
+	forks := []core.Fork{
+		{Name: "poa", Height: 20, Consensus: "poa", Voters: []core.BasicAccount{{Address: tests.Address0, Balance: new(big.Int)}}},
+		{Name: "period", Height: 10, Period: 5, MiningReward: &reward2, DisablePayloadCodes: []uint64{core.TxCVoteStake}},
+		{Name: "limit", Height: 30, MaxTransactions: &maxTxs, EnablePayloadCodes: []uint64{core.TxCVoteStake}},
+	}
+	fs, err := core.NewForkSchedule(genesis, forks)
+	assert.NoError(t, err)
+	return fs
+}
+
+func TestForkScheduleRules(t *testing.T) {
+	fs := makeForkSchedule(t)
+	assert.Equal(t, "period", fs.Forks[0].Name)
+
+	rules := fs.Rules(9)
+	assert.Equal(t, "dpos", rules.Consensus)
+	assert.Equal(t, uint64(3), rules.Period)
+	assert.Equal(t, uint64(10), rules.MiningReward)
+	assert.True(t, rules.IsActive(core.GenesisForkName))
+	assert.False(t, rules.IsActive("period"))
+
+	rules = fs.Rules(10)
+	assert.Equal(t, uint64(5), rules.Period)
+	assert.Equal(t, uint64(3), rules.Round)
+	assert.Equal(t, uint64(5), rules.MiningReward)
+	assert.True(t, rules.IsActive("period"))
+	tx := core.NewTransactionPayload(tests.Address0, tests.Address1, new(big.Int), 1, &core.Payload{Code: core.TxCVoteStake})
+	assert.Equal(t, core.ErrPayloadCodeDisabled, rules.VerifyTransaction(tx))
+
+	assert.False(t, fs.IsConsensusSwitch(19))
+	assert.True(t, fs.IsConsensusSwitch(20))
+	rules = fs.Rules(20)
+	assert.True(t, rules.IsConsensus("POA"))
+	assert.False(t, rules.IsConsensus("DPOS"))
+	assert.Equal(t, 1, len(rules.Voters))
+	assert.Equal(t, []string{"dpos", "poa"}, fs.ConsensusNames())
+
+	rules = fs.Rules(30)
+	assert.NoError(t, rules.VerifyTransaction(tx))
+	assert.NoError(t, rules.VerifyTransactionCount(2))
+	assert.Equal(t, core.ErrTooManyTransactions, rules.VerifyTransactionCount(3))
+}
+
+func TestForkScheduleValidation(t *testing.T) {
+	_, err := core.NewForkSchedule(core.Fork{}, []core.Fork{{Name: "a", Height: 0}})
+	assert.Error(t, err)
+	_, err = core.NewForkSchedule(core.Fork{}, []core.Fork{{Name: "a", Height: 1}, {Name: "a", Height: 2}})
+	assert.Error(t, err)
+	_, err = core.NewForkSchedule(core.Fork{}, []core.Fork{{Height: 1}})
+	assert.Error(t, err)
+}
+
+func TestForkScheduleCompatible(t *testing.T) {
+	mstrg, _ := storage.NewMemoryStorage()
+	fs := makeForkSchedule(t)
+	assert.NoError(t, fs.Save(mstrg))
+	stored, err := core.LoadForkSchedule(mstrg)
+	assert.NoError(t, err)
+	assert.NoError(t, fs.CheckCompatible(stored, 100))
+
+	//change a fork not yet activated
+	fs2 := makeForkSchedule(t)
+	fs2.Forks[2].Height = 40
+	assert.NoError(t, fs2.CheckCompatible(stored, 29))
+	assert.Error(t, fs2.CheckCompatible(stored, 30))
+
+	//add a fork below head
+	fs3 := makeForkSchedule(t)
+	fs3.Forks = append(fs3.Forks, core.Fork{Name: "new", Height: 5})
+	assert.NoError(t, fs3.CheckCompatible(stored, 4))
+	assert.Error(t, fs3.CheckCompatible(stored, 5))
+}
+
+func TestForkScheduleConsensusCase(t *testing.T) {
+	genesis := core.Fork{Consensus: "dpos", Period: 3, Round: 3, TotalMiners: 3}
+	fs, err := core.NewForkSchedule(genesis, []core.Fork{{Name: "upper", Height: 10, Consensus: "DPOS"}})
+	assert.NoError(t, err)
+	//the same consensus in another case is not a switch
+	assert.False(t, fs.IsConsensusSwitch(10))
+	assert.Equal(t, "dpos", fs.Rules(10).Consensus)
+	assert.Equal(t, []string{"dpos"}, fs.ConsensusNames())
+}
+
+type nopConsensus struct {
+	core.Consensus
+}
+
+func TestNewForkConsensus(t *testing.T) {
+	fs := makeForkSchedule(t)
+	//poa has no engine
+	_, err := core.NewForkConsensus(map[string]core.Consensus{"DPOS": &nopConsensus{}}, fs)
+	assert.Error(t, err)
+	_, err = core.NewForkConsensus(map[string]core.Consensus{"DPOS": &nopConsensus{}, "poa": &nopConsensus{}}, fs)
+	assert.NoError(t, err)
+}
+
+func TestRulesRandomBeacon(t *testing.T) {
+	reward := uint64(10)
+	genesis := core.Fork{Consensus: "dpos", MiningReward: &reward}
+	fs, err := core.NewForkSchedule(genesis, []core.Fork{{Name: "beacon", Height: 10, RandomBeacon: true}})
+	assert.NoError(t, err)
+
+	h := &core.Header{Height: 9}
+	block := core.Block{BaseBlock: core.BaseBlock{Header: h}}
+	hash := block.CalcHash()
+	assert.NoError(t, fs.Rules(9).VerifyHeader(h))
+
+	//the random beacon changes the hash only when the header has it
+	h.SetRandomBeacon(common.Hash{}, common.Hash{0x1})
+	assert.NotEqual(t, hash, block.CalcHash())
+	assert.Equal(t, core.ErrRandomBeacon, fs.Rules(9).VerifyHeader(h))
+	assert.NoError(t, fs.Rules(10).VerifyHeader(h))
+	assert.True(t, fs.Rules(20).RandomBeacon)
+
+	h.Random = h.Random[:1]
+	assert.Equal(t, core.ErrRandomBeacon, fs.Rules(10).VerifyHeader(h))
+}
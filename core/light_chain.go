@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	lightHeaderPrefix = "light/header/"
+	lightHeightPrefix = "light/height/"
+	lightTailKey      = "light/tail"
+)
+
+// errors constants
+var (
+	ErrUnknownParent = errors.New("parent header is unknown")
+	ErrHeaderHeight  = errors.New("header height is not parent height + 1")
+	ErrHeaderHash    = errors.New("header.Hash != CalcHash()")
+)
+
+/*
+LightChain keeps the headers verified without transactions and account state.
+A header is verified by its hash, its signature and the consensus with the verified consensus state of its parent,
+the consensus tries a header refers to are not trusted, but must be in storage before its children are inserted.
+The account and transaction roots of the tail are used to verify merkle proofs from full peers.
+*/
+type LightChain struct {
+	mu        sync.RWMutex
+	bc        *BlockChain
+	storage   storage.Storage
+	consensus Consensus
+	tail      *Header
+}
+
+// NewLightChain starts from the genesis of bc, or from the tail saved before
+func NewLightChain(bc *BlockChain) (*LightChain, error) {
+	lc := &LightChain{
+		bc:        bc,
+		storage:   bc.Storage,
+		consensus: bc.Consensus,
+	}
+	hash, err := lc.storage.Get([]byte(lightTailKey))
+	if err == storage.ErrKeyNotFound {
+		genesis := bc.GenesisBlock.Header
+		if err := lc.putHeader(genesis); err != nil {
+			return nil, err
+		}
+		lc.tail = genesis
+		return lc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lc.tail = lc.GetHeaderByHash(common.BytesToHash(hash))
+	if lc.tail == nil {
+		return nil, errors.New("tail header is not in storage")
+	}
+	return lc, nil
+}
+
+func (lc *LightChain) Tail() *Header {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.tail
+}
+
+func (lc *LightChain) GetHeaderByHash(hash common.Hash) *Header {
+	encodedBytes, err := lc.storage.Get(append([]byte(lightHeaderPrefix), hash[:]...))
+	if err != nil {
+		return nil
+	}
+	header := new(Header)
+	if err := rlp.NewStream(bytes.NewReader(encodedBytes), 0).Decode(header); err != nil {
+		return nil
+	}
+	return header
+}
+
+// GetHeaderByHeight returns the header of the canonical chain which ends at the tail
+func (lc *LightChain) GetHeaderByHeight(height uint64) *Header {
+	hash, err := lc.storage.Get(encodeLightHeight(height))
+	if err != nil {
+		return nil
+	}
+	return lc.GetHeaderByHash(common.BytesToHash(hash))
+}
+
+// HasHeader returns true if the header is verified
+func (lc *LightChain) HasHeader(hash common.Hash) bool {
+	_, err := lc.storage.Get(append([]byte(lightHeaderPrefix), hash[:]...))
+	return err == nil
+}
+
+// VerifyHeader checks header with its parent and the consensus, the consensus tries of parent must be in storage
+func (lc *LightChain) VerifyHeader(header *Header) error {
+	parent := lc.GetHeaderByHash(header.ParentHash)
+	if parent == nil {
+		return ErrUnknownParent
+	}
+	if header.Height != parent.Height+1 {
+		return ErrHeaderHeight
+	}
+	block := &Block{BaseBlock: BaseBlock{Header: header}}
+	if header.Hash != block.CalcHash() {
+		return ErrHeaderHash
+	}
+	if err := block.VerifySign(); err != nil {
+		return err
+	}
+	//the miners come from the state of parent, the state of header is not verified without its transactions
+	state, err := lc.bc.newConsensusState(&Block{BaseBlock: BaseBlock{Header: parent}}, header.Height, false)
+	if err != nil {
+		return err
+	}
+	block.SetConsensusState(state)
+	if verifier, ok := lc.consensus.(HeaderVerifier); ok {
+		return verifier.VerifyHeader(block, parent)
+	}
+	return lc.consensus.Verify(block)
+}
+
+// InsertHeader verifies and stores header, it becomes the tail if it is higher than the tail
+func (lc *LightChain) InsertHeader(header *Header) error {
+	if lc.HasHeader(header.Hash) {
+		return nil
+	}
+	if err := lc.VerifyHeader(header); err != nil {
+		return err
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if err := lc.putHeader(header); err != nil {
+		return err
+	}
+	if header.Height <= lc.tail.Height {
+		return nil
+	}
+	//rewrite the height index of the new branch down to the common ancestor
+	for h := header; h != nil && h.Height > 0; h = lc.GetHeaderByHash(h.ParentHash) {
+		hash, err := lc.storage.Get(encodeLightHeight(h.Height))
+		if err == nil && bytes.Equal(hash, h.Hash[:]) {
+			break
+		}
+		if err := lc.storage.Put(encodeLightHeight(h.Height), h.Hash[:]); err != nil {
+			return err
+		}
+	}
+	if err := lc.storage.Put([]byte(lightTailKey), header.Hash[:]); err != nil {
+		return err
+	}
+	lc.tail = header
+	log.CLog().WithFields(logrus.Fields{
+		"Height": header.Height,
+		"Hash":   common.HashToHex(header.Hash),
+	}).Debug("Light tail")
+	return nil
+}
+
+func (lc *LightChain) putHeader(header *Header) error {
+	encodedBytes, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return err
+	}
+	if err := lc.storage.Put(append([]byte(lightHeaderPrefix), header.Hash[:]...), encodedBytes); err != nil {
+		return err
+	}
+	if header.Height == 0 {
+		return lc.storage.Put(encodeLightHeight(0), header.Hash[:])
+	}
+	return nil
+}
+
+func encodeLightHeight(height uint64) []byte {
+	return append([]byte(lightHeightPrefix), encodeBlockHeight(height)...)
+}
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	peer "github.com/libp2p/go-libp2p-peer"
 	"github.com/nacamp/go-simplechain/common"
 	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/event"
 	"github.com/nacamp/go-simplechain/log"
 	"github.com/nacamp/go-simplechain/net"
 	"github.com/nacamp/go-simplechain/rlp"
@@ -22,31 +24,49 @@ type BlockChainService struct {
 	MsgMissingBlockAckCh  chan interface{}
 	MsgMissingBlocksCh    chan interface{}
 	MsgMissingBlocksAckCh chan interface{}
-	MsgNewTxCh            chan interface{}
+	MsgNewBlockHashesCh   chan interface{}
+	fetching              *lru.Cache
+	libSub                *event.Subscription
+	clock                 common.Clock
 }
 
+const (
+	maxFetching     = 1024
+	refetchInterval = 5 * time.Second
+	libEventSize    = 16
+)
+
 func NewBlockChainService(bc *core.BlockChain, streamPool *net.PeerStreamPool) *BlockChainService {
 	bcs := BlockChainService{
 		// node: node,
 		streamPool: streamPool,
 		bc:         bc,
+		clock:      common.SystemClock{},
 	}
 	bcs.MsgNewBlockCh = make(chan interface{}, 1)
 	bcs.MsgMissingBlockCh = make(chan interface{}, 1)
 	bcs.MsgMissingBlockAckCh = make(chan interface{}, 1)
 	bcs.MsgMissingBlocksCh = make(chan interface{}, 1)
 	bcs.MsgMissingBlocksAckCh = make(chan interface{}, 1)
-	bcs.MsgNewTxCh = make(chan interface{}, 1)
+	bcs.MsgNewBlockHashesCh = make(chan interface{}, 1)
+	bcs.fetching, _ = lru.New(maxFetching)
+	//a missed lib only delays the cleanup to the next lib
+	bcs.libSub = bc.Events().Subscribe(libEventSize, core.LibEvent{})
 	return &bcs
 }
 
+// SetClock replaces the wall clock which times out the block requests, call it before Start
+func (bcs *BlockChainService) SetClock(clock common.Clock) {
+	bcs.clock = clock
+}
+
 func (bcs *BlockChainService) Register(peerStream *net.PeerStream) {
 	peerStream.Register(net.MsgNewBlock, bcs.MsgNewBlockCh)
 	peerStream.Register(net.MsgMissingBlock, bcs.MsgMissingBlockCh)
 	peerStream.Register(net.MsgMissingBlockAck, bcs.MsgMissingBlockAckCh)
 	peerStream.Register(net.MsgMissingBlocks, bcs.MsgMissingBlocksCh)
 	peerStream.Register(net.MsgMissingBlocksAck, bcs.MsgMissingBlocksAckCh)
-	peerStream.Register(net.MsgNewTx, bcs.MsgNewTxCh)
+	peerStream.Register(net.MsgNewBlockHashes, bcs.MsgNewBlockHashesCh)
 }
 
 func (bcs *BlockChainService) StartHandler() {
@@ -58,19 +78,14 @@ func (bcs *BlockChainService) Start() {
 }
 
 func (bcs *BlockChainService) loop() {
-	ticker := time.NewTicker(5 * time.Second)
 	bc := bcs.bc
 	for {
 		select {
-		case <-ticker.C:
-			bcs.bc.RequestMissingBlocks()
 		case msg := <-bcs.bc.MessageToRandomNode:
 			bcs.streamPool.SendMessageToRandomNode(msg)
 		case msg := <-bcs.bc.BroadcastMessage:
 			bcs.streamPool.BroadcastMessage(msg)
-		case msg := <-bcs.bc.NewTXMessage:
-			bcs.BroadcastNewTXMessage(msg)
-		case <-bc.LibCh:
+		case <-bcs.libSub.Chan():
 			bc.RemoveOrphanBlock()
 			bc.RemoveFutureBlock()
 		}
@@ -82,24 +97,85 @@ func (bcs *BlockChainService) receiveBlock(msg *net.Message, isNew bool) {
 	// msg := ch.(*Message)
 	baseBlock := &core.BaseBlock{}
 	err := rlp.DecodeBytes(msg.Payload, baseBlock)
-	if err != nil {
-		log.CLog().WithFields(logrus.Fields{"Code": msg.Code}).Warning(fmt.Sprintf("%+v", err))
+	if err != nil || baseBlock.Header == nil {
+		bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("block: %v", err))
+		return
 	}
 	// rlp.DecodeBytes(message.Payload, &data)
 	log.CLog().WithFields(logrus.Fields{}).Debug("PeerID: ", msg.PeerID)
 
-	err = bc.PutBlockIfParentExist(baseBlock.NewBlock())
+	block := baseBlock.NewBlock()
+	if block.Hash() != block.CalcHash() {
+		bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidBlock, "block.Hash() != block.CalcHash()")
+		return
+	}
+	if err := block.VerifySign(); err != nil {
+		bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidBlock, err.Error())
+		return
+	}
+	if ps, err := bcs.streamPool.GetStream(msg.PeerID); err == nil {
+		ps.MarkBlock(block.Hash())
+		if isNew {
+			//the sender has the new block as its tail
+			ps.UpdateRemoteHead(block.Header.Height, block.Hash())
+		}
+	}
+	if bc.GetBlockByHash(block.Hash()) != nil {
+		return
+	}
+	//a block whose parent is missing is kept as a future block without an error
+	err = bc.PutBlockIfParentExist(block)
 	if err != nil {
 		log.CLog().WithFields(logrus.Fields{"Code": msg.Code}).Warning(fmt.Sprintf("%+v", err))
+		if !isLocalError(err) {
+			bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidBlock, err.Error())
+		}
+		return
 	}
+	bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreValidBlock, "")
 	bc.Consensus.UpdateLIB()
-	if isNew {
-		bcs.streamPool.BroadcastMessage(msg)
+	//relay a pushed block or an announced block which became our tail
+	if isNew || bc.Tail().Hash() == block.Hash() {
+		message := net.Message{Code: net.MsgNewBlock, Payload: msg.Payload}
+		bcs.streamPool.BroadcastBlock(block.Hash(), block.Header.Height, &message)
+	}
+}
+
+// receiveBlockHashes fetches the announced blocks which we do not have from the announcer
+func (bcs *BlockChainService) receiveBlockHashes(msg *net.Message) {
+	announces := make([]net.BlockAnnounce, 0)
+	if err := rlp.DecodeBytes(msg.Payload, &announces); err != nil {
+		bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("block hashes: %v", err))
+		return
+	}
+	ps, err := bcs.streamPool.GetStream(msg.PeerID)
+	if err != nil {
+		return
+	}
+	for _, announce := range announces {
+		ps.MarkBlock(announce.Hash)
+		ps.UpdateRemoteHead(announce.Height, announce.Hash)
+		if bcs.bc.GetBlockByHash(announce.Hash) != nil {
+			continue
+		}
+		//another peer may have announced it just before
+		if v, ok := bcs.fetching.Get(announce.Hash); ok && bcs.clock.Now().Sub(v.(time.Time)) < refetchInterval {
+			continue
+		}
+		bcs.fetching.Add(announce.Hash, bcs.clock.Now())
+		message, err := net.NewRLPMessage(net.MsgMissingBlock, announce.Hash)
+		if err != nil {
+			continue
+		}
+		ps.SendMessage(&message)
+		log.CLog().WithFields(logrus.Fields{
+			"Height": announce.Height,
+			"Hash":   common.HashToHex(announce.Hash),
+		}).Debug("fetch announced block")
 	}
 }
 
 func (bcs *BlockChainService) onHandle() {
-	bc := bcs.bc
 	for {
 		select {
 		case ch := <-bcs.MsgMissingBlockAckCh:
@@ -108,12 +184,15 @@ func (bcs *BlockChainService) onHandle() {
 			bcs.receiveBlock(ch.(*net.Message), false)
 		case ch := <-bcs.MsgNewBlockCh:
 			bcs.receiveBlock(ch.(*net.Message), true)
+		case ch := <-bcs.MsgNewBlockHashesCh:
+			bcs.receiveBlockHashes(ch.(*net.Message))
 		case ch := <-bcs.MsgMissingBlockCh:
 			msg := ch.(*net.Message)
 			hash := common.Hash{}
 			err := rlp.DecodeBytes(msg.Payload, &hash)
 			if err != nil {
-				log.CLog().WithFields(logrus.Fields{"Code": msg.Code}).Warning(fmt.Sprintf("%+v", err))
+				bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("missing block: %v", err))
+				continue
 			}
 			log.CLog().WithFields(logrus.Fields{
 				"Hash": common.HashToHex(hash),
@@ -125,7 +204,8 @@ func (bcs *BlockChainService) onHandle() {
 			var blockRange [2]uint64
 			err := rlp.DecodeBytes(msg.Payload, &blockRange)
 			if err != nil {
-				log.CLog().WithFields(logrus.Fields{"Code": msg.Code}).Warning(fmt.Sprintf("%+v", err))
+				bcs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("missing blocks: %v", err))
+				continue
 			}
 			log.CLog().WithFields(logrus.Fields{
 				"Height Start": blockRange[0],
@@ -133,20 +213,6 @@ func (bcs *BlockChainService) onHandle() {
 			}).Debug("missing block request arrived")
 			bcs.SendMissingBlocks(blockRange, msg.PeerID)
 
-		case ch := <-bcs.MsgNewTxCh:
-			msg := ch.(*net.Message)
-			tx := &core.Transaction{}
-			err := rlp.DecodeBytes(msg.Payload, &tx)
-			if err != nil {
-				log.CLog().WithFields(logrus.Fields{"Code": msg.Code}).Warning(fmt.Sprintf("%+v", err))
-			}
-			log.CLog().WithFields(logrus.Fields{
-				"From":   common.AddressToHex(tx.From),
-				"To":     common.AddressToHex(tx.To),
-				"Amount": tx.Amount,
-			}).Info("Received tx")
-			bc.TxPool.Put(tx)
-			bcs.streamPool.BroadcastMessage(msg)
 		}
 	}
 }
@@ -197,12 +263,3 @@ func (bcs *BlockChainService) SendMissingBlocks(blockRange [2]uint64, peerID pee
 	}
 
 }
-
-func (bcs *BlockChainService) BroadcastNewTXMessage(tx *core.Transaction) error {
-	message, err := net.NewRLPMessage(net.MsgNewTx, tx)
-	if err != nil {
-		return err
-	}
-	bcs.streamPool.BroadcastMessage(&message)
-	return nil
-}
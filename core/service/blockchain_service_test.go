@@ -0,0 +1,33 @@
+package service
+
+import (
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockChainServiceReceiveBlock(t *testing.T) {
+	remote := newTestNode(t)
+	blocks := remote.mine(t, 1)
+	local := newTestNode(t)
+	bcs := NewBlockChainService(local.bc, local.pool)
+	reputation := local.pool.Reputation()
+	newBlock := func(block *core.Block) *net.Message {
+		msg, err := net.NewRLPMessage(net.MsgNewBlock, &block.BaseBlock)
+		assert.NoError(t, err)
+		msg.PeerID = peer.ID("peer")
+		return &msg
+	}
+
+	//a block failing verification is not imported and its sender is penalized
+	bcs.receiveBlock(newBlock(forgeBlock(t, blocks[0])), true)
+	assert.Equal(t, local.bc.GenesisBlock.Hash(), local.bc.Tail().Hash())
+	assert.Equal(t, net.ScoreInvalidBlock, reputation.Score(peer.ID("peer")))
+
+	bcs.receiveBlock(newBlock(blocks[0]), true)
+	assert.Equal(t, blocks[0].Hash(), local.bc.Tail().Hash())
+	assert.Equal(t, net.ScoreInvalidBlock+net.ScoreValidBlock, reputation.Score(peer.ID("peer")))
+}
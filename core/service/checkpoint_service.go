@@ -0,0 +1,219 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nacamp/go-simplechain/account"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/trie"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxTrieNodes = 256
+)
+
+/*
+CheckpointService signs the lib when this node is a miner or signer
+and collects the signatures of the others into a finalized checkpoint.
+It serves the checkpoint block, the finalized checkpoint and trie nodes by hash
+to the peers which sync the state with SnapshotService.
+*/
+type CheckpointService struct {
+	bc                          *core.BlockChain
+	streamPool                  *net.PeerStreamPool
+	clock                       common.Clock
+	signer                      common.Address
+	wallet                      *account.Wallet
+	enableSigning               bool
+	lastSigned                  common.Hash
+	MsgCheckpointVoteCh         chan interface{}
+	MsgGetCheckpointBlockCh     chan interface{}
+	MsgGetTrieNodesCh           chan interface{}
+	MsgGetFinalizedCheckpointCh chan interface{}
+}
+
+func NewCheckpointService(bc *core.BlockChain, streamPool *net.PeerStreamPool) *CheckpointService {
+	cs := CheckpointService{
+		streamPool: streamPool,
+		clock:      common.SystemClock{},
+		bc:         bc,
+	}
+	cs.MsgCheckpointVoteCh = make(chan interface{}, 1)
+	cs.MsgGetCheckpointBlockCh = make(chan interface{}, 1)
+	cs.MsgGetTrieNodesCh = make(chan interface{}, 1)
+	cs.MsgGetFinalizedCheckpointCh = make(chan interface{}, 1)
+	return &cs
+}
+
+func (cs *CheckpointService) SetupSigner(signer common.Address, wallet *account.Wallet) {
+	cs.signer = signer
+	cs.wallet = wallet
+	cs.enableSigning = true
+}
+
+// SetClock replaces the wall clock which drives signing, call it before Start
+func (cs *CheckpointService) SetClock(clock common.Clock) {
+	cs.clock = clock
+}
+
+func (cs *CheckpointService) Register(peerStream *net.PeerStream) {
+	peerStream.Register(net.MsgCheckpointVote, cs.MsgCheckpointVoteCh)
+	peerStream.Register(net.MsgGetCheckpointBlock, cs.MsgGetCheckpointBlockCh)
+	peerStream.Register(net.MsgGetTrieNodes, cs.MsgGetTrieNodesCh)
+	peerStream.Register(net.MsgGetFinalizedCheckpoint, cs.MsgGetFinalizedCheckpointCh)
+}
+
+func (cs *CheckpointService) StartHandler() {
+	go cs.onHandle()
+}
+
+func (cs *CheckpointService) Start() {
+	if cs.enableSigning {
+		go cs.loop()
+	}
+}
+
+func (cs *CheckpointService) loop() {
+	ticker := cs.clock.NewTicker(3 * time.Second)
+	for {
+		select {
+		case <-ticker.C():
+			if !cs.bc.IsCheckpointSyncing() {
+				cs.signLib()
+			}
+		}
+	}
+}
+
+func (cs *CheckpointService) onHandle() {
+	for {
+		select {
+		case ch := <-cs.MsgCheckpointVoteCh:
+			msg := ch.(*net.Message)
+			vote := &core.CheckpointVote{}
+			if err := rlp.DecodeBytes(msg.Payload, vote); err != nil {
+				cs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("checkpoint: %v", err))
+				continue
+			}
+			hash := voteHash(msg)
+			if ps, err := cs.streamPool.GetStream(msg.PeerID); err == nil {
+				ps.MarkVote(hash)
+			}
+			//only a new vote is relayed
+			if _, err := cs.bc.AddCheckpointVote(vote); err != nil {
+				log.CLog().WithFields(logrus.Fields{
+					"Height": vote.Height,
+				}).Debug(fmt.Sprintf("%+v", err))
+				continue
+			}
+			cs.streamPool.BroadcastVote(hash, msg)
+		case ch := <-cs.MsgGetCheckpointBlockCh:
+			msg := ch.(*net.Message)
+			hash := common.Hash{}
+			if err := rlp.DecodeBytes(msg.Payload, &hash); err != nil {
+				cs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("checkpoint: %v", err))
+				continue
+			}
+			//empty if the block is unknown
+			blocks := make([]*core.BaseBlock, 0, 1)
+			if block := cs.bc.GetBlockByHash(hash); block != nil {
+				blocks = append(blocks, &block.BaseBlock)
+			}
+			cs.reply(msg, net.MsgCheckpointBlockAck, blocks)
+		case ch := <-cs.MsgGetTrieNodesCh:
+			msg := ch.(*net.Message)
+			hashes := make([][]byte, 0)
+			if err := rlp.DecodeBytes(msg.Payload, &hashes); err != nil {
+				cs.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("checkpoint: %v", err))
+				continue
+			}
+			if len(hashes) > maxTrieNodes {
+				hashes = hashes[:maxTrieNodes]
+			}
+			nodes := make([][]byte, 0, len(hashes))
+			for _, hash := range hashes {
+				if encodedBytes, err := trie.ReadNode(cs.bc.Storage, hash); err == nil {
+					nodes = append(nodes, encodedBytes)
+				}
+			}
+			cs.reply(msg, net.MsgTrieNodes, nodes)
+		case ch := <-cs.MsgGetFinalizedCheckpointCh:
+			msg := ch.(*net.Message)
+			//empty if no checkpoint is finalized yet
+			signed := make([]*core.SignedCheckpoint, 0, 1)
+			if finalized := cs.bc.FinalizedCheckpoint(); finalized != nil {
+				signed = append(signed, finalized)
+			}
+			cs.reply(msg, net.MsgFinalizedCheckpoint, signed)
+		}
+	}
+}
+
+func (cs *CheckpointService) reply(request *net.Message, code uint64, payload interface{}) {
+	ps, err := cs.streamPool.GetStream(request.PeerID)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	if err := ps.Reply(request, code, payload); err != nil {
+		log.CLog().WithFields(logrus.Fields{"Code": code}).Warning(fmt.Sprintf("%+v", err))
+	}
+}
+
+// signLib broadcasts the signature of the lib if the signer is a validator of it
+func (cs *CheckpointService) signLib() {
+	bc := cs.bc
+	lib := bc.Lib()
+	if lib == nil || lib.Header.Height == 0 || lib.Hash() == cs.lastSigned {
+		return
+	}
+	cs.lastSigned = lib.Hash()
+	validators, err := bc.Validators(lib)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Debug(fmt.Sprintf("%+v", err))
+		return
+	}
+	isValidator := false
+	for _, v := range validators {
+		if v == cs.signer {
+			isValidator = true
+			break
+		}
+	}
+	if !isValidator {
+		return
+	}
+
+	vote := &core.CheckpointVote{Checkpoint: core.Checkpoint{Height: lib.Header.Height, Hash: lib.Hash()}}
+	sig, err := cs.wallet.SignHash(cs.signer, vote.SigHash())
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	copy(vote.Signature[:], sig)
+	if _, err := bc.AddCheckpointVote(vote); err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	message, err := net.NewRLPMessage(net.MsgCheckpointVote, vote)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	cs.streamPool.BroadcastVote(voteHash(&message), &message)
+	log.CLog().WithFields(logrus.Fields{
+		"Height": lib.Header.Height,
+	}).Debug("Signed checkpoint")
+}
+
+// voteHash identifies a vote with its signature in the known votes of peers
+func voteHash(message *net.Message) common.Hash {
+	return common.BytesToHash(crypto.Sha3b256(message.Payload))
+}
@@ -0,0 +1,384 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/nacamp/go-simplechain/trie"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	lightRequestTimeout = 10 * time.Second
+)
+
+var (
+	errNoProofPeers   = errors.New("no peer has the tail of light chain")
+	errMissingNodes   = errors.New("peer does not have the consensus state")
+	errLightNotEnable = errors.New("light mode is not enabled")
+)
+
+// ProofRequest is the payload of MsgGetProof, the reply is the trie.MerkleProof of Key in the trie of Root
+type ProofRequest struct {
+	Root common.Hash
+	Key  []byte
+}
+
+/*
+LightService serves merkle proofs to light nodes, and runs a light node when it is enabled.
+A light node downloads headers only, and verifies each one with the consensus tries of the header
+which are fetched by node hash like snapshot sync.
+Accounts and transactions are requested with their proof from full peers
+and checked against AccountHash and TransactionHash of the tail header.
+*/
+type LightService struct {
+	mu            sync.Mutex
+	bc            *core.BlockChain
+	lc            *core.LightChain
+	streamPool    *net.PeerStreamPool
+	clock         common.Clock
+	syncing       bool
+	from          uint64
+	MsgGetProofCh chan interface{}
+	MsgNewHeadCh  chan interface{}
+}
+
+func NewLightService(bc *core.BlockChain, streamPool *net.PeerStreamPool) *LightService {
+	ls := LightService{
+		streamPool: streamPool,
+		clock:      common.SystemClock{},
+		bc:         bc,
+	}
+	ls.MsgGetProofCh = make(chan interface{}, 1)
+	ls.MsgNewHeadCh = make(chan interface{}, 1)
+	return &ls
+}
+
+// Enable makes this node a light node, call it after the chain is set up
+func (ls *LightService) Enable() error {
+	lc, err := core.NewLightChain(ls.bc)
+	if err != nil {
+		return err
+	}
+	ls.lc = lc
+	return nil
+}
+
+func (ls *LightService) LightChain() *core.LightChain {
+	return ls.lc
+}
+
+// SetClock replaces the wall clock which drives the header sync, call it before Start
+func (ls *LightService) SetClock(clock common.Clock) {
+	ls.clock = clock
+}
+
+func (ls *LightService) Register(peerStream *net.PeerStream) {
+	peerStream.Register(net.MsgGetProof, ls.MsgGetProofCh)
+	if ls.lc != nil {
+		//a light node has no BlockChainService, new blocks only tell the tails of peers
+		peerStream.Register(net.MsgNewBlock, ls.MsgNewHeadCh)
+		peerStream.Register(net.MsgNewBlockHashes, ls.MsgNewHeadCh)
+	}
+}
+
+func (ls *LightService) StartHandler() {
+	go ls.onHandle()
+}
+
+func (ls *LightService) Start() {
+	if ls.lc == nil {
+		return
+	}
+	go ls.loop()
+}
+
+func (ls *LightService) loop() {
+	ticker := ls.clock.NewTicker(1 * time.Second)
+	for {
+		select {
+		case <-ticker.C():
+			ls.synchronise()
+		}
+	}
+}
+
+func (ls *LightService) onHandle() {
+	for {
+		select {
+		case ch := <-ls.MsgGetProofCh:
+			msg := ch.(*net.Message)
+			request := ProofRequest{}
+			if err := rlp.DecodeBytes(msg.Payload, &request); err != nil {
+				ls.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("light: %v", err))
+				continue
+			}
+			//empty if the root or the key is unknown
+			proof := trie.MerkleProof{}
+			if tr, err := trie.NewTrie(request.Root[:], ls.bc.Storage, false); err == nil {
+				if p, err := tr.Prove(request.Key); err == nil {
+					proof = p
+				}
+			}
+			ls.reply(msg, net.MsgProof, proof)
+		case ch := <-ls.MsgNewHeadCh:
+			ls.receiveHead(ch.(*net.Message))
+		}
+	}
+}
+
+// receiveHead records the tail of the peer which sent a new block or its hash
+func (ls *LightService) receiveHead(msg *net.Message) {
+	announces := make([]net.BlockAnnounce, 0)
+	if msg.Code == net.MsgNewBlock {
+		baseBlock := core.BaseBlock{}
+		if err := rlp.DecodeBytes(msg.Payload, &baseBlock); err != nil || baseBlock.Header == nil {
+			ls.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("light: %v", err))
+			return
+		}
+		announces = append(announces, net.BlockAnnounce{Hash: baseBlock.Header.Hash, Height: baseBlock.Header.Height})
+	} else if err := rlp.DecodeBytes(msg.Payload, &announces); err != nil {
+		ls.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("light: %v", err))
+		return
+	}
+	ps, err := ls.streamPool.GetStream(msg.PeerID)
+	if err != nil {
+		return
+	}
+	for _, announce := range announces {
+		ps.UpdateRemoteHead(announce.Height, announce.Hash)
+	}
+}
+
+func (ls *LightService) reply(request *net.Message, code uint64, payload interface{}) {
+	ps, err := ls.streamPool.GetStream(request.PeerID)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	if err := ps.Reply(request, code, payload); err != nil {
+		log.CLog().WithFields(logrus.Fields{"Code": code}).Warning(fmt.Sprintf("%+v", err))
+	}
+}
+
+// request sends the message and waits for the reply
+func (ls *LightService) request(ps *net.PeerStream, code uint64, payload interface{}) (*net.Message, error) {
+	message, err := net.NewRLPMessage(code, payload)
+	if err != nil {
+		return nil, err
+	}
+	future, err := ps.Request(&message, lightRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return future.Wait()
+}
+
+// synchronise downloads headers from the peer which has the highest tail, one batch at a time
+func (ls *LightService) synchronise() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.syncing {
+		return
+	}
+	tail := ls.lc.Tail()
+	var best *net.PeerStream
+	var bestHeight uint64
+	for _, ps := range ls.streamPool.Peers() {
+		status := ps.RemoteStatus()
+		if status != nil && status.TailHeight > tail.Height && status.TailHeight > bestHeight {
+			best = ps
+			bestHeight = status.TailHeight
+		}
+	}
+	if best == nil {
+		return
+	}
+	if ls.from == 0 || ls.from > tail.Height+1 {
+		ls.from = tail.Height + 1
+	}
+	ls.syncing = true
+	from := ls.from
+	go func() {
+		next := ls.fetchHeaders(best, from)
+		ls.mu.Lock()
+		ls.syncing = false
+		ls.from = next
+		ls.mu.Unlock()
+	}()
+}
+
+/*
+fetchHeaders inserts the headers from height from, and returns the height to request next.
+If the first header is not linked, the tail is on a fork and earlier headers are requested.
+*/
+func (ls *LightService) fetchHeaders(ps *net.PeerStream, from uint64) uint64 {
+	reply, err := ls.request(ps, net.MsgGetBlockHeaders, HeaderRange{Start: from, Count: maxSyncHeaders})
+	if err != nil {
+		return from
+	}
+	headers := make([]*core.Header, 0)
+	if err := rlp.DecodeBytes(reply.Payload, &headers); err != nil {
+		ls.streamPool.AdjustScore(ps.ID(), net.ScoreInvalidMessage, fmt.Sprintf("light: %v", err))
+		return from
+	}
+	for i, header := range headers {
+		if err := ls.syncConsensusState(ps, header); err != nil {
+			log.CLog().WithFields(logrus.Fields{
+				"Height": header.Height,
+			}).Debug(err)
+			return header.Height
+		}
+		if err := ls.lc.InsertHeader(header); err != nil {
+			if err == core.ErrUnknownParent && i == 0 && from > 1 {
+				if from > maxSyncHeaders {
+					return from - maxSyncHeaders
+				}
+				return 1
+			}
+			ls.streamPool.AdjustScore(ps.ID(), net.ScoreInvalidData, fmt.Sprintf("light: %v", err))
+			return header.Height
+		}
+	}
+	return ls.lc.Tail().Height + 1
+}
+
+// syncConsensusState fetches the consensus trie of header and the tries referred from it
+func (ls *LightService) syncConsensusState(ps *net.PeerStream, header *core.Header) error {
+	ts := trie.NewSync(ls.bc.Storage)
+	if err := ts.AddRoot(header.ConsensusHash[:]); err != nil {
+		return err
+	}
+	if err := ls.fetchNodes(ps, ts); err != nil {
+		return err
+	}
+	stateTrieRoots, ok := ls.bc.Consensus.(core.StateTrieRoots)
+	if !ok {
+		return nil
+	}
+	roots, err := stateTrieRoots.StateTrieRoots(&core.Block{BaseBlock: core.BaseBlock{Header: header}})
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if err := ts.AddRoot(root[:]); err != nil {
+			return err
+		}
+	}
+	return ls.fetchNodes(ps, ts)
+}
+
+// fetchNodes downloads the missing nodes of ts from the peer, a node is stored only if it was requested
+func (ls *LightService) fetchNodes(ps *net.PeerStream, ts *trie.Sync) error {
+	for ts.Pending() > 0 {
+		hashes := ts.Missing(maxTrieNodes)
+		reply, err := ls.request(ps, net.MsgGetTrieNodes, hashes)
+		if err != nil {
+			return err
+		}
+		nodes := make([][]byte, 0)
+		if err := rlp.DecodeBytes(reply.Payload, &nodes); err != nil {
+			ls.streamPool.AdjustScore(ps.ID(), net.ScoreInvalidMessage, fmt.Sprintf("light: %v", err))
+			return err
+		}
+		if len(nodes) == 0 {
+			return errMissingNodes
+		}
+		wanted := make(map[string]bool, len(hashes))
+		for _, hash := range hashes {
+			wanted[string(hash)] = true
+		}
+		for _, encodedBytes := range nodes {
+			if !wanted[string(crypto.Sha3b256(encodedBytes))] {
+				ls.streamPool.AdjustScore(ps.ID(), net.ScoreInvalidData, errUnrequestedNode.Error())
+				return errUnrequestedNode
+			}
+			if err := ts.Process(encodedBytes); err != nil && err != trie.ErrUnrequestedNode {
+				ls.streamPool.AdjustScore(ps.ID(), net.ScoreInvalidData, fmt.Sprintf("light: %v", err))
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+requestProof asks peers for the proof of key in the trie of root, until one returns a valid proof.
+storage.ErrKeyNotFound is returned if no peer proves the key, the absence itself is not proved.
+*/
+func (ls *LightService) requestProof(root common.Hash, height uint64, key []byte) ([]byte, error) {
+	asked := false
+	for _, ps := range ls.streamPool.Peers() {
+		status := ps.RemoteStatus()
+		if status == nil || status.TailHeight < height {
+			continue
+		}
+		asked = true
+		reply, err := ls.request(ps, net.MsgGetProof, ProofRequest{Root: root, Key: key})
+		if err != nil {
+			continue
+		}
+		proof := trie.MerkleProof{}
+		if err := rlp.DecodeBytes(reply.Payload, &proof); err != nil {
+			ls.streamPool.AdjustScore(ps.ID(), net.ScoreInvalidMessage, fmt.Sprintf("light: %v", err))
+			continue
+		}
+		if len(proof) == 0 {
+			continue
+		}
+		value, err := trie.VerifyProof(root[:], key, proof)
+		if err != nil {
+			ls.streamPool.AdjustScore(ps.ID(), net.ScoreInvalidData, fmt.Sprintf("light: %v", err))
+			continue
+		}
+		return value, nil
+	}
+	if !asked {
+		return nil, errNoProofPeers
+	}
+	return nil, storage.ErrKeyNotFound
+}
+
+// GetAccount returns the account at the tail of light chain, a new account if no peer proves it
+func (ls *LightService) GetAccount(address common.Address) (*core.Account, error) {
+	if ls.lc == nil {
+		return nil, errLightNotEnable
+	}
+	tail := ls.lc.Tail()
+	value, err := ls.requestProof(tail.AccountHash, tail.Height, address[:])
+	if err == storage.ErrKeyNotFound {
+		account := core.NewAccount()
+		account.Address = address
+		return account, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return core.DecodeAccount(value)
+}
+
+// GetTransaction returns the transaction included until the tail of light chain
+func (ls *LightService) GetTransaction(hash common.Hash) (*core.Transaction, error) {
+	if ls.lc == nil {
+		return nil, errLightNotEnable
+	}
+	tail := ls.lc.Tail()
+	value, err := ls.requestProof(tail.TransactionHash, tail.Height, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	tx := new(core.Transaction)
+	if err := rlp.DecodeBytes(value, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -0,0 +1,452 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/trie"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotRequestTimeout = 10 * time.Second
+	maxPivotAttempts       = 30 //full sync starts if no peer has a pivot for 30 seconds
+)
+
+var (
+	errUnrequestedNode       = errors.New("trie node was not requested from the peer")
+	errSnapshotBlock         = errors.New("snapshot block is not the pivot")
+	errNoSnapshotPeers       = errors.New("no peer has the pivot")
+	errUnrequestedBlock      = errors.New("more than one snapshot block")
+	errUnrequestedCheckpoint = errors.New("more than one finalized checkpoint")
+)
+
+/*
+SnapshotService syncs the state of a checkpoint instead of executing blocks from genesis.
+The pivot is the trusted checkpoint in config, or else the highest finalized checkpoint of peers
+which is signed by over 2/3 of the validators of genesis, the status of a peer is not trusted.
+Its block is fetched first, then the account, transaction and consensus tries are downloaded
+node by node from several peers by MsgGetTrieNodes which CheckpointService serves.
+A node is accepted only if its hash was requested, and it is requested only when its parent is stored,
+so every node is verified against the hash in its parent up to the roots in the pivot block.
+When nothing is missing, the chain is reset to the pivot and SyncService imports the blocks after it.
+Full sync starts if no peer has the pivot for maxPivotAttempts ticks.
+*/
+type SnapshotService struct {
+	mu              sync.Mutex
+	bc              *core.BlockChain
+	streamPool      *net.PeerStreamPool
+	clock           common.Clock
+	enabled         bool
+	done            bool
+	attempts        int
+	pivot           common.Hash
+	height          uint64 //0 until the block of a trusted checkpoint is fetched
+	block           *core.Block
+	blockReq        peer.ID
+	checkpointReqs  map[peer.ID]bool
+	pivotPeers      map[peer.ID]bool //peers which sent the pivot as their finalized checkpoint
+	sync            *trie.Sync
+	stateTriesAdded bool
+	inflight        map[string]peer.ID
+	busy            map[peer.ID]bool
+}
+
+func NewSnapshotService(bc *core.BlockChain, streamPool *net.PeerStreamPool) *SnapshotService {
+	ss := SnapshotService{
+		streamPool:     streamPool,
+		clock:          common.SystemClock{},
+		bc:             bc,
+		checkpointReqs: make(map[peer.ID]bool),
+		pivotPeers:     make(map[peer.ID]bool),
+		inflight:       make(map[string]peer.ID),
+		busy:           make(map[peer.ID]bool),
+	}
+	return &ss
+}
+
+/*
+Enable syncs the state from a signed checkpoint of peers if the chain has only genesis,
+otherwise the service does nothing. Blocks are not imported until the state is synced, call it after the chain is set up.
+*/
+func (ss *SnapshotService) Enable() {
+	ss.enabled = true
+	if ss.bc.Tail().Header.Height == 0 && ss.bc.Checkpoint() == nil {
+		ss.bc.SetCheckpointSyncing(true)
+	} else {
+		ss.done = true
+	}
+}
+
+// SyncFrom syncs the state of the trusted checkpoint if the block is not in storage
+func (ss *SnapshotService) SyncFrom(hash common.Hash) {
+	bc := ss.bc
+	if block := bc.GetBlockByHash(hash); block != nil {
+		bc.SetTrustedCheckpoint(&core.Checkpoint{Height: block.Header.Height, Hash: hash})
+		return
+	}
+	ss.enabled = true
+	ss.pivot = hash
+	bc.SetTrustedCheckpoint(&core.Checkpoint{Hash: hash})
+	bc.SetCheckpointSyncing(true)
+	log.CLog().WithFields(logrus.Fields{
+		"Hash": common.HashToHex(hash),
+	}).Info("Sync state from trusted checkpoint")
+}
+
+// SetClock replaces the wall clock which drives the snapshot loop, call it before Start
+func (ss *SnapshotService) SetClock(clock common.Clock) {
+	ss.clock = clock
+}
+
+func (ss *SnapshotService) Start() {
+	if !ss.enabled {
+		return
+	}
+	go ss.loop()
+}
+
+func (ss *SnapshotService) loop() {
+	ticker := ss.clock.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if ss.synchronise() {
+				return
+			}
+		}
+	}
+}
+
+func (ss *SnapshotService) request(ps *net.PeerStream, code uint64, payload interface{}) (*net.Future, error) {
+	message, err := net.NewRLPMessage(code, payload)
+	if err != nil {
+		return nil, err
+	}
+	return ps.Request(&message, snapshotRequestTimeout)
+}
+
+// synchronise is called periodically and returns true when the state is synced or not needed
+func (ss *SnapshotService) synchronise() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.done {
+		return true
+	}
+	if ss.pivot == (common.Hash{}) {
+		ss.requestCheckpoints()
+	} else if len(ss.peersWithPivot()) > 0 {
+		ss.attempts = 0
+		if ss.block == nil {
+			ss.requestBlock()
+		} else {
+			ss.requestNodes()
+		}
+		return false
+	}
+	ss.attempts++
+	if ss.attempts >= maxPivotAttempts {
+		ss.fullSync()
+		return true
+	}
+	return false
+}
+
+// fullSync gives up the pivot, the stored trie nodes are left, mu must be held
+func (ss *SnapshotService) fullSync() {
+	log.CLog().WithFields(logrus.Fields{
+		"Hash": common.HashToHex(ss.pivot),
+	}).Info("No peer has the pivot, start full sync")
+	ss.sync = nil
+	ss.block = nil
+	ss.pivot = common.Hash{}
+	ss.bc.SetCheckpointSyncing(false)
+	ss.done = true
+}
+
+// requestCheckpoints asks the peers which are not asked yet for their finalized checkpoint, mu must be held
+func (ss *SnapshotService) requestCheckpoints() {
+	for _, ps := range ss.streamPool.Peers() {
+		peerID := ps.ID()
+		if ss.checkpointReqs[peerID] {
+			continue
+		}
+		future, err := ss.request(ps, net.MsgGetFinalizedCheckpoint, []byte{})
+		if err != nil {
+			continue
+		}
+		ss.checkpointReqs[peerID] = true
+		go func() {
+			reply, err := future.Wait()
+			ss.onCheckpoint(peerID, reply, err)
+		}()
+	}
+}
+
+// onCheckpoint makes a finalized checkpoint the pivot if it is signed by the validators and higher than the pivot
+func (ss *SnapshotService) onCheckpoint(peerID peer.ID, reply *net.Message, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.checkpointReqs, peerID)
+	if err != nil || ss.done || ss.block != nil {
+		return
+	}
+	checkpoints := make([]*core.SignedCheckpoint, 0)
+	if err := rlp.DecodeBytes(reply.Payload, &checkpoints); err != nil {
+		ss.streamPool.AdjustScore(peerID, net.ScoreInvalidMessage, fmt.Sprintf("snapshot: %v", err))
+		return
+	}
+	if len(checkpoints) == 0 {
+		return
+	}
+	if len(checkpoints) > 1 {
+		ss.streamPool.AdjustScore(peerID, net.ScoreInvalidData, errUnrequestedCheckpoint.Error())
+		return
+	}
+	signed := checkpoints[0]
+	if ss.pivot != (common.Hash{}) && signed.Height <= ss.height {
+		//the pivot is verified already
+		if signed.Hash == ss.pivot {
+			ss.pivotPeers[peerID] = true
+		}
+		return
+	}
+	validators, err := ss.bc.Validators(ss.bc.GenesisBlock)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Debug(fmt.Sprintf("%+v", err))
+		return
+	}
+	//not a fault of the peer if the validators changed since genesis, a trusted checkpoint is needed then
+	if err := core.VerifySignedCheckpoint(signed, validators); err != nil {
+		log.CLog().WithFields(logrus.Fields{
+			"ID":     peerID,
+			"Height": signed.Height,
+		}).Debug(fmt.Sprintf("%+v", err))
+		return
+	}
+	ss.pivot = signed.Hash
+	ss.height = signed.Height
+	ss.pivotPeers = map[peer.ID]bool{peerID: true}
+	ss.attempts = 0
+	ss.bc.SetTrustedCheckpoint(&core.Checkpoint{Height: signed.Height, Hash: signed.Hash})
+	log.CLog().WithFields(logrus.Fields{
+		"Height":     signed.Height,
+		"Hash":       common.HashToHex(signed.Hash),
+		"Signatures": len(signed.Signatures),
+	}).Info("Start snapshot sync")
+}
+
+/*
+peersWithPivot returns the peers which sent the pivot as their finalized checkpoint or lib, or a later lib.
+Any peer may have the trusted checkpoint until its height is known.
+*/
+func (ss *SnapshotService) peersWithPivot() []*net.PeerStream {
+	peers := make([]*net.PeerStream, 0)
+	for _, ps := range ss.streamPool.Peers() {
+		status := ps.RemoteStatus()
+		if ss.pivotPeers[ps.ID()] || (status != nil && (status.LibHash == ss.pivot || status.LibHeight >= ss.height)) {
+			peers = append(peers, ps)
+		}
+	}
+	return peers
+}
+
+func (ss *SnapshotService) requestBlock() {
+	if ss.blockReq != "" {
+		return
+	}
+	for _, ps := range ss.peersWithPivot() {
+		future, err := ss.request(ps, net.MsgGetCheckpointBlock, ss.pivot)
+		if err != nil {
+			continue
+		}
+		peerID := ps.ID()
+		ss.blockReq = peerID
+		go func() {
+			reply, err := future.Wait()
+			ss.onBlock(peerID, reply, err)
+		}()
+		return
+	}
+}
+
+func (ss *SnapshotService) onBlock(peerID peer.ID, reply *net.Message, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.blockReq = ""
+	if err != nil || ss.done || ss.block != nil {
+		return
+	}
+	blocks := make([]*core.BaseBlock, 0)
+	if err := rlp.DecodeBytes(reply.Payload, &blocks); err != nil {
+		ss.streamPool.AdjustScore(peerID, net.ScoreInvalidMessage, fmt.Sprintf("snapshot: %v", err))
+		return
+	}
+	if len(blocks) == 0 {
+		return
+	}
+	if len(blocks) > 1 {
+		ss.streamPool.AdjustScore(peerID, net.ScoreInvalidData, errUnrequestedBlock.Error())
+		return
+	}
+	block := blocks[0].NewBlock()
+	if err := ss.verifyBlock(block); err != nil {
+		ss.streamPool.AdjustScore(peerID, net.ScoreInvalidData, fmt.Sprintf("snapshot: %v", err))
+		return
+	}
+	ss.block = block
+	ss.height = block.Header.Height
+	ss.bc.SetTrustedCheckpoint(&core.Checkpoint{Height: block.Header.Height, Hash: block.Hash()})
+	ss.sync = trie.NewSync(ss.bc.Storage)
+	for _, root := range []common.Hash{block.Header.AccountHash, block.Header.TransactionHash, block.Header.ConsensusHash} {
+		if err := ss.sync.AddRoot(root[:]); err != nil {
+			log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+			return
+		}
+	}
+	log.CLog().WithFields(logrus.Fields{
+		"Height": block.Header.Height,
+	}).Info("Received snapshot block")
+	ss.progress()
+}
+
+func (ss *SnapshotService) verifyBlock(block *core.Block) error {
+	if block.Hash() != ss.pivot || (ss.height != 0 && block.Header.Height != ss.height) {
+		return errSnapshotBlock
+	}
+	if block.Hash() != block.CalcHash() {
+		return errors.New("block.Hash() != block.CalcHash()")
+	}
+	return block.VerifySign()
+}
+
+// requestNodes sends the missing nodes which are not in flight to the idle peers, mu must be held
+func (ss *SnapshotService) requestNodes() {
+	if ss.sync == nil {
+		return
+	}
+	peers := ss.peersWithPivot()
+	if len(peers) == 0 {
+		log.CLog().WithFields(logrus.Fields{}).Debug(errNoSnapshotPeers)
+		return
+	}
+	missing := make([][]byte, 0)
+	for _, hash := range ss.sync.Missing(ss.sync.Pending()) {
+		if _, ok := ss.inflight[string(hash)]; !ok {
+			missing = append(missing, hash)
+		}
+	}
+	for _, ps := range peers {
+		if len(missing) == 0 {
+			return
+		}
+		peerID := ps.ID()
+		if ss.busy[peerID] {
+			continue
+		}
+		n := maxTrieNodes
+		if n > len(missing) {
+			n = len(missing)
+		}
+		hashes := missing[:n]
+		future, err := ss.request(ps, net.MsgGetTrieNodes, hashes)
+		if err != nil {
+			continue
+		}
+		missing = missing[n:]
+		ss.busy[peerID] = true
+		for _, hash := range hashes {
+			ss.inflight[string(hash)] = peerID
+		}
+		go func() {
+			reply, err := future.Wait()
+			ss.onNodes(peerID, hashes, reply, err)
+		}()
+	}
+}
+
+// onNodes stores the nodes which were requested from the peer, the others are requested again
+func (ss *SnapshotService) onNodes(peerID peer.ID, requested [][]byte, reply *net.Message, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.busy, peerID)
+	wanted := make(map[string]bool, len(requested))
+	for _, hash := range requested {
+		delete(ss.inflight, string(hash))
+		wanted[string(hash)] = true
+	}
+	if err != nil || ss.sync == nil {
+		return
+	}
+	nodes := make([][]byte, 0)
+	if err := rlp.DecodeBytes(reply.Payload, &nodes); err != nil {
+		ss.streamPool.AdjustScore(peerID, net.ScoreInvalidMessage, fmt.Sprintf("snapshot: %v", err))
+		return
+	}
+	for _, encodedBytes := range nodes {
+		hash := crypto.Sha3b256(encodedBytes)
+		if !wanted[string(hash)] {
+			ss.streamPool.AdjustScore(peerID, net.ScoreInvalidData, errUnrequestedNode.Error())
+			return
+		}
+		delete(wanted, string(hash))
+		if err := ss.sync.Process(encodedBytes); err != nil && err != trie.ErrUnrequestedNode {
+			ss.streamPool.AdjustScore(peerID, net.ScoreInvalidData, fmt.Sprintf("snapshot: %v", err))
+			return
+		}
+	}
+	ss.progress()
+}
+
+/*
+progress adds the tries referred from the consensus trie once it is synced,
+and resets the chain to the pivot when nothing is missing, mu must be held.
+*/
+func (ss *SnapshotService) progress() {
+	if ss.sync.Pending() > 0 {
+		ss.requestNodes()
+		return
+	}
+	if len(ss.inflight) > 0 {
+		return
+	}
+	if !ss.stateTriesAdded {
+		ss.stateTriesAdded = true
+		if stateTrieRoots, ok := ss.bc.Consensus.(core.StateTrieRoots); ok {
+			roots, err := stateTrieRoots.StateTrieRoots(ss.block)
+			if err != nil {
+				log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+				return
+			}
+			for _, root := range roots {
+				if err := ss.sync.AddRoot(root[:]); err != nil {
+					log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+					return
+				}
+			}
+		}
+		ss.progress()
+		return
+	}
+	block := ss.block
+	ss.sync = nil
+	if err := ss.bc.ResetWithCheckpointBlock(block); err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	ss.done = true
+	log.CLog().WithFields(logrus.Fields{
+		"Height": block.Header.Height,
+	}).Info("Finish snapshot sync")
+}
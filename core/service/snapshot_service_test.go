@@ -0,0 +1,70 @@
+package service
+
+import (
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+func checkpointMessage(t *testing.T, block *core.Block, signer string) *net.Message {
+	signed := &core.SignedCheckpoint{Checkpoint: core.Checkpoint{Height: block.Header.Height, Hash: block.Hash()}}
+	sig, err := crypto.Sign(signed.SigHash(), crypto.ByteToPrivateKey(common.FromHex(tests.Keystore[signer])))
+	assert.NoError(t, err)
+	var signature common.Signature
+	copy(signature[:], sig)
+	signed.Signatures = append(signed.Signatures, signature)
+	msg, err := net.NewRLPMessage(net.MsgFinalizedCheckpoint, []*core.SignedCheckpoint{signed})
+	assert.NoError(t, err)
+	return &msg
+}
+
+func blockMessage(t *testing.T, block *core.Block) *net.Message {
+	msg, err := net.NewRLPMessage(net.MsgCheckpointBlockAck, []*core.BaseBlock{&block.BaseBlock})
+	assert.NoError(t, err)
+	return &msg
+}
+
+func TestSnapshotPivot(t *testing.T) {
+	remote := newTestNode(t)
+	blocks := remote.mine(t, 2)
+	local := newTestNode(t)
+	ss := NewSnapshotService(local.bc, local.pool)
+	ss.Enable()
+	assert.True(t, local.bc.IsCheckpointSyncing())
+
+	//the status of peers is not trusted, the checkpoint must be signed by the validators of genesis
+	ss.onCheckpoint(peer.ID("other"), checkpointMessage(t, blocks[1], tests.AddressHex1), nil)
+	assert.Equal(t, common.Hash{}, ss.pivot)
+	assert.False(t, local.pool.IsBanned(peer.ID("other")))
+
+	ss.onCheckpoint(peer.ID("a"), checkpointMessage(t, blocks[0], tests.AddressHex0), nil)
+	assert.Equal(t, blocks[0].Hash(), ss.pivot)
+
+	//a higher checkpoint replaces the pivot, the peers sending the same one have the pivot
+	ss.onCheckpoint(peer.ID("b"), checkpointMessage(t, blocks[1], tests.AddressHex0), nil)
+	ss.onCheckpoint(peer.ID("c"), checkpointMessage(t, blocks[1], tests.AddressHex0), nil)
+	ss.onCheckpoint(peer.ID("a"), checkpointMessage(t, blocks[0], tests.AddressHex0), nil)
+	assert.Equal(t, blocks[1].Hash(), ss.pivot)
+	assert.Equal(t, map[peer.ID]bool{peer.ID("b"): true, peer.ID("c"): true}, ss.pivotPeers)
+
+	//the block must be the pivot
+	ss.onBlock(peer.ID("a"), blockMessage(t, blocks[0]), nil)
+	assert.True(t, local.pool.IsBanned(peer.ID("a")))
+	assert.Nil(t, ss.block)
+	ss.onBlock(peer.ID("b"), blockMessage(t, blocks[1]), nil)
+	assert.NotNil(t, ss.block)
+	assert.Equal(t, &core.Checkpoint{Height: blocks[1].Header.Height, Hash: blocks[1].Hash()}, local.bc.Checkpoint())
+
+	//full sync starts when no peer has the pivot
+	for i := 1; i < maxPivotAttempts; i++ {
+		assert.False(t, ss.synchronise())
+	}
+	assert.True(t, ss.synchronise())
+	assert.False(t, local.bc.IsCheckpointSyncing())
+}
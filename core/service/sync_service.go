@@ -0,0 +1,563 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/nacamp/go-simplechain/trie"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxSyncHeaders     = 128
+	maxSyncBodies      = 16
+	maxSyncQueue       = 1024
+	maxSyncRetries     = 3
+	syncRequestTimeout = 5 * time.Second
+	syncSkipTime       = 5 * time.Minute
+)
+
+// SyncProgress is reported by syncing rpc
+type SyncProgress struct {
+	StartingHeight uint64
+	CurrentHeight  uint64
+	HighestHeight  uint64
+}
+
+// HeaderRange is the payload of MsgGetBlockHeaders
+type HeaderRange struct {
+	Start uint64
+	Count uint64
+}
+
+// BlockBody is the transactions of the block which has Hash
+type BlockBody struct {
+	Hash         common.Hash
+	Transactions []*core.Transaction
+}
+
+var errSyncFork = errors.New("headers are not linked to the tail")
+
+type syncRequest struct {
+	peerID peer.ID
+	start  uint64
+}
+
+/*
+SyncService catches up with the peer which has the highest tail.
+Headers are downloaded from that peer first and verified as a chain,
+then bodies are downloaded from several peers in parallel and imported in order.
+A peer which returns invalid headers or bodies is dropped.
+A peer whose headers fail verification on import is penalized and not synced from for syncSkipTime.
+*/
+type SyncService struct {
+	mu                   sync.Mutex
+	bc                   *core.BlockChain
+	streamPool           *net.PeerStreamPool
+	clock                common.Clock
+	progress             *SyncProgress
+	from                 uint64
+	headers              []*core.Header
+	headerReq            *syncRequest
+	headerPeers          map[common.Hash]peer.ID
+	skipped              map[peer.ID]time.Time
+	bodies               map[common.Hash]*BlockBody
+	bodyPeers            map[common.Hash]peer.ID
+	bodyReqs             map[common.Hash]*syncRequest
+	retries              map[common.Hash]int
+	MsgGetBlockHeadersCh chan interface{}
+	MsgGetBlockBodiesCh  chan interface{}
+}
+
+func NewSyncService(bc *core.BlockChain, streamPool *net.PeerStreamPool) *SyncService {
+	ss := SyncService{
+		streamPool: streamPool,
+		clock:      common.SystemClock{},
+		bc:         bc,
+		skipped:    make(map[peer.ID]time.Time),
+	}
+	ss.reset()
+	ss.MsgGetBlockHeadersCh = make(chan interface{}, 1)
+	ss.MsgGetBlockBodiesCh = make(chan interface{}, 1)
+	return &ss
+}
+
+// SetClock replaces the wall clock which drives the sync loop, call it before Start
+func (ss *SyncService) SetClock(clock common.Clock) {
+	ss.clock = clock
+}
+
+func (ss *SyncService) Register(peerStream *net.PeerStream) {
+	peerStream.Register(net.MsgGetBlockHeaders, ss.MsgGetBlockHeadersCh)
+	peerStream.Register(net.MsgGetBlockBodies, ss.MsgGetBlockBodiesCh)
+}
+
+func (ss *SyncService) StartHandler() {
+	go ss.onHandle()
+}
+
+func (ss *SyncService) Start() {
+	go ss.loop()
+}
+
+// Progress returns nil when the chain is not behind peers
+func (ss *SyncService) Progress() *SyncProgress {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.progress == nil {
+		return nil
+	}
+	progress := *ss.progress
+	return &progress
+}
+
+func (ss *SyncService) loop() {
+	ticker := ss.clock.NewTicker(1 * time.Second)
+	for {
+		select {
+		case <-ticker.C():
+			ss.synchronise()
+		}
+	}
+}
+
+func (ss *SyncService) onHandle() {
+	bc := ss.bc
+	for {
+		select {
+		case ch := <-ss.MsgGetBlockHeadersCh:
+			msg := ch.(*net.Message)
+			headerRange := HeaderRange{}
+			if err := rlp.DecodeBytes(msg.Payload, &headerRange); err != nil {
+				log.CLog().WithFields(logrus.Fields{"Code": msg.Code}).Warning(fmt.Sprintf("%+v", err))
+				continue
+			}
+			if headerRange.Count > maxSyncHeaders {
+				headerRange.Count = maxSyncHeaders
+			}
+			headers := make([]*core.Header, 0, headerRange.Count)
+			for i := headerRange.Start; i < headerRange.Start+headerRange.Count; i++ {
+				block := bc.GetBlockByHeight(i)
+				if block == nil {
+					break
+				}
+				headers = append(headers, block.Header)
+			}
+			ss.reply(msg, net.MsgBlockHeaders, headers)
+		case ch := <-ss.MsgGetBlockBodiesCh:
+			msg := ch.(*net.Message)
+			hashes := make([]common.Hash, 0)
+			if err := rlp.DecodeBytes(msg.Payload, &hashes); err != nil {
+				log.CLog().WithFields(logrus.Fields{"Code": msg.Code}).Warning(fmt.Sprintf("%+v", err))
+				continue
+			}
+			if len(hashes) > maxSyncBodies {
+				hashes = hashes[:maxSyncBodies]
+			}
+			bodies := make([]*BlockBody, 0, len(hashes))
+			for _, hash := range hashes {
+				if block := bc.GetBlockByHash(hash); block != nil {
+					bodies = append(bodies, &BlockBody{Hash: hash, Transactions: block.Transactions})
+				}
+			}
+			ss.reply(msg, net.MsgBlockBodies, bodies)
+		}
+	}
+}
+
+func (ss *SyncService) reply(request *net.Message, code uint64, payload interface{}) {
+	ps, err := ss.streamPool.GetStream(request.PeerID)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	if err := ps.Reply(request, code, payload); err != nil {
+		log.CLog().WithFields(logrus.Fields{"Code": code}).Warning(fmt.Sprintf("%+v", err))
+	}
+}
+
+func (ss *SyncService) request(ps *net.PeerStream, code uint64, payload interface{}) (*net.Future, error) {
+	message, err := net.NewRLPMessage(code, payload)
+	if err != nil {
+		return nil, err
+	}
+	return ps.Request(&message, syncRequestTimeout)
+}
+
+func (ss *SyncService) reset() {
+	ss.from = 0
+	ss.headers = make([]*core.Header, 0)
+	ss.headerReq = nil
+	ss.headerPeers = make(map[common.Hash]peer.ID)
+	ss.bodies = make(map[common.Hash]*BlockBody)
+	ss.bodyPeers = make(map[common.Hash]peer.ID)
+	ss.bodyReqs = make(map[common.Hash]*syncRequest)
+	ss.retries = make(map[common.Hash]int)
+}
+
+// dropPeer disconnects the peer which sent invalid data and reschedules its requests, mu must be held
+func (ss *SyncService) dropPeer(peerID peer.ID, err error) {
+	ss.streamPool.AdjustScore(peerID, net.ScoreInvalidData, fmt.Sprintf("sync: %v", err))
+	if ps, err := ss.streamPool.GetStream(peerID); err == nil {
+		ps.Close()
+	}
+	ss.releasePeer(peerID)
+}
+
+// skipPeer penalizes the peer which sent headers failing verification and does not sync from it for a while, mu must be held
+func (ss *SyncService) skipPeer(peerID peer.ID, err error) {
+	ss.streamPool.AdjustScore(peerID, net.ScoreInvalidBlock, fmt.Sprintf("sync: %v", err))
+	ss.skipped[peerID] = ss.clock.Now().Add(syncSkipTime)
+	ss.releasePeer(peerID)
+}
+
+// isSkipped reports whether the peer is skipped, mu must be held
+func (ss *SyncService) isSkipped(peerID peer.ID) bool {
+	until, ok := ss.skipped[peerID]
+	if ok && !ss.clock.Now().Before(until) {
+		delete(ss.skipped, peerID)
+		return false
+	}
+	return ok
+}
+
+func (ss *SyncService) releasePeer(peerID peer.ID) {
+	if ss.headerReq != nil && ss.headerReq.peerID == peerID {
+		ss.headerReq = nil
+	}
+	for hash, req := range ss.bodyReqs {
+		if req.peerID == peerID {
+			delete(ss.bodyReqs, hash)
+		}
+	}
+}
+
+// synchronise is called periodically, it starts or finishes sync and sends requests
+func (ss *SyncService) synchronise() {
+	if ss.bc.IsCheckpointSyncing() {
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	peers := make([]*net.PeerStream, 0)
+	for _, ps := range ss.streamPool.Peers() {
+		if !ss.isSkipped(ps.ID()) {
+			peers = append(peers, ps)
+		}
+	}
+	var best *net.PeerStream
+	highest := uint64(0)
+	for _, ps := range peers {
+		if status := ps.RemoteStatus(); status != nil && status.TailHeight > highest {
+			best = ps
+			highest = status.TailHeight
+		}
+	}
+
+	current := ss.bc.Tail().Header.Height
+	if ss.progress == nil {
+		if best == nil || highest <= current {
+			return
+		}
+		ss.progress = &SyncProgress{StartingHeight: current, HighestHeight: highest}
+		log.CLog().WithFields(logrus.Fields{
+			"Current": current,
+			"Highest": highest,
+		}).Info("Start sync")
+	}
+	ss.progress.CurrentHeight = current
+	if highest > ss.progress.HighestHeight {
+		ss.progress.HighestHeight = highest
+	}
+	if current >= highest && len(ss.headers) == 0 && ss.headerReq == nil {
+		log.CLog().WithFields(logrus.Fields{
+			"Current": current,
+		}).Info("Finish sync")
+		ss.progress = nil
+		ss.reset()
+		return
+	}
+
+	ss.requestHeaders(best)
+	ss.requestBodies(peers)
+}
+
+// requestHeaders requests the headers after the queued ones from the best peer
+func (ss *SyncService) requestHeaders(best *net.PeerStream) {
+	if ss.headerReq != nil || best == nil || len(ss.headers) >= maxSyncQueue {
+		return
+	}
+	start := ss.bc.Tail().Header.Height + 1
+	if n := len(ss.headers); n > 0 {
+		start = ss.headers[n-1].Height + 1
+	} else if ss.from > 0 {
+		start = ss.from
+	}
+	highest := best.RemoteStatus().TailHeight
+	if start > highest {
+		return
+	}
+	count := highest - start + 1
+	if count > maxSyncHeaders {
+		count = maxSyncHeaders
+	}
+	future, err := ss.request(best, net.MsgGetBlockHeaders, HeaderRange{Start: start, Count: count})
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+		return
+	}
+	req := &syncRequest{peerID: best.ID(), start: start}
+	ss.headerReq = req
+	go func() {
+		reply, err := future.Wait()
+		ss.onHeaders(req, reply, err)
+	}()
+}
+
+// requestBodies assigns the bodies not requested yet to idle peers which have them
+func (ss *SyncService) requestBodies(peers []*net.PeerStream) {
+	busy := make(map[peer.ID]bool)
+	for _, req := range ss.bodyReqs {
+		busy[req.peerID] = true
+	}
+	idlePeer := func(height uint64) *net.PeerStream {
+		for _, ps := range peers {
+			if status := ps.RemoteStatus(); !busy[ps.ID()] && status != nil && status.TailHeight >= height {
+				busy[ps.ID()] = true
+				return ps
+			}
+		}
+		return nil
+	}
+
+	var ps *net.PeerStream
+	var req *syncRequest
+	batch := make([]common.Hash, 0, maxSyncBodies)
+	send := func() {
+		if ps == nil || len(batch) == 0 {
+			return
+		}
+		future, err := ss.request(ps, net.MsgGetBlockBodies, batch)
+		if err != nil {
+			log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+			ss.releasePeer(ps.ID())
+		} else {
+			req := req
+			go func() {
+				reply, err := future.Wait()
+				ss.onBodies(req, reply, err)
+			}()
+		}
+		batch = make([]common.Hash, 0, maxSyncBodies)
+	}
+	for _, header := range ss.headers {
+		if _, ok := ss.bodies[header.Hash]; ok {
+			continue
+		}
+		if _, ok := ss.bodyReqs[header.Hash]; ok {
+			continue
+		}
+		if ps == nil || len(batch) >= maxSyncBodies || ps.RemoteStatus().TailHeight < header.Height {
+			send()
+			if ps = idlePeer(header.Height); ps == nil {
+				break
+			}
+			req = &syncRequest{peerID: ps.ID()}
+		}
+		batch = append(batch, header.Hash)
+		ss.bodyReqs[header.Hash] = req
+	}
+	send()
+}
+
+func (ss *SyncService) onHeaders(req *syncRequest, reply *net.Message, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.headerReq != req {
+		return
+	}
+	ss.headerReq = nil
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{
+			"ID":  req.peerID,
+			"Msg": err,
+		}).Info("Headers request failed")
+		return
+	}
+	headers := make([]*core.Header, 0)
+	if err := rlp.DecodeBytes(reply.Payload, &headers); err != nil {
+		ss.dropPeer(req.peerID, err)
+		return
+	}
+	if err := ss.verifyHeaders(req.start, headers); err == errSyncFork {
+		ss.from = ss.bc.Lib().Header.Height + 1
+		return
+	} else if err != nil {
+		ss.dropPeer(req.peerID, err)
+		return
+	}
+	for _, header := range headers {
+		if ss.bc.GetBlockByHash(header.Hash) == nil {
+			ss.headers = append(ss.headers, header)
+			ss.headerPeers[header.Hash] = req.peerID
+		}
+	}
+	ss.from = 0
+	ss.requestBodies(ss.streamPool.Peers())
+}
+
+/*
+verifyHeaders checks that headers are linked from start and signed.
+If the first header is not linked to the local chain, the tail is on a fork,
+so headers are requested again from the lib.
+*/
+func (ss *SyncService) verifyHeaders(start uint64, headers []*core.Header) error {
+	if len(headers) == 0 {
+		return errors.New("empty headers")
+	}
+	var parentHash common.Hash
+	if n := len(ss.headers); n > 0 {
+		parentHash = ss.headers[n-1].Hash
+	}
+	for i, header := range headers {
+		if header.Height != start+uint64(i) {
+			return errors.New("header.Height is not sequential")
+		}
+		block := (&core.BaseBlock{Header: header}).NewBlock()
+		if block.Hash() != block.CalcHash() {
+			return errors.New("block.Hash() != block.CalcHash()")
+		}
+		if err := block.VerifySign(); err != nil {
+			return err
+		}
+		if i > 0 || parentHash != (common.Hash{}) {
+			if header.ParentHash != parentHash {
+				return errors.New("header.ParentHash is not linked")
+			}
+		} else if ss.bc.GetBlockByHash(header.ParentHash) == nil {
+			if start > ss.bc.Lib().Header.Height+1 {
+				return errSyncFork
+			}
+			return errors.New("headers are not linked to the lib")
+		}
+		parentHash = header.Hash
+	}
+	return nil
+}
+
+/*
+onBodies stores the bodies of req and imports blocks.
+Bodies not returned are requested again to another peer, up to maxSyncRetries times.
+*/
+func (ss *SyncService) onBodies(req *syncRequest, reply *net.Message, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{
+			"ID":  req.peerID,
+			"Msg": err,
+		}).Info("Bodies request failed")
+	} else {
+		bodies := make([]*BlockBody, 0)
+		if err := rlp.DecodeBytes(reply.Payload, &bodies); err != nil {
+			ss.dropPeer(req.peerID, err)
+			return
+		}
+		for _, body := range bodies {
+			if ss.bodyReqs[body.Hash] != req {
+				continue
+			}
+			delete(ss.bodyReqs, body.Hash)
+			ss.bodies[body.Hash] = body
+			ss.bodyPeers[body.Hash] = req.peerID
+		}
+	}
+	for hash, r := range ss.bodyReqs {
+		if r != req {
+			continue
+		}
+		delete(ss.bodyReqs, hash)
+		ss.retries[hash]++
+		if ss.retries[hash] > maxSyncRetries {
+			log.CLog().WithFields(logrus.Fields{
+				"Hash": common.HashToHex(hash),
+			}).Warning("No peer returns block body, restart sync")
+			ss.reset()
+			return
+		}
+	}
+	ss.importBlocks()
+	ss.requestBodies(ss.streamPool.Peers())
+}
+
+// importBlocks imports blocks in order while the next body is downloaded
+func (ss *SyncService) importBlocks() {
+	bc := ss.bc
+	for len(ss.headers) > 0 {
+		header := ss.headers[0]
+		body, ok := ss.bodies[header.Hash]
+		if !ok {
+			return
+		}
+		peerID := ss.bodyPeers[header.Hash]
+		headerPeerID := ss.headerPeers[header.Hash]
+		ss.headers = ss.headers[1:]
+		delete(ss.bodies, header.Hash)
+		delete(ss.bodyPeers, header.Hash)
+		delete(ss.headerPeers, header.Hash)
+		delete(ss.retries, header.Hash)
+		if bc.GetBlockByHash(header.Hash) != nil {
+			continue
+		}
+		block := (&core.BaseBlock{Header: header, Transactions: body.Transactions}).NewBlock()
+		err := bc.VerifyBody(block)
+		if err == nil {
+			err = bc.PutBlockIfParentExist(block)
+		}
+		if err != nil {
+			//a wrong body is the fault of the body peer, a header failing verification is the fault of the header peer
+			ss.reset()
+			if errors.Cause(err) == core.ErrInvalidBody {
+				ss.dropPeer(peerID, err)
+				return
+			}
+			if !isLocalError(err) && bc.HasParentInBlockChain(block) {
+				log.CLog().WithFields(logrus.Fields{
+					"ID":     headerPeerID,
+					"Height": header.Height,
+					"Msg":    err,
+				}).Warning("Invalid header, skip the peer")
+				ss.skipPeer(headerPeerID, err)
+				return
+			}
+			log.CLog().WithFields(logrus.Fields{
+				"Height": header.Height,
+				"Msg":    err,
+			}).Warning("Import failed, restart sync")
+			return
+		}
+		bc.Consensus.UpdateLIB()
+		if ss.progress != nil {
+			ss.progress.CurrentHeight = header.Height
+		}
+	}
+}
+
+// isLocalError reports whether err is caused by the local chain or storage, not by the block of a peer
+func isLocalError(err error) bool {
+	switch errors.Cause(err) {
+	case core.ErrCheckpointSyncing, core.ErrUnknownConsensus, core.ErrForkIncompatible, storage.ErrKeyNotFound, trie.ErrNotFound:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/pkg/errors"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/cmd"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/consensus/poa"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/nacamp/go-simplechain/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNode is a poa node whose only signer is tests.Address0, it mines a block every period
+type testNode struct {
+	bc     *core.BlockChain
+	cs     *poa.Poa
+	pool   *net.PeerStreamPool
+	sync   *SyncService
+	host   *net.Node
+	addr   string
+	period uint64
+}
+
+func newTestNode(t *testing.T) *testNode {
+	config := tests.NewConfig(0)
+	db, _ := storage.NewMemoryStorage()
+	pool := net.NewPeerStreamPool()
+	cs := poa.NewPoa(pool, config.Consensus.Period)
+	cs.SetupMining(tests.Address0, nil)
+	bc := core.NewBlockChain(db, common.HexToAddress(config.Coinbase), uint64(config.MiningReward))
+	bc.Setup(cs, cmd.MakeVoterAccountsFromConfig(config)[:1])
+
+	node := &testNode{bc: bc, cs: cs, pool: pool, sync: NewSyncService(bc, pool), period: config.Consensus.Period}
+	pool.AddHandler(node.sync)
+	return node
+}
+
+// start connects the node to the memory network, the node dials seeds
+func (node *testNode) start(t *testing.T, network *net.MemoryNetwork, index int, seeds ...string) {
+	privKey, _, err := crypto.GenerateKeyPairWithReader(crypto.Secp256k1, 256, rand.New(rand.NewSource(int64(index))))
+	assert.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(privKey)
+	assert.NoError(t, err)
+	addr := fmt.Sprintf("/ip4/10.0.0.%d/tcp/9991", index+1)
+	maddr, _ := ma.NewMultiaddr(addr)
+	node.addr = fmt.Sprintf("%s/ipfs/%s", addr, id.Pretty())
+
+	node.host = net.NewNode(0, privKey, node.pool)
+	node.host.SetTransport(network.NewTransport(id, maddr))
+	node.host.Setup(common.HashToHex(node.bc.GenesisBlock.Hash()))
+	node.host.SetStatusFunc(func() *net.Status {
+		tail := node.bc.Tail()
+		return &net.Status{
+			Version:     net.ProtocolVersion,
+			GenesisHash: node.bc.GenesisBlock.Hash(),
+			TailHeight:  tail.Header.Height,
+			TailHash:    tail.Hash(),
+		}
+	})
+	node.host.Start(seeds)
+}
+
+// mine makes n blocks, txs are included in the first block
+func (node *testNode) mine(t *testing.T, n int, txs ...*core.Transaction) []*core.Block {
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), common.FromHex(tests.Keystore[tests.AddressHex0]))
+	for _, tx := range txs {
+		node.bc.TxPool.Put(tx)
+	}
+	blocks := make([]*core.Block, 0, n)
+	for i := 0; i < n; i++ {
+		tail := node.bc.Tail()
+		block := node.cs.MakeBlock(tail.Header.Time + node.period)
+		assert.NotNil(t, block)
+		assert.NoError(t, block.Sign((*ecdsa.PrivateKey)(priv)))
+		node.bc.PutBlockByCoinbase(block)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func bodiesMessage(t *testing.T, bodies ...*BlockBody) *net.Message {
+	msg, err := net.NewRLPMessage(net.MsgBlockBodies, bodies)
+	assert.NoError(t, err)
+	return &msg
+}
+
+func TestSyncService(t *testing.T) {
+	remote := newTestNode(t)
+	//more blocks than maxSyncBodies, bodies are requested in batches
+	remote.mine(t, maxSyncBodies+4, tests.MakeTransaction(tests.AddressHex0, tests.AddressHex2, new(big.Int).SetUint64(10), 1))
+	local := newTestNode(t)
+
+	network := net.NewMemoryNetwork(common.NewVirtualClock(time.Unix(0, 0)), 1)
+	remote.start(t, network, 0)
+	local.start(t, network, 1, remote.addr)
+	assert.True(t, waitFor(func() bool { return len(local.pool.Peers()) == 1 && len(remote.pool.Peers()) == 1 }))
+
+	tail := remote.bc.Tail()
+	assert.True(t, waitFor(func() bool {
+		local.sync.synchronise()
+		return local.bc.Tail().Hash() == tail.Hash()
+	}))
+	progress := local.sync.Progress()
+	assert.NotNil(t, progress)
+	assert.Equal(t, uint64(0), progress.StartingHeight)
+	assert.Equal(t, tail.Header.Height, progress.HighestHeight)
+
+	//sync finishes when the chain is not behind peers
+	local.sync.synchronise()
+	assert.Nil(t, local.sync.Progress())
+	balance := local.bc.Tail().AccountState.GetAccount(tests.Address2).Balance
+	assert.Equal(t, new(big.Int).SetUint64(10), balance)
+}
+
+func TestSyncServiceRetry(t *testing.T) {
+	remote := newTestNode(t)
+	blocks := remote.mine(t, 3)
+	local := newTestNode(t)
+	ss := local.sync
+	peerID := peer.ID("peer")
+
+	schedule := func() *syncRequest {
+		req := &syncRequest{peerID: peerID}
+		for _, header := range ss.headers {
+			if _, ok := ss.bodies[header.Hash]; !ok {
+				ss.bodyReqs[header.Hash] = req
+			}
+		}
+		return req
+	}
+	for _, block := range blocks {
+		ss.headers = append(ss.headers, block.Header)
+	}
+
+	//the first body is imported, the others are requested again
+	req := schedule()
+	ss.onBodies(req, bodiesMessage(t, &BlockBody{Hash: blocks[0].Hash(), Transactions: blocks[0].Transactions}), nil)
+	assert.Equal(t, blocks[0].Hash(), local.bc.Tail().Hash())
+	assert.Equal(t, 2, len(ss.headers))
+	assert.Equal(t, 0, len(ss.bodyReqs))
+	assert.Equal(t, 1, ss.retries[blocks[1].Hash()])
+
+	//a body which is not requested is ignored
+	req = schedule()
+	ss.onBodies(&syncRequest{peerID: peerID}, bodiesMessage(t, &BlockBody{Hash: blocks[1].Hash(), Transactions: blocks[1].Transactions}), nil)
+	assert.Equal(t, 0, len(ss.bodies))
+	assert.Equal(t, 2, len(ss.bodyReqs))
+
+	//sync restarts when no peer returns the body
+	for i := 1; i < maxSyncRetries; i++ {
+		ss.onBodies(req, nil, errors.New("timeout"))
+		assert.Equal(t, 2, len(ss.headers))
+		req = schedule()
+	}
+	ss.onBodies(req, nil, errors.New("timeout"))
+	assert.Equal(t, 0, len(ss.headers))
+	assert.Equal(t, 0, len(ss.retries))
+	assert.False(t, local.pool.IsBanned(peerID))
+}
+
+func TestSyncServiceDropPeer(t *testing.T) {
+	remote := newTestNode(t)
+	blocks := remote.mine(t, 2, tests.MakeTransaction(tests.AddressHex0, tests.AddressHex2, new(big.Int).SetUint64(10), 1))
+	local := newTestNode(t)
+	ss := local.sync
+
+	//invalid headers
+	req := &syncRequest{peerID: peer.ID("headers"), start: 1}
+	ss.headerReq = req
+	msg, _ := net.NewRLPMessage(net.MsgBlockHeaders, "headers")
+	ss.onHeaders(req, &msg, nil)
+	assert.True(t, local.pool.IsBanned(req.peerID))
+
+	//a body which does not match the header
+	ss.headers = append(ss.headers, blocks[0].Header)
+	ss.bodies[blocks[0].Hash()] = &BlockBody{Hash: blocks[0].Hash(), Transactions: []*core.Transaction{}}
+	ss.bodyPeers[blocks[0].Hash()] = peer.ID("body")
+	ss.importBlocks()
+	assert.True(t, local.pool.IsBanned(peer.ID("body")))
+	assert.Equal(t, local.bc.GenesisBlock.Hash(), local.bc.Tail().Hash())
+
+	//the parent is not in the local chain, it is not the fault of the peer
+	ss.headers = append(ss.headers, blocks[1].Header)
+	ss.bodies[blocks[1].Hash()] = &BlockBody{Hash: blocks[1].Hash(), Transactions: blocks[1].Transactions}
+	ss.bodyPeers[blocks[1].Hash()] = peer.ID("parent")
+	ss.importBlocks()
+	assert.False(t, local.pool.IsBanned(peer.ID("parent")))
+	assert.Equal(t, 0, len(ss.headers))
+}
+
+// forgeBlock returns block signed by its coinbase, which is not a signer of the chain
+func forgeBlock(t *testing.T, block *core.Block) *core.Block {
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), common.FromHex(tests.Keystore[tests.AddressHex1]))
+	header := *block.Header
+	header.Coinbase = tests.Address1
+	forged := (&core.BaseBlock{Header: &header, Transactions: block.Transactions}).NewBlock()
+	forged.MakeHash()
+	assert.NoError(t, forged.Sign((*ecdsa.PrivateKey)(priv)))
+	return forged
+}
+
+func TestSyncServiceBadHeaders(t *testing.T) {
+	remote := newTestNode(t)
+	blocks := remote.mine(t, 1)
+	local := newTestNode(t)
+	ss := local.sync
+	clock := common.NewVirtualClock(time.Unix(0, 0))
+	ss.SetClock(clock)
+
+	bad := forgeBlock(t, blocks[0])
+	serve := func() {
+		ss.headers = append(ss.headers, bad.Header)
+		ss.headerPeers[bad.Hash()] = peer.ID("headers")
+		ss.bodies[bad.Hash()] = &BlockBody{Hash: bad.Hash(), Transactions: blocks[0].Transactions}
+		ss.bodyPeers[bad.Hash()] = peer.ID("body")
+		ss.importBlocks()
+	}
+
+	//the header peer is penalized and skipped, the body matches the header
+	serve()
+	assert.Equal(t, local.bc.GenesisBlock.Hash(), local.bc.Tail().Hash())
+	assert.True(t, ss.isSkipped(peer.ID("headers")))
+	assert.False(t, local.pool.IsBanned(peer.ID("headers")))
+	assert.False(t, local.pool.IsBanned(peer.ID("body")))
+
+	serve()
+	assert.True(t, local.pool.IsBanned(peer.ID("headers")))
+	assert.False(t, local.pool.IsBanned(peer.ID("body")))
+
+	clock.Advance(syncSkipTime)
+	assert.False(t, ss.isSkipped(peer.ID("headers")))
+}
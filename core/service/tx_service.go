@@ -0,0 +1,253 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxTxAnnounce      = 256
+	maxPooledTxsSize   = 2 * 1024 * 1024
+	maxFetchingTxs     = 32768
+	txAnnounceInterval = 100 * time.Millisecond
+	txRequestTimeout   = 5 * time.Second
+)
+
+var errUnrequestedTx = errors.New("transaction was not requested")
+
+/*
+TxService gossips transactions in batches.
+The hashes of new transactions are collected and announced every txAnnounceInterval,
+a peer requests the transactions it does not have by MsgGetPooledTxs and
+they are sent back at once by MsgPooledTxs.
+*/
+type TxService struct {
+	mu                     sync.Mutex
+	bc                     *core.BlockChain
+	streamPool             *net.PeerStreamPool
+	clock                  common.Clock
+	pending                []common.Hash
+	fetching               *lru.Cache
+	MsgNewPooledTxHashesCh chan interface{}
+	MsgGetPooledTxsCh      chan interface{}
+}
+
+func NewTxService(bc *core.BlockChain, streamPool *net.PeerStreamPool) *TxService {
+	ts := TxService{
+		bc:         bc,
+		clock:      common.SystemClock{},
+		streamPool: streamPool,
+		pending:    make([]common.Hash, 0),
+	}
+	ts.fetching, _ = lru.New(maxFetchingTxs)
+	ts.MsgNewPooledTxHashesCh = make(chan interface{}, 1)
+	ts.MsgGetPooledTxsCh = make(chan interface{}, 1)
+	return &ts
+}
+
+// SetClock replaces the wall clock which drives the announcements, call it before Start
+func (ts *TxService) SetClock(clock common.Clock) {
+	ts.clock = clock
+}
+
+func (ts *TxService) Register(peerStream *net.PeerStream) {
+	peerStream.Register(net.MsgNewPooledTxHashes, ts.MsgNewPooledTxHashesCh)
+	peerStream.Register(net.MsgGetPooledTxs, ts.MsgGetPooledTxsCh)
+}
+
+func (ts *TxService) StartHandler() {
+	go ts.onHandle()
+}
+
+func (ts *TxService) Start() {
+	go ts.loop()
+}
+
+func (ts *TxService) loop() {
+	ticker := ts.clock.NewTicker(txAnnounceInterval)
+	for {
+		select {
+		case tx := <-ts.bc.NewTXMessage:
+			ts.addPending(tx.Hash)
+		case <-ticker.C():
+			ts.announce()
+		}
+	}
+}
+
+func (ts *TxService) onHandle() {
+	for {
+		select {
+		case ch := <-ts.MsgNewPooledTxHashesCh:
+			ts.onTxHashes(ch.(*net.Message))
+		case ch := <-ts.MsgGetPooledTxsCh:
+			msg := ch.(*net.Message)
+			hashes := make([]common.Hash, 0)
+			if err := rlp.DecodeBytes(msg.Payload, &hashes); err != nil {
+				ts.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("get pooled txs: %v", err))
+				continue
+			}
+			txs := ts.pooledTxs(hashes)
+			ps, err := ts.streamPool.GetStream(msg.PeerID)
+			if err != nil {
+				continue
+			}
+			for _, tx := range txs {
+				ps.MarkTx(tx.Hash)
+			}
+			if err := ps.Reply(msg, net.MsgPooledTxs, txs); err != nil {
+				log.CLog().WithFields(logrus.Fields{"Code": net.MsgPooledTxs}).Warning(fmt.Sprintf("%+v", err))
+			}
+		}
+	}
+}
+
+// pooledTxs returns the requested transactions in the pool, up to maxTxAnnounce transactions and maxPooledTxsSize bytes
+func (ts *TxService) pooledTxs(hashes []common.Hash) []*core.Transaction {
+	if len(hashes) > maxTxAnnounce {
+		hashes = hashes[:maxTxAnnounce]
+	}
+	txs := make([]*core.Transaction, 0, len(hashes))
+	size := 0
+	for _, hash := range hashes {
+		tx := ts.bc.TxPool.Get(hash)
+		if tx == nil {
+			continue
+		}
+		encodedBytes, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			continue
+		}
+		if size += len(encodedBytes); size > maxPooledTxsSize {
+			break
+		}
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// addPending queues the hash to be announced, the batch is sent at once when it is full
+func (ts *TxService) addPending(hash common.Hash) {
+	ts.mu.Lock()
+	ts.pending = append(ts.pending, hash)
+	full := len(ts.pending) >= maxTxAnnounce
+	ts.mu.Unlock()
+	if full {
+		ts.announce()
+	}
+}
+
+func (ts *TxService) announce() {
+	ts.mu.Lock()
+	hashes := ts.pending
+	ts.pending = make([]common.Hash, 0)
+	ts.mu.Unlock()
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > maxTxAnnounce {
+			n = maxTxAnnounce
+		}
+		ts.streamPool.AnnounceTxs(hashes[:n])
+		hashes = hashes[n:]
+	}
+}
+
+// onTxHashes requests the announced transactions which are neither in the pool nor being fetched
+func (ts *TxService) onTxHashes(msg *net.Message) {
+	hashes := make([]common.Hash, 0)
+	if err := rlp.DecodeBytes(msg.Payload, &hashes); err != nil || len(hashes) > maxTxAnnounce {
+		ts.streamPool.AdjustScore(msg.PeerID, net.ScoreInvalidMessage, fmt.Sprintf("pooled tx hashes: %v", err))
+		return
+	}
+	ps, err := ts.streamPool.GetStream(msg.PeerID)
+	if err != nil {
+		return
+	}
+	unknown := make([]common.Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		ps.MarkTx(hash)
+		if ts.bc.TxPool.Get(hash) != nil {
+			continue
+		}
+		if v, ok := ts.fetching.Get(hash); ok && ts.clock.Now().Sub(v.(time.Time)) < txRequestTimeout {
+			continue
+		}
+		ts.fetching.Add(hash, ts.clock.Now())
+		unknown = append(unknown, hash)
+	}
+	if len(unknown) == 0 {
+		return
+	}
+	message, err := net.NewRLPMessage(net.MsgGetPooledTxs, unknown)
+	if err != nil {
+		return
+	}
+	future, err := ps.Request(&message, txRequestTimeout)
+	if err != nil {
+		return
+	}
+	go func() {
+		reply, err := future.Wait()
+		ts.onPooledTxs(msg.PeerID, unknown, reply, err)
+	}()
+}
+
+// onPooledTxs verifies the transactions and adds them to the pool, they are announced to the other peers
+func (ts *TxService) onPooledTxs(peerID peer.ID, requested []common.Hash, reply *net.Message, err error) {
+	for _, hash := range requested {
+		ts.fetching.Remove(hash)
+	}
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{
+			"ID":  peerID,
+			"Msg": err,
+		}).Debug("pooled txs")
+		return
+	}
+	txs := make([]*core.Transaction, 0)
+	if err := rlp.DecodeBytes(reply.Payload, &txs); err != nil {
+		ts.streamPool.AdjustScore(peerID, net.ScoreInvalidMessage, fmt.Sprintf("pooled txs: %v", err))
+		return
+	}
+	wanted := make(map[common.Hash]bool, len(requested))
+	for _, hash := range requested {
+		wanted[hash] = true
+	}
+	for _, tx := range txs {
+		if !wanted[tx.Hash] {
+			ts.streamPool.AdjustScore(peerID, net.ScoreInvalidData, errUnrequestedTx.Error())
+			return
+		}
+		delete(wanted, tx.Hash)
+		if tx.Hash != tx.CalcHash() {
+			ts.streamPool.AdjustScore(peerID, net.ScoreInvalidTx, "tx.Hash != tx.CalcHash()")
+			continue
+		}
+		if err := tx.VerifySign(); err != nil {
+			ts.streamPool.AdjustScore(peerID, net.ScoreInvalidTx, err.Error())
+			continue
+		}
+		if ts.bc.TxPool.Get(tx.Hash) != nil {
+			continue
+		}
+		log.CLog().WithFields(logrus.Fields{
+			"From":   common.AddressToHex(tx.From),
+			"To":     common.AddressToHex(tx.To),
+			"Amount": tx.Amount,
+		}).Info("Received tx")
+		ts.bc.TxPool.Put(tx)
+		ts.addPending(tx.Hash)
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTxTestNode(t *testing.T) (*testNode, *TxService) {
+	node := newTestNode(t)
+	ts := NewTxService(node.bc, node.pool)
+	node.pool.AddHandler(ts)
+	return node, ts
+}
+
+func makeTxs(n int) []*core.Transaction {
+	txs := make([]*core.Transaction, 0, n)
+	for i := 0; i < n; i++ {
+		txs = append(txs, tests.MakeTransaction(tests.AddressHex0, tests.AddressHex2, new(big.Int).SetUint64(10), uint64(i+1)))
+	}
+	return txs
+}
+
+// connectTxNodes connects two nodes, the loops announcing pending txs are not started
+func connectTxNodes(t *testing.T) (local *testNode, localTs *TxService, remote *testNode, remoteTs *TxService) {
+	remote, remoteTs = newTxTestNode(t)
+	local, localTs = newTxTestNode(t)
+	network := net.NewMemoryNetwork(common.NewVirtualClock(time.Unix(0, 0)), 1)
+	remote.start(t, network, 0)
+	local.start(t, network, 1, remote.addr)
+	assert.True(t, waitFor(func() bool { return len(local.pool.Peers()) == 1 && len(remote.pool.Peers()) == 1 }))
+	return
+}
+
+func TestTxServiceAnnounce(t *testing.T) {
+	local, _, remote, remoteTs := connectTxNodes(t)
+	ps := remote.pool.Peers()[0]
+
+	//hashes are not announced until the batch is full
+	txs := makeTxs(maxTxAnnounce)
+	for _, tx := range txs[:maxTxAnnounce-1] {
+		remote.bc.TxPool.Put(tx)
+		remoteTs.addPending(tx.Hash)
+	}
+	assert.Equal(t, maxTxAnnounce-1, len(remoteTs.pending))
+	assert.False(t, ps.KnowsTx(txs[0].Hash))
+
+	last := txs[maxTxAnnounce-1]
+	remote.bc.TxPool.Put(last)
+	remoteTs.addPending(last.Hash)
+	assert.Equal(t, 0, len(remoteTs.pending))
+	for _, tx := range txs {
+		assert.True(t, ps.KnowsTx(tx.Hash))
+	}
+
+	//the peer requests the announced txs
+	assert.True(t, waitFor(func() bool {
+		for _, tx := range txs {
+			if local.bc.TxPool.Get(tx.Hash) == nil {
+				return false
+			}
+		}
+		return true
+	}))
+}
+
+func TestTxServiceFetching(t *testing.T) {
+	local, localTs, remote, _ := connectTxNodes(t)
+	tx := makeTxs(1)[0]
+	remote.bc.TxPool.Put(tx)
+	msg, err := net.NewRLPMessage(net.MsgNewPooledTxHashes, []common.Hash{tx.Hash})
+	assert.NoError(t, err)
+	msg.PeerID = local.pool.Peers()[0].ID()
+	clock := common.NewVirtualClock(time.Unix(0, 0))
+	localTs.SetClock(clock)
+
+	//the tx is being fetched from another peer
+	requested := clock.Now()
+	localTs.fetching.Add(tx.Hash, requested)
+	localTs.onTxHashes(&msg)
+	v, ok := localTs.fetching.Get(tx.Hash)
+	assert.True(t, ok)
+	assert.Equal(t, requested, v.(time.Time))
+
+	//the request timed out, the tx is requested again
+	clock.Advance(txRequestTimeout)
+	localTs.onTxHashes(&msg)
+	assert.True(t, waitFor(func() bool {
+		return local.bc.TxPool.Get(tx.Hash) != nil && !localTs.fetching.Contains(tx.Hash)
+	}))
+}
+
+func TestTxServiceUnrequested(t *testing.T) {
+	local, ts := newTxTestNode(t)
+	txs := makeTxs(2)
+	reply := func(txs ...*core.Transaction) *net.Message {
+		msg, err := net.NewRLPMessage(net.MsgPooledTxs, txs)
+		assert.NoError(t, err)
+		return &msg
+	}
+
+	ts.fetching.Add(txs[0].Hash, time.Now())
+	ts.onPooledTxs(peer.ID("peer"), []common.Hash{txs[0].Hash}, reply(txs[0]), nil)
+	assert.False(t, local.pool.IsBanned(peer.ID("peer")))
+	assert.False(t, ts.fetching.Contains(txs[0].Hash))
+	assert.NotNil(t, local.bc.TxPool.Get(txs[0].Hash))
+
+	ts.onPooledTxs(peer.ID("peer"), []common.Hash{txs[0].Hash}, reply(txs[1]), nil)
+	assert.True(t, local.pool.IsBanned(peer.ID("peer")))
+	assert.Nil(t, local.bc.TxPool.Get(txs[1].Hash))
+}
+
+func TestTxServicePooledTxs(t *testing.T) {
+	local, ts := newTxTestNode(t)
+	txs := makeTxs(3)
+	for _, tx := range txs {
+		//the hash is not recalculated, only the size matters
+		tx.Payload = &core.Payload{Data: make([]byte, maxPooledTxsSize/2)}
+		local.bc.TxPool.Put(tx)
+	}
+	unknown := common.Hash{0x01}
+
+	pooled := ts.pooledTxs([]common.Hash{unknown, txs[0].Hash, txs[1].Hash, txs[2].Hash})
+	assert.Equal(t, 1, len(pooled))
+	assert.Equal(t, txs[0].Hash, pooled[0].Hash)
+
+	txs[1].Payload = nil
+	pooled = ts.pooledTxs([]common.Hash{txs[0].Hash, txs[1].Hash, txs[2].Hash})
+	assert.Equal(t, 2, len(pooled))
+}
@@ -174,22 +174,28 @@ func (accs *AccountState) PutAccount(account *Account) (hash common.Hash) {
 	return hash
 }
 
+// DecodeAccount decodes the value of the account trie, the fields decoded before an error are kept
+func DecodeAccount(decodedBytes []byte) (*Account, error) {
+	rlpAcc := new(rlpAccount)
+	err := rlp.NewStream(bytes.NewReader(decodedBytes), 0).Decode(rlpAcc)
+	account := Account{
+		Address:          rlpAcc.Address,
+		Balance:          rlpAcc.Balance,
+		Nonce:            rlpAcc.Nonce,
+		Staking:          make(map[common.Address]*big.Int),
+		TotalPeggedStake: rlpAcc.TotalPeggedStake,
+	}
+	for _, v := range rlpAcc.Staking {
+		account.Staking[v.Address] = v.Balance
+	}
+	return &account, err
+}
+
 func (accs *AccountState) GetAccount(address common.Address) (account *Account) {
 	decodedBytes, err := accs.Trie.Get(address[:])
 	if err == nil {
-		rlpAcc := new(rlpAccount)
-		rlp.NewStream(bytes.NewReader(decodedBytes), 0).Decode(rlpAcc)
-		account := Account{
-			Address:          rlpAcc.Address,
-			Balance:          rlpAcc.Balance,
-			Nonce:            rlpAcc.Nonce,
-			Staking:          make(map[common.Address]*big.Int),
-			TotalPeggedStake: rlpAcc.TotalPeggedStake,
-		}
-		for _, v := range rlpAcc.Staking {
-			account.Staking[v.Address] = v.Balance
-		}
-		return &account
+		account, _ := DecodeAccount(decodedBytes)
+		return account
 	} else {
 		if err == storage.ErrKeyNotFound {
 			account := NewAccount()
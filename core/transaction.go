@@ -29,6 +29,7 @@ const (
 	//Empty payload is 0x00
 	TxCVoteStake   = uint64(0x01)
 	TxCVoteUnStake = uint64(0x02)
+	TxCVoteParams  = uint64(0x03) //dpos miners vote for period, round, totalMiners
 )
 
 type Payload struct {
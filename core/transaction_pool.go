@@ -4,23 +4,34 @@ import (
 	"sync"
 
 	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/event"
 )
 
 type TransactionPool struct {
 	mu    sync.RWMutex
 	queue []common.Hash
 	txMap map[common.Hash]*Transaction
+	feed  *event.Feed
 }
 
 func NewTransactionPool() *TransactionPool {
-	return &TransactionPool{txMap: make(map[common.Hash]*Transaction)}
+	return newTransactionPool(new(event.Feed))
+}
+
+func newTransactionPool(feed *event.Feed) *TransactionPool {
+	return &TransactionPool{txMap: make(map[common.Hash]*Transaction), feed: feed}
 }
 
 func (pool *TransactionPool) Put(tx *Transaction) {
 	pool.mu.Lock()
+	_, ok := pool.txMap[tx.Hash]
 	pool.txMap[tx.Hash] = tx
 	pool.queue = append(pool.queue, tx.Hash)
 	pool.mu.Unlock()
+	//consensus puts back the transactions it popped, they are not new
+	if !ok {
+		pool.feed.Send(TxPoolAddEvent{Tx: tx})
+	}
 }
 
 func (pool *TransactionPool) Pop() (tx *Transaction) {
@@ -52,6 +63,8 @@ func (pool *TransactionPool) Peek() (tx *Transaction) {
 	return nil
 }
 func (pool *TransactionPool) Get(hash common.Hash) (tx *Transaction) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
 	return pool.txMap[hash]
 }
 
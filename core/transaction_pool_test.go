@@ -62,3 +62,23 @@ func TestRefresh(t *testing.T) {
 	tx.MakeHash()
 	assert.Equal(t, tx.Hash, pool.queue[3])
 }
+
+func TestTxPoolAddEvent(t *testing.T) {
+	from := common.HexToAddress("0xd182458d4f299f73f496b7025912b0688653dbef74bc98638cd73e7e9ca01f8e9d416e44")
+	to := common.HexToAddress("0xfdf75c884f7f1d1537177a3a35e783236739a426ee649fa3e2d8aed598b4f29e838170e2")
+
+	pool := NewTransactionPool()
+	sub := pool.feed.Subscribe(10, TxPoolAddEvent{})
+	defer sub.Unsubscribe()
+
+	tx := NewTransaction(from, to, new(big.Int).SetInt64(100), uint64(1))
+	tx.MakeHash()
+	pool.Put(tx)
+	ev := (<-sub.Chan()).(TxPoolAddEvent)
+	assert.Equal(t, tx.Hash, ev.Tx.Hash)
+
+	//a popped transaction put back is not new
+	assert.Equal(t, tx, pool.Pop())
+	pool.Put(tx)
+	assert.Equal(t, 0, len(sub.Chan()))
+}
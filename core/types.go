@@ -2,15 +2,20 @@ package core
 
 import (
 	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/storage"
 )
 
-
 type ConsensusState interface {
 	RootHash() (hash common.Hash)
 	ExecuteTransaction(block *Block, txIndex int, account *Account) (err error)
 	Clone() (ConsensusState, error)
 }
 
+// ConsensusStateCopier is implemented by a consensus state whose tries can be written to another storage
+type ConsensusStateCopier interface {
+	CopyTo(storage storage.Storage) (ConsensusState, error)
+}
+
 type Consensus interface {
 	UpdateLIB()
 	ConsensusType() string
@@ -20,4 +25,27 @@ type Consensus interface {
 	Verify(block *Block) (err error)
 	SaveState(block *Block) error
 	LoadState(block *Block) (state ConsensusState, err error)
-}
\ No newline at end of file
+}
+
+// ConsensusInitializer is implemented by a consensus that can take over the chain at a fork height
+type ConsensusInitializer interface {
+	InitState(parent *Block, voters []*Account) (state ConsensusState, err error)
+}
+
+// Validators is implemented by a consensus whose miners or signers sign checkpoints
+type Validators interface {
+	Validators(block *Block) ([]common.Address, error)
+}
+
+/*
+HeaderVerifier is implemented by a consensus which needs the parent to verify a block without its transactions, for light nodes.
+The consensus state of block is the state of parent, or the initial state at a consensus switch.
+*/
+type HeaderVerifier interface {
+	VerifyHeader(block *Block, parent *Header) error
+}
+
+// StateTrieRoots is implemented by a consensus whose state refers to other tries from the consensus trie
+type StateTrieRoots interface {
+	StateTrieRoots(block *Block) ([]common.Hash, error)
+}
@@ -0,0 +1,95 @@
+package event
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Feed delivers an event to the subscriptions of its type without blocking the sender.
+A subscription whose channel is full misses the event and counts it as dropped,
+so a slow subscriber cannot stall block import, the transaction pool or the peers.
+The zero value is ready to use.
+*/
+type Feed struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	feed    *Feed
+	types   map[reflect.Type]struct{}
+	ch      chan interface{}
+	once    sync.Once
+	dropped uint64
+}
+
+/*
+Subscribe returns a subscription with a channel of size.
+It receives the events of the same types as the values of events, like core.ChainHeadEvent{},
+all events if there is no value.
+*/
+func (f *Feed) Subscribe(size int, events ...interface{}) *Subscription {
+	sub := &Subscription{feed: f, ch: make(chan interface{}, size)}
+	if len(events) > 0 {
+		sub.types = make(map[reflect.Type]struct{}, len(events))
+		for _, ev := range events {
+			sub.types[reflect.TypeOf(ev)] = struct{}{}
+		}
+	}
+	f.mu.Lock()
+	if f.subs == nil {
+		f.subs = make(map[*Subscription]struct{})
+	}
+	f.subs[sub] = struct{}{}
+	f.mu.Unlock()
+	return sub
+}
+
+// Send returns the number of subscriptions which received ev
+func (f *Feed) Send(ev interface{}) int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	sent := 0
+	typ := reflect.TypeOf(ev)
+	for sub := range f.subs {
+		if sub.types != nil {
+			if _, ok := sub.types[typ]; !ok {
+				continue
+			}
+		}
+		select {
+		case sub.ch <- ev:
+			sent++
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+	return sent
+}
+
+func (f *Feed) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.subs)
+}
+
+func (s *Subscription) Chan() <-chan interface{} {
+	return s.ch
+}
+
+// Dropped returns the number of events missed because the channel was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe removes the subscription and closes its channel, it can be called more than once
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.feed.mu.Lock()
+		delete(s.feed.subs, s)
+		close(s.ch)
+		s.feed.mu.Unlock()
+	})
+}
@@ -0,0 +1,52 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeed(t *testing.T) {
+	var feed Feed
+	sub1 := feed.Subscribe(1)
+	sub2 := feed.Subscribe(2)
+	assert.Equal(t, 2, feed.Len())
+
+	assert.Equal(t, 2, feed.Send(1))
+	//sub1 is full
+	assert.Equal(t, 1, feed.Send(2))
+	assert.Equal(t, uint64(1), sub1.Dropped())
+	assert.Equal(t, uint64(0), sub2.Dropped())
+	assert.Equal(t, 1, <-sub1.Chan())
+	assert.Equal(t, 1, <-sub2.Chan())
+	assert.Equal(t, 2, <-sub2.Chan())
+
+	sub1.Unsubscribe()
+	sub1.Unsubscribe()
+	_, ok := <-sub1.Chan()
+	assert.False(t, ok)
+	assert.Equal(t, 1, feed.Len())
+	assert.Equal(t, 1, feed.Send(3))
+	assert.Equal(t, 3, <-sub2.Chan())
+}
+
+type testEventA struct{ n int }
+type testEventB struct{ n int }
+
+func TestFeedTypes(t *testing.T) {
+	var feed Feed
+	subA := feed.Subscribe(10, testEventA{})
+	subAB := feed.Subscribe(10, testEventA{}, testEventB{})
+	subAll := feed.Subscribe(10)
+
+	assert.Equal(t, 3, feed.Send(testEventA{1}))
+	assert.Equal(t, 2, feed.Send(testEventB{2}))
+	assert.Equal(t, 1, feed.Send("other"))
+
+	assert.Equal(t, 1, len(subA.Chan()))
+	assert.Equal(t, testEventA{1}, <-subA.Chan())
+	assert.Equal(t, 2, len(subAB.Chan()))
+	assert.Equal(t, testEventA{1}, <-subAB.Chan())
+	assert.Equal(t, testEventB{2}, <-subAB.Chan())
+	assert.Equal(t, 3, len(subAll.Chan()))
+}
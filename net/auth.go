@@ -0,0 +1,212 @@
+package net
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/common"
+	scrypto "github.com/nacamp/go-simplechain/crypto"
+)
+
+// errors constants
+var (
+	ErrAuthRequired   = errors.New("peer did not authenticate")
+	ErrAuthSignature  = errors.New("handshake signature is invalid")
+	ErrAuthPeerID     = errors.New("node key does not match peer id")
+	ErrValidatorSig   = errors.New("validator signature is invalid")
+	ErrEphemeralKey   = errors.New("ephemeral key is invalid")
+	ErrFrameEncrypted = errors.New("frame is not encrypted")
+)
+
+var (
+	handshakeDomain = []byte("simplechain handshake")
+	validatorDomain = []byte("simplechain validator")
+)
+
+// Hello is the payload of MsgHello and MsgHelloAck
+type Hello struct {
+	Status Status
+	Auth   Auth
+}
+
+/*
+Auth proves that the sender has the node key of its peer id in this session.
+Signature signs the ephemeral keys of both peers and the receiver id by the node key,
+so it can not be replayed to another peer or session.
+Frames after handshake are encrypted by the keys derived from the ephemeral keys.
+A miner advertises Validator signed by its account key for its peer id.
+*/
+type Auth struct {
+	PubKey       []byte
+	EphemeralKey []byte
+	Signature    []byte
+	Validator    common.Address
+	ValidatorSig []byte
+}
+
+// Identity is the node key and the validator which this node represents
+type Identity struct {
+	privKey      crypto.PrivKey
+	id           peer.ID
+	validator    common.Address
+	validatorSig []byte
+}
+
+func NewIdentity(privKey crypto.PrivKey) (*Identity, error) {
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{privKey: privKey, id: id}, nil
+}
+
+func (identity *Identity) ID() peer.ID {
+	return identity.id
+}
+
+// SetValidator sets the validator address and its signature of ValidatorHash(identity.ID())
+func (identity *Identity) SetValidator(address common.Address, sig []byte) {
+	identity.validator = address
+	identity.validatorSig = sig
+}
+
+// ValidatorHash is signed by the account key of validator to bind it to the peer id
+func ValidatorHash(id peer.ID) []byte {
+	return scrypto.Sha3b256(validatorDomain, []byte(id))
+}
+
+func authHash(ephemeralKey, remoteEphemeralKey []byte, remoteID peer.ID) []byte {
+	return scrypto.Sha3b256(handshakeDomain, ephemeralKey, remoteEphemeralKey, []byte(remoteID))
+}
+
+// ephemeral is the P256 key of a session
+type ephemeral struct {
+	priv []byte
+	pub  []byte
+}
+
+func newEphemeral() (*ephemeral, error) {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ephemeral{priv: priv, pub: elliptic.Marshal(elliptic.P256(), x, y)}, nil
+}
+
+func (e *ephemeral) sharedSecret(remotePub []byte) ([]byte, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), remotePub)
+	if x == nil {
+		return nil, ErrEphemeralKey
+	}
+	sx, _ := elliptic.P256().ScalarMult(x, y, e.priv)
+	return sx.Bytes(), nil
+}
+
+// makeAuth signs the handshake of this node to remoteID
+func (identity *Identity) makeAuth(e *ephemeral, remoteEphemeralKey []byte, remoteID peer.ID) (*Auth, error) {
+	pubKey, err := identity.privKey.GetPublic().Bytes()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := identity.privKey.Sign(authHash(e.pub, remoteEphemeralKey, remoteID))
+	if err != nil {
+		return nil, err
+	}
+	return &Auth{
+		PubKey:       pubKey,
+		EphemeralKey: e.pub,
+		Signature:    sig,
+		Validator:    identity.validator,
+		ValidatorSig: identity.validatorSig,
+	}, nil
+}
+
+// verifyAuth checks the auth of remoteID sent to localID and returns the validator if it is advertised
+func verifyAuth(auth *Auth, localEphemeralKey []byte, remoteID, localID peer.ID) (common.Address, error) {
+	if len(auth.PubKey) == 0 {
+		return common.Address{}, ErrAuthRequired
+	}
+	pubKey, err := crypto.UnmarshalPublicKey(auth.PubKey)
+	if err != nil {
+		return common.Address{}, err
+	}
+	id, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if id != remoteID {
+		return common.Address{}, ErrAuthPeerID
+	}
+	ok, err := pubKey.Verify(authHash(auth.EphemeralKey, localEphemeralKey, localID), auth.Signature)
+	if err != nil || !ok {
+		return common.Address{}, ErrAuthSignature
+	}
+	if len(auth.ValidatorSig) == 0 {
+		return common.Address{}, nil
+	}
+	pub, err := scrypto.Ecrecover(ValidatorHash(remoteID), auth.ValidatorSig)
+	if err != nil || scrypto.CreateAddressFromPublicKeyByte(pub) != auth.Validator {
+		return common.Address{}, ErrValidatorSig
+	}
+	return auth.Validator, nil
+}
+
+// sessionCipher encrypts frames by AES-GCM with a counter nonce for each direction
+type sessionCipher struct {
+	read       cipher.AEAD
+	write      cipher.AEAD
+	readNonce  uint64
+	writeNonce uint64
+}
+
+// newSessionCipher derives keys for the initiator which sent MsgHello or the responder
+func newSessionCipher(secret, initiatorKey, responderKey []byte, initiator bool) (*sessionCipher, error) {
+	initiatorAEAD, err := newAEAD(scrypto.Sha3b256(secret, initiatorKey, responderKey, []byte("initiator")))
+	if err != nil {
+		return nil, err
+	}
+	responderAEAD, err := newAEAD(scrypto.Sha3b256(secret, initiatorKey, responderKey, []byte("responder")))
+	if err != nil {
+		return nil, err
+	}
+	if initiator {
+		return &sessionCipher{read: responderAEAD, write: initiatorAEAD}, nil
+	}
+	return &sessionCipher{read: initiatorAEAD, write: responderAEAD}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func counterNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+func (c *sessionCipher) seal(plain []byte) []byte {
+	sealed := c.write.Seal(nil, counterNonce(c.write, c.writeNonce), plain, nil)
+	c.writeNonce++
+	return sealed
+}
+
+func (c *sessionCipher) open(sealed []byte) ([]byte, error) {
+	plain, err := c.read.Open(nil, counterNonce(c.read, c.readNonce), sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.readNonce++
+	return plain, nil
+}
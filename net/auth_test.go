@@ -0,0 +1,159 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/common"
+	scrypto "github.com/nacamp/go-simplechain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestIdentity(t *testing.T) *Identity {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Secp256k1, 256)
+	assert.NoError(t, err)
+	identity, err := NewIdentity(privKey)
+	assert.NoError(t, err)
+	return identity
+}
+
+func TestAuth(t *testing.T) {
+	client := newTestIdentity(t)
+	server := newTestIdentity(t)
+	priv, validator := scrypto.CreateAddress()
+	sig, _ := scrypto.Sign(ValidatorHash(client.ID()), priv)
+	client.SetValidator(validator, sig)
+
+	clientEph, _ := newEphemeral()
+	serverEph, _ := newEphemeral()
+	auth, err := client.makeAuth(clientEph, nil, server.ID())
+	assert.NoError(t, err)
+	address, err := verifyAuth(auth, nil, client.ID(), server.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, validator, address)
+
+	//bound to the peer id and the receiver
+	_, err = verifyAuth(auth, nil, server.ID(), server.ID())
+	assert.Equal(t, ErrAuthPeerID, err)
+	_, err = verifyAuth(auth, nil, client.ID(), client.ID())
+	assert.Equal(t, ErrAuthSignature, err)
+
+	//bound to the ephemeral key of receiver
+	auth, _ = server.makeAuth(serverEph, clientEph.pub, client.ID())
+	_, err = verifyAuth(auth, serverEph.pub, server.ID(), client.ID())
+	assert.Equal(t, ErrAuthSignature, err)
+	address, err = verifyAuth(auth, clientEph.pub, server.ID(), client.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, common.Address{}, address)
+
+	//validator signed for another peer
+	sig, _ = scrypto.Sign(ValidatorHash(server.ID()), priv)
+	client.SetValidator(validator, sig)
+	auth, _ = client.makeAuth(clientEph, nil, server.ID())
+	_, err = verifyAuth(auth, nil, client.ID(), server.ID())
+	assert.Equal(t, ErrValidatorSig, err)
+
+	_, err = verifyAuth(&Auth{}, nil, client.ID(), server.ID())
+	assert.Equal(t, ErrAuthRequired, err)
+}
+
+func TestEncryptedFrame(t *testing.T) {
+	clientEph, _ := newEphemeral()
+	serverEph, _ := newEphemeral()
+	secret1, err := clientEph.sharedSecret(serverEph.pub)
+	assert.NoError(t, err)
+	secret2, _ := serverEph.sharedSecret(clientEph.pub)
+	assert.Equal(t, secret1, secret2)
+	client, _ := newSessionCipher(secret1, clientEph.pub, serverEph.pub, true)
+	server, _ := newSessionCipher(secret2, clientEph.pub, serverEph.pub, false)
+
+	msg, _ := NewRLPMessage(MsgNewTx, bytes.Repeat([]byte{0x1}, 1000))
+	buf := new(bytes.Buffer)
+	for _, compress := range []bool{false, true} {
+		frame, err := encodeFrame(&msg, compress, client)
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(frame, msg.Payload[:100]))
+		buf.Write(frame)
+	}
+	for i := 0; i < 2; i++ {
+		decoded, err := readFrame(buf, server)
+		assert.NoError(t, err)
+		assert.Equal(t, msg.Payload, decoded.Payload)
+	}
+
+	//replayed frame does not match the nonce
+	frame, _ := encodeFrame(&msg, false, client)
+	_, err = readFrame(bytes.NewReader(frame), server)
+	assert.NoError(t, err)
+	_, err = readFrame(bytes.NewReader(frame), server)
+	assert.Error(t, err)
+
+	//plain frame is rejected after handshake
+	frame, _ = encodeFrame(&msg, false, nil)
+	_, err = readFrame(bytes.NewReader(frame), server)
+	assert.Equal(t, ErrFrameEncrypted, err)
+}
+
+func TestAuthenticatedHandshake(t *testing.T) {
+	network := NewMemoryNetwork(common.NewVirtualClock(time.Unix(0, 0)), 1)
+	client := newTestIdentity(t)
+	server := newTestIdentity(t)
+	priv, validator := scrypto.CreateAddress()
+	sig, _ := scrypto.Sign(ValidatorHash(server.ID()), priv)
+	server.SetValidator(validator, sig)
+
+	addr1, _ := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/9991")
+	addr2, _ := ma.NewMultiaddr("/ip4/10.0.0.2/tcp/9991")
+	t1 := network.NewTransport(server.ID(), addr1)
+	t2 := network.NewTransport(client.ID(), addr2)
+	inbound := make(chan *PeerStream, 1)
+	t1.SetStreamHandler("/test", func(s Stream) {
+		ps, _ := NewPeerStream(s)
+		ps.SetIdentity(server)
+		inbound <- ps
+		ps.Start()
+	})
+
+	connect := func(identity *Identity) (*PeerStream, bool) {
+		s, err := t2.NewStream(server.ID(), addr1, "/test")
+		assert.NoError(t, err)
+		ps, _ := NewPeerStream(s)
+		if identity != nil {
+			ps.SetIdentity(identity)
+		}
+		ps.Start()
+		assert.NoError(t, ps.SendHello(addr2))
+		select {
+		case ok := <-ps.HandshakeSucceedCh:
+			return ps, ok
+		case <-time.After(time.Second):
+			return ps, false
+		}
+	}
+
+	ps, ok := connect(client)
+	assert.True(t, ok)
+	remote := <-inbound
+	assert.Equal(t, validator, ps.RemoteValidator())
+	assert.Equal(t, common.Address{}, remote.RemoteValidator())
+
+	received := make(chan interface{}, 1)
+	remote.Register(MsgNewTx, received)
+	msg, _ := NewRLPMessage(MsgNewTx, []byte{0x1})
+	assert.NoError(t, ps.SendMessage(&msg))
+	select {
+	case m := <-received:
+		assert.Equal(t, msg.Payload, m.(*Message).Payload)
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+
+	//a peer without identity is rejected
+	_, ok = connect(nil)
+	assert.False(t, ok)
+	remote = <-inbound
+	assert.False(t, remote.IsHandshakeSucceed())
+}
@@ -0,0 +1,148 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dialInterval   = time.Second
+	minDialBackoff = 2 * time.Second
+	maxDialBackoff = 5 * time.Minute
+)
+
+type dialTask struct {
+	info     *peerstore.PeerInfo
+	static   bool
+	failures int
+	next     time.Time
+}
+
+/*
+Dialer dials seeds and static peers again and again with exponential backoff.
+A seed is forgotten once it is connected, a static peer is redialed whenever it is disconnected.
+*/
+type Dialer struct {
+	mu        sync.Mutex
+	tasks     map[peer.ID]*dialTask
+	dial      func(info *peerstore.PeerInfo) error
+	connected func(id peer.ID) bool
+}
+
+func NewDialer(dial func(info *peerstore.PeerInfo) error, connected func(id peer.ID) bool) *Dialer {
+	return &Dialer{
+		tasks:     make(map[peer.ID]*dialTask),
+		dial:      dial,
+		connected: connected,
+	}
+}
+
+// ParsePeerAddr parses the address like /ip4/127.0.0.1/tcp/9991/ipfs/nodeid
+func ParsePeerAddr(s string) (*peerstore.PeerInfo, error) {
+	addr, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return nil, err
+	}
+	return peerstore.InfoFromP2pAddr(addr)
+}
+
+func (d *Dialer) AddSeed(info *peerstore.PeerInfo) {
+	d.add(info, false)
+}
+
+func (d *Dialer) AddStatic(info *peerstore.PeerInfo) {
+	d.add(info, true)
+}
+
+func (d *Dialer) add(info *peerstore.PeerInfo, static bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if task, ok := d.tasks[info.ID]; ok {
+		task.info = info
+		task.static = task.static || static
+		return
+	}
+	d.tasks[info.ID] = &dialTask{info: info, static: static}
+}
+
+func (d *Dialer) Remove(id peer.ID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tasks, id)
+}
+
+// IsStatic returns true if the peer is kept connected
+func (d *Dialer) IsStatic(id peer.ID) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	task, ok := d.tasks[id]
+	return ok && task.static
+}
+
+func (d *Dialer) Start() {
+	ticker := time.NewTicker(dialInterval)
+	for {
+		select {
+		case now := <-ticker.C:
+			d.dialDue(now)
+		}
+	}
+}
+
+// dialDue dials the peers which are not connected and whose backoff is over
+func (d *Dialer) dialDue(now time.Time) {
+	d.mu.Lock()
+	due := make([]*dialTask, 0)
+	for id, task := range d.tasks {
+		if d.connected(id) {
+			task.failures = 0
+			if !task.static {
+				delete(d.tasks, id)
+			}
+			continue
+		}
+		if !now.Before(task.next) {
+			due = append(due, task)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, task := range due {
+		err := d.dial(task.info)
+		d.mu.Lock()
+		if err == nil {
+			task.failures = 0
+			if !task.static {
+				delete(d.tasks, task.info.ID)
+			}
+		} else {
+			task.failures++
+			task.next = now.Add(dialBackoff(task.failures))
+			log.CLog().WithFields(logrus.Fields{
+				"ID":       task.info.ID,
+				"Failures": task.failures,
+				"Next":     task.next,
+			}).Warning(fmt.Sprintf("dial: %v", err))
+		}
+		d.mu.Unlock()
+	}
+}
+
+// dialBackoff doubles from minDialBackoff to maxDialBackoff
+func dialBackoff(failures int) time.Duration {
+	backoff := minDialBackoff
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= maxDialBackoff {
+			return maxDialBackoff
+		}
+	}
+	return backoff
+}
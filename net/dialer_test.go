@@ -0,0 +1,61 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialBackoff(t *testing.T) {
+	assert.Equal(t, minDialBackoff, dialBackoff(1))
+	assert.Equal(t, 2*minDialBackoff, dialBackoff(2))
+	assert.Equal(t, 4*minDialBackoff, dialBackoff(3))
+	assert.Equal(t, maxDialBackoff, dialBackoff(100))
+}
+
+func TestDialer(t *testing.T) {
+	seed, _ := ParsePeerAddr("/ip4/127.0.0.1/tcp/9991/ipfs/16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk")
+	static, _ := ParsePeerAddr("/ip4/127.0.0.1/tcp/9992/ipfs/16Uiu2HAkxKaG3PHSLfDhfZ7a8YzP6w6fKooBTY1gmfSXxGYbsNuN")
+
+	up := make(map[peer.ID]bool)
+	dials := make(map[peer.ID]int)
+	d := NewDialer(func(info *peerstore.PeerInfo) error {
+		dials[info.ID]++
+		if !up[info.ID] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, func(id peer.ID) bool {
+		return false
+	})
+	d.AddSeed(seed)
+	d.AddStatic(static)
+
+	//both fail and wait for backoff
+	now := time.Now()
+	d.dialDue(now)
+	d.dialDue(now.Add(time.Second))
+	assert.Equal(t, 1, dials[seed.ID])
+	assert.Equal(t, 1, dials[static.ID])
+
+	//the seed is forgotten after it is connected
+	up[seed.ID] = true
+	up[static.ID] = true
+	now = now.Add(minDialBackoff)
+	d.dialDue(now)
+	assert.Equal(t, 2, dials[seed.ID])
+	assert.Equal(t, 2, dials[static.ID])
+	d.dialDue(now)
+	assert.Equal(t, 2, dials[seed.ID])
+	assert.Equal(t, 3, dials[static.ID])
+	assert.True(t, d.IsStatic(static.ID))
+
+	d.Remove(static.ID)
+	d.dialDue(now)
+	assert.Equal(t, 3, dials[static.ID])
+}
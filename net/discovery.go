@@ -1,9 +1,12 @@
 package net
 
 import (
+	crand "crypto/rand"
 	"fmt"
 	"math/rand"
 	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,6 +16,7 @@ import (
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	peer "github.com/libp2p/go-libp2p-peer"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/nacamp/go-simplechain/log"
 	"github.com/nacamp/go-simplechain/rlp"
 	"github.com/sirupsen/logrus"
@@ -21,8 +25,37 @@ import (
 const (
 	ConcurrencyLimit = 3
 	BucketSize       = 16
+	maxPeerDBSeeds   = 4 * BucketSize
+
+	discoveryInterval     = 30 * time.Second
+	bucketRefreshInterval = 10 * time.Minute
+	maxRefreshCpl         = 15 //buckets closer than this are refreshed with the last one
+	maxRefreshPerRound    = ConcurrencyLimit
+	pingInterval          = 2 * time.Minute
+	pingTimeout           = 1 * time.Second
+	maxPingsPerRound      = BucketSize
+	maxPingFailures       = 3
+	findnodeWindow        = 10 * time.Second
+	findnodeLimit         = 10 //MsgNearestPeers served per peer in findnodeWindow
 )
 
+// liveness is the result of pinging a peer in the routing table
+type liveness struct {
+	lastPong time.Time
+	failures int
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+/*
+Discovery keeps the routing table of kademlia.
+Every bucket is refreshed by a lookup of a random id in it, and peers in the table are pinged,
+a peer which fails maxPingFailures pings in a row is evicted.
+The table accepts tableIPLimit peers of an ip and tableSubnetLimit peers of a subnet.
+*/
 type Discovery struct {
 	peerstore    peerstore.Peerstore
 	routingTable *kb.RoutingTable
@@ -30,13 +63,20 @@ type Discovery struct {
 	_bond        func(peerInfo *peerstore.PeerInfo) *peerstore.PeerInfo
 
 	// MsgHelloCh    chan interface{}
-	HandshakeSucceedCh   chan interface{}
-	MsgNearestPeersCh    chan interface{}
-	MsgNearestPeersAckCh chan interface{}
-	conn                 IConnect
-	streamPool           *PeerStreamPool
-	hostAddr             ma.Multiaddr
-	hostID               peer.ID
+	HandshakeSucceedCh chan interface{}
+	MsgNearestPeersCh  chan interface{}
+	conn               IConnect
+	streamPool         *PeerStreamPool
+	hostAddr           ma.Multiaddr
+	hostID             peer.ID
+	peerDB             *PeerDB
+	MsgPingCh          chan interface{}
+
+	mu        sync.Mutex
+	limiter   ipLimiter
+	liveness  map[peer.ID]*liveness
+	refreshed map[int]time.Time
+	findnodes map[peer.ID]*rateWindow
 }
 
 func NewDiscovery(hostID peer.ID, hostAddr ma.Multiaddr, metrics peerstore.Metrics, peerstore peerstore.Peerstore, streamPool *PeerStreamPool, conn IConnect) *Discovery {
@@ -45,25 +85,92 @@ func NewDiscovery(hostID peer.ID, hostAddr ma.Multiaddr, metrics peerstore.Metri
 		kb.NewRoutingTable(BucketSize, kb.ConvertPeerID(hostID), time.Minute, metrics)
 	d.peerstore = peerstore
 	d.MsgNearestPeersCh = make(chan interface{}, 1)
-	d.MsgNearestPeersAckCh = make(chan interface{}, 1)
 	d.HandshakeSucceedCh = make(chan interface{}, 1)
+	d.MsgPingCh = make(chan interface{}, 1)
+	d.peerDB, _ = NewPeerDB(nil)
 	return d
 }
 
+// SetPeerDB replaces the peer db which is not saved, the routing table is filled with the recently seen peers
+func (d *Discovery) SetPeerDB(peerDB *PeerDB) {
+	d.peerDB = peerDB
+	d.expirePeers()
+	for _, record := range peerDB.Peers(maxPeerDBSeeds) {
+		info, err := record.PeerInfo()
+		if err != nil || info.ID == d.hostID {
+			continue
+		}
+		d.Update(info)
+	}
+	log.CLog().WithFields(logrus.Fields{
+		"Size": d.routingTable.Size(),
+	}).Info("routing table from peer db")
+}
+
+// expirePeers removes the peers which are not seen for a long time
+func (d *Discovery) expirePeers() {
+	expired, err := d.peerDB.Expire(time.Now())
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+	}
+	for _, id := range expired {
+		if _, err := d.streamPool.GetStream(id); err != nil {
+			d.removeFromTable(id)
+		}
+	}
+}
+
+// addToTable returns false if the ip of addr has too many peers in the table
+func (d *Discovery) addToTable(id peer.ID, addr ma.Multiaddr) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.routingTable.Find(id) == "" {
+		if !d.limiter.add(id, addrIP(addr)) {
+			log.CLog().WithFields(logrus.Fields{
+				"ID":   id,
+				"Addr": addr,
+			}).Debug("ip limit of routing table")
+			return false
+		}
+	}
+	d.routingTable.Update(id)
+	if d.routingTable.Find(id) == "" {
+		//the bucket is full
+		d.limiter.remove(id)
+	}
+	return true
+}
+
+func (d *Discovery) removeFromTable(id peer.ID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.routingTable.Remove(id)
+	d.limiter.remove(id)
+	delete(d.liveness, id)
+}
+
 func (d *Discovery) Update(peerInfo *peerstore.PeerInfo) {
-	d.routingTable.Update(peerInfo.ID)
+	var addr ma.Multiaddr
+	if len(peerInfo.Addrs) > 0 {
+		addr = peerInfo.Addrs[0]
+	}
+	if !d.addToTable(peerInfo.ID, addr) {
+		return
+	}
 	d.peerstore.AddAddrs(peerInfo.ID, peerInfo.Addrs, peerstore.PermanentAddrTTL)
 }
 
 func (d *Discovery) Remove(peerInfo *peerstore.PeerInfo) {
-	d.routingTable.Remove(peerInfo.ID)
+	d.removeFromTable(peerInfo.ID)
 	d.peerstore.ClearAddrs(peerInfo.ID)
 	//d.peerstore.AddAddrs(peerInfo.ID, peerInfo.Addrs, peerstore.PermanentAddrTTL)
 	log.CLog().WithFields(logrus.Fields{}).Warn("ID : ", peerInfo.ID)
 }
 
 func (d *Discovery) UpdateAddr(id peer.ID, addr ma.Multiaddr) {
-	d.routingTable.Update(id)
+	if !d.addToTable(id, addr) {
+		return
+	}
 	d.peerstore.AddAddr(id, addr, peerstore.PermanentAddrTTL)
 }
 
@@ -121,16 +228,28 @@ func (d *Discovery) findnode(peerInfo *peerstore.PeerInfo, targetID peer.ID, rep
 		return
 	}
 	msg, _ := NewRLPMessage(MsgNearestPeers, targetID)
-	replyAck := make(chan interface{}, 1)
-	peerStream.SendMessageReply(&msg, replyAck)
-	//timeout
-	select {
-	case <-time.After(1 * time.Second):
+	future, err := peerStream.Request(&msg, 1*time.Second)
+	if err != nil {
+		reply <- nil
+		return
+	}
+	ack, err := future.Wait()
+	if err != nil {
 		peerStream.Close()
 		reply <- nil
-	case ack := <-replyAck:
-		reply <- ack.([]*peerstore.PeerInfo)
+		return
 	}
+	payload := make([]*PeerInfo2, 0)
+	_ = rlp.DecodeBytes(ack.Payload, &payload)
+	peerInfos := make([]*peerstore.PeerInfo, 0)
+	for _, info := range payload {
+		if info != nil {
+			peerInfos = append(peerInfos, FromPeerInfo2(info))
+		}
+	}
+	peerInfos = filterPeerInfos(peerInfos, peerInfo.Addrs[0], d.hostID)
+	log.CLog().WithFields(logrus.Fields{"Size": len(peerInfos)}).Debug("PeerID: ", ack.PeerID)
+	reply <- peerInfos
 }
 
 func (d *Discovery) bond(peerInfo *peerstore.PeerInfo) (*PeerStream, error) {
@@ -138,6 +257,26 @@ func (d *Discovery) bond(peerInfo *peerstore.PeerInfo) (*PeerStream, error) {
 		d._bond(peerInfo)
 		return nil, nil
 	}
+	peerStream, err := d.handshake(peerInfo)
+	if err != nil {
+		if removed, _ := d.peerDB.Failed(peerInfo.ID); removed {
+			log.CLog().WithFields(logrus.Fields{
+				"ID": peerInfo.ID,
+			}).Debug("removed from peer db")
+		}
+		return nil, err
+	}
+	d.Update(peerInfo)
+	if err := d.peerDB.Seen(peerInfo, time.Now()); err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
+	}
+	log.CLog().WithFields(logrus.Fields{
+		"ID": peerInfo.ID,
+	}).Debug("addr: ", AddrFromPeerInfo(peerInfo))
+	return peerStream, nil
+}
+
+func (d *Discovery) handshake(peerInfo *peerstore.PeerInfo) (*PeerStream, error) {
 	peerStream, err := d.conn.Connect(peerInfo.ID, peerInfo.Addrs[0])
 	if err != nil {
 		return nil, err
@@ -151,13 +290,12 @@ func (d *Discovery) bond(peerInfo *peerstore.PeerInfo) (*PeerStream, error) {
 		case <-time.After(1 * time.Second):
 			peerStream.Close()
 			return nil, errors.New("timeout")
-		case <-peerStream.HandshakeSucceedCh:
+		case ok := <-peerStream.HandshakeSucceedCh:
+			if !ok {
+				return nil, errors.New("handshake failed")
+			}
 		}
 	}
-	d.Update(peerInfo)
-	log.CLog().WithFields(logrus.Fields{
-		"ID": peerInfo.ID,
-	}).Debug("addr: ", AddrFromPeerInfo(peerInfo))
 	return peerStream, nil
 }
 
@@ -188,14 +326,30 @@ func (d *Discovery) bondReply(peerInfo *peerstore.PeerInfo, reply chan<- *peerst
 
 func (d *Discovery) Register(peerStream *PeerStream) {
 	peerStream.Register(MsgNearestPeers, d.MsgNearestPeersCh)
-	peerStream.Register(MsgNearestPeersAck, d.MsgNearestPeersAckCh)
 	peerStream.Register(MsgHello, d.HandshakeSucceedCh)
+	peerStream.Register(MsgPing, d.MsgPingCh)
 }
 
 func (d *Discovery) StartHandler() {
 	go d.onMsgNearestPeers()
-	go d.onMsgNearestPeersAck()
 	go d.onMsgHello()
+	go d.onMsgPing()
+}
+
+func (d *Discovery) onMsgPing() {
+	for {
+		select {
+		case ch := <-d.MsgPingCh:
+			msg := ch.(*Message)
+			ps, err := d.streamPool.GetStream(msg.PeerID)
+			if err != nil {
+				continue
+			}
+			if err := ps.Reply(msg, MsgPong, []byte{}); err != nil {
+				log.CLog().WithFields(logrus.Fields{"Code": MsgPong}).Warning(fmt.Sprintf("%+v", err))
+			}
+		}
+	}
 }
 
 func (d *Discovery) onMsgHello() {
@@ -210,7 +364,7 @@ func (d *Discovery) onMsgHello() {
 			// 	"ID": message.PeerID,
 			// }).Debug("addr: ", data)
 			ps, err := d.streamPool.GetStream(message.PeerID)
-			// a := ps.stream.Conn().RemoteMultiaddr()
+			// a := ps.stream.RemoteAddr()
 			// log.CLog().WithFields(logrus.Fields{}).Warn(a)
 			// addr, err := ma.NewMultiaddr(data)
 			// if err != nil {
@@ -219,23 +373,18 @@ func (d *Discovery) onMsgHello() {
 			if err != nil {
 				continue
 			}
-			d.UpdateAddr(message.PeerID, ps.stream.Conn().RemoteMultiaddr())
+			d.UpdateAddr(message.PeerID, ps.stream.RemoteAddr())
 		}
 	}
 }
 
-func (d *Discovery) SendNearestPeers(targetID peer.ID, ps *PeerStream) error {
+func (d *Discovery) SendNearestPeers(request *Message, targetID peer.ID, ps *PeerStream) error {
 	closestPeerInfo := d.NearestPeers(targetID)
 	payload := make([]*PeerInfo2, 0)
 	for _, info := range closestPeerInfo {
 		payload = append(payload, ToPeerInfo2(info))
 	}
-	if msg, err := NewRLPMessage(MsgNearestPeersAck, &payload); err != nil {
-		return err
-	} else {
-		ps.SendMessage(&msg)
-	}
-	return nil
+	return ps.Reply(request, MsgNearestPeersAck, &payload)
 }
 
 func (d *Discovery) onMsgNearestPeers() {
@@ -245,37 +394,16 @@ func (d *Discovery) onMsgNearestPeers() {
 			msg := ch.(*Message)
 			var targetID peer.ID
 			_ = rlp.DecodeBytes(msg.Payload, &targetID)
-			ps, err := d.streamPool.GetStream(msg.PeerID)
-			if err != nil {
+			if !d.allowFindnode(msg.PeerID, time.Now()) {
+				log.CLog().WithFields(logrus.Fields{"ID": msg.PeerID}).Debug("findnode rate limit")
 				continue
 			}
-			d.SendNearestPeers(targetID, ps)
-			log.CLog().WithFields(logrus.Fields{"TargetID": targetID}).Debug("PeerID: ", msg.PeerID)
-		}
-	}
-}
-
-func (d *Discovery) onMsgNearestPeersAck() {
-	for {
-		select {
-		case ch := <-d.MsgNearestPeersAckCh:
-			msg := ch.(*Message)
 			ps, err := d.streamPool.GetStream(msg.PeerID)
 			if err != nil {
 				continue
 			}
-			v, ok := ps.replys.Load(msg.Code)
-			if ok {
-				payload := make([]*PeerInfo2, 0)
-				_ = rlp.DecodeBytes(msg.Payload, &payload)
-				reply := make([]*peerstore.PeerInfo, 0)
-				for _, info := range payload {
-					reply = append(reply, FromPeerInfo2(info))
-				}
-				replyCh := v.(chan interface{})
-				replyCh <- reply
-				log.CLog().WithFields(logrus.Fields{"Size": len(reply)}).Debug("PeerID: ", msg.PeerID)
-			}
+			d.SendNearestPeers(msg, targetID, ps)
+			log.CLog().WithFields(logrus.Fields{"TargetID": targetID}).Debug("PeerID: ", msg.PeerID)
 		}
 	}
 }
@@ -353,26 +481,214 @@ func (d *Discovery) lookup(peerID peer.ID) error {
 	return nil
 }
 
-func (d *Discovery) randomLookup() error {
+// allowFindnode returns false if the peer sent more than findnodeLimit requests in findnodeWindow
+func (d *Discovery) allowFindnode(id peer.ID, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.findnodes == nil {
+		d.findnodes = make(map[peer.ID]*rateWindow)
+	}
+	w, ok := d.findnodes[id]
+	if !ok || now.Sub(w.start) >= findnodeWindow {
+		w = &rateWindow{start: now}
+		d.findnodes[id] = w
+	}
+	w.count++
+	return w.count <= findnodeLimit
+}
+
+// pruneFindnodes removes the windows which are over
+func (d *Discovery) pruneFindnodes(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, w := range d.findnodes {
+		if now.Sub(w.start) >= findnodeWindow {
+			delete(d.findnodes, id)
+		}
+	}
+}
+
+// cpl is the index of the bucket of id, the buckets after maxRefreshCpl are counted as one
+func (d *Discovery) cpl(id peer.ID) int {
+	cpl := kb.CommonPrefixLen(kb.ConvertPeerID(id), kb.ConvertPeerID(d.hostID))
+	if cpl > maxRefreshCpl {
+		cpl = maxRefreshCpl
+	}
+	return cpl
+}
+
+// randomID returns a random id which falls in the bucket of cpl
+func (d *Discovery) randomID(cpl int) (peer.ID, error) {
+	buf := make([]byte, 32)
+	for i := 0; i < 1<<20; i++ {
+		if _, err := crand.Read(buf); err != nil {
+			return "", err
+		}
+		hash, err := mh.Sum(buf, mh.SHA2_256, -1)
+		if err != nil {
+			return "", err
+		}
+		id := peer.ID(hash)
+		if d.cpl(id) == cpl {
+			return id, nil
+		}
+	}
+	return "", errors.Errorf("no random id for bucket %d", cpl)
+}
+
+/*
+staleBuckets returns the buckets which are not refreshed in bucketRefreshInterval, the oldest first.
+The buckets up to the closest peer are refreshed, so the table learns the peers near the host.
+*/
+func (d *Discovery) staleBuckets(now time.Time) []int {
 	peers := d.routingTable.ListPeers()
-	size := len(peers)
-	if size == 0 {
+	if len(peers) == 0 {
+		return nil
+	}
+	maxCpl := 0
+	for _, id := range peers {
+		if cpl := d.cpl(id); cpl > maxCpl {
+			maxCpl = cpl
+		}
+	}
+	if maxCpl < maxRefreshCpl {
+		maxCpl++
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refreshed == nil {
+		d.refreshed = make(map[int]time.Time)
+	}
+	stale := make([]int, 0)
+	for cpl := 0; cpl <= maxCpl; cpl++ {
+		if now.Sub(d.refreshed[cpl]) >= bucketRefreshInterval {
+			stale = append(stale, cpl)
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool {
+		return d.refreshed[stale[i]].Before(d.refreshed[stale[j]])
+	})
+	return stale
+}
+
+// refreshBuckets looks up a random id in the stale buckets, maxRefreshPerRound at most
+func (d *Discovery) refreshBuckets(now time.Time) error {
+	stale := d.staleBuckets(now)
+	if d.routingTable.Size() == 0 {
 		return errors.New("Not found peer")
 	}
-	rand.Seed(time.Now().Unix())
-	id := peers[rand.Intn(size)]
-	if id == d.hostID {
-		return errors.New("TargetID cannot is hostID")
+	if len(stale) > maxRefreshPerRound {
+		stale = stale[:maxRefreshPerRound]
+	}
+	for _, cpl := range stale {
+		id, err := d.randomID(cpl)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.refreshed[cpl] = now
+		d.mu.Unlock()
+		if err := d.lookup(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pingTargets returns the peers in the table which did not answer a ping in pingInterval, the oldest first
+func (d *Discovery) pingTargets(now time.Time) []peer.ID {
+	peers := d.routingTable.ListPeers()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.liveness == nil {
+		d.liveness = make(map[peer.ID]*liveness)
+	}
+	targets := make([]peer.ID, 0)
+	for _, id := range peers {
+		l, ok := d.liveness[id]
+		if !ok {
+			l = &liveness{}
+			d.liveness[id] = l
+		}
+		if now.Sub(l.lastPong) >= pingInterval {
+			targets = append(targets, id)
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return d.liveness[targets[i]].lastPong.Before(d.liveness[targets[j]].lastPong)
+	})
+	if len(targets) > maxPingsPerRound {
+		targets = targets[:maxPingsPerRound]
+	}
+	return targets
+}
+
+// recordPing returns true if the peer failed maxPingFailures pings in a row
+func (d *Discovery) recordPing(id peer.ID, ok bool, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l, exists := d.liveness[id]
+	if !exists {
+		return false
+	}
+	if ok {
+		l.lastPong = now
+		l.failures = 0
+		return false
+	}
+	l.failures++
+	return l.failures >= maxPingFailures
+}
+
+// ping connects to the peer if it is not connected and waits for MsgPong
+func (d *Discovery) ping(id peer.ID) error {
+	info := d.peerstore.PeerInfo(id)
+	if len(info.Addrs) == 0 {
+		return errors.New("no address")
+	}
+	ps, err := d.bond(&info)
+	if err != nil {
+		return err
+	}
+	msg, err := NewRLPMessage(MsgPing, []byte{})
+	if err != nil {
+		return err
+	}
+	future, err := ps.Request(&msg, pingTimeout)
+	if err != nil {
+		return err
+	}
+	_, err = future.Wait()
+	return err
+}
+
+// pingPeers pings the peers of the table in parallel and evicts the dead ones
+func (d *Discovery) pingPeers(now time.Time) {
+	var wg sync.WaitGroup
+	for _, id := range d.pingTargets(now) {
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			err := d.ping(id)
+			if d.recordPing(id, err == nil, time.Now()) {
+				log.CLog().WithFields(logrus.Fields{
+					"ID":  id,
+					"Msg": err,
+				}).Info("evict dead peer from routing table")
+				d.removeFromTable(id)
+				d.peerstore.ClearAddrs(id)
+			}
+		}(id)
 	}
-	return d.lookup(id)
+	wg.Wait()
 }
 
 func (d *Discovery) Start() {
-	err := d.randomLookup()
+	err := d.refreshBuckets(time.Now())
 	if err != nil {
 		log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
 	}
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(discoveryInterval)
 	for {
 		select {
 		case <-ticker.C:
@@ -380,11 +696,15 @@ func (d *Discovery) Start() {
 			log.CLog().WithFields(logrus.Fields{
 				"count": runtime.NumGoroutine(),
 			}).Debug("NumGoroutine")
-			err := d.randomLookup()
+			now := time.Now()
+			d.expirePeers()
+			d.pruneFindnodes(now)
+			d.pingPeers(now)
+			err := d.refreshBuckets(now)
 			if err != nil {
 				log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
 			}
-			ticker = time.NewTicker(30 * time.Second)
+			ticker = time.NewTicker(discoveryInterval)
 		}
 	}
 }
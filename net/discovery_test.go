@@ -197,6 +197,87 @@ func TestRandomPeerInfo(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestDiscoveryIPLimit(t *testing.T) {
+	peerInfos := MakePeerInfo()
+	addr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/8080")
+	d := NewDiscovery(peerInfos[0].ID, addr, peerstore.NewMetrics(), pstoremem.NewPeerstore(), NewPeerStreamPool(), nil)
+	public, _ := multiaddr.NewMultiaddr("/ip4/8.8.8.8/tcp/9991")
+	for i := 1; i <= tableIPLimit+1; i++ {
+		d.Update(&peerstore.PeerInfo{ID: peerInfos[i].ID, Addrs: []ma.Multiaddr{public}})
+	}
+	assert.Equal(t, tableIPLimit, d.routingTable.Size())
+	assert.Equal(t, 0, len(d.peerstore.Addrs(peerInfos[tableIPLimit+1].ID)))
+
+	//a removed peer frees its ip
+	d.Remove(peerInfos[1])
+	d.UpdateAddr(peerInfos[tableIPLimit+1].ID, public)
+	assert.Equal(t, tableIPLimit, d.routingTable.Size())
+	assert.Equal(t, peerInfos[tableIPLimit+1].ID, d.routingTable.Find(peerInfos[tableIPLimit+1].ID))
+}
+
+func TestDiscoveryPing(t *testing.T) {
+	peerInfos := MakePeerInfo()
+	addr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/8080")
+	d := NewDiscovery(peerInfos[0].ID, addr, peerstore.NewMetrics(), pstoremem.NewPeerstore(), NewPeerStreamPool(), nil)
+	d.Update(peerInfos[1])
+	d.Update(peerInfos[2])
+	now := time.Now()
+
+	//every peer is pinged first, then only the peers without pong in pingInterval
+	assert.Equal(t, 2, len(d.pingTargets(now)))
+	assert.False(t, d.recordPing(peerInfos[1].ID, true, now))
+	targets := d.pingTargets(now.Add(time.Second))
+	assert.Equal(t, []peer.ID{peerInfos[2].ID}, targets)
+	assert.Equal(t, 2, len(d.pingTargets(now.Add(pingInterval))))
+
+	//evicted after maxPingFailures failures in a row
+	for i := 1; i < maxPingFailures; i++ {
+		assert.False(t, d.recordPing(peerInfos[2].ID, false, now))
+	}
+	assert.False(t, d.recordPing(peerInfos[2].ID, true, now))
+	for i := 1; i < maxPingFailures; i++ {
+		assert.False(t, d.recordPing(peerInfos[2].ID, false, now))
+	}
+	assert.True(t, d.recordPing(peerInfos[2].ID, false, now))
+}
+
+func TestDiscoveryRefresh(t *testing.T) {
+	peerInfos := MakePeerInfo()
+	addr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/8080")
+	d := NewDiscovery(peerInfos[0].ID, addr, peerstore.NewMetrics(), pstoremem.NewPeerstore(), NewPeerStreamPool(), nil)
+	now := time.Now()
+	assert.Nil(t, d.staleBuckets(now))
+	for _, info := range peerInfos[1:] {
+		d.Update(info)
+	}
+	stale := d.staleBuckets(now)
+	assert.True(t, len(stale) > 1)
+	for _, cpl := range []int{0, stale[len(stale)-1]} {
+		id, err := d.randomID(cpl)
+		assert.NoError(t, err)
+		assert.Equal(t, cpl, d.cpl(id))
+	}
+
+	//a refreshed bucket is stale again after bucketRefreshInterval
+	d.refreshed[0] = now
+	assert.NotContains(t, d.staleBuckets(now), 0)
+	assert.Equal(t, 0, d.staleBuckets(now.Add(bucketRefreshInterval))[len(stale)-1])
+}
+
+func TestFindnodeRateLimit(t *testing.T) {
+	peerInfos := MakePeerInfo()
+	d := &Discovery{}
+	now := time.Now()
+	for i := 0; i < findnodeLimit; i++ {
+		assert.True(t, d.allowFindnode(peerInfos[1].ID, now))
+	}
+	assert.False(t, d.allowFindnode(peerInfos[1].ID, now))
+	assert.True(t, d.allowFindnode(peerInfos[2].ID, now))
+	assert.True(t, d.allowFindnode(peerInfos[1].ID, now.Add(findnodeWindow)))
+	d.pruneFindnodes(now.Add(2 * findnodeWindow))
+	assert.Equal(t, 0, len(d.findnodes))
+}
+
 func TestDistance(t *testing.T) {
 	peerInfos := MakePeerInfo()
 	ids := make([]peer.ID, 0, len(peerInfos))
@@ -0,0 +1,175 @@
+package net
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/rlp"
+)
+
+const (
+	frameHeaderSize = 7 //length(4) + flag(1) + code(2)
+	frameRaw        = byte(0)
+	frameSnappy     = byte(1)
+	frameEncrypted  = byte(2)
+
+	// MaxFrameSize is the limit of any frame, a message is limited by maxMessageSizes of its code
+	MaxFrameSize          = 16 * 1024 * 1024
+	defaultMaxMessageSize = 1024 * 1024
+)
+
+// errors constants
+var (
+	ErrFrameTooLarge   = errors.New("frame is too large")
+	ErrMessageTooLarge = errors.New("message is too large for its code")
+	ErrUnknownFrame    = errors.New("unknown frame flag")
+	ErrFrameCode       = errors.New("message code does not match the frame")
+)
+
+// maximum size of encoded message by code, defaultMaxMessageSize if not listed
+var maxMessageSizes = map[uint64]int{
+	MsgHello:                  4 * 1024,
+	MsgHelloAck:               4 * 1024,
+	MsgPing:                   256,
+	MsgPong:                   256,
+	MsgNearestPeers:           1024,
+	MsgNearestPeersAck:        64 * 1024,
+	MsgNewBlock:               4 * 1024 * 1024,
+	MsgMissingBlock:           1024,
+	MsgMissingBlockAck:        4 * 1024 * 1024,
+	MsgMissingBlocks:          1024,
+	MsgMissingBlocksAck:       4 * 1024 * 1024,
+	MsgNewTx:                  128 * 1024,
+	MsgNewBlockHashes:         64 * 1024,
+	MsgNewPooledTxHashes:      16 * 1024,
+	MsgGetPooledTxs:           16 * 1024,
+	MsgPooledTxs:              4 * 1024 * 1024,
+	MsgCheckpointVote:         1024,
+	MsgGetCheckpointBlock:     1024,
+	MsgCheckpointBlockAck:     4 * 1024 * 1024,
+	MsgGetTrieNodes:           64 * 1024,
+	MsgTrieNodes:              MaxFrameSize,
+	MsgGetFinalizedCheckpoint: 1024,
+	MsgFinalizedCheckpoint:    64 * 1024,
+	MsgGetProof:               1024,
+	MsgProof:                  64 * 1024,
+	MsgGetBlockHeaders:        1024,
+	MsgBlockHeaders:           2 * 1024 * 1024,
+	MsgGetBlockBodies:         4 * 1024,
+	MsgBlockBodies:            MaxFrameSize,
+}
+
+func maxMessageSize(code uint64) int {
+	if size, ok := maxMessageSizes[code]; ok {
+		return size
+	}
+	return defaultMaxMessageSize
+}
+
+// maxFrameBodySize is the largest body of a frame whose message is not over limit after it is compressed and sealed
+func maxFrameBodySize(limit int, cipher *sessionCipher) int {
+	size := snappy.MaxEncodedLen(limit)
+	if cipher != nil {
+		size += cipher.read.Overhead()
+	}
+	return size
+}
+
+/*
+encodeFrame encodes message with length prefix.
+frame : length(4, big endian) | flag(1) | code(2, big endian) | rlp(message), snappy compressed if flag has frameSnappy
+and then sealed by cipher if flag has frameEncrypted.
+The code is not sealed, it is only used to limit the size and is compared with the message after decoding.
+*/
+func encodeFrame(message *Message, compress bool, cipher *sessionCipher) ([]byte, error) {
+	encodedBytes, err := rlp.EncodeToBytes(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(encodedBytes) > maxMessageSize(message.Code) {
+		return nil, ErrMessageTooLarge
+	}
+	if message.Code > 0xffff {
+		return nil, ErrFrameCode
+	}
+	flag := frameRaw
+	if compress {
+		encodedBytes = snappy.Encode(nil, encodedBytes)
+		flag = frameSnappy
+	}
+	if cipher != nil {
+		encodedBytes = cipher.seal(encodedBytes)
+		flag |= frameEncrypted
+	}
+	frame := make([]byte, frameHeaderSize+len(encodedBytes))
+	binary.BigEndian.PutUint32(frame, uint32(len(encodedBytes)))
+	frame[4] = flag
+	binary.BigEndian.PutUint16(frame[5:], uint16(message.Code))
+	copy(frame[frameHeaderSize:], encodedBytes)
+	return frame, nil
+}
+
+/*
+readFrame reads a message, frames must be encrypted if cipher is set.
+The limit of the code in the header is checked before the body is read and before it is decompressed.
+*/
+func readFrame(r io.Reader, cipher *sessionCipher) (*Message, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	code := uint64(binary.BigEndian.Uint16(header[5:]))
+	limit := maxMessageSize(code)
+	if int(size) > maxFrameBodySize(limit, cipher) {
+		return nil, ErrMessageTooLarge
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	flag := header[4]
+	if flag&^(frameSnappy|frameEncrypted) != 0 {
+		return nil, ErrUnknownFrame
+	}
+	if flag&frameEncrypted != 0 {
+		if cipher == nil {
+			return nil, ErrUnknownFrame
+		}
+		var err error
+		if body, err = cipher.open(body); err != nil {
+			return nil, err
+		}
+	} else if cipher != nil {
+		return nil, ErrFrameEncrypted
+	}
+	if flag&frameSnappy != 0 {
+		decodedLen, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if decodedLen > limit {
+			return nil, ErrMessageTooLarge
+		}
+		if body, err = snappy.Decode(nil, body); err != nil {
+			return nil, err
+		}
+	}
+	if len(body) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	message := new(Message)
+	if err := rlp.DecodeBytes(body, message); err != nil {
+		return nil, err
+	}
+	if message.Code != code {
+		return nil, ErrFrameCode
+	}
+	return message, nil
+}
@@ -0,0 +1,59 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		msg, _ := NewRLPMessage(MsgNewTx, bytes.Repeat([]byte{0x1}, 1000))
+		msg.RequestID = 7
+		frame, err := encodeFrame(&msg, compress, nil)
+		assert.NoError(t, err)
+		if compress {
+			assert.True(t, len(frame) < 1000)
+		}
+		buf := bytes.NewBuffer(frame)
+		buf.Write(frame)
+		for i := 0; i < 2; i++ {
+			decoded, err := readFrame(buf, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, msg.Payload, decoded.Payload)
+			assert.Equal(t, uint64(7), decoded.RequestID)
+		}
+	}
+
+	//limit by code
+	msg, _ := NewRLPMessage(MsgNearestPeers, bytes.Repeat([]byte{0x1}, 2000))
+	_, err := encodeFrame(&msg, false, nil)
+	assert.Equal(t, ErrMessageTooLarge, err)
+	encodedBytes, _ := rlp.EncodeToBytes(&msg)
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(encodedBytes))
+	binary.BigEndian.PutUint32(frame, uint32(len(encodedBytes)))
+	binary.BigEndian.PutUint16(frame[5:], uint16(MsgNearestPeers))
+	//rejected by the header before reading body
+	_, err = readFrame(bytes.NewReader(frame[:frameHeaderSize]), nil)
+	assert.Equal(t, ErrMessageTooLarge, err)
+
+	//the code of the header must be the code of the message
+	binary.BigEndian.PutUint16(frame[5:], uint16(MsgNewTx))
+	frame = append(frame, encodedBytes...)
+	_, err = readFrame(bytes.NewReader(frame), nil)
+	assert.Equal(t, ErrFrameCode, err)
+
+	//frame over MaxFrameSize is rejected before reading body
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header, MaxFrameSize+1)
+	_, err = readFrame(bytes.NewReader(header), nil)
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	header[4] = 0x4
+	binary.BigEndian.PutUint32(header, 0)
+	_, err = readFrame(bytes.NewReader(header), nil)
+	assert.Equal(t, ErrUnknownFrame, err)
+}
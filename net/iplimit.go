@@ -0,0 +1,142 @@
+package net
+
+import (
+	gonet "net"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	tableIPLimit     = 2  //peers of the same ip in the routing table
+	tableSubnetLimit = 10 //peers of the same /24 (/64 for ipv6) subnet in the routing table
+)
+
+var lanNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*gonet.IPNet {
+	nets := make([]*gonet.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := gonet.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// addrIP returns the ip of addr, nil if addr is not an ip address
+func addrIP(addr ma.Multiaddr) gonet.IP {
+	if addr == nil {
+		return nil
+	}
+	if v, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
+		return gonet.ParseIP(v).To4()
+	}
+	if v, err := addr.ValueForProtocol(ma.P_IP6); err == nil {
+		return gonet.ParseIP(v)
+	}
+	return nil
+}
+
+// isLAN returns true if ip is loopback, private, link local or unspecified
+func isLAN(ip gonet.IP) bool {
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// subnet is the /24 of ipv4 or the /64 of ipv6
+func subnet(ip gonet.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(gonet.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(gonet.CIDRMask(64, 128)).String()
+}
+
+/*
+filterPeerInfos drops the peers which have no usable address or are the host.
+A peer on a public address cannot advertise lan addresses, they are not reachable from here
+or they are used to make this node dial inside its network.
+*/
+func filterPeerInfos(infos []*peerstore.PeerInfo, from ma.Multiaddr, hostID peer.ID) []*peerstore.PeerInfo {
+	fromIP := addrIP(from)
+	fromLAN := fromIP == nil || isLAN(fromIP)
+	filtered := make([]*peerstore.PeerInfo, 0, len(infos))
+	for _, info := range infos {
+		if info == nil || info.ID == hostID || len(info.Addrs) == 0 || info.Addrs[0] == nil {
+			continue
+		}
+		ip := addrIP(info.Addrs[0])
+		if ip == nil || ip.IsUnspecified() || (!fromLAN && isLAN(ip)) {
+			continue
+		}
+		filtered = append(filtered, info)
+	}
+	return filtered
+}
+
+/*
+ipLimiter counts the peers of the routing table by ip and subnet,
+so a host cannot fill the table with many peer ids. Lan addresses are not limited.
+*/
+type ipLimiter struct {
+	peers   map[peer.ID]gonet.IP
+	ips     map[string]int
+	subnets map[string]int
+}
+
+// add returns false if the ip or its subnet has too many peers
+func (l *ipLimiter) add(id peer.ID, ip gonet.IP) bool {
+	if l.peers == nil {
+		l.peers = make(map[peer.ID]gonet.IP)
+		l.ips = make(map[string]int)
+		l.subnets = make(map[string]int)
+	}
+	if old, ok := l.peers[id]; ok {
+		if old.Equal(ip) {
+			return true
+		}
+		l.remove(id)
+	}
+	if ip == nil || isLAN(ip) {
+		return true
+	}
+	if l.ips[ip.String()] >= tableIPLimit || l.subnets[subnet(ip)] >= tableSubnetLimit {
+		return false
+	}
+	l.peers[id] = ip
+	l.ips[ip.String()]++
+	l.subnets[subnet(ip)]++
+	return true
+}
+
+func (l *ipLimiter) remove(id peer.ID) {
+	ip, ok := l.peers[id]
+	if !ok {
+		return
+	}
+	delete(l.peers, id)
+	if l.ips[ip.String()]--; l.ips[ip.String()] <= 0 {
+		delete(l.ips, ip.String())
+	}
+	if l.subnets[subnet(ip)]--; l.subnets[subnet(ip)] <= 0 {
+		delete(l.subnets, subnet(ip))
+	}
+}
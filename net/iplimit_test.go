@@ -0,0 +1,64 @@
+package net
+
+import (
+	"fmt"
+	"testing"
+
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPLimiter(t *testing.T) {
+	peerInfos := MakePeerInfo()
+	l := ipLimiter{}
+	ip := addrIP(mustAddr("/ip4/8.8.8.8/tcp/9991"))
+
+	//tableIPLimit peers of an ip
+	for i := 0; i < tableIPLimit; i++ {
+		assert.True(t, l.add(peerInfos[i].ID, ip))
+	}
+	assert.False(t, l.add(peerInfos[tableIPLimit].ID, ip))
+	l.remove(peerInfos[0].ID)
+	assert.True(t, l.add(peerInfos[tableIPLimit].ID, ip))
+	assert.True(t, l.add(peerInfos[tableIPLimit].ID, ip))
+
+	//tableSubnetLimit peers of a /24
+	l = ipLimiter{}
+	for i := 0; i < tableSubnetLimit; i++ {
+		assert.True(t, l.add(peerInfos[i].ID, addrIP(mustAddr(fmt.Sprintf("/ip4/8.8.8.%d/tcp/9991", i)))))
+	}
+	assert.False(t, l.add(peerInfos[tableSubnetLimit].ID, addrIP(mustAddr("/ip4/8.8.8.200/tcp/9991"))))
+	assert.True(t, l.add(peerInfos[tableSubnetLimit].ID, addrIP(mustAddr("/ip4/8.8.9.200/tcp/9991"))))
+
+	//lan addresses are not limited
+	l = ipLimiter{}
+	for i := 0; i < tableSubnetLimit+1; i++ {
+		assert.True(t, l.add(peerInfos[i].ID, addrIP(mustAddr("/ip4/127.0.0.1/tcp/9991"))))
+	}
+}
+
+func TestFilterPeerInfos(t *testing.T) {
+	peerInfos := MakePeerInfo()
+	public := &peerstore.PeerInfo{ID: peerInfos[1].ID, Addrs: []ma.Multiaddr{mustAddr("/ip4/8.8.8.8/tcp/9991")}}
+	lan := &peerstore.PeerInfo{ID: peerInfos[2].ID, Addrs: []ma.Multiaddr{mustAddr("/ip4/192.168.0.1/tcp/9991")}}
+	unspecified := &peerstore.PeerInfo{ID: peerInfos[3].ID, Addrs: []ma.Multiaddr{mustAddr("/ip4/0.0.0.0/tcp/9991")}}
+	host := &peerstore.PeerInfo{ID: peerInfos[0].ID, Addrs: []ma.Multiaddr{mustAddr("/ip4/8.8.4.4/tcp/9991")}}
+	noAddr := &peerstore.PeerInfo{ID: peerInfos[4].ID}
+	infos := []*peerstore.PeerInfo{public, lan, unspecified, host, noAddr, nil}
+
+	//a public peer cannot advertise lan addresses
+	filtered := filterPeerInfos(infos, mustAddr("/ip4/1.1.1.1/tcp/9991"), peerInfos[0].ID)
+	assert.Equal(t, []*peerstore.PeerInfo{public}, filtered)
+
+	filtered = filterPeerInfos(infos, mustAddr("/ip4/10.0.0.1/tcp/9991"), peerInfos[0].ID)
+	assert.Equal(t, []*peerstore.PeerInfo{public, lan}, filtered)
+}
+
+func mustAddr(s string) ma.Multiaddr {
+	addr, err := ma.NewMultiaddr(s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
@@ -0,0 +1,35 @@
+package net
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/nacamp/go-simplechain/common"
+)
+
+const (
+	maxKnownBlocks = 1024
+	maxKnownTxs    = 32768
+	maxKnownVotes  = 1024
+)
+
+// knownSet records the hashes that a peer is known to have, the oldest hash is evicted over the limit
+type knownSet struct {
+	cache *lru.Cache
+}
+
+func newKnownSet(limit int) *knownSet {
+	cache, _ := lru.New(limit)
+	return &knownSet{cache: cache}
+}
+
+func (k *knownSet) Add(hash common.Hash) {
+	k.cache.Add(hash, struct{}{})
+}
+
+func (k *knownSet) Contains(hash common.Hash) bool {
+	return k.cache.Contains(hash)
+}
+
+func (k *knownSet) Len() int {
+	return k.cache.Len()
+}
@@ -0,0 +1,33 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKnownSet(t *testing.T) {
+	known := newKnownSet(2)
+	h1 := common.BytesToHash([]byte{1})
+	h2 := common.BytesToHash([]byte{2})
+	h3 := common.BytesToHash([]byte{3})
+
+	known.Add(h1)
+	known.Add(h2)
+	assert.True(t, known.Contains(h1))
+	assert.True(t, known.Contains(h2))
+
+	//the oldest is evicted
+	known.Add(h3)
+	assert.Equal(t, 2, known.Len())
+	assert.False(t, known.Contains(h1))
+	assert.True(t, known.Contains(h3))
+}
+
+func TestPushCount(t *testing.T) {
+	assert.Equal(t, 1, pushCount(1))
+	assert.Equal(t, 1, pushCount(3))
+	assert.Equal(t, 2, pushCount(4))
+	assert.Equal(t, 3, pushCount(10))
+}
@@ -0,0 +1,286 @@
+package net
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/common"
+)
+
+// errors constants
+var (
+	ErrPeerUnreachable     = errors.New("peer is unreachable")
+	ErrProtocolUnsupported = errors.New("protocol is not supported by peer")
+)
+
+/*
+MemoryNetwork connects MemoryTransports in one process.
+Each write is delivered as a whole after latency measured by clock, or lost with the loss rate,
+so a lost write drops whole frames and the stream stays decodable.
+Peers in different partitions can neither dial nor receive writes of each other.
+*/
+type MemoryNetwork struct {
+	inflight   int64  //bytes which are delivered but not read yet
+	activity   uint64 //writes and reads so far
+	mu         sync.Mutex
+	clock      common.Clock
+	rand       *rand.Rand
+	transports map[peer.ID]*MemoryTransport
+	latency    time.Duration
+	loss       float64
+	partitions map[peer.ID]int
+}
+
+func NewMemoryNetwork(clock common.Clock, seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		clock:      clock,
+		rand:       rand.New(rand.NewSource(seed)),
+		transports: make(map[peer.ID]*MemoryTransport),
+		partitions: make(map[peer.ID]int),
+	}
+}
+
+// NewTransport attaches the peer to the network
+func (n *MemoryNetwork) NewTransport(id peer.ID, addr ma.Multiaddr) *MemoryTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t := &MemoryTransport{
+		network:   n,
+		id:        id,
+		addr:      addr,
+		peerstore: pstoremem.NewPeerstore(),
+		handlers:  make(map[string]func(Stream)),
+	}
+	n.transports[id] = t
+	return t
+}
+
+func (n *MemoryNetwork) SetLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = latency
+}
+
+// SetLoss sets the rate of lost writes between 0 and 1
+func (n *MemoryNetwork) SetLoss(loss float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = loss
+}
+
+// Partition splits the network into groups, the peers which are not in any group are in group 0
+func (n *MemoryNetwork) Partition(groups ...[]peer.ID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = make(map[peer.ID]int)
+	for i, group := range groups {
+		for _, id := range group {
+			n.partitions[id] = i + 1
+		}
+	}
+}
+
+// Heal removes partitions
+func (n *MemoryNetwork) Heal() {
+	n.Partition()
+}
+
+/*
+Activity returns the number of bytes which are delivered but not read yet and
+a counter which moves on every delivery and read.
+The network is quiet when nothing is in flight and the counter stays.
+*/
+func (n *MemoryNetwork) Activity() (inflight int64, activity uint64) {
+	return atomic.LoadInt64(&n.inflight), atomic.LoadUint64(&n.activity)
+}
+
+func (n *MemoryNetwork) track(delta int) {
+	atomic.AddInt64(&n.inflight, int64(delta))
+	atomic.AddUint64(&n.activity, 1)
+}
+
+func (n *MemoryNetwork) reachable(from, to peer.ID) bool {
+	return n.partitions[from] == n.partitions[to]
+}
+
+func (n *MemoryNetwork) dial(from *MemoryTransport, to peer.ID, protocolID string) (Stream, error) {
+	n.mu.Lock()
+	remote, ok := n.transports[to]
+	if !ok || !n.reachable(from.id, to) {
+		n.mu.Unlock()
+		return nil, ErrPeerUnreachable
+	}
+	n.mu.Unlock()
+	handler := remote.handler(protocolID)
+	if handler == nil {
+		return nil, ErrProtocolUnsupported
+	}
+	local, inbound := newMemoryStreamPair(n, from, remote)
+	go handler(inbound)
+	return local, nil
+}
+
+// send delivers data to the remote end of stream unless it is lost
+func (n *MemoryNetwork) send(s *memoryStream, data []byte) {
+	n.mu.Lock()
+	lost := !n.reachable(s.local, s.remote) || (n.loss > 0 && n.rand.Float64() < n.loss)
+	latency := n.latency
+	n.mu.Unlock()
+	if lost {
+		return
+	}
+	copied := append([]byte(nil), data...)
+	if latency == 0 {
+		s.peer.in.write(copied)
+		return
+	}
+	n.clock.AfterFunc(latency, func() {
+		s.peer.in.write(copied)
+	})
+}
+
+// MemoryTransport is a Transport on MemoryNetwork
+type MemoryTransport struct {
+	mu        sync.Mutex
+	network   *MemoryNetwork
+	id        peer.ID
+	addr      ma.Multiaddr
+	peerstore peerstore.Peerstore
+	handlers  map[string]func(Stream)
+}
+
+func (t *MemoryTransport) ID() peer.ID {
+	return t.id
+}
+
+func (t *MemoryTransport) Addr() ma.Multiaddr {
+	return t.addr
+}
+
+func (t *MemoryTransport) Peerstore() peerstore.Peerstore {
+	return t.peerstore
+}
+
+func (t *MemoryTransport) SetStreamHandler(protocolID string, handler func(Stream)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers[protocolID] = handler
+}
+
+func (t *MemoryTransport) handler(protocolID string) func(Stream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.handlers[protocolID]
+}
+
+func (t *MemoryTransport) NewStream(id peer.ID, addr ma.Multiaddr, protocolID string) (Stream, error) {
+	t.peerstore.AddAddr(id, addr, peerstore.PermanentAddrTTL)
+	return t.network.dial(t, id, protocolID)
+}
+
+// memoryBuffer is the receiving side of memoryStream, read blocks until data is written or it is closed
+type memoryBuffer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	network *MemoryNetwork
+	buf     bytes.Buffer
+	closed  bool
+}
+
+func newMemoryBuffer(n *MemoryNetwork) *memoryBuffer {
+	b := &memoryBuffer{network: n}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memoryBuffer) write(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.buf.Write(data)
+	b.network.track(len(data))
+	b.cond.Broadcast()
+}
+
+func (b *memoryBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, err := b.buf.Read(p)
+	b.network.track(-n)
+	return n, err
+}
+
+func (b *memoryBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+type memoryStream struct {
+	network    *MemoryNetwork
+	local      peer.ID
+	remote     peer.ID
+	remoteAddr ma.Multiaddr
+	in         *memoryBuffer
+	peer       *memoryStream
+	closeOnce  sync.Once
+}
+
+func newMemoryStreamPair(n *MemoryNetwork, dialer, listener *MemoryTransport) (*memoryStream, *memoryStream) {
+	outbound := &memoryStream{network: n, local: dialer.id, remote: listener.id, remoteAddr: listener.addr, in: newMemoryBuffer(n)}
+	inbound := &memoryStream{network: n, local: listener.id, remote: dialer.id, remoteAddr: dialer.addr, in: newMemoryBuffer(n)}
+	outbound.peer = inbound
+	inbound.peer = outbound
+	return outbound, inbound
+}
+
+func (s *memoryStream) Read(p []byte) (int, error) {
+	return s.in.read(p)
+}
+
+func (s *memoryStream) Write(p []byte) (int, error) {
+	s.in.mu.Lock()
+	closed := s.in.closed
+	s.in.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	s.network.send(s, p)
+	return len(p), nil
+}
+
+// Close closes both ends
+func (s *memoryStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.in.close()
+		s.peer.Close()
+	})
+	return nil
+}
+
+func (s *memoryStream) RemotePeer() peer.ID {
+	return s.remote
+}
+
+func (s *memoryStream) RemoteAddr() ma.Multiaddr {
+	return s.remoteAddr
+}
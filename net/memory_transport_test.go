@@ -0,0 +1,74 @@
+package net
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	clock := common.NewVirtualClock(time.Unix(0, 0))
+	network := NewMemoryNetwork(clock, 1)
+	id1, _ := peer.IDB58Decode("16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk")
+	id2, _ := peer.IDB58Decode("16Uiu2HAkxKaG3PHSLfDhfZ7a8YzP6w6fKooBTY1gmfSXxGYbsNuN")
+	addr1, _ := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/9991")
+	addr2, _ := ma.NewMultiaddr("/ip4/10.0.0.2/tcp/9991")
+	t1 := network.NewTransport(id1, addr1)
+	t2 := network.NewTransport(id2, addr2)
+
+	inbound := make(chan Stream, 1)
+	t1.SetStreamHandler("/test", func(s Stream) {
+		inbound <- s
+	})
+	_, err := t2.NewStream(id1, addr1, "/other")
+	assert.Equal(t, ErrProtocolUnsupported, err)
+
+	s2, err := t2.NewStream(id1, addr1, "/test")
+	assert.NoError(t, err)
+	s1 := <-inbound
+	assert.Equal(t, id2, s1.RemotePeer())
+	assert.Equal(t, addr2.String(), s1.RemoteAddr().String())
+
+	//delivered after latency
+	network.SetLatency(time.Second)
+	s2.Write([]byte("hello"))
+	assert.Equal(t, 1, clock.Pending())
+	inflight, activity := network.Activity()
+	assert.Equal(t, int64(0), inflight)
+	clock.Advance(time.Second)
+	inflight, _ = network.Activity()
+	assert.Equal(t, int64(5), inflight)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(s1, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	inflight, moved := network.Activity()
+	assert.Equal(t, int64(0), inflight)
+	assert.True(t, moved > activity)
+
+	//lost
+	network.SetLatency(0)
+	network.SetLoss(1)
+	s2.Write([]byte("lost"))
+	network.SetLoss(0)
+	s2.Write([]byte("ok"))
+	buf = make([]byte, 2)
+	_, err = io.ReadFull(s1, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+
+	//partitioned
+	network.Partition([]peer.ID{id1}, []peer.ID{id2})
+	_, err = t2.NewStream(id1, addr1, "/test")
+	assert.Equal(t, ErrPeerUnreachable, err)
+	network.Heal()
+
+	s2.Close()
+	_, err = s1.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,174 @@
+package net
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+const maxPeerCounters = 1024 //peers whose counters are kept, the least recently active is forgotten
+
+// Counters are the traffic of a peer or a message code
+type Counters struct {
+	BytesIn      uint64
+	BytesOut     uint64
+	MessagesIn   uint64
+	MessagesOut  uint64
+	Errors       uint64
+	Requests     uint64        //requests completed by a reply
+	LatencyTotal time.Duration //sum of the latency of Requests
+	LatencyMax   time.Duration
+}
+
+// LatencyAvg is the average latency of requests completed by a reply
+func (c *Counters) LatencyAvg() time.Duration {
+	if c.Requests == 0 {
+		return 0
+	}
+	return c.LatencyTotal / time.Duration(c.Requests)
+}
+
+func (c *Counters) addLatency(latency time.Duration) {
+	c.Requests++
+	c.LatencyTotal += latency
+	if latency > c.LatencyMax {
+		c.LatencyMax = latency
+	}
+}
+
+// PeerCounters are the counters of a peer
+type PeerCounters struct {
+	ID peer.ID
+	Counters
+}
+
+// CodeCounters are the counters of a message code
+type CodeCounters struct {
+	Code uint64
+	Counters
+}
+
+/*
+Metrics counts the frames which PeerStream sends and receives by peer and by message code.
+Bytes are the size of frames on the wire, errors are broken frames, failed writes and failed requests.
+Counters of a peer are kept after it is disconnected until maxPeerCounters other peers are more recently active,
+the total and the counters of codes still include the forgotten peers.
+*/
+type Metrics struct {
+	mu    sync.Mutex
+	total Counters
+	peers *lru.Cache
+	codes map[uint64]*Counters
+}
+
+func NewMetrics() *Metrics {
+	peers, _ := lru.New(maxPeerCounters)
+	return &Metrics{
+		peers: peers,
+		codes: make(map[uint64]*Counters),
+	}
+}
+
+// update calls f with the counters of total, the peer and the code, code is skipped if it is unknown
+func (m *Metrics) update(id peer.ID, code uint64, hasCode bool, f func(c *Counters)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&m.total)
+	var c *Counters
+	if v, ok := m.peers.Get(id); ok {
+		c = v.(*Counters)
+	} else {
+		c = new(Counters)
+		m.peers.Add(id, c)
+	}
+	f(c)
+	if !hasCode {
+		return
+	}
+	c, ok := m.codes[code]
+	if !ok {
+		c = new(Counters)
+		m.codes[code] = c
+	}
+	f(c)
+}
+
+func (m *Metrics) recordIn(id peer.ID, code uint64, size int) {
+	m.update(id, code, true, func(c *Counters) {
+		c.BytesIn += uint64(size)
+		c.MessagesIn++
+	})
+}
+
+func (m *Metrics) recordOut(id peer.ID, code uint64, size int) {
+	m.update(id, code, true, func(c *Counters) {
+		c.BytesOut += uint64(size)
+		c.MessagesOut++
+	})
+}
+
+// recordReadError counts a frame which is not decodable, its code is unknown
+func (m *Metrics) recordReadError(id peer.ID, size int) {
+	m.update(id, 0, false, func(c *Counters) {
+		c.BytesIn += uint64(size)
+		c.Errors++
+	})
+}
+
+func (m *Metrics) recordError(id peer.ID, code uint64) {
+	m.update(id, code, true, func(c *Counters) {
+		c.Errors++
+	})
+}
+
+// recordLatency is counted by the code of request
+func (m *Metrics) recordLatency(id peer.ID, code uint64, latency time.Duration) {
+	m.update(id, code, true, func(c *Counters) {
+		c.addLatency(latency)
+	})
+}
+
+func (m *Metrics) Total() Counters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Peers returns the counters of peers, the peer which sent the most bytes is first
+func (m *Metrics) Peers() []PeerCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]PeerCounters, 0, m.peers.Len())
+	for _, key := range m.peers.Keys() {
+		if v, ok := m.peers.Peek(key); ok {
+			peers = append(peers, PeerCounters{ID: key.(peer.ID), Counters: *v.(*Counters)})
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].BytesIn == peers[j].BytesIn {
+			return peers[i].ID < peers[j].ID
+		}
+		return peers[i].BytesIn > peers[j].BytesIn
+	})
+	return peers
+}
+
+// Codes returns the counters of message codes in order of code
+func (m *Metrics) Codes() []CodeCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := make([]CodeCounters, 0, len(m.codes))
+	for code, c := range m.codes {
+		codes = append(codes, CodeCounters{Code: code, Counters: *c})
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i].Code < codes[j].Code
+	})
+	return codes
+}
@@ -0,0 +1,63 @@
+package net
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	id1, _ := peer.IDB58Decode("16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk")
+	id2, _ := peer.IDB58Decode("16Uiu2HAkxKaG3PHSLfDhfZ7a8YzP6w6fKooBTY1gmfSXxGYbsNuN")
+
+	m.recordIn(id1, MsgNewBlock, 100)
+	m.recordIn(id2, MsgNewBlock, 1000)
+	m.recordOut(id1, MsgGetBlockHeaders, 10)
+	m.recordLatency(id1, MsgGetBlockHeaders, time.Second)
+	m.recordLatency(id1, MsgGetBlockHeaders, 3*time.Second)
+	m.recordError(id1, MsgGetBlockHeaders)
+	m.recordReadError(id2, 5)
+
+	total := m.Total()
+	assert.Equal(t, uint64(1105), total.BytesIn)
+	assert.Equal(t, uint64(2), total.MessagesIn)
+	assert.Equal(t, uint64(10), total.BytesOut)
+	assert.Equal(t, uint64(2), total.Errors)
+	assert.Equal(t, 2*time.Second, total.LatencyAvg())
+	assert.Equal(t, 3*time.Second, total.LatencyMax)
+
+	//the peer which sent the most bytes is first
+	peers := m.Peers()
+	assert.Equal(t, 2, len(peers))
+	assert.Equal(t, id2, peers[0].ID)
+	assert.Equal(t, uint64(1005), peers[0].BytesIn)
+	assert.Equal(t, uint64(1), peers[0].Errors)
+
+	//a broken frame has no code
+	codes := m.Codes()
+	assert.Equal(t, 2, len(codes))
+	assert.Equal(t, uint64(MsgNewBlock), codes[0].Code)
+	assert.Equal(t, uint64(1100), codes[0].BytesIn)
+	assert.Equal(t, uint64(MsgGetBlockHeaders), codes[1].Code)
+	assert.Equal(t, uint64(2), codes[1].Requests)
+	assert.Equal(t, uint64(1), codes[1].Errors)
+
+	//counters of the least recently active peer are forgotten, the total keeps them
+	for i := 0; i < maxPeerCounters; i++ {
+		m.recordIn(peer.ID(fmt.Sprintf("peer%d", i)), MsgNewTx, 1)
+	}
+	peers = m.Peers()
+	assert.Equal(t, maxPeerCounters, len(peers))
+	for _, p := range peers {
+		assert.NotEqual(t, id1, p.ID)
+	}
+	assert.Equal(t, uint64(1105+maxPeerCounters), m.Total().BytesIn)
+
+	//nil metrics is ignored
+	var none *Metrics
+	none.recordIn(id1, MsgNewBlock, 1)
+}
@@ -1,18 +1,14 @@
 package net
 
 import (
-	"context"
 	"fmt"
+	"time"
 
-	libp2p "github.com/libp2p/go-libp2p"
 	crypto "github.com/libp2p/go-libp2p-crypto"
-	host "github.com/libp2p/go-libp2p-host"
-	libnet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
-	pstore "github.com/libp2p/go-libp2p-peerstore"
-	protocol "github.com/libp2p/go-libp2p-protocol"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/common"
 	"github.com/nacamp/go-simplechain/log"
 	"github.com/sirupsen/logrus"
 )
@@ -22,10 +18,14 @@ type Node struct {
 	done       chan bool
 	privKey    crypto.PrivKey
 	maddr      ma.Multiaddr
-	host       host.Host
+	transport  Transport
 	streamPool *PeerStreamPool
 	discovery  *Discovery
 	hash       string
+	statusFunc func() *Status
+	dialer     *Dialer
+	peerDB     *PeerDB
+	identity   *Identity
 }
 
 func NewNode(port int, privKey crypto.PrivKey, streamPool *PeerStreamPool) *Node {
@@ -36,6 +36,14 @@ func NewNode(port int, privKey crypto.PrivKey, streamPool *PeerStreamPool) *Node
 		done:       make(chan bool, 1),
 		streamPool: streamPool,
 	}
+	_node.dialer = NewDialer(_node.dial, _node.isConnected)
+	identity, err := NewIdentity(privKey)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{
+			"Msg": err,
+		}).Panic("identity")
+	}
+	_node.identity = identity
 	return _node
 }
 
@@ -43,54 +51,138 @@ func (node *Node) Setup(hash string) {
 	node.hash = hash
 }
 
-func (node *Node) Start(seed string) {
-	host, _ := libp2p.New(
-		context.Background(),
-		libp2p.ListenAddrs(node.maddr),
-		libp2p.Identity(node.privKey),
-	)
-	node.discovery = NewDiscovery(host.ID(), node.maddr, peerstore.NewMetrics(), host.Peerstore(), node.streamPool, node)
-	node.streamPool.AddHandler(node.discovery)
+// SetStatusFunc sets the function which makes the status sent at handshake
+func (node *Node) SetStatusFunc(statusFunc func() *Status) {
+	node.statusFunc = statusFunc
+}
 
-	log.CLog().WithFields(logrus.Fields{
-		"fullAddr": fmt.Sprintf("/ipfs/%s", host.ID().Pretty()),
-	}).Info("My address")
-	node.host = host
+// SetTransport replaces libp2p, call it before Start
+func (node *Node) SetTransport(transport Transport) {
+	node.transport = transport
+}
+
+func (node *Node) protocolID() string {
+	return node.hash + "/0.0.1"
+}
 
-	if seed != "" {
-		addr, err := ma.NewMultiaddr(seed)
+// SetValidator advertises address at handshake, sign signs ValidatorHash of this node by the account key of address, call it before Start
+func (node *Node) SetValidator(address common.Address, sign func(hash []byte) ([]byte, error)) error {
+	sig, err := sign(ValidatorHash(node.identity.ID()))
+	if err != nil {
+		return err
+	}
+	node.identity.SetValidator(address, sig)
+	return nil
+}
+
+// SetPeerDB sets the db of discovered peers, call it before Start
+func (node *Node) SetPeerDB(peerDB *PeerDB) {
+	node.peerDB = peerDB
+}
+
+// Start dials the seeds and the peers added by AddStaticPeer, AddTrustedPeer before start
+func (node *Node) Start(seeds []string) {
+	if node.transport == nil {
+		transport, err := NewLibp2pTransport(node.maddr, node.privKey)
 		if err != nil {
 			log.CLog().WithFields(logrus.Fields{
 				"Msg": err,
-			}).Panic("seed")
+			}).Panic("transport")
+		}
+		node.transport = transport
+	}
+	node.maddr = node.transport.Addr()
+	node.discovery = NewDiscovery(node.transport.ID(), node.maddr, peerstore.NewMetrics(), node.transport.Peerstore(), node.streamPool, node)
+	node.streamPool.AddHandler(node.discovery)
+	if node.peerDB != nil {
+		node.discovery.SetPeerDB(node.peerDB)
+	}
+
+	log.CLog().WithFields(logrus.Fields{
+		"fullAddr": fmt.Sprintf("/ipfs/%s", node.transport.ID().Pretty()),
+	}).Info("My address")
+
+	for _, seed := range seeds {
+		if seed == "" {
+			continue
 		}
-		info, err := peerstore.InfoFromP2pAddr(addr)
+		info, err := ParsePeerAddr(seed)
 		if err != nil {
 			log.CLog().WithFields(logrus.Fields{
-				"Address": addr,
+				"Address": seed,
 				"Msg":     err,
-			}).Panic("seed")
+			}).Warning("seed")
+			continue
 		}
-		_, err = node.Connect(info.ID, AddrFromPeerInfo(info))
 		node.discovery.Update(info)
-		if err != nil {
-			log.CLog().WithFields(logrus.Fields{
-				"Msg": err,
-			}).Panic("seed connect")
-		}
+		node.dialer.AddSeed(info)
 	}
+	//the first dial is done before lookup so that the routing table has the seeds
+	node.dialer.dialDue(time.Now())
+	go node.dialer.Start()
 	go node.discovery.Start()
-	node.host.SetStreamHandler(protocol.ID(node.hash+"/0.0.1"), node.HandleStream)
+	node.transport.SetStreamHandler(node.protocolID(), node.HandleStream)
+}
+
+// AddStaticPeer keeps the peer connected
+func (node *Node) AddStaticPeer(addr string) error {
+	info, err := ParsePeerAddr(addr)
+	if err != nil {
+		return err
+	}
+	node.dialer.AddStatic(info)
+	return nil
+}
+
+// AddTrustedPeer keeps the peer connected even if the pool is full
+func (node *Node) AddTrustedPeer(addr string) error {
+	info, err := ParsePeerAddr(addr)
+	if err != nil {
+		return err
+	}
+	node.streamPool.AddTrusted(info.ID)
+	node.dialer.AddStatic(info)
+	return nil
 }
 
-func (node *Node) HandleStream(s libnet.Stream) {
+// RemovePeer stops keeping the peer connected and disconnects it
+func (node *Node) RemovePeer(addr string) error {
+	info, err := ParsePeerAddr(addr)
+	if err != nil {
+		return err
+	}
+	node.dialer.Remove(info.ID)
+	node.streamPool.RemoveTrusted(info.ID)
+	if ps, err := node.streamPool.GetStream(info.ID); err == nil {
+		ps.Close()
+	}
+	return nil
+}
+
+func (node *Node) dial(info *peerstore.PeerInfo) error {
+	_, err := node.discovery.bond(info)
+	return err
+}
+
+func (node *Node) isConnected(id peer.ID) bool {
+	ps, err := node.streamPool.GetStream(id)
+	return err == nil && !ps.IsClosed() && ps.IsHandshakeSucceed()
+}
+
+func (node *Node) HandleStream(s Stream) {
 	log.CLog().WithFields(logrus.Fields{
-		"RemotePeer": s.Conn().RemotePeer().Pretty(),
+		"RemotePeer": s.RemotePeer().Pretty(),
 	}).Debug("new stream")
 
+	if node.streamPool.IsBanned(s.RemotePeer()) {
+		s.Close()
+		return
+	}
 	peerStream, err := NewPeerStream(s)
+	peerStream.SetStatusFunc(node.statusFunc)
+	peerStream.SetIdentity(node.identity)
 	log.CLog().WithFields(logrus.Fields{
-		"ID": peerStream.stream.Conn().RemotePeer(),
+		"ID": peerStream.stream.RemotePeer(),
 	}).Warning("inbound")
 	log.CLog().WithFields(logrus.Fields{}).Warning(fmt.Sprintf("%+v", err))
 	node.streamPool.AddStream(peerStream)
@@ -98,6 +190,9 @@ func (node *Node) HandleStream(s libnet.Stream) {
 }
 
 func (node *Node) Connect(id peer.ID, addr ma.Multiaddr) (*PeerStream, error) {
+	if node.streamPool.IsBanned(id) {
+		return nil, ErrPeerBanned
+	}
 	peerStream, err := node.streamPool.GetStream(id)
 	if err == nil && !peerStream.IsClosed() {
 		return peerStream, nil
@@ -105,13 +200,13 @@ func (node *Node) Connect(id peer.ID, addr ma.Multiaddr) (*PeerStream, error) {
 	log.CLog().WithFields(logrus.Fields{
 		"ID": id,
 	}).Warning("outbound")
-	// Always firt add id and addr at Peerstore
-	node.host.Peerstore().AddAddr(id, addr, pstore.PermanentAddrTTL)
-	s, err := node.host.NewStream(context.Background(), id, protocol.ID(node.hash+"/0.0.1"))
+	s, err := node.transport.NewStream(id, addr, node.protocolID())
 	if err != nil {
 		return nil, err
 	}
 	peerStream, err = NewPeerStream(s)
+	peerStream.SetStatusFunc(node.statusFunc)
+	peerStream.SetIdentity(node.identity)
 	node.streamPool.AddStream(peerStream)
 	peerStream.Start()
 	return peerStream, nil
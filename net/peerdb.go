@@ -0,0 +1,202 @@
+package net
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/storage"
+)
+
+const (
+	peerDBPrefix     = "peerdb/"
+	peerDBIndexKey   = peerDBPrefix + "index"
+	maxPeerFailures  = 5
+	PeerDBExpiration = 24 * time.Hour
+)
+
+// PeerRecord is a discovered peer, LastSeen is the unix time of the last successful handshake
+type PeerRecord struct {
+	ID       peer.ID
+	Addr     []byte
+	LastSeen uint64
+	Failures uint64
+}
+
+func (r *PeerRecord) PeerInfo() (*peerstore.PeerInfo, error) {
+	addr, err := ma.NewMultiaddrBytes(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &peerstore.PeerInfo{ID: r.ID, Addrs: []ma.Multiaddr{addr}}, nil
+}
+
+/*
+PeerDB keeps the discovered peers in storage so that the routing table is filled again after restart.
+Records are saved under peerDBPrefix, a record is removed when it failed maxPeerFailures times in a row
+or was not seen for PeerDBExpiration.
+*/
+type PeerDB struct {
+	mu      sync.Mutex
+	storage storage.Storage
+	records map[peer.ID]*PeerRecord
+}
+
+func NewPeerDB(db storage.Storage) (*PeerDB, error) {
+	pdb := &PeerDB{
+		storage: db,
+		records: make(map[peer.ID]*PeerRecord),
+	}
+	if db == nil {
+		return pdb, nil
+	}
+	encodedBytes, err := db.Get([]byte(peerDBIndexKey))
+	if err == storage.ErrKeyNotFound {
+		return pdb, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ids := make([]peer.ID, 0)
+	if err := rlp.DecodeBytes(encodedBytes, &ids); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		encodedBytes, err := db.Get(peerDBKey(id))
+		if err != nil {
+			continue
+		}
+		record := new(PeerRecord)
+		if err := rlp.DecodeBytes(encodedBytes, record); err != nil {
+			continue
+		}
+		pdb.records[id] = record
+	}
+	return pdb, nil
+}
+
+func peerDBKey(id peer.ID) []byte {
+	return []byte(peerDBPrefix + "node/" + string(id))
+}
+
+// Seen records the successful handshake with the peer
+func (pdb *PeerDB) Seen(info *peerstore.PeerInfo, now time.Time) error {
+	if len(info.Addrs) == 0 {
+		return nil
+	}
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+	record, ok := pdb.records[info.ID]
+	if !ok {
+		record = &PeerRecord{ID: info.ID}
+		pdb.records[info.ID] = record
+	}
+	record.Addr = info.Addrs[0].Bytes()
+	record.LastSeen = uint64(now.Unix())
+	record.Failures = 0
+	if err := pdb.put(record); err != nil {
+		return err
+	}
+	if !ok {
+		return pdb.saveIndex()
+	}
+	return nil
+}
+
+// Failed counts the failure to reach the peer and returns true if the peer is removed by it
+func (pdb *PeerDB) Failed(id peer.ID) (bool, error) {
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+	record, ok := pdb.records[id]
+	if !ok {
+		return false, nil
+	}
+	record.Failures++
+	if record.Failures < maxPeerFailures {
+		return false, pdb.put(record)
+	}
+	return true, pdb.remove(id)
+}
+
+// Expire removes the peers which were not seen since now - PeerDBExpiration
+func (pdb *PeerDB) Expire(now time.Time) ([]peer.ID, error) {
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+	deadline := uint64(now.Add(-PeerDBExpiration).Unix())
+	expired := make([]peer.ID, 0)
+	for id, record := range pdb.records {
+		if record.LastSeen < deadline {
+			expired = append(expired, id)
+		}
+	}
+	for _, id := range expired {
+		if err := pdb.remove(id); err != nil {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
+// Peers returns at most n peers, the most recently seen first
+func (pdb *PeerDB) Peers(n int) []*PeerRecord {
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+	records := make([]*PeerRecord, 0, len(pdb.records))
+	for _, record := range pdb.records {
+		copied := *record
+		records = append(records, &copied)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen > records[j].LastSeen
+	})
+	if len(records) > n {
+		records = records[:n]
+	}
+	return records
+}
+
+func (pdb *PeerDB) Len() int {
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+	return len(pdb.records)
+}
+
+func (pdb *PeerDB) remove(id peer.ID) error {
+	delete(pdb.records, id)
+	if pdb.storage == nil {
+		return nil
+	}
+	if err := pdb.storage.Del(peerDBKey(id)); err != nil && err != storage.ErrKeyNotFound {
+		return err
+	}
+	return pdb.saveIndex()
+}
+
+func (pdb *PeerDB) put(record *PeerRecord) error {
+	if pdb.storage == nil {
+		return nil
+	}
+	encodedBytes, err := rlp.EncodeToBytes(record)
+	if err != nil {
+		return err
+	}
+	return pdb.storage.Put(peerDBKey(record.ID), encodedBytes)
+}
+
+func (pdb *PeerDB) saveIndex() error {
+	if pdb.storage == nil {
+		return nil
+	}
+	ids := make([]peer.ID, 0, len(pdb.records))
+	for id := range pdb.records {
+		ids = append(ids, id)
+	}
+	encodedBytes, err := rlp.EncodeToBytes(ids)
+	if err != nil {
+		return err
+	}
+	return pdb.storage.Put([]byte(peerDBIndexKey), encodedBytes)
+}
@@ -0,0 +1,48 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerDB(t *testing.T) {
+	db, _ := storage.NewMemoryStorage()
+	pdb, err := NewPeerDB(db)
+	assert.NoError(t, err)
+
+	info1, _ := ParsePeerAddr("/ip4/127.0.0.1/tcp/9991/ipfs/16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk")
+	info2, _ := ParsePeerAddr("/ip4/127.0.0.1/tcp/9992/ipfs/16Uiu2HAkxKaG3PHSLfDhfZ7a8YzP6w6fKooBTY1gmfSXxGYbsNuN")
+	now := time.Now()
+	assert.NoError(t, pdb.Seen(info1, now.Add(-time.Hour)))
+	assert.NoError(t, pdb.Seen(info2, now))
+
+	//loaded again after restart, the most recently seen first
+	pdb, err = NewPeerDB(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pdb.Len())
+	records := pdb.Peers(10)
+	assert.Equal(t, info2.ID, records[0].ID)
+	info, err := records[1].PeerInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, info1.Addrs[0].String(), info.Addrs[0].String())
+
+	//removed after maxPeerFailures failures
+	for i := 1; i < maxPeerFailures; i++ {
+		removed, _ := pdb.Failed(info1.ID)
+		assert.False(t, removed)
+	}
+	removed, _ := pdb.Failed(info1.ID)
+	assert.True(t, removed)
+	pdb, _ = NewPeerDB(db)
+	assert.Equal(t, 1, pdb.Len())
+
+	//expired
+	expired, err := pdb.Expire(now.Add(PeerDBExpiration + time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, info2.ID, expired[0])
+	pdb, _ = NewPeerDB(db)
+	assert.Equal(t, 0, pdb.Len())
+}
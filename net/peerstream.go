@@ -2,13 +2,15 @@ package net
 
 import (
 	"bufio"
-	"hash/crc32"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
-	libnet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/common"
 	"github.com/nacamp/go-simplechain/log"
 	"github.com/nacamp/go-simplechain/rlp"
 	"github.com/sirupsen/logrus"
@@ -22,31 +24,49 @@ const (
 
 type PeerStream struct {
 	mu                 sync.RWMutex //sync.Mutex
-	stream             libnet.Stream
+	stream             Stream
 	status             int
 	HandshakeSucceedCh chan bool
 	messageCh          chan *Message
-	replys             *sync.Map
+	requestID          uint64
+	requests           map[uint64]*Future
 	handlers           *sync.Map
 	inboud             bool
+	statusFunc         func() *Status
+	remoteStatus       *Status
+	wmu                sync.Mutex
+	snappy             bool
+	compress           bool
+	knownBlocks        *knownSet
+	knownTxs           *knownSet
+	knownVotes         *knownSet
+	trusted            bool
+	identity           *Identity
+	ephemeral          *ephemeral
+	cipher             *sessionCipher
+	remoteValidator    common.Address
+	metrics            *Metrics
 }
 
-func NewPeerStream(s libnet.Stream) (*PeerStream, error) {
+func NewPeerStream(s Stream) (*PeerStream, error) {
 	PeerStream := &PeerStream{
 		stream:             s,
 		status:             statusInit,
 		messageCh:          make(chan *Message, 5),
-		HandshakeSucceedCh: make(chan bool),
-		replys:             new(sync.Map),
+		HandshakeSucceedCh: make(chan bool, 1),
+		requests:           make(map[uint64]*Future),
 		handlers:           new(sync.Map),
+		snappy:             true,
+		knownBlocks:        newKnownSet(maxKnownBlocks),
+		knownTxs:           newKnownSet(maxKnownTxs),
+		knownVotes:         newKnownSet(maxKnownVotes),
 	}
 	return PeerStream, nil
 }
 
 func (ps *PeerStream) Start() { //isHost bool
 	log.CLog().Debug("Start")
-	rw := bufio.NewReadWriter(bufio.NewReader(ps.stream), bufio.NewWriter(ps.stream))
-	go ps.readData(rw)
+	go ps.readData(&countingReader{r: bufio.NewReader(ps.stream)})
 	// go ps.writeData(rw)
 }
 
@@ -54,46 +74,91 @@ func (ps *PeerStream) callHandler(message *Message) {
 	v, ok := ps.handlers.Load(message.Code)
 	if ok {
 		handler := v.(chan interface{})
-		RecordRecvMessage(message.PeerID, crc32.ChecksumIEEE(message.Payload))
 		handler <- message
 	}
 }
 
-func (ps *PeerStream) readData(rw *bufio.ReadWriter) {
+// countingReader counts the bytes of a frame for metrics
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// readData closes the stream when a frame is over the limit or not decodable
+func (ps *PeerStream) readData(r *countingReader) {
 	for {
-		message := Message{}
 		//<-done not need
-		err := rlp.Decode(rw, &message)
+		ps.mu.RLock()
+		cipher := ps.cipher
+		ps.mu.RUnlock()
+		r.n = 0
+		message, err := readFrame(r, cipher)
 		if err != nil {
+			if r.n > 0 {
+				ps.metrics.recordReadError(ps.stream.RemotePeer(), r.n)
+			}
 			ps.stream.Close()
 			ps.status = statusClosed
 			log.CLog().WithFields(logrus.Fields{
 				"Msg": err,
 			}).Info("closed")
-			ps.callHandler(&Message{Code: StatusStreamClosed, PeerID: ps.stream.Conn().RemotePeer()})
+			ps.cancelRequests(ErrStreamClosed)
+			ps.callHandler(&Message{Code: StatusStreamClosed, PeerID: ps.stream.RemotePeer()})
 			return
 		}
-		message.PeerID = ps.stream.Conn().RemotePeer()
+		ps.metrics.recordIn(ps.stream.RemotePeer(), message.Code, r.n)
+		message.PeerID = ps.stream.RemotePeer()
+		if message.Reply {
+			ps.completeRequest(message)
+			continue
+		}
 		switch message.Code {
-		case MsgHello:
-			ps.onHello(&message)
-		case MsgHelloAck:
-			ps.onHelloAck(&message)
+		case MsgHello, MsgHelloAck:
+			//the handshake is done once, a later hello must not replace the cipher or the remote status
+			if ps.IsHandshakeSucceed() {
+				log.CLog().WithFields(logrus.Fields{
+					"ID":   message.PeerID,
+					"Code": message.Code,
+				}).Info("hello after handshake")
+				continue
+			}
+			if message.Code == MsgHello {
+				err = ps.onHello(message)
+			} else {
+				err = ps.onHelloAck(message)
+			}
+			if err != nil {
+				continue
+			}
 		default:
-			if ps.status != statusHandshakeSucceed {
+			if !ps.IsHandshakeSucceed() {
 				continue
 			}
 		}
-		ps.callHandler(&message)
+		ps.callHandler(message)
 	}
 }
 
 /*
 client, server
 c:SendHello => s:onHello , SendHelloAck  => c:onHelloAck
+Frames after MsgHelloAck are encrypted if both peers have identity.
 */
 func (ps *PeerStream) SendHello(hostAddr ma.Multiaddr) error {
-	if msg, err := NewRLPMessage(MsgHello, hostAddr.String()); err != nil {
+	status := ps.localStatus()
+	status.Addr = hostAddr.String()
+	status.Snappy = ps.snappy
+	hello, err := ps.makeHello(status, nil)
+	if err != nil {
+		return err
+	}
+	if msg, err := NewRLPMessage(MsgHello, hello); err != nil {
 		return err
 	} else {
 		log.CLog().WithFields(logrus.Fields{}).Debug("hostAddr: ", hostAddr.String())
@@ -101,20 +166,48 @@ func (ps *PeerStream) SendHello(hostAddr ma.Multiaddr) error {
 	}
 }
 
-func (ps *PeerStream) SendHelloAck() error {
-	if msg, err := NewRLPMessage(MsgHelloAck, ""); err != nil {
+func (ps *PeerStream) SendHelloAck(remoteEphemeralKey []byte) error {
+	status := ps.localStatus()
+	status.Snappy = ps.snappy
+	hello, err := ps.makeHello(status, remoteEphemeralKey)
+	if err != nil {
+		return err
+	}
+	if msg, err := NewRLPMessage(MsgHelloAck, hello); err != nil {
 		return err
 	} else {
-		log.CLog().WithFields(logrus.Fields{}).Debug("ID: ", ps.stream.Conn().RemotePeer())
+		log.CLog().WithFields(logrus.Fields{}).Debug("ID: ", ps.stream.RemotePeer())
 		err := ps.SendMessage(&msg)
 		return err
 	}
 }
 
+// makeHello signs the handshake with a new ephemeral key if this node has identity
+func (ps *PeerStream) makeHello(status *Status, remoteEphemeralKey []byte) (*Hello, error) {
+	hello := &Hello{Status: *status}
+	if ps.identity == nil {
+		return hello, nil
+	}
+	e, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := ps.identity.makeAuth(e, remoteEphemeralKey, ps.stream.RemotePeer())
+	if err != nil {
+		return nil, err
+	}
+	ps.ephemeral = e
+	hello.Auth = *auth
+	return hello, nil
+}
+
 func (ps *PeerStream) onHello(message *Message) error {
-	defer ps.finshHandshake()
-	log.CLog().WithFields(logrus.Fields{}).Debug("ID: ", ps.stream.Conn().RemotePeer())
-	message.PeerID = ps.stream.Conn().RemotePeer()
+	hello, err := ps.checkHello(message, nil)
+	if err != nil {
+		return err
+	}
+	log.CLog().WithFields(logrus.Fields{}).Debug("ID: ", ps.stream.RemotePeer())
+	message.PeerID = ps.stream.RemotePeer()
 	v, ok := ps.handlers.Load(message.Code)
 	if ok {
 		log.CLog().WithFields(logrus.Fields{
@@ -123,18 +216,176 @@ func (ps *PeerStream) onHello(message *Message) error {
 		handler := v.(chan interface{})
 		handler <- message
 	}
-	return ps.SendHelloAck()
+	if err := ps.SendHelloAck(hello.Auth.EphemeralKey); err != nil {
+		return err
+	}
+	//the next frame is read after the cipher is set because readData calls onHello
+	if err := ps.startCipher(hello.Auth.EphemeralKey, false); err != nil {
+		ps.Close()
+		return err
+	}
+	ps.finshHandshake()
+	return nil
 }
 
 func (ps *PeerStream) onHelloAck(message *Message) error {
-	defer ps.finshHandshake()
-	data := string("")
-	rlp.DecodeBytes(message.Payload, &data)
-	log.CLog().WithFields(logrus.Fields{}).Debug("ID: ", ps.stream.Conn().RemotePeer())
-	ps.HandshakeSucceedCh <- true
+	hello, err := ps.checkHello(message, ps.localEphemeralKey())
+	if err == nil {
+		if err = ps.startCipher(hello.Auth.EphemeralKey, true); err != nil {
+			ps.Close()
+		}
+	}
+	if err != nil {
+		select {
+		case ps.HandshakeSucceedCh <- false:
+		default:
+		}
+		return err
+	}
+	ps.finshHandshake()
+	log.CLog().WithFields(logrus.Fields{}).Debug("ID: ", ps.stream.RemotePeer())
+	//nobody may wait for the result, readData must not block
+	select {
+	case ps.HandshakeSucceedCh <- true:
+	default:
+	}
 	return nil
 }
 
+func (ps *PeerStream) localEphemeralKey() []byte {
+	if ps.ephemeral == nil {
+		return nil
+	}
+	return ps.ephemeral.pub
+}
+
+// startCipher encrypts the frames after handshake by the keys agreed with the ephemeral keys
+func (ps *PeerStream) startCipher(remoteEphemeralKey []byte, initiator bool) error {
+	if ps.identity == nil {
+		return nil
+	}
+	secret, err := ps.ephemeral.sharedSecret(remoteEphemeralKey)
+	if err != nil {
+		return err
+	}
+	initiatorKey, responderKey := ps.ephemeral.pub, remoteEphemeralKey
+	if !initiator {
+		initiatorKey, responderKey = remoteEphemeralKey, ps.ephemeral.pub
+	}
+	cipher, err := newSessionCipher(secret, initiatorKey, responderKey, initiator)
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	ps.cipher = cipher
+	ps.mu.Unlock()
+	return nil
+}
+
+/*
+checkHello records the status of remote peer and disconnects the peer if it is not compatible.
+If this node has identity, the peer must prove its node key and the validator it advertises.
+*/
+func (ps *PeerStream) checkHello(message *Message, localEphemeralKey []byte) (*Hello, error) {
+	hello := new(Hello)
+	err := rlp.DecodeBytes(message.Payload, hello)
+	if err == nil {
+		err = ps.localStatus().Compatible(&hello.Status)
+	}
+	var validator common.Address
+	if err == nil && ps.identity != nil {
+		validator, err = verifyAuth(&hello.Auth, localEphemeralKey, ps.stream.RemotePeer(), ps.identity.ID())
+	}
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{
+			"ID":  ps.stream.RemotePeer(),
+			"Msg": err,
+		}).Warning("handshake failed")
+		ps.Close()
+		return nil, err
+	}
+	ps.mu.Lock()
+	ps.remoteStatus = &hello.Status
+	ps.remoteValidator = validator
+	ps.compress = ps.snappy && hello.Status.Snappy
+	ps.mu.Unlock()
+	return hello, nil
+}
+
+// SetIdentity authenticates the handshake by the node key and encrypts the session, call it before handshake
+func (ps *PeerStream) SetIdentity(identity *Identity) {
+	ps.identity = identity
+}
+
+// RemoteValidator returns the validator which the peer proved at handshake, or zero address
+func (ps *PeerStream) RemoteValidator() common.Address {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.remoteValidator
+}
+
+// SetSnappy sets whether snappy compression is offered at handshake, call it before handshake
+func (ps *PeerStream) SetSnappy(enable bool) {
+	ps.snappy = enable
+}
+
+// SetStatusFunc sets the function which makes the status of this node at handshake
+func (ps *PeerStream) SetStatusFunc(statusFunc func() *Status) {
+	ps.statusFunc = statusFunc
+}
+
+func (ps *PeerStream) localStatus() *Status {
+	if ps.statusFunc == nil {
+		return &Status{Version: ProtocolVersion}
+	}
+	return ps.statusFunc()
+}
+
+// RemoteStatus returns the status that the peer sent at handshake
+func (ps *PeerStream) RemoteStatus() *Status {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.remoteStatus
+}
+
+// UpdateRemoteHead records the new tail of the peer
+func (ps *PeerStream) UpdateRemoteHead(height uint64, hash common.Hash) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.remoteStatus == nil || ps.remoteStatus.TailHeight >= height {
+		return
+	}
+	ps.remoteStatus.TailHeight = height
+	ps.remoteStatus.TailHash = hash
+}
+
+// MarkBlock records that the peer has the block, so it is neither sent nor announced to the peer
+func (ps *PeerStream) MarkBlock(hash common.Hash) {
+	ps.knownBlocks.Add(hash)
+}
+
+func (ps *PeerStream) KnowsBlock(hash common.Hash) bool {
+	return ps.knownBlocks.Contains(hash)
+}
+
+// MarkTx records that the peer has the transaction
+func (ps *PeerStream) MarkTx(hash common.Hash) {
+	ps.knownTxs.Add(hash)
+}
+
+func (ps *PeerStream) KnowsTx(hash common.Hash) bool {
+	return ps.knownTxs.Contains(hash)
+}
+
+// MarkVote records that the peer has the checkpoint vote
+func (ps *PeerStream) MarkVote(hash common.Hash) {
+	ps.knownVotes.Add(hash)
+}
+
+func (ps *PeerStream) KnowsVote(hash common.Hash) bool {
+	return ps.knownVotes.Contains(hash)
+}
+
 func (ps *PeerStream) finshHandshake() {
 	ps.mu.Lock()
 	ps.status = statusHandshakeSucceed
@@ -145,27 +396,101 @@ func (ps *PeerStream) SendMessage(message *Message) error {
 	if !ps.IsHandshakeSucceed() && !(message.Code == MsgHello || message.Code == MsgHelloAck) {
 		return errors.New("Handshake not completed")
 	}
-	encodedBytes, _ := rlp.EncodeToBytes(message)
-	_, err := ps.stream.Write(encodedBytes)
+	ps.mu.RLock()
+	compress := ps.compress
+	cipher := ps.cipher
+	ps.mu.RUnlock()
+	//nonces of cipher must be in order of writes
+	ps.wmu.Lock()
+	frame, err := encodeFrame(message, compress, cipher)
+	if err != nil {
+		ps.wmu.Unlock()
+		return err
+	}
+	_, err = ps.stream.Write(frame)
+	ps.wmu.Unlock()
 	if err != nil {
+		ps.metrics.recordError(ps.stream.RemotePeer(), message.Code)
 		ps.stream.Close()
 		ps.status = statusClosed
 		log.CLog().WithFields(logrus.Fields{
 			"Msg": err,
 		}).Info("closed")
 		ps.callHandler(&Message{})
+		go ps.cancelRequests(ErrStreamClosed)
 		return err
 	}
+	ps.metrics.recordOut(ps.stream.RemotePeer(), message.Code, len(frame))
 	return nil
 }
 
 /*
 client, server
-c:SendMessageReply => s:onXXXX , XXXXAck  (handler)=> c:onXXXXAck
+c:Request => s:onXXXX , Reply  (handler)=> c:Future
+Request returns the future completed by the reply with the same request id.
 */
-func (ps *PeerStream) SendMessageReply(message *Message, reply chan interface{}) error {
-	ps.replys.Store(message.Code+uint64(1), reply)
-	return ps.SendMessage(message)
+func (ps *PeerStream) Request(message *Message, timeout time.Duration) (*Future, error) {
+	future := newFuture()
+	future.code = message.Code
+	future.start = time.Now()
+	ps.mu.Lock()
+	ps.requestID++
+	id := ps.requestID
+	ps.requests[id] = future
+	future.timer = time.AfterFunc(timeout, func() {
+		ps.removeRequest(id, nil, ErrRequestTimeout)
+	})
+	ps.mu.Unlock()
+
+	message.RequestID = id
+	message.Reply = false
+	if err := ps.SendMessage(message); err != nil {
+		ps.removeRequest(id, nil, err)
+		return nil, err
+	}
+	return future, nil
+}
+
+// Reply sends payload to the peer which sent request
+func (ps *PeerStream) Reply(request *Message, code uint64, payload interface{}) error {
+	message, err := NewRLPMessage(code, payload)
+	if err != nil {
+		return err
+	}
+	message.RequestID = request.RequestID
+	message.Reply = true
+	return ps.SendMessage(&message)
+}
+
+func (ps *PeerStream) completeRequest(message *Message) {
+	ps.removeRequest(message.RequestID, message, nil)
+}
+
+func (ps *PeerStream) removeRequest(id uint64, reply *Message, err error) {
+	ps.mu.Lock()
+	future, ok := ps.requests[id]
+	delete(ps.requests, id)
+	ps.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err != nil {
+		ps.metrics.recordError(ps.stream.RemotePeer(), future.code)
+	} else {
+		ps.metrics.recordLatency(ps.stream.RemotePeer(), future.code, time.Since(future.start))
+	}
+	future.complete(reply, err)
+}
+
+func (ps *PeerStream) cancelRequests(err error) {
+	ps.mu.Lock()
+	requests := ps.requests
+	ps.requests = make(map[uint64]*Future)
+	ps.mu.Unlock()
+	for _, future := range requests {
+		ps.metrics.recordError(ps.stream.RemotePeer(), future.code)
+		future.complete(nil, err)
+	}
 }
 
 func (ps *PeerStream) Register(code uint64, handler chan interface{}) {
@@ -184,6 +509,10 @@ func (ps *PeerStream) IsHandshakeSucceed() bool {
 	return ps.status == statusHandshakeSucceed
 }
 
+func (ps *PeerStream) ID() peer.ID {
+	return ps.stream.RemotePeer()
+}
+
 func (ps *PeerStream) Close() {
 	ps.stream.Close()
 }
@@ -1,7 +1,7 @@
 package net
 
 import (
-	"hash/crc32"
+	"math"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -10,8 +10,23 @@ import (
 	"github.com/pkg/errors"
 
 	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/event"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/sirupsen/logrus"
 )
 
+const (
+	PeerEventAdd  = "add"
+	PeerEventDrop = "drop"
+)
+
+// PeerEvent is sent when a peer is added to or dropped from the streams, lookup streams are not counted
+type PeerEvent struct {
+	Type string
+	ID   peer.ID
+}
+
 type PeerStreamHandler interface {
 	Register(stream *PeerStream)
 	StartHandler()
@@ -25,6 +40,10 @@ type PeerStreamPool struct {
 	limit                int32
 	count                int32
 	StatusStreamClosedCh chan interface{}
+	reputation           *Reputation
+	trusted              *sync.Map
+	metrics              *Metrics
+	events               *event.Feed
 }
 
 func NewPeerStreamPool() *PeerStreamPool {
@@ -32,29 +51,99 @@ func NewPeerStreamPool() *PeerStreamPool {
 	p.limit = 10
 	p.StatusStreamClosedCh = make(chan interface{}, 1)
 	p.lookupStreams = new(sync.Map)
+	p.trusted = new(sync.Map)
+	p.metrics = NewMetrics()
+	p.events = new(event.Feed)
+	p.reputation, _ = NewReputation(nil, DefaultBanDuration)
 	return &p
 }
 
+// SetReputation replaces the reputation which does not save bans
+func (p *PeerStreamPool) SetReputation(reputation *Reputation) {
+	p.reputation = reputation
+}
+
+func (p *PeerStreamPool) Reputation() *Reputation {
+	return p.reputation
+}
+
+// SetEvents replaces the feed of PeerEvent, to share the feed of the chain
+func (p *PeerStreamPool) SetEvents(events *event.Feed) {
+	p.events = events
+}
+
+// Metrics counts the traffic of all streams in the pool
+func (p *PeerStreamPool) Metrics() *Metrics {
+	return p.metrics
+}
+
+func (p *PeerStreamPool) IsBanned(id peer.ID) bool {
+	return p.reputation.IsBanned(id)
+}
+
+// AdjustScore is called by protocol handlers, the peer is disconnected when banned
+func (p *PeerStreamPool) AdjustScore(id peer.ID, delta int, reason string) {
+	if delta < 0 {
+		log.CLog().WithFields(logrus.Fields{
+			"ID":     id,
+			"Delta":  delta,
+			"Reason": reason,
+		}).Warning("Bad peer")
+	}
+	if !p.reputation.Adjust(id, delta) {
+		return
+	}
+	log.CLog().WithFields(logrus.Fields{
+		"ID": id,
+	}).Warning("Banned peer")
+	if ps, err := p.GetStream(id); err == nil {
+		ps.Close()
+	}
+}
+
 func (p *PeerStreamPool) SetLimit(maxPeers int) {
 	p.limit = int32(maxPeers)
 }
 
+// AddTrusted lets the peer connect even if the pool is full
+func (p *PeerStreamPool) AddTrusted(id peer.ID) {
+	p.trusted.Store(id, true)
+}
+
+func (p *PeerStreamPool) RemoveTrusted(id peer.ID) {
+	p.trusted.Delete(id)
+}
+
+func (p *PeerStreamPool) IsTrusted(id peer.ID) bool {
+	_, ok := p.trusted.Load(id)
+	return ok
+}
+
 //only use at Node.HandleStream, Connect
 //TODO: how to distinguish lookupStreams with general connection
 func (p *PeerStreamPool) AddStream(peerStream *PeerStream) {
 	defer p.mu.Unlock()
 	p.mu.Lock()
+	if p.IsTrusted(peerStream.ID()) {
+		//trusted streams are not counted
+		peerStream.trusted = true
+		p.addStream(p.streams, peerStream)
+		p.events.Send(PeerEvent{Type: PeerEventAdd, ID: peerStream.ID()})
+		return
+	}
 	if p.count >= p.limit {
 		p.addStream(p.lookupStreams, peerStream)
 		return
 	}
 	p.count++
 	p.addStream(p.streams, peerStream)
+	p.events.Send(PeerEvent{Type: PeerEventAdd, ID: peerStream.ID()})
 	return
 }
 
 func (p *PeerStreamPool) addStream(streams *sync.Map, peerStream *PeerStream) {
-	streams.Store(peerStream.stream.Conn().RemotePeer(), peerStream)
+	peerStream.metrics = p.metrics
+	streams.Store(peerStream.stream.RemotePeer(), peerStream)
 	p.register(peerStream)
 	p.startHandler()
 	for _, h := range p.handlers {
@@ -82,10 +171,13 @@ func (p *PeerStreamPool) getStream(streams *sync.Map, id peer.ID) (*PeerStream,
 }
 
 func (p *PeerStreamPool) RemoveStream(id peer.ID) {
-	_, ok := p.streams.Load(id)
+	v, ok := p.streams.Load(id)
 	if ok {
 		p.streams.Delete(id)
-		atomic.AddInt32(&p.count, -1)
+		if !v.(*PeerStream).trusted {
+			atomic.AddInt32(&p.count, -1)
+		}
+		p.events.Send(PeerEvent{Type: PeerEventDrop, ID: id})
 	} else {
 		p.lookupStreams.Delete(id)
 	}
@@ -101,6 +193,19 @@ func (p *PeerStreamPool) RemoveAllLookupStream() {
 
 }
 
+// Peers returns the streams which completed handshake
+func (p *PeerStreamPool) Peers() []*PeerStream {
+	peers := make([]*PeerStream, 0)
+	p.streams.Range(func(key, value interface{}) bool {
+		ps := value.(*PeerStream)
+		if ps.IsHandshakeSucceed() {
+			peers = append(peers, ps)
+		}
+		return true
+	})
+	return peers
+}
+
 func (p *PeerStreamPool) AddHandler(handler PeerStreamHandler) {
 	p.handlers = append(p.handlers, handler)
 }
@@ -126,18 +231,84 @@ func (p *PeerStreamPool) SendMessageToRandomNode(message *Message) error {
 	return nil
 }
 
+// BroadcastMessage sends the message to all peers except the peer which sent it
 func (p *PeerStreamPool) BroadcastMessage(message *Message) {
 	p.streams.Range(func(key, value interface{}) bool {
 		id := key.(peer.ID)
 		ps := value.(*PeerStream)
-		if !HasRecvMessage(id, crc32.ChecksumIEEE(message.Payload)) {
-			RecordRecvMessage(id, crc32.ChecksumIEEE(message.Payload))
+		if id != message.PeerID {
 			ps.SendMessage(message)
 		}
 		return true
 	})
 }
 
+// BroadcastVote sends the checkpoint vote to the peers which do not know it, a vote goes through a peer at most once
+func (p *PeerStreamPool) BroadcastVote(hash common.Hash, message *Message) {
+	for _, ps := range p.Peers() {
+		if ps.ID() == message.PeerID || ps.KnowsVote(hash) {
+			continue
+		}
+		ps.MarkVote(hash)
+		ps.SendMessage(message)
+	}
+}
+
+/*
+BroadcastBlock sends the block to the peers which do not know it.
+The full block is pushed to sqrt(n) peers and only the hash is announced to the rest,
+they fetch the block by MsgMissingBlock if they do not have it.
+*/
+func (p *PeerStreamPool) BroadcastBlock(hash common.Hash, height uint64, message *Message) {
+	peers := make([]*PeerStream, 0)
+	for _, ps := range p.Peers() {
+		if !ps.KnowsBlock(hash) {
+			peers = append(peers, ps)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	announce, err := NewRLPMessage(MsgNewBlockHashes, []BlockAnnounce{{Hash: hash, Height: height}})
+	if err != nil {
+		return
+	}
+	push := pushCount(len(peers))
+	for i, j := range rand.Perm(len(peers)) {
+		ps := peers[j]
+		ps.MarkBlock(hash)
+		if i < push {
+			ps.SendMessage(message)
+		} else {
+			ps.SendMessage(&announce)
+		}
+	}
+}
+
+// AnnounceTxs sends each peer the hashes of the transactions which it does not know
+func (p *PeerStreamPool) AnnounceTxs(hashes []common.Hash) {
+	for _, ps := range p.Peers() {
+		unknown := make([]common.Hash, 0, len(hashes))
+		for _, hash := range hashes {
+			if !ps.KnowsTx(hash) {
+				ps.MarkTx(hash)
+				unknown = append(unknown, hash)
+			}
+		}
+		if len(unknown) == 0 {
+			continue
+		}
+		if message, err := NewRLPMessage(MsgNewPooledTxHashes, unknown); err == nil {
+			ps.SendMessage(&message)
+		}
+	}
+}
+
+// pushCount is the number of peers receiving the full block among n peers
+func pushCount(n int) int {
+	return int(math.Sqrt(float64(n)))
+}
+
 func (p *PeerStreamPool) register(peerStream *PeerStream) {
 	peerStream.Register(StatusStreamClosed, p.StatusStreamClosedCh)
 }
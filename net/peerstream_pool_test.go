@@ -14,6 +14,7 @@ import (
 
 func TestPeerStreamPool(t *testing.T) {
 	pool := NewPeerStreamPool()
+	peerEvents := pool.events.Subscribe(10, PeerEvent{})
 	hander := NewTestPeerStreamHandler()
 	pool.AddHandler(hander)
 
@@ -36,8 +37,10 @@ func TestPeerStreamPool(t *testing.T) {
 	pool.AddStream(sn.peerStream)
 	pool.AddStream(cn.peerStream)
 	assert.Equal(t, int32(2), pool.count)
+	assert.Equal(t, PeerEventAdd, (<-peerEvents.Chan()).(PeerEvent).Type)
+	assert.Equal(t, PeerEventAdd, (<-peerEvents.Chan()).(PeerEvent).Type)
 
-	ps2, _ := pool.GetStream(sn.peerStream.stream.Conn().RemotePeer())
+	ps2, _ := pool.GetStream(sn.peerStream.stream.RemotePeer())
 	assert.Equal(t, sn.peerStream, ps2)
 
 	msg, _ := NewRLPMessage(MsgNewBlock, "new block")
@@ -56,6 +59,8 @@ func TestPeerStreamPool(t *testing.T) {
 		}
 	}
 	<-hander.MsgNewTxCh
+	assert.Equal(t, PeerEventDrop, (<-peerEvents.Chan()).(PeerEvent).Type)
+	assert.Equal(t, PeerEventDrop, (<-peerEvents.Chan()).(PeerEvent).Type)
 
 	//remove lookupStreams
 	pool.SetLimit(0)
@@ -74,6 +79,8 @@ func TestPeerStreamPool(t *testing.T) {
 		return true
 	})
 	assert.Equal(t, int32(2), lookupStreamsCount)
+	//lookup streams are not peers
+	assert.Equal(t, 0, len(peerEvents.Chan()))
 
 	msg2, _ = NewRLPMessage(MsgNewTx, "waiting")
 	sn.peerStream.SendMessage(&msg2)
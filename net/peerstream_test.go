@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nacamp/go-simplechain/rlp"
 	"github.com/stretchr/testify/assert"
 
 	libp2p "github.com/libp2p/go-libp2p"
@@ -45,40 +46,58 @@ func TestPeerStream(t *testing.T) {
 	}
 	fmt.Println("true")
 
-	handler2 := make(chan interface{}, 1)
-	cn.peerStream.Register(MsgNearestPeersAck, handler2)
-	go func() {
-		msg := <-handler2
-		// fmt.Println(msg)
-		msg2 := msg.(*Message)
-		//fmt.Println(msg2.Code)
-		v, ok := cn.peerStream.replys.Load(msg2.Code)
-		if ok {
-			reply := v.(chan interface{})
-			reply <- "hi"
-		}
-	}()
+	//hello after handshake is dropped
+	hello := make(chan interface{}, 1)
+	sn.peerStream.Register(MsgHello, hello)
+	assert.NoError(t, cn.peerStream.SendHello(cn.maddr))
+	select {
+	case <-hello:
+		t.Error("hello after handshake is handled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 0, len(cn.peerStream.HandshakeSucceedCh))
 
 	handler := make(chan interface{}, 1)
 	sn.peerStream.Register(MsgNearestPeers, handler)
 	go func() {
-		msg := <-handler
-		fmt.Println(msg)
-		// msg2 := msg.(*Message)
-		// fmt.Println(msg2.Code)
-		msg3, _ := NewRLPMessage(MsgNearestPeersAck, id)
-		sn.peerStream.SendMessage(&msg3)
+		for msg := range handler {
+			request := msg.(*Message)
+			sn.peerStream.Reply(request, MsgNearestPeersAck, "hi")
+		}
 	}()
 
-	// //Handshake is completed
-	// //RequestNearestPeers(id peer.ID)
+	//concurrent requests of same code are not mixed
 	msg, _ = NewRLPMessage(MsgNearestPeers, id)
-	reply := make(chan interface{}, 1)
-	assert.NoError(t, cn.peerStream.SendMessageReply(&msg, reply))
-	assert.Equal(t, "hi", <-reply)
+	future1, err := cn.peerStream.Request(&msg, 1*time.Second)
+	assert.NoError(t, err)
+	msg, _ = NewRLPMessage(MsgNearestPeers, id)
+	future2, err := cn.peerStream.Request(&msg, 1*time.Second)
+	assert.NoError(t, err)
+	reply2, err := future2.Wait()
+	assert.NoError(t, err)
+	reply1, err := future1.Wait()
+	assert.NoError(t, err)
+	assert.NotEqual(t, reply1.RequestID, reply2.RequestID)
+	data := ""
+	rlp.DecodeBytes(reply1.Payload, &data)
+	assert.Equal(t, "hi", data)
+
+	//no reply
+	msg, _ = NewRLPMessage(MsgNewTx, id)
+	future3, err := cn.peerStream.Request(&msg, 100*time.Millisecond)
+	assert.NoError(t, err)
+	_, err = future3.Wait()
+	assert.Equal(t, ErrRequestTimeout, err)
+
 	assert.True(t, sn.peerStream.IsHandshakeSucceed())
 	assert.False(t, sn.peerStream.IsClosed())
+	//pending request is cancelled when the stream is closed
+	msg, _ = NewRLPMessage(MsgNewTx, id)
+	future4, err := cn.peerStream.Request(&msg, 10*time.Second)
+	assert.NoError(t, err)
 	cn.peerStream.Close()
+	_, err = future4.Wait()
+	assert.Equal(t, ErrStreamClosed, err)
 
 	ticker := time.NewTicker(100 * time.Millisecond)
 	for t := range ticker.C {
@@ -127,7 +146,7 @@ func (node *TestNode) Start(isServer bool) {
 func (node *TestNode) HandleStream(s libnet.Stream) {
 	fmt.Println("RemotePeer", s.Conn().RemotePeer().Pretty())
 	fmt.Println("inbound")
-	peerStream, _ := NewPeerStream(s)
+	peerStream, _ := NewPeerStream(newLibp2pStream(s))
 	node.peerStream = peerStream
 	peerStream.Start()
 }
@@ -139,7 +158,7 @@ func (node *TestNode) Connect(peerid peer.ID, addr ma.Multiaddr) {
 		fmt.Println(err)
 	}
 	fmt.Println("outbound")
-	peerStream, _ := NewPeerStream(s)
+	peerStream, _ := NewPeerStream(newLibp2pStream(s))
 	node.peerStream = peerStream
 	peerStream.Start()
 }
@@ -0,0 +1,178 @@
+package net
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	banKey             = "bans"
+	BanThreshold       = -100
+	maxScore           = 100
+	maxScores          = 4096 //peers whose scores are kept, the least recently scored is forgotten
+	DefaultBanDuration = time.Hour
+)
+
+// errors constants
+var (
+	ErrPeerBanned = errors.New("peer is banned")
+)
+
+// score changes used by protocol handlers
+const (
+	ScoreInvalidMessage = -20  //payload is not decodable
+	ScoreInvalidTx      = -20  //hash or signature is wrong
+	ScoreInvalidBlock   = -50  //hash or signature is wrong
+	ScoreInvalidData    = -100 //data is not what was requested
+	ScoreValidBlock     = 1
+)
+
+// Ban is a peer refused until Until (unix time)
+type Ban struct {
+	ID    peer.ID
+	Until uint64
+}
+
+/*
+Reputation scores peers by their behavior.
+A peer whose score falls to BanThreshold is banned for banDuration.
+Bans are saved in storage if it is given.
+*/
+type Reputation struct {
+	mu          sync.Mutex
+	scores      *lru.Cache
+	bans        map[peer.ID]uint64
+	storage     storage.Storage
+	banDuration time.Duration
+}
+
+func NewReputation(db storage.Storage, banDuration time.Duration) (*Reputation, error) {
+	scores, _ := lru.New(maxScores)
+	r := &Reputation{
+		scores:      scores,
+		bans:        make(map[peer.ID]uint64),
+		storage:     db,
+		banDuration: banDuration,
+	}
+	if db == nil {
+		return r, nil
+	}
+	encodedBytes, err := db.Get([]byte(banKey))
+	if err == storage.ErrKeyNotFound {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	bans := make([]Ban, 0)
+	if err := rlp.DecodeBytes(encodedBytes, &bans); err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		r.bans[ban.ID] = ban.Until
+	}
+	return r, nil
+}
+
+func (r *Reputation) Score(id peer.ID) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.score(id)
+}
+
+func (r *Reputation) score(id peer.ID) int {
+	if score, ok := r.scores.Get(id); ok {
+		return score.(int)
+	}
+	return 0
+}
+
+// Adjust changes the score of the peer and returns true if the peer is banned by it
+func (r *Reputation) Adjust(id peer.ID, delta int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	score := r.score(id) + delta
+	if score > maxScore {
+		score = maxScore
+	}
+	if score > BanThreshold {
+		r.scores.Add(id, score)
+		return false
+	}
+	r.scores.Remove(id)
+	r.bans[id] = uint64(time.Now().Add(r.banDuration).Unix())
+	if err := r.save(); err != nil {
+		log.CLog().WithFields(logrus.Fields{
+			"Msg": err,
+		}).Warning("save bans")
+	}
+	return true
+}
+
+func (r *Reputation) IsBanned(id peer.ID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.bans[id]
+	if !ok {
+		return false
+	}
+	if uint64(time.Now().Unix()) < until {
+		return true
+	}
+	delete(r.bans, id)
+	r.save()
+	return false
+}
+
+// Bans returns the peers banned now
+func (r *Reputation) Bans() []Ban {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := uint64(time.Now().Unix())
+	bans := make([]Ban, 0, len(r.bans))
+	for id, until := range r.bans {
+		if now < until {
+			bans = append(bans, Ban{ID: id, Until: until})
+		}
+	}
+	return bans
+}
+
+// Unban clears the ban and score of the peer
+func (r *Reputation) Unban(id peer.ID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.bans, id)
+	r.scores.Remove(id)
+	return r.save()
+}
+
+func (r *Reputation) ClearBans() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bans = make(map[peer.ID]uint64)
+	return r.save()
+}
+
+func (r *Reputation) save() error {
+	if r.storage == nil {
+		return nil
+	}
+	bans := make([]Ban, 0, len(r.bans))
+	for id, until := range r.bans {
+		bans = append(bans, Ban{ID: id, Until: until})
+	}
+	encodedBytes, err := rlp.EncodeToBytes(bans)
+	if err != nil {
+		return err
+	}
+	return r.storage.Put([]byte(banKey), encodedBytes)
+}
@@ -0,0 +1,52 @@
+package net
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReputation(t *testing.T) {
+	db, _ := storage.NewMemoryStorage()
+	r, err := NewReputation(db, time.Hour)
+	assert.NoError(t, err)
+	id, _ := peer.IDB58Decode("16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk")
+	id2, _ := peer.IDB58Decode("16Uiu2HAkxKaG3PHSLfDhfZ7a8YzP6w6fKooBTY1gmfSXxGYbsNuN")
+
+	assert.False(t, r.Adjust(id, ScoreValidBlock))
+	assert.False(t, r.Adjust(id, ScoreInvalidBlock))
+	assert.Equal(t, 1+ScoreInvalidBlock, r.Score(id))
+	assert.False(t, r.Adjust(id, ScoreInvalidBlock))
+	assert.False(t, r.IsBanned(id))
+	assert.True(t, r.Adjust(id, ScoreInvalidBlock))
+	assert.True(t, r.IsBanned(id))
+	assert.True(t, r.Adjust(id2, ScoreInvalidData))
+	assert.Equal(t, 2, len(r.Bans()))
+
+	//bans are loaded after restart
+	r2, err := NewReputation(db, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, r2.IsBanned(id))
+	assert.NoError(t, r2.Unban(id))
+	assert.False(t, r2.IsBanned(id))
+	assert.True(t, r2.IsBanned(id2))
+	assert.NoError(t, r2.ClearBans())
+	r3, _ := NewReputation(db, time.Hour)
+	assert.Equal(t, 0, len(r3.Bans()))
+
+	//scores are bounded
+	for i := 0; i < maxScores+1; i++ {
+		r.Adjust(peer.ID(fmt.Sprintf("peer%d", i)), ScoreValidBlock)
+	}
+	assert.Equal(t, maxScores, r.scores.Len())
+	assert.Equal(t, 0, r.Score(peer.ID("peer0")))
+
+	//ban expires
+	r4, _ := NewReputation(nil, 0)
+	assert.True(t, r4.Adjust(id, ScoreInvalidData))
+	assert.False(t, r4.IsBanned(id))
+}
@@ -0,0 +1,47 @@
+package net
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errors constants
+var (
+	ErrRequestTimeout = errors.New("request timeout")
+	ErrStreamClosed   = errors.New("stream closed")
+)
+
+// Future is the reply of a request, it is completed by the reply, a timeout or closing the stream
+type Future struct {
+	done  chan struct{}
+	reply *Message
+	err   error
+	timer *time.Timer
+	code  uint64    //code of request for metrics
+	start time.Time //time when request is sent
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) complete(reply *Message, err error) {
+	f.reply = reply
+	f.err = err
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	close(f.done)
+}
+
+// Done is closed when the future is completed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the reply arrives
+func (f *Future) Wait() (*Message, error) {
+	<-f.done
+	return f.reply, f.err
+}
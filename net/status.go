@@ -0,0 +1,47 @@
+package net
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/common"
+)
+
+// ProtocolVersion is increased when messages are not compatible with old peers
+const ProtocolVersion = uint64(10)
+
+// errors constants
+var (
+	ErrProtocolVersion = errors.New("protocol version mismatch")
+	ErrChainID         = errors.New("chain id mismatch")
+	ErrGenesisHash     = errors.New("genesis hash mismatch")
+)
+
+/*
+Status is exchanged by MsgHello and MsgHelloAck.
+Version, ChainID and GenesisHash must be same, the head is recorded for sync.
+Messages are compressed with snappy after handshake if both peers set Snappy.
+*/
+type Status struct {
+	Version     uint64
+	ChainID     uint64
+	GenesisHash common.Hash
+	TailHeight  uint64
+	TailHash    common.Hash
+	LibHeight   uint64
+	LibHash     common.Hash
+	Addr        string
+	Snappy      bool
+}
+
+func (s *Status) Compatible(remote *Status) error {
+	if s.Version != remote.Version {
+		return ErrProtocolVersion
+	}
+	if s.ChainID != remote.ChainID {
+		return ErrChainID
+	}
+	if s.GenesisHash != remote.GenesisHash {
+		return ErrGenesisHash
+	}
+	return nil
+}
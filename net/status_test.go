@@ -0,0 +1,32 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusCompatible(t *testing.T) {
+	local := &Status{Version: ProtocolVersion, ChainID: 1, GenesisHash: common.HexToHash("0x01"), TailHeight: 10}
+	remote := &Status{Version: ProtocolVersion, ChainID: 1, GenesisHash: common.HexToHash("0x01"), TailHeight: 20, Addr: "/ip4/127.0.0.1/tcp/9991"}
+
+	//head is not compared
+	assert.NoError(t, local.Compatible(remote))
+
+	encodedBytes, err := rlp.EncodeToBytes(remote)
+	assert.NoError(t, err)
+	decoded := new(Status)
+	assert.NoError(t, rlp.DecodeBytes(encodedBytes, decoded))
+	assert.Equal(t, remote, decoded)
+
+	remote.Version = ProtocolVersion + 1
+	assert.Equal(t, ErrProtocolVersion, local.Compatible(remote))
+	remote.Version = ProtocolVersion
+	remote.ChainID = 2
+	assert.Equal(t, ErrChainID, local.Compatible(remote))
+	remote.ChainID = 1
+	remote.GenesisHash = common.HexToHash("0x02")
+	assert.Equal(t, ErrGenesisHash, local.Compatible(remote))
+}
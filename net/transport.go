@@ -0,0 +1,107 @@
+package net
+
+import (
+	"context"
+	"io"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	host "github.com/libp2p/go-libp2p-host"
+	libnet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	peerstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Stream is a connection with a peer which PeerStream reads and writes frames on
+type Stream interface {
+	io.ReadWriteCloser
+	RemotePeer() peer.ID
+	RemoteAddr() ma.Multiaddr
+}
+
+/*
+Transport opens streams between peers.
+Node uses libp2p by default, MemoryTransport connects nodes in one process for tests.
+*/
+type Transport interface {
+	ID() peer.ID
+	Addr() ma.Multiaddr
+	Peerstore() peerstore.Peerstore
+	SetStreamHandler(protocolID string, handler func(Stream))
+	NewStream(id peer.ID, addr ma.Multiaddr, protocolID string) (Stream, error)
+}
+
+type libp2pTransport struct {
+	host  host.Host
+	maddr ma.Multiaddr
+}
+
+func NewLibp2pTransport(maddr ma.Multiaddr, privKey crypto.PrivKey) (Transport, error) {
+	host, err := libp2p.New(
+		context.Background(),
+		libp2p.ListenAddrs(maddr),
+		libp2p.Identity(privKey),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &libp2pTransport{host: host, maddr: maddr}, nil
+}
+
+func (t *libp2pTransport) ID() peer.ID {
+	return t.host.ID()
+}
+
+func (t *libp2pTransport) Addr() ma.Multiaddr {
+	return t.maddr
+}
+
+func (t *libp2pTransport) Peerstore() peerstore.Peerstore {
+	return t.host.Peerstore()
+}
+
+func (t *libp2pTransport) SetStreamHandler(protocolID string, handler func(Stream)) {
+	t.host.SetStreamHandler(protocol.ID(protocolID), func(s libnet.Stream) {
+		handler(newLibp2pStream(s))
+	})
+}
+
+func (t *libp2pTransport) NewStream(id peer.ID, addr ma.Multiaddr, protocolID string) (Stream, error) {
+	// Always firt add id and addr at Peerstore
+	t.host.Peerstore().AddAddr(id, addr, peerstore.PermanentAddrTTL)
+	s, err := t.host.NewStream(context.Background(), id, protocol.ID(protocolID))
+	if err != nil {
+		return nil, err
+	}
+	return newLibp2pStream(s), nil
+}
+
+type libp2pStream struct {
+	stream libnet.Stream
+}
+
+func newLibp2pStream(s libnet.Stream) Stream {
+	return &libp2pStream{stream: s}
+}
+
+func (s *libp2pStream) Read(p []byte) (int, error) {
+	return s.stream.Read(p)
+}
+
+func (s *libp2pStream) Write(p []byte) (int, error) {
+	return s.stream.Write(p)
+}
+
+func (s *libp2pStream) Close() error {
+	return s.stream.Close()
+}
+
+func (s *libp2pStream) RemotePeer() peer.ID {
+	return s.stream.Conn().RemotePeer()
+}
+
+func (s *libp2pStream) RemoteAddr() ma.Multiaddr {
+	return s.stream.Conn().RemoteMultiaddr()
+}
@@ -4,12 +4,15 @@ import (
 	peer "github.com/libp2p/go-libp2p-peer"
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/common"
 	"github.com/nacamp/go-simplechain/rlp"
 )
 
 const (
 	MsgHello           = uint64(0x00)
 	MsgHelloAck        = uint64(0x01)
+	MsgPing            = uint64(0x02)
+	MsgPong            = uint64(0x03)
 	MsgNearestPeers    = uint64(0x04)
 	MsgNearestPeersAck = uint64(0x05)
 
@@ -19,14 +22,41 @@ const (
 	MsgMissingBlocks    = 0x14
 	MsgMissingBlocksAck = 0x15
 	MsgNewTx            = 0x16
+	MsgNewBlockHashes   = 0x17
+
+	MsgNewPooledTxHashes = 0x18
+	MsgGetPooledTxs      = 0x19
+	MsgPooledTxs         = 0x1a
+
+	MsgCheckpointVote     = 0x20
+	MsgGetCheckpointBlock = 0x21
+	MsgCheckpointBlockAck = 0x22
+	MsgGetTrieNodes       = 0x23
+	MsgTrieNodes          = 0x24
+
+	MsgGetFinalizedCheckpoint = 0x25
+	MsgFinalizedCheckpoint    = 0x26
+	MsgGetProof               = 0x29
+	MsgProof                  = 0x2a
+
+	MsgGetBlockHeaders = 0x30
+	MsgBlockHeaders    = 0x31
+	MsgGetBlockBodies  = 0x32
+	MsgBlockBodies     = 0x33
 
 	StatusStreamClosed = 0x101
 )
 
+/*
+Message is sent on PeerStream.
+RequestID is set by PeerStream.Request and copied to the reply by PeerStream.Reply.
+*/
 type Message struct {
-	Code    uint64
-	PeerID  peer.ID
-	Payload []byte
+	Code      uint64
+	PeerID    peer.ID
+	Payload   []byte
+	RequestID uint64
+	Reply     bool
 }
 
 func NewRLPMessage(code uint64, payload interface{}) (msg Message, err error) {
@@ -39,6 +69,12 @@ func NewRLPMessage(code uint64, payload interface{}) (msg Message, err error) {
 	return msg, nil
 }
 
+// BlockAnnounce is sent by MsgNewBlockHashes instead of the full block
+type BlockAnnounce struct {
+	Hash   common.Hash
+	Height uint64
+}
+
 type PeerInfo2 struct {
 	ID   peer.ID
 	Addr []byte
@@ -0,0 +1,373 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-go/fastjson"
+	"github.com/nacamp/go-simplechain/cmd"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/common/hexutil"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/osamingo/jsonrpc"
+)
+
+const clientName = "go-simplechain"
+
+var (
+	errUnknownBlock = errors.New("unknown block")
+	errParams       = errors.New("invalid params")
+)
+
+/*
+The eth_* handlers serve the data of BlockChain in the format of ethereum json rpc,
+quantities are hex with 0x. Gas is not used by this chain, it is always 0.
+eth_sendRawTransaction takes a signed core.Transaction encoded by rlp, not an ethereum transaction.
+*/
+
+type EthTransaction struct {
+	Hash             string `json:"hash"`
+	Nonce            string `json:"nonce"`
+	BlockHash        string `json:"blockHash"`
+	BlockNumber      string `json:"blockNumber"`
+	TransactionIndex string `json:"transactionIndex"`
+	From             string `json:"from"`
+	To               string `json:"to"`
+	Value            string `json:"value"`
+	Gas              string `json:"gas"`
+	GasPrice         string `json:"gasPrice"`
+	Input            string `json:"input"`
+}
+
+type EthBlock struct {
+	Number           string        `json:"number"`
+	Hash             string        `json:"hash"`
+	ParentHash       string        `json:"parentHash"`
+	Nonce            string        `json:"nonce"`
+	Miner            string        `json:"miner"`
+	Difficulty       string        `json:"difficulty"`
+	StateRoot        string        `json:"stateRoot"`
+	TransactionsRoot string        `json:"transactionsRoot"`
+	Timestamp        string        `json:"timestamp"`
+	GasLimit         string        `json:"gasLimit"`
+	GasUsed          string        `json:"gasUsed"`
+	Transactions     []interface{} `json:"transactions"`
+	Uncles           []string      `json:"uncles"`
+}
+
+type EthReceipt struct {
+	TransactionHash   string        `json:"transactionHash"`
+	TransactionIndex  string        `json:"transactionIndex"`
+	BlockHash         string        `json:"blockHash"`
+	BlockNumber       string        `json:"blockNumber"`
+	From              string        `json:"from"`
+	To                string        `json:"to"`
+	CumulativeGasUsed string        `json:"cumulativeGasUsed"`
+	GasUsed           string        `json:"gasUsed"`
+	ContractAddress   *string       `json:"contractAddress"`
+	Logs              []interface{} `json:"logs"`
+	Status            string        `json:"status"`
+}
+
+// ethParams decodes positional params of mixed types
+func ethParams(params *fastjson.RawMessage, min int) ([]interface{}, *jsonrpc.Error) {
+	p := []interface{}{}
+	if params != nil {
+		if err := jsonrpc.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+	}
+	if len(p) < min {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	return p, nil
+}
+
+func ethString(p []interface{}, i int) (string, error) {
+	if i >= len(p) {
+		return "", errParams
+	}
+	s, ok := p[i].(string)
+	if !ok {
+		return "", errParams
+	}
+	return s, nil
+}
+
+// ethBlock returns the block of a hex number or of "latest", "pending" and "earliest", latest if it is omitted
+func ethBlock(bc *core.BlockChain, p []interface{}, i int) (*core.Block, error) {
+	if i >= len(p) {
+		return bc.Tail(), nil
+	}
+	tag, err := ethString(p, i)
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case "latest", "pending":
+		return bc.Tail(), nil
+	case "earliest":
+		return bc.GenesisBlock, nil
+	}
+	height, err := hexutil.DecodeUint64(tag)
+	if err != nil {
+		return nil, err
+	}
+	block := bc.GetBlockByHeight(height)
+	if block == nil {
+		return nil, errUnknownBlock
+	}
+	return block, nil
+}
+
+func ethAccount(bc *core.BlockChain, p []interface{}) (*core.Account, error) {
+	address, err := ethString(p, 0)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ethBlock(bc, p, 1)
+	if err != nil {
+		return nil, err
+	}
+	accs, err := core.NewAccountStateRootHash(block.Header.AccountHash, bc.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return accs.GetAccount(common.HexToAddress(address)), nil
+}
+
+// ethTxLocation returns the block and the index of an included transaction
+func ethTxLocation(bc *core.BlockChain, tx *core.Transaction) (*core.Block, int) {
+	block := bc.GetBlockByHeight(tx.Height)
+	if block == nil {
+		return nil, 0
+	}
+	for i, btx := range block.Transactions {
+		if btx.Hash == tx.Hash {
+			return block, i
+		}
+	}
+	return nil, 0
+}
+
+func toEthTransaction(tx *core.Transaction, block *core.Block, index int) *EthTransaction {
+	etx := &EthTransaction{
+		Hash:     common.HashToHex(tx.Hash),
+		Nonce:    hexutil.EncodeUint64(tx.Nonce),
+		From:     common.AddressToHex(tx.From),
+		To:       common.AddressToHex(tx.To),
+		Value:    hexutil.EncodeBig(tx.Amount),
+		Gas:      hexutil.EncodeUint64(0),
+		GasPrice: hexutil.EncodeUint64(0),
+		Input:    "0x",
+	}
+	if tx.Payload != nil {
+		etx.Input = hexutil.Encode(tx.Payload.Data)
+	}
+	if block != nil {
+		etx.BlockHash = common.HashToHex(block.Hash())
+		etx.BlockNumber = hexutil.EncodeUint64(block.Header.Height)
+		etx.TransactionIndex = hexutil.EncodeUint64(uint64(index))
+	}
+	return etx
+}
+
+func toEthBlock(block *core.Block, fullTx bool) *EthBlock {
+	header := block.Header
+	eblock := &EthBlock{
+		Number:           hexutil.EncodeUint64(header.Height),
+		Hash:             common.HashToHex(block.Hash()),
+		ParentHash:       common.HashToHex(header.ParentHash),
+		Nonce:            hexutil.EncodeUint64(header.Nonce),
+		Miner:            common.AddressToHex(header.Coinbase),
+		Difficulty:       hexutil.EncodeUint64(0),
+		StateRoot:        common.HashToHex(header.AccountHash),
+		TransactionsRoot: common.HashToHex(header.TransactionHash),
+		Timestamp:        hexutil.EncodeUint64(header.Time),
+		GasLimit:         hexutil.EncodeUint64(0),
+		GasUsed:          hexutil.EncodeUint64(0),
+		Transactions:     make([]interface{}, 0, len(block.Transactions)),
+		Uncles:           []string{},
+	}
+	if header.Difficulty != nil {
+		eblock.Difficulty = hexutil.EncodeBig(header.Difficulty)
+	}
+	for i, tx := range block.Transactions {
+		if fullTx {
+			eblock.Transactions = append(eblock.Transactions, toEthTransaction(tx, block, i))
+		} else {
+			eblock.Transactions = append(eblock.Transactions, common.HashToHex(tx.Hash))
+		}
+	}
+	return eblock
+}
+
+type EthBlockNumberHandler struct {
+	bc *core.BlockChain
+}
+
+func (h *EthBlockNumberHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	return hexutil.EncodeUint64(h.bc.Tail().Header.Height), nil
+}
+
+type EthGetBalanceHandler struct {
+	bc *core.BlockChain
+}
+
+func (h *EthGetBalanceHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p, jerr := ethParams(params, 1)
+	if jerr != nil {
+		return nil, jerr
+	}
+	account, err := ethAccount(h.bc, p)
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return hexutil.EncodeBig(account.AvailableBalance()), nil
+}
+
+type EthGetTransactionCountHandler struct {
+	bc *core.BlockChain
+}
+
+// the nonce of the first transaction is 1, so the count is the nonce of the last transaction
+func (h *EthGetTransactionCountHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p, jerr := ethParams(params, 1)
+	if jerr != nil {
+		return nil, jerr
+	}
+	account, err := ethAccount(h.bc, p)
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return hexutil.EncodeUint64(account.Nonce), nil
+}
+
+type EthGetBlockByNumberHandler struct {
+	bc *core.BlockChain
+}
+
+// null is returned for an unknown block
+func (h *EthGetBlockByNumberHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p, jerr := ethParams(params, 1)
+	if jerr != nil {
+		return nil, jerr
+	}
+	block, err := ethBlock(h.bc, p, 0)
+	if err == errUnknownBlock {
+		return nil, nil
+	} else if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	fullTx := false
+	if len(p) > 1 {
+		fullTx, _ = p[1].(bool)
+	}
+	return toEthBlock(block, fullTx), nil
+}
+
+type EthSendRawTransactionHandler struct {
+	bc *core.BlockChain
+}
+
+func (h *EthSendRawTransactionHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p, jerr := ethParams(params, 1)
+	if jerr != nil {
+		return nil, jerr
+	}
+	data, err := ethString(p, 0)
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	encodedBytes, err := hexutil.Decode(data)
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	tx := new(core.Transaction)
+	if err := rlp.DecodeBytes(encodedBytes, tx); err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	if tx.Hash != tx.CalcHash() {
+		return "", &jsonrpc.Error{Code: 0, Message: "tx.Hash != tx.CalcHash()"}
+	}
+	if err := tx.VerifySign(); err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	account := h.bc.Tail().AccountState.GetAccount(tx.From)
+	if tx.Nonce <= account.Nonce {
+		return "", &jsonrpc.Error{Code: 0, Message: "This transaction have wrong nonce"}
+	}
+	if h.bc.TxPool.Get(tx.Hash) == nil {
+		h.bc.TxPool.Put(tx)
+		h.bc.NewTXMessage <- tx
+	}
+	return common.HashToHex(tx.Hash), nil
+}
+
+type EthGetTransactionReceiptHandler struct {
+	bc *core.BlockChain
+}
+
+// null is returned for a pending or unknown transaction, an included transaction always succeeded
+func (h *EthGetTransactionReceiptHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p, jerr := ethParams(params, 1)
+	if jerr != nil {
+		return nil, jerr
+	}
+	hash, err := ethString(p, 0)
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	tx, err := h.bc.Tail().TransactionState.GetTransaction(common.HexToHash(hash))
+	if err != nil {
+		return nil, nil
+	}
+	block, index := ethTxLocation(h.bc, tx)
+	if block == nil {
+		return nil, nil
+	}
+	return &EthReceipt{
+		TransactionHash:   common.HashToHex(tx.Hash),
+		TransactionIndex:  hexutil.EncodeUint64(uint64(index)),
+		BlockHash:         common.HashToHex(block.Hash()),
+		BlockNumber:       hexutil.EncodeUint64(block.Header.Height),
+		From:              common.AddressToHex(tx.From),
+		To:                common.AddressToHex(tx.To),
+		CumulativeGasUsed: hexutil.EncodeUint64(0),
+		GasUsed:           hexutil.EncodeUint64(0),
+		Logs:              []interface{}{},
+		Status:            hexutil.EncodeUint64(1),
+	}, nil
+}
+
+type NetVersionHandler struct {
+	chainID uint64
+}
+
+// net_version is the decimal chain id
+func (h *NetVersionHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	return strconv.FormatUint(h.chainID, 10), nil
+}
+
+type ClientVersionHandler struct{}
+
+func (h *ClientVersionHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	return fmt.Sprintf("%s/%s-%s/%s", clientName, runtime.GOOS, runtime.GOARCH, runtime.Version()), nil
+}
+
+// SetupEth registers the ethereum compatible methods
+func (rs *RpcService) SetupEth(config *cmd.Config, bc *core.BlockChain) {
+	rs.server.RegisterHandler("eth_blockNumber", &EthBlockNumberHandler{bc: bc}, []string{}, "")
+	rs.server.RegisterHandler("eth_getBalance", &EthGetBalanceHandler{bc: bc}, []string{}, "")
+	rs.server.RegisterHandler("eth_getTransactionCount", &EthGetTransactionCountHandler{bc: bc}, []string{}, "")
+	rs.server.RegisterHandler("eth_getBlockByNumber", &EthGetBlockByNumberHandler{bc: bc}, []interface{}{}, EthBlock{})
+	rs.server.RegisterHandler("eth_sendRawTransaction", &EthSendRawTransactionHandler{bc: bc}, []string{}, "")
+	rs.server.RegisterHandler("eth_getTransactionReceipt", &EthGetTransactionReceiptHandler{bc: bc}, []string{}, EthReceipt{})
+	rs.server.RegisterHandler("net_version", &NetVersionHandler{chainID: config.ChainID}, []string{}, "")
+	rs.server.RegisterHandler("web3_clientVersion", &ClientVersionHandler{}, []string{}, "")
+}
@@ -0,0 +1,132 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/intel-go/fastjson"
+	"github.com/nacamp/go-simplechain/cmd"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/consensus/poa"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/nacamp/go-simplechain/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+// newEthTestChain mines 2 blocks, the first block includes tx
+func newEthTestChain(t *testing.T) (bc *core.BlockChain, tx *core.Transaction) {
+	config := tests.NewConfig(0)
+	db, _ := storage.NewMemoryStorage()
+	cs := poa.NewPoa(net.NewPeerStreamPool(), config.Consensus.Period)
+	cs.SetupMining(tests.Address0, nil)
+	bc = core.NewBlockChain(db, common.HexToAddress(config.Coinbase), uint64(config.MiningReward))
+	bc.Setup(cs, cmd.MakeVoterAccountsFromConfig(config)[:1])
+
+	tx = tests.MakeTransaction(tests.AddressHex0, tests.AddressHex2, new(big.Int).SetUint64(10), 1)
+	bc.TxPool.Put(tx)
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), common.FromHex(tests.Keystore[tests.AddressHex0]))
+	for i := 0; i < 2; i++ {
+		block := cs.MakeBlock(bc.Tail().Header.Time + config.Consensus.Period)
+		assert.NotNil(t, block)
+		assert.NoError(t, block.Sign((*ecdsa.PrivateKey)(priv)))
+		bc.PutBlockByCoinbase(block)
+	}
+	assert.Equal(t, uint64(2), bc.Tail().Header.Height)
+	return bc, tx
+}
+
+func ethParamsOf(raw string) []interface{} {
+	params := fastjson.RawMessage(raw)
+	p, _ := ethParams(&params, 0)
+	return p
+}
+
+func TestEthBlock(t *testing.T) {
+	bc, _ := newEthTestChain(t)
+
+	for _, raw := range []string{`[]`, `["latest"]`, `["pending"]`, `["0x2"]`} {
+		block, err := ethBlock(bc, ethParamsOf(raw), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, bc.Tail().Hash(), block.Hash())
+	}
+	block, err := ethBlock(bc, ethParamsOf(`["earliest"]`), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bc.GenesisBlock.Hash(), block.Hash())
+	block, err = ethBlock(bc, ethParamsOf(`["0x1"]`), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), block.Header.Height)
+
+	//quantities must be hex with 0x
+	_, err = ethBlock(bc, ethParamsOf(`["1"]`), 0)
+	assert.Error(t, err)
+	_, err = ethBlock(bc, ethParamsOf(`[1]`), 0)
+	assert.Equal(t, errParams, err)
+	_, err = ethBlock(bc, ethParamsOf(`["0x9"]`), 0)
+	assert.Equal(t, errUnknownBlock, err)
+
+	//null is returned for an unknown block
+	params := fastjson.RawMessage(`["0x9", false]`)
+	result, jerr := (&EthGetBlockByNumberHandler{bc: bc}).ServeJSONRPC(context.Background(), &params)
+	assert.Nil(t, jerr)
+	assert.Nil(t, result)
+}
+
+func TestEthHex(t *testing.T) {
+	bc, tx := newEthTestChain(t)
+	block := bc.GetBlockByHeight(1)
+
+	eblock := toEthBlock(block, false)
+	assert.Equal(t, "0x1", eblock.Number)
+	assert.Equal(t, "0x0", eblock.GasUsed)
+	assert.Equal(t, []interface{}{common.HashToHex(tx.Hash)}, eblock.Transactions)
+
+	eblock = toEthBlock(block, true)
+	etx := eblock.Transactions[0].(*EthTransaction)
+	assert.Equal(t, "0x1", etx.Nonce)
+	assert.Equal(t, "0xa", etx.Value)
+	assert.Equal(t, "0x0", etx.Gas)
+	assert.Equal(t, "0x", etx.Input)
+	assert.Equal(t, "0x1", etx.BlockNumber)
+	assert.Equal(t, "0x0", etx.TransactionIndex)
+
+	params := fastjson.RawMessage(`[]`)
+	result, jerr := (&EthBlockNumberHandler{bc: bc}).ServeJSONRPC(context.Background(), &params)
+	assert.Nil(t, jerr)
+	assert.Equal(t, "0x2", result)
+	params = fastjson.RawMessage(`["` + tests.AddressHex0 + `", "earliest"]`)
+	result, jerr = (&EthGetTransactionCountHandler{bc: bc}).ServeJSONRPC(context.Background(), &params)
+	assert.Nil(t, jerr)
+	assert.Equal(t, "0x0", result)
+	params = fastjson.RawMessage(`["` + tests.AddressHex0 + `", "latest"]`)
+	result, jerr = (&EthGetTransactionCountHandler{bc: bc}).ServeJSONRPC(context.Background(), &params)
+	assert.Nil(t, jerr)
+	assert.Equal(t, "0x1", result)
+}
+
+func TestEthReceipt(t *testing.T) {
+	bc, tx := newEthTestChain(t)
+	handler := &EthGetTransactionReceiptHandler{bc: bc}
+	receipt := func(hash common.Hash) interface{} {
+		params := fastjson.RawMessage(`["` + common.HashToHex(hash) + `"]`)
+		result, jerr := handler.ServeJSONRPC(context.Background(), &params)
+		assert.Nil(t, jerr)
+		return result
+	}
+
+	r := receipt(tx.Hash).(*EthReceipt)
+	assert.Equal(t, "0x1", r.BlockNumber)
+	assert.Equal(t, "0x0", r.TransactionIndex)
+	assert.Equal(t, "0x1", r.Status)
+	assert.Nil(t, r.ContractAddress)
+
+	//null is returned for a pending or unknown transaction
+	pending := tests.MakeTransaction(tests.AddressHex0, tests.AddressHex2, new(big.Int).SetUint64(10), 2)
+	bc.TxPool.Put(pending)
+	assert.Nil(t, receipt(pending.Hash))
+	assert.Nil(t, receipt(common.Hash{0x01}))
+}
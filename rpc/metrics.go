@@ -0,0 +1,41 @@
+package rpc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/nacamp/go-simplechain/net"
+)
+
+// metricsHandler writes the network metrics in the text format of prometheus at /metrics
+type metricsHandler struct {
+	metrics *net.Metrics
+}
+
+func NewMetricsHandler(metrics *net.Metrics) http.Handler {
+	return &metricsHandler{metrics: metrics}
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	total := h.metrics.Total()
+	writeCounters(w, "", &total)
+	for _, c := range h.metrics.Peers() {
+		writeCounters(w, fmt.Sprintf(`{peer="%s"}`, c.ID.Pretty()), &c.Counters)
+	}
+	for _, c := range h.metrics.Codes() {
+		writeCounters(w, fmt.Sprintf(`{code="0x%x"}`, c.Code), &c.Counters)
+	}
+}
+
+func writeCounters(w io.Writer, labels string, c *net.Counters) {
+	fmt.Fprintf(w, "simplechain_p2p_bytes_in_total%s %d\n", labels, c.BytesIn)
+	fmt.Fprintf(w, "simplechain_p2p_bytes_out_total%s %d\n", labels, c.BytesOut)
+	fmt.Fprintf(w, "simplechain_p2p_messages_in_total%s %d\n", labels, c.MessagesIn)
+	fmt.Fprintf(w, "simplechain_p2p_messages_out_total%s %d\n", labels, c.MessagesOut)
+	fmt.Fprintf(w, "simplechain_p2p_errors_total%s %d\n", labels, c.Errors)
+	fmt.Fprintf(w, "simplechain_p2p_requests_total%s %d\n", labels, c.Requests)
+	fmt.Fprintf(w, "simplechain_p2p_request_latency_seconds_sum%s %f\n", labels, c.LatencyTotal.Seconds())
+	fmt.Fprintf(w, "simplechain_p2p_request_latency_seconds_max%s %f\n", labels, c.LatencyMax.Seconds())
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/gorilla/websocket"
+	"github.com/nacamp/go-simplechain/core"
 	"github.com/nacamp/go-simplechain/log"
 	"github.com/sirupsen/logrus"
 
@@ -15,15 +17,22 @@ type JsonHandler interface {
 }
 
 type RpcServer struct {
-	mr      *jsonrpc.MethodRepository
-	address string
+	mr       *jsonrpc.MethodRepository
+	address  string
+	upgrader websocket.Upgrader
+	hub      *subscriptionHub
+	ws       bool
+	origins  map[string]bool
 }
 
 func NewRpcServer(address string) *RpcServer {
-	return &RpcServer{
+	js := &RpcServer{
 		mr:      jsonrpc.NewMethodRepository(),
 		address: address,
+		origins: make(map[string]bool),
 	}
+	js.upgrader = websocket.Upgrader{CheckOrigin: js.checkOrigin}
+	return js
 }
 
 func (js *RpcServer) RegisterHandler(name string, handler JsonHandler, params interface{}, result interface{}) {
@@ -33,9 +42,33 @@ func (js *RpcServer) RegisterHandler(name string, handler JsonHandler, params in
 
 }
 
+// Handle serves an http endpoint besides json rpc on the same address, call it before Start
+func (js *RpcServer) Handle(pattern string, handler http.Handler) {
+	http.Handle(pattern, handler)
+}
+
+// EnableWebsocket serves /ws to the same origin and origins, "*" allows any origin, call it before Start
+func (js *RpcServer) EnableWebsocket(origins []string) {
+	js.ws = true
+	for _, origin := range origins {
+		js.origins[origin] = true
+	}
+}
+
+// EnableSubscription lets websocket clients subscribe to the events of bc, call it before Start
+func (js *RpcServer) EnableSubscription(bc *core.BlockChain) {
+	js.hub = newSubscriptionHub(bc)
+}
+
 func (js *RpcServer) Start() {
 
 	http.Handle("/jrpc", js.mr)
+	if js.ws {
+		http.HandleFunc(wsPath, js.serveWS)
+	}
+	if js.hub != nil {
+		js.hub.start()
+	}
 	// http.HandleFunc("/jrpc/debug", mr.ServeDebug)
 	go func() {
 		if err := http.ListenAndServe(js.address, http.DefaultServeMux); err != nil {
@@ -3,17 +3,28 @@ package rpc
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/nacamp/go-simplechain/account"
 	"github.com/nacamp/go-simplechain/cmd"
+	"github.com/nacamp/go-simplechain/consensus/dpos"
+	"github.com/nacamp/go-simplechain/core/service"
+	"github.com/nacamp/go-simplechain/net"
 	"github.com/nacamp/go-simplechain/rlp"
 	"github.com/nacamp/go-simplechain/storage"
+	"github.com/nacamp/go-simplechain/trie"
 
 	"github.com/intel-go/fastjson"
+	peer "github.com/libp2p/go-libp2p-peer"
 	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/common/hexutil"
 	"github.com/nacamp/go-simplechain/core"
 	"github.com/osamingo/jsonrpc"
 )
@@ -112,7 +123,7 @@ func (h *SendTransactionHandler) ServeJSONRPC(c context.Context, params *fastjso
 	usedAmount := new(big.Int)
 	if p.Payload == nil {
 		usedAmount = usedAmount.Add(usedAmount, amount)
-	} else if h.consensus == "dpos" && p.Payload.Code == "1" {
+	} else if core.SameConsensus(h.consensus, "dpos") && p.Payload.Code == "1" {
 		_amount, _ := new(big.Int).SetString(p.Payload.Data, 10)
 		usedAmount = usedAmount.Add(usedAmount, _amount)
 	}
@@ -127,7 +138,7 @@ func (h *SendTransactionHandler) ServeJSONRPC(c context.Context, params *fastjso
 	for _, tx := range txs {
 		if tx.Payload.Code == uint64(0) {
 			usedAmount = usedAmount.Add(usedAmount, tx.Amount)
-		} else if h.consensus == "dpos" && tx.Payload.Code == uint64(1) {
+		} else if core.SameConsensus(h.consensus, "dpos") && tx.Payload.Code == uint64(1) {
 			_amount := new(big.Int)
 			err := rlp.Decode(bytes.NewReader(tx.Payload.Data), _amount)
 			if err != nil {
@@ -149,7 +160,13 @@ func (h *SendTransactionHandler) ServeJSONRPC(c context.Context, params *fastjso
 
 		code, _ := strconv.ParseUint(p.Payload.Code, 10, 64)
 		txPayload.Code = code
-		if p.Payload.Data == "" {
+		if code == core.TxCVoteParams {
+			params, err := parseDposParams(p.Payload.Data)
+			if err != nil {
+				return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+			}
+			txPayload.Data, _ = rlp.EncodeToBytes(params)
+		} else if p.Payload.Data == "" {
 			data, _ := strconv.ParseUint(p.Payload.Data, 10, 64)
 			bytePayload, _ := rlp.EncodeToBytes(data)
 			txPayload.Data = bytePayload
@@ -168,6 +185,34 @@ func (h *SendTransactionHandler) ServeJSONRPC(c context.Context, params *fastjso
 	return common.HashToHex(tx.Hash), nil
 }
 
+// newSimulatedTransaction makes the unsigned transaction of p to simulate, the data of a stake or unstake payload is the decimal amount
+func newSimulatedTransaction(from common.Address, nonce uint64, p *JsonTx) (*core.Transaction, error) {
+	amount, ok := new(big.Int).SetString(p.Amount, 10)
+	if !ok {
+		amount = new(big.Int)
+	}
+	if p.Payload == nil {
+		return core.NewTransaction(from, common.HexToAddress(p.To), amount, nonce), nil
+	}
+	txPayload := new(core.Payload)
+	code, _ := strconv.ParseUint(p.Payload.Code, 10, 64)
+	txPayload.Code = code
+	if code == core.TxCVoteParams {
+		params, err := parseDposParams(p.Payload.Data)
+		if err != nil {
+			return nil, err
+		}
+		txPayload.Data, _ = rlp.EncodeToBytes(params)
+	} else {
+		data, ok := new(big.Int).SetString(p.Payload.Data, 10)
+		if !ok {
+			data = new(big.Int)
+		}
+		txPayload.Data, _ = rlp.EncodeToBytes(data)
+	}
+	return core.NewTransactionPayload(from, common.HexToAddress(p.To), amount, nonce, txPayload), nil
+}
+
 type GetTransactionByHashHandler struct {
 	bc *core.BlockChain
 }
@@ -193,21 +238,110 @@ func (h *GetTransactionByHashHandler) ServeJSONRPC(c context.Context, params *fa
 	} else {
 		rtx.Height = strconv.FormatUint(tx.Height, 10)
 	}
+	if err := fillJsonTx(rtx, tx); err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return rtx, nil
+}
+
+// fillJsonTx sets the fields of rtx except Height from tx
+func fillJsonTx(rtx *JsonTx, tx *core.Transaction) error {
 	rtx.From = common.AddressToHex(tx.From)
 	rtx.To = common.AddressToHex(tx.To)
 	rtx.Nonce = strconv.FormatUint(tx.Nonce, 10)
 	rtx.Amount = tx.Amount.String()
 	rtx.Payload = &JsonPayload{}
 	rtx.Payload.Code = strconv.FormatUint(tx.Payload.Code, 10)
-	if len(tx.Payload.Data) != 0 {
+	if tx.Payload.Code == core.TxCVoteParams {
+		params := dpos.DposParams{}
+		if err := rlp.DecodeBytes(tx.Payload.Data, &params); err != nil {
+			return err
+		}
+		rtx.Payload.Data = formatDposParams(&params)
+	} else if len(tx.Payload.Data) != 0 {
 		data := new(uint64)
-		err = rlp.Decode(bytes.NewReader(tx.Payload.Data), data)
-		if err != nil {
-			return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+		if err := rlp.Decode(bytes.NewReader(tx.Payload.Data), data); err != nil {
+			return err
 		}
 		rtx.Payload.Data = strconv.FormatUint(*data, 10)
 	}
-	return rtx, nil
+	return nil
+}
+
+type JsonAccountState struct {
+	Balance          string            `json:"balance"`
+	Nonce            string            `json:"nonce"`
+	Staking          map[string]string `json:"staking"`
+	TotalPeggedStake string            `json:"totalPeggedStake"`
+}
+
+type JsonAccountChange struct {
+	Address string            `json:"address"`
+	Before  *JsonAccountState `json:"before"`
+	After   *JsonAccountState `json:"after"`
+}
+
+type JsonSimulation struct {
+	Success  bool                 `json:"success"`
+	Error    string               `json:"error,omitempty"`
+	Accounts []*JsonAccountChange `json:"accounts"`
+}
+
+func toJsonAccountState(acc *core.Account) *JsonAccountState {
+	state := &JsonAccountState{
+		Balance:          acc.Balance.String(),
+		Nonce:            strconv.FormatUint(acc.Nonce, 10),
+		Staking:          make(map[string]string),
+		TotalPeggedStake: "0",
+	}
+	for address, amount := range acc.Staking {
+		state.Staking[common.AddressToHex(address)] = amount.String()
+	}
+	if acc.TotalPeggedStake != nil {
+		state.TotalPeggedStake = acc.TotalPeggedStake.String()
+	}
+	return state
+}
+
+type SimulateTransactionHandler struct {
+	bc *core.BlockChain
+}
+
+// the params are of sendTransaction, the next nonce of the tail is used if nonce is empty
+func (h *SimulateTransactionHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	var p JsonTx
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	from := common.HexToAddress(p.From)
+	var nonce uint64
+	if p.Nonce == "" {
+		nonce = h.bc.Tail().AccountState.GetAccount(from).Nonce + 1
+	} else {
+		var err error
+		if nonce, err = strconv.ParseUint(p.Nonce, 10, 64); err != nil {
+			return nil, jsonrpc.ErrInvalidParams()
+		}
+	}
+	tx, err := newSimulatedTransaction(from, nonce, &p)
+	if err != nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	result := &JsonSimulation{Accounts: []*JsonAccountChange{}}
+	changes, err := h.bc.SimulateTransaction(tx)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.Success = true
+	for _, change := range changes {
+		result.Accounts = append(result.Accounts, &JsonAccountChange{
+			Address: common.AddressToHex(change.After.Address),
+			Before:  toJsonAccountState(change.Before),
+			After:   toJsonAccountState(change.After),
+		})
+	}
+	return result, nil
 }
 
 type NewAccountHandler struct {
@@ -242,6 +376,516 @@ func (h *UnlockHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMess
 	return "success", nil
 }
 
+type JsonFork struct {
+	Name   string `json:"name"`
+	Height string `json:"height"`
+	Active bool   `json:"active"`
+}
+
+type JsonRules struct {
+	Consensus            string   `json:"consensus"`
+	Period               string   `json:"period"`
+	Round                string   `json:"round"`
+	TotalMiners          string   `json:"totalMiners"`
+	MiningReward         string   `json:"miningReward"`
+	MaxTransactions      string   `json:"maxTransactions"`
+	DisabledPayloadCodes []string `json:"disabledPayloadCodes"`
+}
+
+type JsonForkSchedule struct {
+	Height string     `json:"height"`
+	Forks  []JsonFork `json:"forks"`
+	Rules  *JsonRules `json:"rules"`
+}
+
+type ForkScheduleHandler struct {
+	bc *core.BlockChain
+}
+
+func (h *ForkScheduleHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	height := h.bc.Tail().Header.Height
+	fs := h.bc.ForkSchedule()
+	rules := h.bc.Rules(height)
+	result := &JsonForkSchedule{
+		Height: strconv.FormatUint(height, 10),
+		Forks:  []JsonFork{},
+		Rules: &JsonRules{
+			Consensus:            rules.Consensus,
+			Period:               strconv.FormatUint(rules.Period, 10),
+			Round:                strconv.FormatUint(rules.Round, 10),
+			TotalMiners:          strconv.FormatUint(rules.TotalMiners, 10),
+			MiningReward:         strconv.FormatUint(rules.MiningReward, 10),
+			MaxTransactions:      strconv.FormatUint(rules.MaxTransactions, 10),
+			DisabledPayloadCodes: []string{},
+		},
+	}
+	for _, fork := range append([]core.Fork{fs.Genesis}, fs.Forks...) {
+		result.Forks = append(result.Forks, JsonFork{
+			Name:   fork.Name,
+			Height: strconv.FormatUint(fork.Height, 10),
+			Active: rules.IsActive(fork.Name),
+		})
+	}
+	for code := range rules.DisabledCodes {
+		result.Rules.DisabledPayloadCodes = append(result.Rules.DisabledPayloadCodes, strconv.FormatUint(code, 10))
+	}
+	return result, nil
+}
+
+// data of payload is "period,round,totalMiners"
+func parseDposParams(data string) (*dpos.DposParams, error) {
+	values := strings.Split(data, ",")
+	if len(values) != 3 {
+		return nil, errors.New("data must be period,round,totalMiners")
+	}
+	nums := make([]uint64, 3)
+	for i, v := range values {
+		num, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		nums[i] = num
+	}
+	params := &dpos.DposParams{Period: nums[0], Round: nums[1], TotalMiners: nums[2]}
+	return params, params.Verify()
+}
+
+func formatDposParams(params *dpos.DposParams) string {
+	return fmt.Sprintf("%d,%d,%d", params.Period, params.Round, params.TotalMiners)
+}
+
+type JsonDposParams struct {
+	Params      string `json:"params"`
+	ElectedTime string `json:"electedTime"`
+	Approved    string `json:"approved"`
+	Seed        string `json:"seed"`
+}
+
+type DposParamsHandler struct {
+	bc *core.BlockChain
+}
+
+func (h *DposParamsHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	state, ok := h.bc.Tail().ConsensusState().(*dpos.DposState)
+	if !ok {
+		return "", &jsonrpc.Error{Code: 0, Message: "Consensus is not dpos"}
+	}
+	result := &JsonDposParams{
+		Params:      formatDposParams(&state.Params),
+		ElectedTime: strconv.FormatUint(state.ElectedTime, 10),
+		Seed:        common.HashToHex(state.Seed),
+	}
+	approved, err := state.TallyParams(state.Params.TotalMiners)
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	if approved != nil {
+		result.Approved = formatDposParams(approved)
+	}
+	return result, nil
+}
+
+type JsonMissedSlot struct {
+	Address     string `json:"address"`
+	Missed      string `json:"missed"`
+	TotalMissed string `json:"totalMissed"`
+	JailCount   string `json:"jailCount"`
+	Jailed      bool   `json:"jailed"`
+}
+
+type MissedSlotsHandler struct {
+	bc *core.BlockChain
+}
+
+func (h *MissedSlotsHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	state, ok := h.bc.Tail().ConsensusState().(*dpos.DposState)
+	if !ok {
+		return "", &jsonrpc.Error{Code: 0, Message: "Consensus is not dpos"}
+	}
+	slots, err := state.MissedSlots()
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	result := make([]JsonMissedSlot, 0, len(slots))
+	for address, slot := range slots {
+		result = append(result, JsonMissedSlot{
+			Address:     common.AddressToHex(address),
+			Missed:      strconv.FormatUint(slot.Missed, 10),
+			TotalMissed: strconv.FormatUint(slot.TotalMissed, 10),
+			JailCount:   strconv.FormatUint(slot.JailCount, 10),
+			Jailed:      slot.Jailed,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result, nil
+}
+
+type JsonSyncing struct {
+	StartingHeight string `json:"startingHeight"`
+	CurrentHeight  string `json:"currentHeight"`
+	HighestHeight  string `json:"highestHeight"`
+}
+
+type SyncingHandler struct {
+	sync *service.SyncService
+}
+
+// false is returned when the chain is not behind peers
+func (h *SyncingHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	progress := h.sync.Progress()
+	if progress == nil {
+		return false, nil
+	}
+	return &JsonSyncing{
+		StartingHeight: strconv.FormatUint(progress.StartingHeight, 10),
+		CurrentHeight:  strconv.FormatUint(progress.CurrentHeight, 10),
+		HighestHeight:  strconv.FormatUint(progress.HighestHeight, 10),
+	}, nil
+}
+
+type JsonBan struct {
+	ID    string `json:"id"`
+	Until string `json:"until"`
+}
+
+type ListBansHandler struct {
+	streamPool *net.PeerStreamPool
+}
+
+func (h *ListBansHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	bans := h.streamPool.Reputation().Bans()
+	result := make([]JsonBan, 0, len(bans))
+	for _, ban := range bans {
+		result = append(result, JsonBan{
+			ID:    ban.ID.Pretty(),
+			Until: time.Unix(int64(ban.Until), 0).Format(time.RFC3339),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+type ClearBansHandler struct {
+	streamPool *net.PeerStreamPool
+}
+
+// clears the ban of the given peer, or all bans without params
+func (h *ClearBansHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if params != nil {
+		if err := jsonrpc.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+	}
+	reputation := h.streamPool.Reputation()
+	if len(p) == 0 {
+		if err := reputation.ClearBans(); err != nil {
+			return false, &jsonrpc.Error{Code: 0, Message: err.Error()}
+		}
+		return true, nil
+	}
+	id, err := peer.IDB58Decode(p[0])
+	if err != nil {
+		return false, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	if err := reputation.Unban(id); err != nil {
+		return false, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return true, nil
+}
+
+type AddPeerHandler struct {
+	node *net.Node
+}
+
+// the peer is kept connected, it is redialed with backoff when disconnected
+func (h *AddPeerHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return false, &jsonrpc.Error{Code: 0, Message: "peer address is required"}
+	}
+	if err := h.node.AddStaticPeer(p[0]); err != nil {
+		return false, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return true, nil
+}
+
+type RemovePeerHandler struct {
+	node *net.Node
+}
+
+func (h *RemovePeerHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return false, &jsonrpc.Error{Code: 0, Message: "peer address is required"}
+	}
+	if err := h.node.RemovePeer(p[0]); err != nil {
+		return false, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return true, nil
+}
+
+type JsonCounters struct {
+	BytesIn     string `json:"bytesIn"`
+	BytesOut    string `json:"bytesOut"`
+	MessagesIn  string `json:"messagesIn"`
+	MessagesOut string `json:"messagesOut"`
+	Errors      string `json:"errors"`
+	Requests    string `json:"requests"`
+	LatencyAvg  string `json:"latencyAvg"`
+	LatencyMax  string `json:"latencyMax"`
+}
+
+type JsonPeerCounters struct {
+	ID string `json:"id"`
+	JsonCounters
+}
+
+type JsonCodeCounters struct {
+	Code string `json:"code"`
+	JsonCounters
+}
+
+type JsonNetMetrics struct {
+	Total JsonCounters       `json:"total"`
+	Peers []JsonPeerCounters `json:"peers"`
+	Codes []JsonCodeCounters `json:"codes"`
+}
+
+func toJsonCounters(c *net.Counters) JsonCounters {
+	return JsonCounters{
+		BytesIn:     strconv.FormatUint(c.BytesIn, 10),
+		BytesOut:    strconv.FormatUint(c.BytesOut, 10),
+		MessagesIn:  strconv.FormatUint(c.MessagesIn, 10),
+		MessagesOut: strconv.FormatUint(c.MessagesOut, 10),
+		Errors:      strconv.FormatUint(c.Errors, 10),
+		Requests:    strconv.FormatUint(c.Requests, 10),
+		LatencyAvg:  c.LatencyAvg().String(),
+		LatencyMax:  c.LatencyMax.String(),
+	}
+}
+
+type NetMetricsHandler struct {
+	streamPool *net.PeerStreamPool
+}
+
+// peers are sorted by bytes in, so the peer which floods this node is first
+func (h *NetMetricsHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	metrics := h.streamPool.Metrics()
+	total := metrics.Total()
+	result := &JsonNetMetrics{
+		Total: toJsonCounters(&total),
+		Peers: make([]JsonPeerCounters, 0),
+		Codes: make([]JsonCodeCounters, 0),
+	}
+	for _, p := range metrics.Peers() {
+		result.Peers = append(result.Peers, JsonPeerCounters{ID: p.ID.Pretty(), JsonCounters: toJsonCounters(&p.Counters)})
+	}
+	for _, code := range metrics.Codes() {
+		result.Codes = append(result.Codes, JsonCodeCounters{Code: fmt.Sprintf("0x%x", code.Code), JsonCounters: toJsonCounters(&code.Counters)})
+	}
+	return result, nil
+}
+
+type LightGetBalanceHandler struct {
+	light *service.LightService
+}
+
+func (h *LightGetBalanceHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	account, err := h.light.GetAccount(common.HexToAddress(p[0]))
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return account.AvailableBalance().String(), nil
+}
+
+type LightGetTransactionCountHandler struct {
+	light *service.LightService
+}
+
+func (h *LightGetTransactionCountHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	account, err := h.light.GetAccount(common.HexToAddress(p[0]))
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return strconv.FormatUint(account.Nonce, 10), nil
+}
+
+type LightGetTransactionByHashHandler struct {
+	light *service.LightService
+}
+
+// the transaction is proved by a full peer, a pending transaction is not found
+func (h *LightGetTransactionByHashHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	tx, err := h.light.GetTransaction(common.HexToHash(p[0]))
+	if err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	rtx := &JsonTx{Height: strconv.FormatUint(tx.Height, 10)}
+	if err := fillJsonTx(rtx, tx); err != nil {
+		return "", &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return rtx, nil
+}
+
+type JsonLightHead struct {
+	Height string `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+type LightHeadHandler struct {
+	light *service.LightService
+}
+
+func (h *LightHeadHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	tail := h.light.LightChain().Tail()
+	return &JsonLightHead{
+		Height: strconv.FormatUint(tail.Height, 10),
+		Hash:   common.HashToHex(tail.Hash),
+	}, nil
+}
+
+/*
+JsonProof has the rlp value of key in the trie of root and the rlp nodes from root to the value.
+The hash of the first node is root, it is checked by trie.DecodeProof and trie.VerifyProof.
+*/
+type JsonProof struct {
+	Height    string   `json:"height"`
+	BlockHash string   `json:"blockHash"`
+	Root      string   `json:"root"`
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`
+	Proof     []string `json:"proof"`
+}
+
+func newJsonProof(block *core.Block, root common.Hash, tr *trie.Trie, key []byte) (*JsonProof, error) {
+	proof, err := tr.Prove(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := trie.VerifyProof(root[:], key, proof)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := trie.EncodeProof(proof)
+	if err != nil {
+		return nil, err
+	}
+	jproof := &JsonProof{
+		Height:    strconv.FormatUint(block.Header.Height, 10),
+		BlockHash: common.HashToHex(block.Hash()),
+		Root:      common.HashToHex(root),
+		Key:       hexutil.Encode(key),
+		Value:     hexutil.Encode(value),
+		Proof:     make([]string, 0, len(nodes)),
+	}
+	for _, node := range nodes {
+		jproof.Proof = append(jproof.Proof, hexutil.Encode(node))
+	}
+	return jproof, nil
+}
+
+type GetAccountProofHandler struct {
+	bc *core.BlockChain
+}
+
+// the root is the account root of the block at height, the tail if height is omitted
+func (h *GetAccountProofHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	block := h.bc.Tail()
+	if len(p) > 1 && p[1] != "" {
+		height, err := strconv.ParseUint(p[1], 10, 64)
+		if err != nil {
+			return nil, jsonrpc.ErrInvalidParams()
+		}
+		if block = h.bc.GetBlockByHeight(height); block == nil {
+			return nil, &jsonrpc.Error{Code: 0, Message: "unknown block"}
+		}
+	}
+	accs, err := core.NewAccountStateRootHash(block.Header.AccountHash, h.bc.Storage)
+	if err != nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	address := common.HexToAddress(p[0])
+	proof, err := newJsonProof(block, block.Header.AccountHash, accs.Trie, address[:])
+	if err == trie.ErrNotFound {
+		return nil, &jsonrpc.Error{Code: 0, Message: "account is not in the state"}
+	} else if err != nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return proof, nil
+}
+
+type GetTransactionProofHandler struct {
+	bc *core.BlockChain
+}
+
+// the root is the transaction root of the block which included the transaction
+func (h *GetTransactionProofHandler) ServeJSONRPC(c context.Context, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	hash := common.HexToHash(p[0])
+	tx, err := h.bc.Tail().TransactionState.GetTransaction(hash)
+	if err != nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: "transaction is not included"}
+	}
+	block := h.bc.GetBlockByHeight(tx.Height)
+	if block == nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: "unknown block"}
+	}
+	txs, err := core.NewTransactionStateRootHash(block.Header.TransactionHash, h.bc.Storage)
+	if err != nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	proof, err := newJsonProof(block, block.Header.TransactionHash, txs.Trie, hash[:])
+	if err != nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return proof, nil
+}
+
 type RpcService struct {
 	server *RpcServer
 }
@@ -253,8 +897,39 @@ func (rs *RpcService) Setup(server *RpcServer, config *cmd.Config, bc *core.Bloc
 	rs.server.RegisterHandler("getTransactionCount", &GetTransactionCountHandler{bc: bc}, []string{}, "")                               //same *new(string)
 	rs.server.RegisterHandler("sendTransaction", &SendTransactionHandler{bc: bc, w: w, consensus: config.Consensus.Name}, JsonTx{}, "") //same *new(string)
 	rs.server.RegisterHandler("getTransactionByHash", &GetTransactionByHashHandler{bc: bc}, []string{}, JsonTx{})
+	rs.server.RegisterHandler("simulateTransaction", &SimulateTransactionHandler{bc: bc}, JsonTx{}, JsonSimulation{})
+	rs.server.RegisterHandler("getAccountProof", &GetAccountProofHandler{bc: bc}, []string{}, JsonProof{})
+	rs.server.RegisterHandler("getTransactionProof", &GetTransactionProofHandler{bc: bc}, []string{}, JsonProof{})
 	rs.server.RegisterHandler("newAccount", &NewAccountHandler{w: w}, []string{}, "") //same *new(string)
 	rs.server.RegisterHandler("unlock", &UnlockHandler{w: w}, JsonAccount{}, "")      //same *new(string)
+	rs.server.RegisterHandler("forkSchedule", &ForkScheduleHandler{bc: bc}, []string{}, JsonForkSchedule{})
+	rs.server.RegisterHandler("dposParams", &DposParamsHandler{bc: bc}, []string{}, JsonDposParams{})
+	rs.server.RegisterHandler("missedSlots", &MissedSlotsHandler{bc: bc}, []string{}, []JsonMissedSlot{})
+}
+
+// SetupLight is used instead of Setup on a light node, state is queried from full peers with merkle proofs
+func (rs *RpcService) SetupLight(server *RpcServer, light *service.LightService, w *account.Wallet) {
+	rs.server = server
+	rs.server.RegisterHandler("accounts", &AccountsHandler{w: w}, []string{}, []string{})
+	rs.server.RegisterHandler("getBalance", &LightGetBalanceHandler{light: light}, []string{}, "")
+	rs.server.RegisterHandler("getTransactionCount", &LightGetTransactionCountHandler{light: light}, []string{}, "")
+	rs.server.RegisterHandler("getTransactionByHash", &LightGetTransactionByHashHandler{light: light}, []string{}, JsonTx{})
+	rs.server.RegisterHandler("newAccount", &NewAccountHandler{w: w}, []string{}, "")
+	rs.server.RegisterHandler("unlock", &UnlockHandler{w: w}, JsonAccount{}, "")
+	rs.server.RegisterHandler("lightHead", &LightHeadHandler{light: light}, []string{}, JsonLightHead{})
+}
+
+func (rs *RpcService) SetupSync(sync *service.SyncService) {
+	rs.server.RegisterHandler("syncing", &SyncingHandler{sync: sync}, []string{}, JsonSyncing{})
+}
+
+func (rs *RpcService) SetupAdmin(streamPool *net.PeerStreamPool, node *net.Node) {
+	rs.server.RegisterHandler("admin_listBans", &ListBansHandler{streamPool: streamPool}, []string{}, []JsonBan{})
+	rs.server.RegisterHandler("admin_clearBans", &ClearBansHandler{streamPool: streamPool}, []string{}, true)
+	rs.server.RegisterHandler("admin_addPeer", &AddPeerHandler{node: node}, []string{}, true)
+	rs.server.RegisterHandler("admin_removePeer", &RemovePeerHandler{node: node}, []string{}, true)
+	rs.server.RegisterHandler("admin_netMetrics", &NetMetricsHandler{streamPool: streamPool}, []string{}, JsonNetMetrics{})
+	rs.server.Handle("/metrics", NewMetricsHandler(streamPool.Metrics()))
 }
 
 /*
@@ -266,5 +941,16 @@ curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "metho
 curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "sendTransaction", "params": {"from": "0x3068c6c17a079f67b3f29a9844cbf6137a2bd7a3a58f0d0eac11b8afcd4564b8e4173af7","to": "0x03e864b08b08f632c61c6727cde0e23d125f7784b5a5a188446fc5c91ffa51faa1","amount": "1", "nonce": "1"}}' http://localhost:8080/jrpc
 curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "getTransactionByHash", "params":["0xb017e021b8b2deba156941f32ee2e6c53c767a13749fba2533c7a30616ff48c3"]}' http://localhost:8080/jrpc
 curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "newAccount", "params":["password"]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "forkSchedule", "params":[]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "dposParams", "params":[]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "missedSlots", "params":[]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "syncing", "params":[]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "lightHead", "params":[]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "admin_listBans", "params":[]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "admin_clearBans", "params":["16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk"]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "admin_addPeer", "params":["/ip4/127.0.0.1/tcp/9991/ipfs/16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk"]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "admin_removePeer", "params":["/ip4/127.0.0.1/tcp/9991/ipfs/16Uiu2HAkwR1pV8ZR8ApcZWrMSw5iNMwaJHFpKr91H9a1a65WGehk"]}' http://localhost:8080/jrpc
+curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "admin_netMetrics", "params":[]}' http://localhost:8080/jrpc
+curl http://localhost:8080/metrics
 curl -X POST -H "Content-Type: application/json" -d '{"jsonrpc": "2.0",   "method": "unlock", "params": {"address": "0x3068c6c17a079f67b3f29a9844cbf6137a2bd7a3a58f0d0eac11b8afcd4564b8e4173af7","password": "password","timeout": 300}}' http://localhost:8080/jrpc
 */
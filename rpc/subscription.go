@@ -0,0 +1,178 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/common/hexutil"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/event"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SubNewHeads               = "newHeads"
+	SubNewPendingTransactions = "newPendingTransactions"
+	SubLib                    = "lib"
+	SubReorg                  = "reorg"
+
+	eventBufferSize    = 256
+	wsMaxSubscriptions = 32 //per connection
+)
+
+var (
+	errUnknownSubscription = errors.New("unknown subscription kind")
+	errTooManySubscription = errors.New("too many subscriptions")
+	errNoSubscription      = errors.New("subscriptions are not available")
+)
+
+type JsonHead struct {
+	Height     string `json:"height"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+	Coinbase   string `json:"coinbase"`
+	Time       string `json:"time"`
+	TxCount    string `json:"txCount"`
+}
+
+type JsonReorg struct {
+	OldHeight string `json:"oldHeight"`
+	OldHash   string `json:"oldHash"`
+	NewHeight string `json:"newHeight"`
+	NewHash   string `json:"newHash"`
+}
+
+type wsSubscription struct {
+	id   string
+	kind string
+	conn *wsConn
+}
+
+/*
+subscriptionHub receives the events of the chain and the transaction pool
+and notifies the websocket connections which subscribed to them.
+A notification never blocks the hub, see wsConn.notify.
+*/
+type subscriptionHub struct {
+	mu     sync.RWMutex
+	subs   map[string]*wsSubscription
+	conns  map[*wsConn]map[string]struct{}
+	events *event.Subscription
+}
+
+func newSubscriptionHub(bc *core.BlockChain) *subscriptionHub {
+	return &subscriptionHub{
+		subs:  make(map[string]*wsSubscription),
+		conns: make(map[*wsConn]map[string]struct{}),
+		events: bc.Events().Subscribe(eventBufferSize,
+			core.ChainHeadEvent{}, core.LibEvent{}, core.ReorgEvent{}, core.TxPoolAddEvent{}),
+	}
+}
+
+func (h *subscriptionHub) start() {
+	go h.loop()
+}
+
+func (h *subscriptionHub) loop() {
+	for ev := range h.events.Chan() {
+		switch e := ev.(type) {
+		case core.ChainHeadEvent:
+			h.publish(SubNewHeads, toJsonHead(e.Block))
+		case core.LibEvent:
+			h.publish(SubLib, &JsonLightHead{
+				Height: strconv.FormatUint(e.Block.Header.Height, 10),
+				Hash:   common.HashToHex(e.Block.Hash()),
+			})
+		case core.ReorgEvent:
+			h.publish(SubReorg, &JsonReorg{
+				OldHeight: strconv.FormatUint(e.OldTail.Header.Height, 10),
+				OldHash:   common.HashToHex(e.OldTail.Hash()),
+				NewHeight: strconv.FormatUint(e.NewTail.Header.Height, 10),
+				NewHash:   common.HashToHex(e.NewTail.Hash()),
+			})
+		case core.TxPoolAddEvent:
+			h.publish(SubNewPendingTransactions, common.HashToHex(e.Tx.Hash))
+		}
+	}
+}
+
+func (h *subscriptionHub) publish(kind string, result interface{}) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, sub := range h.subs {
+		if sub.kind != kind {
+			continue
+		}
+		if !sub.conn.notify(sub.id, result) {
+			log.CLog().WithFields(logrus.Fields{
+				"Subscription": sub.id,
+			}).Debug("Slow websocket connection closed")
+		}
+	}
+}
+
+func (h *subscriptionHub) subscribe(conn *wsConn, kind string) (string, error) {
+	switch kind {
+	case SubNewHeads, SubNewPendingTransactions, SubLib, SubReorg:
+	default:
+		return "", errUnknownSubscription
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids := h.conns[conn]
+	if len(ids) >= wsMaxSubscriptions {
+		return "", errTooManySubscription
+	}
+	if ids == nil {
+		ids = make(map[string]struct{})
+		h.conns[conn] = ids
+	}
+	id := newSubscriptionID()
+	h.subs[id] = &wsSubscription{id: id, kind: kind, conn: conn}
+	ids[id] = struct{}{}
+	return id, nil
+}
+
+// unsubscribe returns false if conn has no subscription of id
+func (h *subscriptionHub) unsubscribe(conn *wsConn, id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub, ok := h.subs[id]
+	if !ok || sub.conn != conn {
+		return false
+	}
+	delete(h.subs, id)
+	delete(h.conns[conn], id)
+	return true
+}
+
+func (h *subscriptionHub) removeConn(conn *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id := range h.conns[conn] {
+		delete(h.subs, id)
+	}
+	delete(h.conns, conn)
+}
+
+func newSubscriptionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hexutil.Encode(b)
+}
+
+func toJsonHead(block *core.Block) *JsonHead {
+	return &JsonHead{
+		Height:     strconv.FormatUint(block.Header.Height, 10),
+		Hash:       common.HashToHex(block.Hash()),
+		ParentHash: common.HashToHex(block.Header.ParentHash),
+		Coinbase:   common.AddressToHex(block.Header.Coinbase),
+		Time:       strconv.FormatUint(block.Header.Time, 10),
+		TxCount:    strconv.Itoa(len(block.Transactions)),
+	}
+}
@@ -0,0 +1,242 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/intel-go/fastjson"
+	"github.com/nacamp/go-simplechain/log"
+	"github.com/osamingo/jsonrpc"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	wsPath           = "/ws"
+	wsSendQueue      = 256
+	wsWriteTimeout   = 10 * time.Second
+	wsMaxMessageSize = 1 << 20
+)
+
+type wsRequest struct {
+	Version string               `json:"jsonrpc"`
+	Method  string               `json:"method"`
+	Params  *fastjson.RawMessage `json:"params"`
+	ID      *fastjson.RawMessage `json:"id"`
+}
+
+type wsResponse struct {
+	Version string               `json:"jsonrpc"`
+	Result  interface{}          `json:"result,omitempty"`
+	Error   *jsonrpc.Error       `json:"error,omitempty"`
+	ID      *fastjson.RawMessage `json:"id,omitempty"`
+}
+
+type wsNotification struct {
+	Version string               `json:"jsonrpc"`
+	Method  string               `json:"method"`
+	Params  wsNotificationParams `json:"params"`
+}
+
+type wsNotificationParams struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result"`
+}
+
+/*
+wsConn queues the messages of a websocket connection for its writer.
+A response waits for room in the queue, so a client which does not read its responses is not served any more.
+A notification does not wait, the connection is closed if its queue is full.
+*/
+type wsConn struct {
+	ws   *websocket.Conn
+	out  chan interface{}
+	quit chan struct{}
+	once sync.Once
+}
+
+func newWsConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{
+		ws:   ws,
+		out:  make(chan interface{}, wsSendQueue),
+		quit: make(chan struct{}),
+	}
+}
+
+// send returns false if the connection is closed
+func (c *wsConn) send(msg interface{}) bool {
+	select {
+	case c.out <- msg:
+		return true
+	case <-c.quit:
+		return false
+	}
+}
+
+// notify returns false if the connection is closed or too slow
+func (c *wsConn) notify(id string, result interface{}) bool {
+	msg := &wsNotification{
+		Version: jsonrpc.Version,
+		Method:  "subscription",
+		Params:  wsNotificationParams{Subscription: id, Result: result},
+	}
+	select {
+	case <-c.quit:
+		return false
+	default:
+	}
+	select {
+	case c.out <- msg:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+func (c *wsConn) close() {
+	c.once.Do(func() {
+		close(c.quit)
+		c.ws.Close()
+	})
+}
+
+func (c *wsConn) writeLoop() {
+	defer c.close()
+	for {
+		select {
+		case msg := <-c.out:
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.ws.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+/*
+checkOrigin allows the same origin and the configured origins.
+/ws dispatches to every method of /jrpc including the wallet, so a page of another site must not use the browser of a user.
+A request without Origin is not sent by a browser.
+*/
+func (js *RpcServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || js.origins["*"] || js.origins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// serveWS serves the methods of the http endpoint and subscribe/unsubscribe
+func (js *RpcServer) serveWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := js.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.CLog().WithFields(logrus.Fields{}).Debug(err)
+		return
+	}
+	ws.SetReadLimit(wsMaxMessageSize)
+	conn := newWsConn(ws)
+	go conn.writeLoop()
+	defer func() {
+		if js.hub != nil {
+			js.hub.removeConn(conn)
+		}
+		conn.close()
+	}()
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if !conn.send(js.handleWS(conn, data)) {
+			return
+		}
+	}
+}
+
+// handleWS returns a response or the responses of a batch
+func (js *RpcServer) handleWS(conn *wsConn, data []byte) interface{} {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) > 0 && data[0] == '[' {
+		reqs := []*wsRequest{}
+		if err := fastjson.Unmarshal(data, &reqs); err != nil || len(reqs) == 0 {
+			return &wsResponse{Version: jsonrpc.Version, Error: jsonrpc.ErrInvalidRequest()}
+		}
+		resps := make([]*wsResponse, 0, len(reqs))
+		for _, req := range reqs {
+			resps = append(resps, js.invokeWS(conn, req))
+		}
+		return resps
+	}
+	req := new(wsRequest)
+	if err := fastjson.Unmarshal(data, req); err != nil {
+		return &wsResponse{Version: jsonrpc.Version, Error: jsonrpc.ErrParse()}
+	}
+	return js.invokeWS(conn, req)
+}
+
+func (js *RpcServer) invokeWS(conn *wsConn, req *wsRequest) *wsResponse {
+	res := &wsResponse{Version: jsonrpc.Version, ID: req.ID}
+	switch req.Method {
+	case "subscribe":
+		res.Result, res.Error = js.wsSubscribe(conn, req.Params)
+	case "unsubscribe":
+		res.Result, res.Error = js.wsUnsubscribe(conn, req.Params)
+	default:
+		h, jerr := js.mr.TakeMethod(&jsonrpc.Request{
+			Version: req.Version,
+			Method:  req.Method,
+			Params:  req.Params,
+			ID:      req.ID,
+		})
+		if jerr != nil {
+			res.Error = jerr
+			return res
+		}
+		res.Result, res.Error = h.ServeJSONRPC(context.Background(), req.Params)
+	}
+	return res
+}
+
+func (js *RpcServer) wsSubscribe(conn *wsConn, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	if js.hub == nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: errNoSubscription.Error()}
+	}
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	id, err := js.hub.subscribe(conn, p[0])
+	if err != nil {
+		return nil, &jsonrpc.Error{Code: 0, Message: err.Error()}
+	}
+	return id, nil
+}
+
+func (js *RpcServer) wsUnsubscribe(conn *wsConn, params *fastjson.RawMessage) (interface{}, *jsonrpc.Error) {
+	if js.hub == nil {
+		return false, nil
+	}
+	p := []string{}
+	if err := jsonrpc.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, jsonrpc.ErrInvalidParams()
+	}
+	return js.hub.unsubscribe(conn, p[0]), nil
+}
@@ -0,0 +1,29 @@
+package rpc
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWsCheckOrigin(t *testing.T) {
+	js := NewRpcServer("127.0.0.1:8080")
+	js.EnableWebsocket([]string{"http://localhost:3000"})
+	allowed := func(origin string) bool {
+		r := httptest.NewRequest("GET", "http://127.0.0.1:8080"+wsPath, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return js.upgrader.CheckOrigin(r)
+	}
+
+	assert.True(t, allowed(""))
+	assert.True(t, allowed("http://127.0.0.1:8080"))
+	assert.True(t, allowed("http://localhost:3000"))
+	assert.False(t, allowed("http://localhost:3001"))
+	assert.False(t, allowed("https://example.com"))
+
+	js.EnableWebsocket([]string{"*"})
+	assert.True(t, allowed("https://example.com"))
+}
@@ -0,0 +1,47 @@
+package storage
+
+/*
+OverlayStorage reads through to base and keeps writes in memory,
+so a trie can be changed on top of persistent storage without writing to it.
+*/
+type OverlayStorage struct {
+	base   Storage
+	memory *MemoryStorage
+}
+
+// NewOverlayStorage init a storage over base
+func NewOverlayStorage(base Storage) *OverlayStorage {
+	memory, _ := NewMemoryStorage()
+	return &OverlayStorage{base: base, memory: memory}
+}
+
+// Get return value to the key in memory, otherwise in base
+func (db *OverlayStorage) Get(key []byte) ([]byte, error) {
+	if value, err := db.memory.Get(key); err == nil {
+		return value, nil
+	}
+	return db.base.Get(key)
+}
+
+// Put put the key-value entry to memory
+func (db *OverlayStorage) Put(key []byte, value []byte) error {
+	return db.memory.Put(key, value)
+}
+
+// Del delete the key in memory, base is not changed
+func (db *OverlayStorage) Del(key []byte) error {
+	return db.memory.Del(key)
+}
+
+// EnableBatch enable batch write.
+func (db *OverlayStorage) EnableBatch() {
+}
+
+// Flush write and flush pending batch write.
+func (db *OverlayStorage) Flush() error {
+	return nil
+}
+
+// DisableBatch disable batch write.
+func (db *OverlayStorage) DisableBatch() {
+}
@@ -0,0 +1,388 @@
+package simulation
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/nacamp/go-simplechain/account"
+	"github.com/nacamp/go-simplechain/cmd"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/nacamp/go-simplechain/consensus/dpos"
+	"github.com/nacamp/go-simplechain/consensus/poa"
+	"github.com/nacamp/go-simplechain/consensus/pow"
+	"github.com/nacamp/go-simplechain/core"
+	"github.com/nacamp/go-simplechain/core/service"
+	scrypto "github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/net"
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/nacamp/go-simplechain/tests"
+)
+
+const (
+	chainID       = 1
+	password      = "password"
+	quietPolls    = 20
+	maxSettleTime = 10 * time.Second
+)
+
+// the voters of genesis, a node mines with the voter of its index
+var voters = []string{
+	tests.AddressHex0,
+	tests.AddressHex1,
+	tests.AddressHex2,
+	tests.AddressHex3,
+	tests.AddressHex4,
+	tests.AddressHex5,
+}
+
+// Node is a full node or a light node without rpc
+type Node struct {
+	ID        peer.ID
+	Addr      string
+	Miner     common.Address
+	Chain     *core.BlockChain
+	Consensus core.Consensus
+	Pool      *net.PeerStreamPool
+	Net       *net.Node
+	Sync      *service.SyncService
+	bcService *service.BlockChainService
+	txService *service.TxService
+	cpService *service.CheckpointService
+	snapshot  *service.SnapshotService
+	Light     *service.LightService
+}
+
+/*
+Simulation runs full nodes in one process on MemoryNetwork.
+Mining, the loops of services and the delivery of messages are driven by Clock, so blocks are made only when Advance is called.
+Node 0 is the seed of the others.
+With pow only node 0 mines, the miners would make a block of the same height at every tick of Clock.
+*/
+type Simulation struct {
+	Clock   *common.VirtualClock
+	Network *net.MemoryNetwork
+	Nodes   []*Node
+	Lights  []*Node
+	config  *cmd.Config
+	dir     string
+	random  *rand.Rand
+}
+
+// NewSimulation makes size nodes which agree on consensus, seed makes peer ids and message loss reproducible
+func NewSimulation(size int, consensus cmd.Consensus, seed int64) (*Simulation, error) {
+	if size < 1 || size > len(voters) {
+		return nil, errors.Errorf("size must be between 1 and %d", len(voters))
+	}
+	dir, err := ioutil.TempDir("", "simulation")
+	if err != nil {
+		return nil, err
+	}
+	config := &cmd.Config{
+		ChainID:      chainID,
+		MiningReward: 10,
+		Consensus:    consensus,
+		Coinbase:     voters[0],
+	}
+	if config.Consensus.Difficulty == nil {
+		config.Consensus.Difficulty = big.NewInt(1000)
+	}
+	for i := 0; i < size; i++ {
+		config.Voters = append(config.Voters, cmd.ConfigAccount{Address: voters[i], Balance: big.NewInt(int64(100 - i*10))})
+	}
+	clock := common.NewVirtualClock(time.Unix(1546300800, 0))
+	s := &Simulation{
+		Clock:   clock,
+		Network: net.NewMemoryNetwork(clock, seed),
+		config:  config,
+		dir:     dir,
+	}
+	s.random = rand.New(rand.NewSource(seed))
+	for i := 0; i < size; i++ {
+		node, err := s.newNode(i, false)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Nodes = append(s.Nodes, node)
+	}
+	return s, nil
+}
+
+// newNode makes a node with the address of index, a light node neither mines nor imports blocks
+func (s *Simulation) newNode(index int, light bool) (*Node, error) {
+	config := s.config
+	privKey, _, err := crypto.GenerateKeyPairWithReader(crypto.Secp256k1, 256, s.random)
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	addr := fmt.Sprintf("/ip4/10.0.0.%d/tcp/9991", index+1)
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var miner common.Address
+	var wallet *account.Wallet
+	if !light {
+		miner = common.HexToAddress(voters[index])
+		wallet, err = s.newWallet(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	db, _ := storage.NewMemoryStorage()
+	pool := net.NewPeerStreamPool()
+	bc := core.NewBlockChain(db, common.HexToAddress(config.Coinbase), uint64(config.MiningReward))
+	forkSchedule, err := cmd.MakeForkScheduleFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	bc.SetForkSchedule(forkSchedule)
+
+	var cs core.Consensus
+	switch config.Consensus.Name {
+	case "dpos":
+		engine := dpos.NewDpos(pool, config.Consensus.Period, config.Consensus.Round, config.Consensus.TotalMiners)
+		if !light {
+			engine.SetupMining(miner, wallet)
+		}
+		engine.SetClock(s.Clock)
+		cs = engine
+	case "poa":
+		engine := poa.NewPoa(pool, config.Consensus.Period)
+		if !light {
+			engine.SetupMining(miner, wallet)
+		}
+		engine.SetClock(s.Clock)
+		cs = engine
+	case "pow":
+		engine := pow.NewPow(pool, config.Consensus.Difficulty)
+		if !light && index == 0 {
+			engine.SetupMining(miner, wallet)
+		}
+		engine.SetClock(s.Clock)
+		cs = engine
+	default:
+		return nil, errors.Errorf("unknown consensus %s", config.Consensus.Name)
+	}
+	bc.Setup(cs, cmd.MakeVoterAccountsFromConfig(config))
+
+	node := &Node{
+		ID:        id,
+		Addr:      fmt.Sprintf("%s/ipfs/%s", addr, id.Pretty()),
+		Miner:     miner,
+		Chain:     bc,
+		Consensus: cs,
+		Pool:      pool,
+		bcService: service.NewBlockChainService(bc, pool),
+		Sync:      service.NewSyncService(bc, pool),
+		txService: service.NewTxService(bc, pool),
+		cpService: service.NewCheckpointService(bc, pool),
+		snapshot:  service.NewSnapshotService(bc, pool),
+		Light:     service.NewLightService(bc, pool),
+	}
+	if light {
+		if err := node.Light.Enable(); err != nil {
+			return nil, err
+		}
+	} else {
+		pool.AddHandler(node.bcService)
+		pool.AddHandler(node.Sync)
+		pool.AddHandler(node.txService)
+		pool.AddHandler(node.cpService)
+		node.cpService.SetupSigner(miner, wallet)
+	}
+	pool.AddHandler(node.Light)
+	node.bcService.SetClock(s.Clock)
+	node.Sync.SetClock(s.Clock)
+	node.txService.SetClock(s.Clock)
+	node.cpService.SetClock(s.Clock)
+	node.snapshot.SetClock(s.Clock)
+	node.Light.SetClock(s.Clock)
+
+	node.Net = net.NewNode(0, privKey, pool)
+	node.Net.SetTransport(s.Network.NewTransport(id, maddr))
+	node.Net.Setup(common.HashToHex(bc.GenesisBlock.Hash()))
+	node.Net.SetStatusFunc(node.status)
+	if light {
+		return node, nil
+	}
+	err = node.Net.SetValidator(miner, func(hash []byte) ([]byte, error) {
+		return wallet.SignHash(miner, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// newWallet stores the key of the voter in the temporary directory and unlocks it
+func (s *Simulation) newWallet(index int) (*account.Wallet, error) {
+	key := new(account.Key)
+	key.PrivateKey = scrypto.ByteToPrivateKey(common.FromHex(tests.Keystore[voters[index]]))
+	key.Address = scrypto.CreateAddressFromPrivateKey(key.PrivateKey)
+	wallet := account.NewWallet(filepath.Join(s.dir, fmt.Sprintf("keystore%d.dat", index)))
+	if err := wallet.StoreKey(key, password); err != nil {
+		return nil, err
+	}
+	if err := wallet.TimedUnlock(key.Address, password, time.Duration(0)); err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+func (node *Node) status() *net.Status {
+	tail := node.Chain.Tail()
+	lib := node.Chain.Lib()
+	return &net.Status{
+		Version:     net.ProtocolVersion,
+		ChainID:     chainID,
+		GenesisHash: node.Chain.GenesisBlock.Hash(),
+		TailHeight:  tail.Header.Height,
+		TailHash:    tail.Hash(),
+		LibHeight:   lib.Header.Height,
+		LibHash:     lib.Hash(),
+	}
+}
+
+// Start starts node 0 first and connects the others to it
+func (s *Simulation) Start() {
+	for i, node := range s.Nodes {
+		s.startNode(node, i > 0)
+	}
+}
+
+func (s *Simulation) startNode(node *Node, seed bool) {
+	seeds := []string{}
+	if seed {
+		seeds = append(seeds, s.Nodes[0].Addr)
+	}
+	node.Net.Start(seeds)
+	node.Light.Start()
+	if node.Light.LightChain() != nil {
+		return
+	}
+	node.bcService.Start()
+	node.Sync.Start()
+	node.txService.Start()
+	node.cpService.Start()
+	node.snapshot.Start()
+	node.Consensus.Start()
+}
+
+/*
+AddNode starts a node which joins after the others, it mines with the voter of its index if the voter is in genesis.
+With snapshot, it syncs the state of the finalized checkpoint of peers instead of importing blocks from genesis.
+*/
+func (s *Simulation) AddNode(snapshot bool) (*Node, error) {
+	if len(s.Nodes)+len(s.Lights) >= len(voters) {
+		return nil, errors.Errorf("simulation has %d nodes at most", len(voters))
+	}
+	node, err := s.newNode(len(s.Nodes)+len(s.Lights), false)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot {
+		node.snapshot.Enable()
+	}
+	s.Nodes = append(s.Nodes, node)
+	s.startNode(node, true)
+	return node, nil
+}
+
+// AddLightNode starts a light node which syncs headers from the full nodes, it is not counted by Converged
+func (s *Simulation) AddLightNode() (*Node, error) {
+	node, err := s.newNode(len(s.Nodes)+len(s.Lights), true)
+	if err != nil {
+		return nil, err
+	}
+	s.Lights = append(s.Lights, node)
+	s.startNode(node, true)
+	return node, nil
+}
+
+// Advance moves the clock by d in steps, the nodes handle the messages and blocks of a step before the next step
+func (s *Simulation) Advance(d, step time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += step {
+		s.Clock.Advance(step)
+		s.settle()
+	}
+}
+
+/*
+settle waits until the network is quiet, nothing is in flight and nothing is written or read for quietPolls polls.
+Handlers run on goroutines, the polls give a handler time to reply to the message it read.
+*/
+func (s *Simulation) settle() {
+	deadline := time.Now().Add(maxSettleTime)
+	_, last := s.Network.Activity()
+	for quiet := 0; quiet < quietPolls && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		inflight, activity := s.Network.Activity()
+		if inflight == 0 && activity == last {
+			quiet++
+		} else {
+			quiet = 0
+		}
+		last = activity
+	}
+}
+
+// WaitFor advances the clock by a second until cond is true or timeout of the clock passes
+func (s *Simulation) WaitFor(cond func() bool, timeout time.Duration) bool {
+	s.settle()
+	for elapsed := time.Duration(0); elapsed < timeout; elapsed += time.Second {
+		if cond() {
+			return true
+		}
+		s.Advance(time.Second, time.Second)
+	}
+	return cond()
+}
+
+// Partition splits the nodes by their indexes
+func (s *Simulation) Partition(groups ...[]int) {
+	idGroups := make([][]peer.ID, 0, len(groups))
+	for _, group := range groups {
+		ids := make([]peer.ID, 0, len(group))
+		for _, i := range group {
+			ids = append(ids, s.Nodes[i].ID)
+		}
+		idGroups = append(idGroups, ids)
+	}
+	s.Network.Partition(idGroups...)
+}
+
+func (s *Simulation) Heal() {
+	s.Network.Heal()
+}
+
+// Converged returns true if all nodes have the same tail
+func (s *Simulation) Converged() bool {
+	tail := s.Nodes[0].Chain.Tail().Hash()
+	for _, node := range s.Nodes[1:] {
+		if node.Chain.Tail().Hash() != tail {
+			return false
+		}
+	}
+	return true
+}
+
+// Close removes the wallets, the goroutines of nodes are left until the process exits
+func (s *Simulation) Close() {
+	os.RemoveAll(s.dir)
+}
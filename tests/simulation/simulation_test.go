@@ -0,0 +1,126 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nacamp/go-simplechain/cmd"
+	"github.com/nacamp/go-simplechain/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulationPoa(t *testing.T) {
+	s, err := NewSimulation(3, cmd.Consensus{Name: "poa", Period: 3}, 1)
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Start()
+
+	s.Advance(30*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 5*time.Second))
+	assert.True(t, s.Nodes[0].Chain.Tail().Header.Height > 0)
+
+	//the isolated node catches up after the partition is healed
+	s.Partition([]int{0, 1}, []int{2})
+	s.Advance(30*time.Second, time.Second)
+	s.Heal()
+	s.Advance(30*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 10*time.Second))
+}
+
+func TestSimulationDpos(t *testing.T) {
+	s, err := NewSimulation(3, cmd.Consensus{Name: "dpos", Period: 3, Round: 3, TotalMiners: 3}, 4)
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Start()
+
+	s.Advance(30*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 5*time.Second))
+	chain := s.Nodes[0].Chain
+	assert.True(t, chain.Tail().Header.Height > 0)
+
+	//the elected miners take turns
+	coinbases := make(map[common.Address]bool)
+	for height := uint64(1); height <= chain.Tail().Header.Height; height++ {
+		coinbases[chain.GetBlockByHeight(height).Header.Coinbase] = true
+	}
+	assert.True(t, len(coinbases) > 1)
+
+	//the minority mines only in its own slots, so its chain is replaced after the partition is healed
+	s.Partition([]int{0, 1}, []int{2})
+	s.Advance(30*time.Second, time.Second)
+	s.Heal()
+	s.Advance(30*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 10*time.Second))
+}
+
+func TestSimulationPow(t *testing.T) {
+	s, err := NewSimulation(3, cmd.Consensus{Name: "pow"}, 5)
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Start()
+
+	s.Advance(10*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 5*time.Second))
+	assert.True(t, s.Nodes[0].Chain.Tail().Header.Height > 0)
+	for _, node := range s.Nodes[1:] {
+		assert.Equal(t, s.Nodes[0].Miner, node.Chain.Tail().Header.Coinbase)
+	}
+
+	//the isolated node imports the blocks mined during the partition
+	s.Partition([]int{0, 1}, []int{2})
+	s.Advance(10*time.Second, time.Second)
+	height := s.Nodes[0].Chain.Tail().Header.Height
+	assert.True(t, s.Nodes[2].Chain.Tail().Header.Height < height)
+	s.Heal()
+	s.Advance(10*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 10*time.Second))
+	assert.True(t, s.Nodes[2].Chain.Tail().Header.Height >= height)
+}
+
+func TestSimulationSnapshotSync(t *testing.T) {
+	s, err := NewSimulation(3, cmd.Consensus{Name: "poa", Period: 3}, 2)
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Start()
+	s.Advance(60*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 5*time.Second))
+	//the signers sign the lib
+	assert.True(t, s.WaitFor(func() bool { return s.Nodes[0].Chain.FinalizedCheckpoint() != nil }, 30*time.Second))
+	finalized := s.Nodes[0].Chain.FinalizedCheckpoint().Height
+	assert.True(t, finalized > 0)
+
+	//the new node starts from the signed checkpoint of peers, so it does not have the blocks before it
+	node, err := s.AddNode(true)
+	assert.NoError(t, err)
+	s.Advance(30*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 10*time.Second))
+	assert.NotNil(t, node.Chain.Checkpoint())
+	assert.True(t, node.Chain.Checkpoint().Height >= finalized)
+	assert.Nil(t, node.Chain.GetBlockByHeight(1))
+}
+
+func TestSimulationLightNode(t *testing.T) {
+	s, err := NewSimulation(3, cmd.Consensus{Name: "poa", Period: 3}, 3)
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Start()
+	s.Advance(30*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 5*time.Second))
+
+	light, err := s.AddLightNode()
+	assert.NoError(t, err)
+	s.Advance(15*time.Second, time.Second)
+	assert.True(t, s.WaitFor(s.Converged, 5*time.Second))
+	full := s.Nodes[0].Chain
+	assert.True(t, s.WaitFor(func() bool {
+		return light.Light.LightChain().Tail().Hash == full.Tail().Hash()
+	}, 10*time.Second))
+
+	//the account is proved by full peers against the tail header
+	miner := common.HexToAddress(voters[0])
+	account, err := light.Light.GetAccount(miner)
+	assert.NoError(t, err)
+	expected := full.Tail().AccountState.GetAccount(miner)
+	assert.Equal(t, expected.Balance, account.Balance)
+	assert.Equal(t, expected.Nonce, account.Nonce)
+}
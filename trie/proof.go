@@ -21,6 +21,8 @@ package trie
 import (
 	"bytes"
 	"errors"
+
+	"github.com/nacamp/go-simplechain/rlp"
 )
 
 // MerkleProof is a path from root to the proved node
@@ -119,3 +121,80 @@ func (t *Trie) Verify(rootHash []byte, key []byte, proof MerkleProof) error {
 	}
 	return nil
 }
+
+// errors constants
+var (
+	ErrInvalidProof = errors.New("invalid merkle proof")
+)
+
+/*
+VerifyProof checks the proof from rootHash to the leaf of key and returns the value of the leaf.
+Unlike Verify, it needs no storage and rejects a proof which does not end with the leaf,
+so it can check a proof received from an untrusted peer.
+*/
+func VerifyProof(rootHash []byte, key []byte, proof MerkleProof) ([]byte, error) {
+	route := keyToRoute(key)
+	wantHash := rootHash
+	for _, val := range proof {
+		n := &node{Val: val}
+		if err := n.EncodeAndHash(); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(wantHash, n.Hash) {
+			return nil, ErrInvalidProof
+		}
+		flag, err := n.Type()
+		if err != nil {
+			return nil, ErrInvalidProof
+		}
+		switch flag {
+		case branch:
+			if len(route) == 0 {
+				return nil, ErrInvalidProof
+			}
+			wantHash = val[route[0]]
+			route = route[1:]
+		case ext:
+			path := val[1]
+			if len(path) > len(route) || !bytes.Equal(path, route[:len(path)]) {
+				return nil, ErrInvalidProof
+			}
+			wantHash = val[2]
+			route = route[len(path):]
+		case leaf:
+			if !bytes.Equal(val[1], route) {
+				return nil, ErrInvalidProof
+			}
+			return val[2], nil
+		default:
+			return nil, ErrInvalidProof
+		}
+	}
+	return nil, ErrInvalidProof
+}
+
+// EncodeProof encodes each node of proof by rlp, the hash of an encoded node is its hash in the trie
+func EncodeProof(proof MerkleProof) ([][]byte, error) {
+	nodes := make([][]byte, 0, len(proof))
+	for _, val := range proof {
+		encoded, err := rlp.EncodeToBytes(val)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, encoded)
+	}
+	return nodes, nil
+}
+
+// DecodeProof decodes the nodes of EncodeProof, so a proof from rpc can be checked by VerifyProof
+func DecodeProof(nodes [][]byte) (MerkleProof, error) {
+	proof := make(MerkleProof, 0, len(nodes))
+	for _, encoded := range nodes {
+		var val [][]byte
+		if err := rlp.DecodeBytes(encoded, &val); err != nil {
+			return nil, err
+		}
+		proof = append(proof, val)
+	}
+	return proof, nil
+}
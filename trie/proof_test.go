@@ -0,0 +1,60 @@
+package trie
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyProof(t *testing.T) {
+	db, _ := storage.NewMemoryStorage()
+	tr, _ := NewTrie(nil, db, false)
+	for i := 0; i < 100; i++ {
+		tr.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+	}
+
+	proof, err := tr.Prove([]byte("key7"))
+	assert.NoError(t, err)
+	val, err := VerifyProof(tr.RootHash(), []byte("key7"), proof)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val7"), val)
+
+	//proof of another key
+	_, err = VerifyProof(tr.RootHash(), []byte("key8"), proof)
+	assert.Equal(t, ErrInvalidProof, err)
+
+	//truncated proof does not reach the leaf
+	_, err = VerifyProof(tr.RootHash(), []byte("key7"), proof[:len(proof)-1])
+	assert.Equal(t, ErrInvalidProof, err)
+
+	//changed value does not match the hash in parent
+	last := proof[len(proof)-1]
+	proof[len(proof)-1] = [][]byte{last[0], last[1], []byte("val8")}
+	_, err = VerifyProof(tr.RootHash(), []byte("key7"), proof)
+	assert.Equal(t, ErrInvalidProof, err)
+}
+
+func TestEncodeProof(t *testing.T) {
+	db, _ := storage.NewMemoryStorage()
+	tr, _ := NewTrie(nil, db, false)
+	for i := 0; i < 100; i++ {
+		tr.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+	}
+
+	proof, err := tr.Prove([]byte("key7"))
+	assert.NoError(t, err)
+	nodes, err := EncodeProof(proof)
+	assert.NoError(t, err)
+	assert.Equal(t, len(proof), len(nodes))
+
+	decoded, err := DecodeProof(nodes)
+	assert.NoError(t, err)
+	val, err := VerifyProof(tr.RootHash(), []byte("key7"), decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val7"), val)
+
+	_, err = DecodeProof([][]byte{{0xff}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package trie
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/nacamp/go-simplechain/crypto"
+	"github.com/nacamp/go-simplechain/rlp"
+	"github.com/nacamp/go-simplechain/storage"
+)
+
+// errors constants
+var (
+	ErrUnrequestedNode = errors.New("trie node was not requested")
+)
+
+/*
+Sync downloads tries node by node.
+Nodes are addressed by their hash, so a node from any peer can be verified and stored.
+A node already in storage is walked instead of being requested.
+*/
+type Sync struct {
+	storage   storage.Storage
+	requested map[string]bool
+	queue     [][]byte
+}
+
+func NewSync(storage storage.Storage) *Sync {
+	return &Sync{
+		storage:   storage,
+		requested: make(map[string]bool),
+		queue:     make([][]byte, 0),
+	}
+}
+
+// AddRoot schedules the trie of rootHash, an empty hash is ignored
+func (s *Sync) AddRoot(rootHash []byte) error {
+	if len(rootHash) == 0 || bytes.Equal(rootHash, make([]byte, len(rootHash))) {
+		return nil
+	}
+	return s.schedule(rootHash)
+}
+
+func (s *Sync) schedule(hash []byte) error {
+	hashes := [][]byte{hash}
+	for len(hashes) > 0 {
+		hash, hashes = hashes[0], hashes[1:]
+		if s.requested[string(hash)] {
+			continue
+		}
+		encodedBytes, err := s.storage.Get(hash)
+		if err == storage.ErrKeyNotFound {
+			s.requested[string(hash)] = true
+			s.queue = append(s.queue, hash)
+			continue
+		} else if err != nil {
+			return err
+		}
+		children, err := childHashes(encodedBytes)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, children...)
+	}
+	return nil
+}
+
+// Missing returns at most max hashes to request
+func (s *Sync) Missing(max int) [][]byte {
+	if max > len(s.queue) {
+		max = len(s.queue)
+	}
+	hashes := make([][]byte, max)
+	copy(hashes, s.queue[:max])
+	return hashes
+}
+
+// Process stores a requested node and schedules its children
+func (s *Sync) Process(encodedBytes []byte) error {
+	hash := crypto.Sha3b256(encodedBytes)
+	if !s.requested[string(hash)] {
+		return ErrUnrequestedNode
+	}
+	children, err := childHashes(encodedBytes)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.Put(hash, encodedBytes); err != nil {
+		return err
+	}
+	delete(s.requested, string(hash))
+	for i, v := range s.queue {
+		if bytes.Equal(v, hash) {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	for _, child := range children {
+		if err := s.schedule(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ReadNode returns the encoded trie node of hash in storage.
+Other values are kept in the same storage, so a value is returned only if its hash is the key,
+a peer cannot read keys like "lib" or the bans through it.
+*/
+func ReadNode(storage storage.Storage, hash []byte) ([]byte, error) {
+	encodedBytes, err := storage.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(crypto.Sha3b256(encodedBytes), hash) {
+		return nil, ErrNotFound
+	}
+	return encodedBytes, nil
+}
+
+// Pending returns the number of nodes not downloaded yet
+func (s *Sync) Pending() int {
+	return len(s.queue)
+}
+
+func childHashes(encodedBytes []byte) ([][]byte, error) {
+	n := new(node)
+	if err := rlp.DecodeBytes(encodedBytes, &n.Val); err != nil {
+		return nil, err
+	}
+	flag, err := n.Type()
+	if err != nil {
+		return nil, err
+	}
+	children := make([][]byte, 0)
+	switch flag {
+	case branch:
+		for _, v := range n.Val {
+			if len(v) > 0 {
+				children = append(children, v)
+			}
+		}
+	case ext:
+		children = append(children, n.Val[2])
+	case leaf:
+	default:
+		return nil, errors.New("unknown node type")
+	}
+	return children, nil
+}
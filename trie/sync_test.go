@@ -0,0 +1,57 @@
+package trie
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nacamp/go-simplechain/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+	remote, _ := storage.NewMemoryStorage()
+	tr, _ := NewTrie(nil, remote, false)
+	for i := 0; i < 100; i++ {
+		tr.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+	}
+
+	local, _ := storage.NewMemoryStorage()
+	sync := NewSync(local)
+	assert.NoError(t, sync.AddRoot(tr.RootHash()))
+	assert.Equal(t, 1, sync.Pending())
+
+	assert.Equal(t, ErrUnrequestedNode, sync.Process([]byte{0x1}))
+	for sync.Pending() > 0 {
+		for _, hash := range sync.Missing(16) {
+			encodedBytes, err := ReadNode(remote, hash)
+			assert.NoError(t, err)
+			assert.NoError(t, sync.Process(encodedBytes))
+		}
+	}
+
+	tr2, err := NewTrie(tr.RootHash(), local, false)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		val, err := tr2.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("val%d", i)), val)
+	}
+
+	//already synced trie is not requested
+	sync = NewSync(local)
+	assert.NoError(t, sync.AddRoot(tr.RootHash()))
+	assert.Equal(t, 0, sync.Pending())
+}
+
+func TestReadNode(t *testing.T) {
+	db, _ := storage.NewMemoryStorage()
+	tr, _ := NewTrie(nil, db, false)
+	tr.Put([]byte("key"), []byte("val"))
+	db.Put([]byte("lib"), []byte("val"))
+
+	_, err := ReadNode(db, tr.RootHash())
+	assert.NoError(t, err)
+	//only trie nodes are served
+	_, err = ReadNode(db, []byte("lib"))
+	assert.Equal(t, ErrNotFound, err)
+}